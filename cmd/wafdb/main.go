@@ -3,9 +3,12 @@ package main
 import (
 	"SeproWAF/database"
 	_ "SeproWAF/models"
+	"SeproWAF/proxy"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/beego/beego/v2/server/web"
 )
@@ -19,6 +22,10 @@ var (
 	adminEmail  = flag.String("admin-email", "admin@admin.com", "Admin email")
 	adminPass   = flag.String("admin-pass", "", "Admin password")
 	seed        = flag.Bool("seed", false, "Seed demo data")
+	replay      = flag.String("replay", "", "Replay a request corpus (JSONL, HAR or exported WAF logs) through the rules of -site")
+	replaySite  = flag.Int("site", 0, "Site whose rules the corpus is replayed through")
+	candidate   = flag.String("candidate", "", "Candidate rule change, a JSON file with rules, remove and directives or a SecLang file")
+	reportPath  = flag.String("report", "", "Write the replay report as JSON to this file")
 )
 
 func init() {
@@ -83,9 +90,90 @@ func main() {
 		fmt.Println("Demo data seeded successfully")
 	}
 
+	// Replay a corpus if requested, failing when requests would be decided differently
+	if *replay != "" {
+		if !runReplay(*replay, *replaySite, *candidate, *reportPath) {
+			os.Exit(2)
+		}
+	}
+
 	// If no actions were specified, print help
-	if !*migrate && !*createAdmin && !*seed {
+	if !*migrate && !*createAdmin && !*seed && *replay == "" {
 		fmt.Println("No actions specified")
 		flag.PrintDefaults()
 	}
 }
+
+// runReplay replays a corpus through the rules of a site with and without a candidate change and
+// prints the requests whose outcome changed. It returns false when any request would be blocked,
+// passed or challenged differently, or could not be replayed, so that deployments can be gated on it.
+func runReplay(corpusPath string, siteID int, candidatePath, reportPath string) bool {
+	if siteID <= 0 {
+		fmt.Println("Error: -site is required with -replay")
+		os.Exit(1)
+	}
+
+	data, err := os.ReadFile(corpusPath)
+	if err != nil {
+		fmt.Printf("Failed to read corpus: %v\n", err)
+		os.Exit(1)
+	}
+	corpus, err := proxy.ParseReplayCorpus(data)
+	if err != nil {
+		fmt.Printf("Invalid corpus: %v\n", err)
+		os.Exit(1)
+	}
+
+	var change proxy.ReplayCandidate
+	if candidatePath != "" {
+		data, err := os.ReadFile(candidatePath)
+		if err != nil {
+			fmt.Printf("Failed to read candidate: %v\n", err)
+			os.Exit(1)
+		}
+		if strings.HasSuffix(strings.ToLower(candidatePath), ".json") {
+			if err := json.Unmarshal(data, &change); err != nil {
+				fmt.Printf("Invalid candidate: %v\n", err)
+				os.Exit(1)
+			}
+		} else {
+			change.Directives = string(data)
+		}
+	}
+
+	fmt.Printf("Replaying %d requests through the rules of site %d...\n", len(corpus), siteID)
+	report, err := proxy.ReplayCorpus(siteID, &change, corpus)
+	if err != nil {
+		fmt.Printf("Replay failed: %v\n", err)
+		os.Exit(1)
+	}
+
+	for _, result := range report.Results {
+		name := result.ID
+		if name == "" {
+			name = fmt.Sprintf("#%d", result.Index)
+		}
+		switch {
+		case result.Error != "":
+			fmt.Printf("  %-14s %s %s %s: %s\n", result.Change, name, result.Method, result.URL, result.Error)
+		default:
+			fmt.Printf("  %-14s %s %s %s: %s -> %s, rules +%v -%v\n", result.Change, name, result.Method, result.URL,
+				result.Baseline.Action, result.Candidate.Action, result.AddedRules, result.RemovedRules)
+		}
+	}
+	fmt.Printf("%d requests: %d newly blocked, %d newly passed, %d action changed, %d rules changed, %d unchanged, %d errors\n",
+		report.Total, report.NewlyBlocked, report.NewlyPassed, report.ActionChanged, report.RulesChanged, report.Unchanged, report.Errors)
+
+	if reportPath != "" {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err == nil {
+			err = os.WriteFile(reportPath, data, 0644)
+		}
+		if err != nil {
+			fmt.Printf("Failed to write report: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	return report.Regressions() == 0 && report.Errors == 0
+}
@@ -0,0 +1,318 @@
+package controllers
+
+import (
+	"SeproWAF/models"
+	"SeproWAF/services"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/beego/beego/v2/client/orm"
+	"github.com/beego/beego/v2/core/logs"
+	"github.com/beego/beego/v2/server/web"
+)
+
+// BanController handles the temporary bans of clients and the policies placing them
+type BanController struct {
+	web.Controller
+}
+
+// BanRequest represents the request body for banning a client by hand
+type BanRequest struct {
+	Kind     models.BanTarget `json:"kind"`
+	Value    string           `json:"value"`
+	Duration string           `json:"duration"` // Duration such as "24h"
+	Reason   string           `json:"reason"`
+}
+
+// BanPolicyRequest represents the request body for creating/updating ban policies
+type BanPolicyRequest struct {
+	models.BanPolicy
+	Enabled *bool `json:"enabled"`
+}
+
+// requireAdmin checks that the user may manage bans, which apply to every site
+func (c *BanController) requireAdmin() bool {
+	if role, _ := c.Ctx.Input.GetData("userRole").(models.Role); role != models.RoleAdmin {
+		c.Ctx.Output.SetStatus(http.StatusForbidden)
+		c.Data["json"] = map[string]string{"error": "Only administrators can manage bans"}
+		c.ServeJSON()
+		return false
+	}
+	return true
+}
+
+// ListBans returns the active bans
+func (c *BanController) ListBans() {
+	if !c.requireAdmin() {
+		return
+	}
+
+	bans, err := services.ListBans(c.Ctx.Request.Context())
+	if err != nil {
+		c.Ctx.Output.SetStatus(http.StatusServiceUnavailable)
+		c.Data["json"] = map[string]string{"error": "Failed to get bans: " + err.Error()}
+		c.ServeJSON()
+		return
+	}
+
+	c.Ctx.Output.SetStatus(http.StatusOK)
+	c.Data["json"] = bans
+	c.ServeJSON()
+}
+
+// AddBan bans a client by hand, replacing its current ban
+func (c *BanController) AddBan() {
+	if !c.requireAdmin() {
+		return
+	}
+
+	var req BanRequest
+	if err := json.Unmarshal(c.Ctx.Input.RequestBody, &req); err != nil {
+		c.Ctx.Output.SetStatus(http.StatusBadRequest)
+		c.Data["json"] = map[string]string{"error": "Invalid request format"}
+		c.ServeJSON()
+		return
+	}
+
+	req.Value = strings.TrimSpace(req.Value)
+	if req.Kind == "" {
+		req.Kind = models.BanTargetIP
+	}
+	if !req.Kind.IsValid() || req.Value == "" {
+		c.Ctx.Output.SetStatus(http.StatusBadRequest)
+		c.Data["json"] = map[string]string{"error": "A kind of ip or ja4 and a value are required"}
+		c.ServeJSON()
+		return
+	}
+	if req.Kind == models.BanTargetIP {
+		prefix, err := models.ParseIPAccessPrefix(req.Value)
+		if err != nil || prefix.Bits() != prefix.Addr().BitLen() {
+			c.Ctx.Output.SetStatus(http.StatusBadRequest)
+			c.Data["json"] = map[string]string{"error": "Invalid IP address, use the IP access list for networks"}
+			c.ServeJSON()
+			return
+		}
+		req.Value = prefix.Addr().String()
+	}
+
+	duration, err := time.ParseDuration(req.Duration)
+	if err != nil || duration <= 0 {
+		c.Ctx.Output.SetStatus(http.StatusBadRequest)
+		c.Data["json"] = map[string]string{"error": "Invalid ban duration: " + req.Duration}
+		c.ServeJSON()
+		return
+	}
+	if req.Reason == "" {
+		req.Reason = "Banned by an administrator"
+	}
+
+	now := time.Now()
+	ban := &services.Ban{
+		Kind:      req.Kind,
+		Value:     req.Value,
+		Reason:    req.Reason,
+		CreatedAt: now,
+		ExpiresAt: now.Add(duration),
+	}
+	if err := services.AddBan(c.Ctx.Request.Context(), ban); err != nil {
+		c.Ctx.Output.SetStatus(http.StatusServiceUnavailable)
+		c.Data["json"] = map[string]string{"error": "Failed to add ban: " + err.Error()}
+		c.ServeJSON()
+		return
+	}
+
+	c.Ctx.Output.SetStatus(http.StatusCreated)
+	c.Data["json"] = ban
+	c.ServeJSON()
+}
+
+// RemoveBan lifts the ban of the client given by the kind and value query parameters
+func (c *BanController) RemoveBan() {
+	if !c.requireAdmin() {
+		return
+	}
+
+	kind := models.BanTarget(c.GetString("kind"))
+	value := c.GetString("value")
+	if !kind.IsValid() || value == "" {
+		c.Ctx.Output.SetStatus(http.StatusBadRequest)
+		c.Data["json"] = map[string]string{"error": "A kind of ip or ja4 and a value are required"}
+		c.ServeJSON()
+		return
+	}
+
+	if err := services.GetBanEngine().LiftBan(c.Ctx.Request.Context(), kind, value); err != nil {
+		c.Ctx.Output.SetStatus(http.StatusServiceUnavailable)
+		c.Data["json"] = map[string]string{"error": "Failed to remove ban: " + err.Error()}
+		c.ServeJSON()
+		return
+	}
+
+	c.Ctx.Output.SetStatus(http.StatusOK)
+	c.Data["json"] = map[string]string{"message": "Ban removed successfully"}
+	c.ServeJSON()
+}
+
+// getBanPolicy loads the ban policy from the URL
+func (c *BanController) getBanPolicy() *models.BanPolicy {
+	policyID, err := strconv.Atoi(c.Ctx.Input.Param(":id"))
+	if err != nil {
+		c.Ctx.Output.SetStatus(http.StatusBadRequest)
+		c.Data["json"] = map[string]string{"error": "Invalid policy ID"}
+		c.ServeJSON()
+		return nil
+	}
+
+	policy, err := models.GetBanPolicyByID(policyID)
+	if err != nil {
+		c.Ctx.Output.SetStatus(http.StatusNotFound)
+		c.Data["json"] = map[string]string{"error": "Policy not found"}
+		c.ServeJSON()
+		return nil
+	}
+	return policy
+}
+
+// saveBanPolicy validates and stores a policy, then applies the policies to new blocks
+func (c *BanController) saveBanPolicy(policy *models.BanPolicy, status int) {
+	if err := policy.Validate(); err != nil {
+		c.Ctx.Output.SetStatus(http.StatusBadRequest)
+		c.Data["json"] = map[string]string{"error": err.Error()}
+		c.ServeJSON()
+		return
+	}
+	if policy.SiteID != 0 {
+		if _, err := models.GetSiteByID(policy.SiteID); err != nil {
+			c.Ctx.Output.SetStatus(http.StatusBadRequest)
+			c.Data["json"] = map[string]string{"error": "Site not found"}
+			c.ServeJSON()
+			return
+		}
+	}
+
+	o := orm.NewOrm()
+	var err error
+	if policy.ID == 0 {
+		_, err = o.Insert(policy)
+	} else {
+		_, err = o.Update(policy)
+	}
+	if err != nil {
+		c.Ctx.Output.SetStatus(http.StatusInternalServerError)
+		c.Data["json"] = map[string]string{"error": "Failed to save policy: " + err.Error()}
+		c.ServeJSON()
+		return
+	}
+
+	if err := services.GetBanEngine().Reload(); err != nil {
+		logs.Error("Failed to reload ban policies: %v", err)
+	}
+
+	c.Ctx.Output.SetStatus(status)
+	c.Data["json"] = policy
+	c.ServeJSON()
+}
+
+// ListBanPolicies returns all ban policies
+func (c *BanController) ListBanPolicies() {
+	if !c.requireAdmin() {
+		return
+	}
+
+	policies, err := models.GetBanPolicies()
+	if err != nil {
+		c.Ctx.Output.SetStatus(http.StatusInternalServerError)
+		c.Data["json"] = map[string]string{"error": "Failed to get policies: " + err.Error()}
+		c.ServeJSON()
+		return
+	}
+	if policies == nil {
+		policies = []*models.BanPolicy{}
+	}
+
+	c.Ctx.Output.SetStatus(http.StatusOK)
+	c.Data["json"] = policies
+	c.ServeJSON()
+}
+
+// CreateBanPolicy creates a ban policy
+func (c *BanController) CreateBanPolicy() {
+	if !c.requireAdmin() {
+		return
+	}
+
+	var req BanPolicyRequest
+	if err := json.Unmarshal(c.Ctx.Input.RequestBody, &req); err != nil {
+		c.Ctx.Output.SetStatus(http.StatusBadRequest)
+		c.Data["json"] = map[string]string{"error": "Invalid request format"}
+		c.ServeJSON()
+		return
+	}
+
+	policy := req.BanPolicy
+	policy.ID = 0
+	policy.Enabled = req.Enabled == nil || *req.Enabled
+	policy.CreatedBy = c.Ctx.Input.GetData("userID").(int)
+	c.saveBanPolicy(&policy, http.StatusCreated)
+}
+
+// UpdateBanPolicy replaces the settings of a ban policy
+func (c *BanController) UpdateBanPolicy() {
+	if !c.requireAdmin() {
+		return
+	}
+
+	existing := c.getBanPolicy()
+	if existing == nil {
+		return
+	}
+
+	var req BanPolicyRequest
+	if err := json.Unmarshal(c.Ctx.Input.RequestBody, &req); err != nil {
+		c.Ctx.Output.SetStatus(http.StatusBadRequest)
+		c.Data["json"] = map[string]string{"error": "Invalid request format"}
+		c.ServeJSON()
+		return
+	}
+
+	policy := req.BanPolicy
+	policy.ID = existing.ID
+	policy.Enabled = existing.Enabled
+	if req.Enabled != nil {
+		policy.Enabled = *req.Enabled
+	}
+	policy.CreatedBy = existing.CreatedBy
+	policy.CreatedAt = existing.CreatedAt
+	c.saveBanPolicy(&policy, http.StatusOK)
+}
+
+// DeleteBanPolicy deletes a ban policy; the bans it placed run out as planned
+func (c *BanController) DeleteBanPolicy() {
+	if !c.requireAdmin() {
+		return
+	}
+
+	policy := c.getBanPolicy()
+	if policy == nil {
+		return
+	}
+
+	o := orm.NewOrm()
+	if _, err := o.Delete(policy); err != nil {
+		c.Ctx.Output.SetStatus(http.StatusInternalServerError)
+		c.Data["json"] = map[string]string{"error": "Failed to delete policy: " + err.Error()}
+		c.ServeJSON()
+		return
+	}
+
+	if err := services.GetBanEngine().Reload(); err != nil {
+		logs.Error("Failed to reload ban policies: %v", err)
+	}
+
+	c.Ctx.Output.SetStatus(http.StatusOK)
+	c.Data["json"] = map[string]string{"message": "Policy deleted successfully"}
+	c.ServeJSON()
+}
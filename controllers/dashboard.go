@@ -3,10 +3,12 @@ package controllers
 
 import (
 	"SeproWAF/models"
+	"SeproWAF/proxy"
+	"SeproWAF/services"
 	"fmt"
 	"net"
+	"sort"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/beego/beego/v2/client/orm"
@@ -269,6 +271,20 @@ func (c *DashboardController) GetTopAttackedSites() {
 	c.ServeJSON()
 }
 
+// GetCircuitBreakers returns the upstream circuit breakers that are not closed or changed state in the last hour
+func (c *DashboardController) GetCircuitBreakers() {
+	breakers := proxy.GetCircuitBreakers(time.Now().Add(-1 * time.Hour))
+	if breakers == nil {
+		breakers = []proxy.CircuitBreakerInfo{}
+	}
+
+	c.Data["json"] = map[string]interface{}{
+		"success":          true,
+		"circuit_breakers": breakers,
+	}
+	c.ServeJSON()
+}
+
 // GetAttacksByHour returns the distribution of attacks by hour of day
 func (c *DashboardController) GetAttacksByHour() {
 	o := orm.NewOrm()
@@ -361,13 +377,13 @@ func (c *DashboardController) GetGeoAttackDistribution() {
 	// Get data for the last 30 days
 	thirtyDaysAgo := time.Now().Add(-30 * 24 * time.Hour)
 
-	// Query for client IPs of blocked requests
-	sql := `SELECT client_ip, COUNT(*) as count 
+	// Query for the countries and client IPs of blocked requests
+	sql := `SELECT country, client_ip, COUNT(*) as count 
 			FROM waf_log 
 			WHERE created_at >= ? AND action = 'block'
-			GROUP BY client_ip
+			GROUP BY country, client_ip
 			ORDER BY count DESC
-			LIMIT 100`
+			LIMIT 1000`
 
 	var results []orm.Params
 	_, err := o.Raw(sql, thirtyDaysAgo).Values(&results)
@@ -384,18 +400,17 @@ func (c *DashboardController) GetGeoAttackDistribution() {
 	// Map to store country counts
 	countryCount := make(map[string]int64)
 
-	// Process IPs and determine countries (simplified approach)
 	for _, result := range results {
-		ipVal := result["client_ip"]
-		if ipVal == nil {
-			continue
+		// Logs written before GeoIP was configured have no country yet
+		country := ""
+		if countryVal := result["country"]; countryVal != nil {
+			country = fmt.Sprintf("%v", countryVal)
+		}
+		if country == "" {
+			if ipVal := result["client_ip"]; ipVal != nil {
+				country = getCountryFromIP(fmt.Sprintf("%v", ipVal))
+			}
 		}
-
-		ipStr := fmt.Sprintf("%v", ipVal)
-
-		// Simple country determination based on IP ranges
-		// This is a simplified approach - in production, use a proper GeoIP database
-		country := getCountryFromIP(ipStr)
 
 		// Get count value
 		countVal := result["count"]
@@ -426,8 +441,9 @@ func (c *DashboardController) GetGeoAttackDistribution() {
 	}
 
 	// Sort by count descending
-	// Note: Simplified sorting - in Go you'd use sort.Slice with a custom less function
-	// This is just conceptual
+	sort.Slice(countryList, func(i, j int) bool {
+		return countryList[i].Count > countryList[j].Count
+	})
 
 	// Take top 10 countries
 	maxEntries := 10
@@ -460,46 +476,18 @@ func (c *DashboardController) GetGeoAttackDistribution() {
 	c.ServeJSON()
 }
 
-// Helper function to get country from IP (simplified)
+// getCountryFromIP returns the country code of an IP from the GeoIP database
 func getCountryFromIP(ipStr string) string {
-	// This is a very simplified approach
-	// In production, use a proper GeoIP database like MaxMind
-
 	ip := net.ParseIP(ipStr)
 	if ip == nil {
 		return "Unknown"
 	}
-
-	// Some very simplified rules
 	if ip.IsPrivate() || ip.IsLoopback() {
 		return "Local"
 	}
 
-	// Simple prefix checks (extremely simplified)
-	// In a real implementation, use a GeoIP database
-	ipStr = ip.String()
-	switch {
-	case strings.HasPrefix(ipStr, "1."):
-		return "China"
-	case strings.HasPrefix(ipStr, "2."):
-		return "France"
-	case strings.HasPrefix(ipStr, "3."):
-		return "USA"
-	case strings.HasPrefix(ipStr, "5."):
-		return "Germany"
-	case strings.HasPrefix(ipStr, "8."):
-		return "UK"
-	case strings.HasPrefix(ipStr, "9."):
-		return "Japan"
-	case strings.HasPrefix(ipStr, "13."):
-		return "Australia"
-	case strings.HasPrefix(ipStr, "14."):
-		return "Canada"
-	case strings.HasPrefix(ipStr, "18."):
-		return "Brazil"
-	case strings.HasPrefix(ipStr, "20."):
-		return "Russia"
-	default:
-		return "Other"
+	if info := services.LookupGeoIP(ipStr); info != nil && info.CountryCode != "" {
+		return info.CountryCode
 	}
+	return "Unknown"
 }
@@ -0,0 +1,314 @@
+package controllers
+
+import (
+	"SeproWAF/models"
+	"SeproWAF/proxy"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/beego/beego/v2/client/orm"
+	"github.com/beego/beego/v2/core/logs"
+	"github.com/beego/beego/v2/server/web"
+)
+
+// DataListController handles the data lists referenced by WAF rules
+type DataListController struct {
+	web.Controller
+}
+
+// DataListRequest represents the request body for creating/updating data lists
+type DataListRequest struct {
+	Name        string              `json:"name"`
+	Type        models.DataListType `json:"type"`
+	Description *string             `json:"description"`
+	Entries     []string            `json:"entries"`
+}
+
+// DataListEntriesRequest represents the request body for adding or removing entries
+type DataListEntriesRequest struct {
+	Entries []string `json:"entries"`
+}
+
+// dataListResponse describes a data list, with its entries when requested
+func dataListResponse(list *models.DataList, withEntries bool) map[string]interface{} {
+	entries := list.GetEntries()
+	response := map[string]interface{}{
+		"id":          list.ID,
+		"name":        list.Name,
+		"type":        list.Type,
+		"description": list.Description,
+		"entryCount":  len(entries),
+		"createdAt":   list.CreatedAt,
+		"updatedAt":   list.UpdatedAt,
+	}
+	if withEntries {
+		if entries == nil {
+			entries = []string{}
+		}
+		response["entries"] = entries
+	}
+	return response
+}
+
+// requireAdmin checks that the user may change data lists, which apply to every site
+func (c *DataListController) requireAdmin() bool {
+	if role, _ := c.Ctx.Input.GetData("userRole").(models.Role); role != models.RoleAdmin {
+		c.Ctx.Output.SetStatus(http.StatusForbidden)
+		c.Data["json"] = map[string]string{"error": "Only administrators can change data lists"}
+		c.ServeJSON()
+		return false
+	}
+	return true
+}
+
+// getDataList loads the data list from the URL
+func (c *DataListController) getDataList() *models.DataList {
+	listID, err := strconv.Atoi(c.Ctx.Input.Param(":id"))
+	if err != nil {
+		c.Ctx.Output.SetStatus(http.StatusBadRequest)
+		c.Data["json"] = map[string]string{"error": "Invalid list ID"}
+		c.ServeJSON()
+		return nil
+	}
+
+	list, err := models.GetDataListByID(listID)
+	if err != nil {
+		c.Ctx.Output.SetStatus(http.StatusNotFound)
+		c.Data["json"] = map[string]string{"error": "List not found"}
+		c.ServeJSON()
+		return nil
+	}
+	return list
+}
+
+// saveDataList stores the list and makes the WAF pick up its entries
+func (c *DataListController) saveDataList(list *models.DataList, status int) {
+	o := orm.NewOrm()
+	var err error
+	if list.ID == 0 {
+		_, err = o.Insert(list)
+	} else {
+		_, err = o.Update(list)
+	}
+	if err != nil {
+		c.Ctx.Output.SetStatus(http.StatusInternalServerError)
+		c.Data["json"] = map[string]string{"error": "Failed to save list: " + err.Error()}
+		c.ServeJSON()
+		return
+	}
+
+	if err := proxy.ReloadDataList(list); err != nil {
+		logs.Error("Failed to apply data list %s: %v", list.Name, err)
+		c.Ctx.Output.SetStatus(http.StatusInternalServerError)
+		c.Data["json"] = map[string]string{"error": "List saved but could not be applied: " + err.Error()}
+		c.ServeJSON()
+		return
+	}
+
+	c.Ctx.Output.SetStatus(status)
+	c.Data["json"] = dataListResponse(list, false)
+	c.ServeJSON()
+}
+
+// ListDataLists returns all data lists without their entries
+func (c *DataListController) ListDataLists() {
+	lists, err := models.GetDataLists()
+	if err != nil {
+		c.Ctx.Output.SetStatus(http.StatusInternalServerError)
+		c.Data["json"] = map[string]string{"error": "Failed to get lists: " + err.Error()}
+		c.ServeJSON()
+		return
+	}
+
+	response := make([]map[string]interface{}, 0, len(lists))
+	for _, list := range lists {
+		response = append(response, dataListResponse(list, false))
+	}
+
+	c.Ctx.Output.SetStatus(http.StatusOK)
+	c.Data["json"] = response
+	c.ServeJSON()
+}
+
+// GetDataList returns a data list with its entries
+func (c *DataListController) GetDataList() {
+	list := c.getDataList()
+	if list == nil {
+		return
+	}
+
+	c.Ctx.Output.SetStatus(http.StatusOK)
+	c.Data["json"] = dataListResponse(list, true)
+	c.ServeJSON()
+}
+
+// CreateDataList creates a data list
+func (c *DataListController) CreateDataList() {
+	if !c.requireAdmin() {
+		return
+	}
+
+	var req DataListRequest
+	if err := json.Unmarshal(c.Ctx.Input.RequestBody, &req); err != nil {
+		c.Ctx.Output.SetStatus(http.StatusBadRequest)
+		c.Data["json"] = map[string]string{"error": "Invalid request format"}
+		c.ServeJSON()
+		return
+	}
+
+	list := &models.DataList{
+		Name:      req.Name,
+		Type:      req.Type,
+		CreatedBy: c.Ctx.Input.GetData("userID").(int),
+	}
+	if req.Description != nil {
+		list.Description = *req.Description
+	}
+
+	if err := list.Validate(); err != nil {
+		c.Ctx.Output.SetStatus(http.StatusBadRequest)
+		c.Data["json"] = map[string]string{"error": err.Error()}
+		c.ServeJSON()
+		return
+	}
+	if err := list.SetEntries(req.Entries); err != nil {
+		c.Ctx.Output.SetStatus(http.StatusBadRequest)
+		c.Data["json"] = map[string]string{"error": err.Error()}
+		c.ServeJSON()
+		return
+	}
+
+	if _, err := models.GetDataListByName(list.Name); err == nil {
+		c.Ctx.Output.SetStatus(http.StatusConflict)
+		c.Data["json"] = map[string]string{"error": "A list with this name already exists"}
+		c.ServeJSON()
+		return
+	}
+
+	c.saveDataList(list, http.StatusCreated)
+}
+
+// UpdateDataList replaces the description and entries of a data list
+func (c *DataListController) UpdateDataList() {
+	if !c.requireAdmin() {
+		return
+	}
+
+	list := c.getDataList()
+	if list == nil {
+		return
+	}
+
+	var req DataListRequest
+	if err := json.Unmarshal(c.Ctx.Input.RequestBody, &req); err != nil {
+		c.Ctx.Output.SetStatus(http.StatusBadRequest)
+		c.Data["json"] = map[string]string{"error": "Invalid request format"}
+		c.ServeJSON()
+		return
+	}
+
+	// Rules reference lists by name and rely on the type of their entries
+	if (req.Name != "" && req.Name != list.Name) || (req.Type != "" && req.Type != list.Type) {
+		c.Ctx.Output.SetStatus(http.StatusBadRequest)
+		c.Data["json"] = map[string]string{"error": "The name and type of a list cannot be changed"}
+		c.ServeJSON()
+		return
+	}
+
+	if req.Description != nil {
+		list.Description = *req.Description
+	}
+	if req.Entries != nil {
+		if err := list.SetEntries(req.Entries); err != nil {
+			c.Ctx.Output.SetStatus(http.StatusBadRequest)
+			c.Data["json"] = map[string]string{"error": err.Error()}
+			c.ServeJSON()
+			return
+		}
+	}
+
+	c.saveDataList(list, http.StatusOK)
+}
+
+// AddDataListEntries adds entries to a data list
+func (c *DataListController) AddDataListEntries() {
+	c.changeEntries(true)
+}
+
+// RemoveDataListEntries removes entries from a data list
+func (c *DataListController) RemoveDataListEntries() {
+	c.changeEntries(false)
+}
+
+// changeEntries adds or removes the entries of the request
+func (c *DataListController) changeEntries(add bool) {
+	if !c.requireAdmin() {
+		return
+	}
+
+	list := c.getDataList()
+	if list == nil {
+		return
+	}
+
+	var req DataListEntriesRequest
+	if err := json.Unmarshal(c.Ctx.Input.RequestBody, &req); err != nil || len(req.Entries) == 0 {
+		c.Ctx.Output.SetStatus(http.StatusBadRequest)
+		c.Data["json"] = map[string]string{"error": "At least one entry is required"}
+		c.ServeJSON()
+		return
+	}
+
+	var entries []string
+	if add {
+		entries = append(list.GetEntries(), req.Entries...)
+	} else {
+		removed := make(map[string]bool, len(req.Entries))
+		for _, entry := range req.Entries {
+			removed[entry] = true
+		}
+		for _, entry := range list.GetEntries() {
+			if !removed[entry] {
+				entries = append(entries, entry)
+			}
+		}
+	}
+
+	if err := list.SetEntries(entries); err != nil {
+		c.Ctx.Output.SetStatus(http.StatusBadRequest)
+		c.Data["json"] = map[string]string{"error": err.Error()}
+		c.ServeJSON()
+		return
+	}
+
+	c.saveDataList(list, http.StatusOK)
+}
+
+// DeleteDataList deletes a data list
+func (c *DataListController) DeleteDataList() {
+	if !c.requireAdmin() {
+		return
+	}
+
+	list := c.getDataList()
+	if list == nil {
+		return
+	}
+
+	o := orm.NewOrm()
+	if _, err := o.Delete(list); err != nil {
+		c.Ctx.Output.SetStatus(http.StatusInternalServerError)
+		c.Data["json"] = map[string]string{"error": "Failed to delete list: " + err.Error()}
+		c.ServeJSON()
+		return
+	}
+
+	if err := proxy.RemoveDataList(list.Name); err != nil {
+		logs.Error("Failed to remove data list %s: %v", list.Name, err)
+	}
+
+	c.Ctx.Output.SetStatus(http.StatusOK)
+	c.Data["json"] = map[string]string{"message": "List deleted successfully"}
+	c.ServeJSON()
+}
@@ -0,0 +1,155 @@
+package controllers
+
+import (
+	"SeproWAF/models"
+	"SeproWAF/proxy"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/beego/beego/v2/client/orm"
+	"github.com/beego/beego/v2/server/web"
+)
+
+// maxDescriptorSetSize caps the size of an uploaded descriptor set
+const maxDescriptorSetSize = 10 << 20
+
+// GRPCController handles the gRPC descriptor set of a site
+type GRPCController struct {
+	web.Controller
+}
+
+// DescriptorSetRequest represents the request body for uploading a descriptor set
+type DescriptorSetRequest struct {
+	Name          string `json:"name"`
+	DescriptorSet string `json:"descriptor_set"` // Base64 encoded output of protoc --include_imports --descriptor_set_out
+}
+
+// descriptorSetResponse describes an uploaded descriptor set without its content
+func descriptorSetResponse(set *models.GRPCDescriptorSet) map[string]interface{} {
+	services := []string{}
+	if set.Services != "" {
+		services = strings.Split(set.Services, ",")
+	}
+
+	return map[string]interface{}{
+		"name":       set.Name,
+		"services":   services,
+		"size":       base64.StdEncoding.DecodedLen(len(set.Data)),
+		"updated_at": set.UpdatedAt,
+	}
+}
+
+// GetDescriptorSet returns the services of the descriptor set uploaded for a site
+func (c *GRPCController) GetDescriptorSet() {
+	site := getManagedSite(&c.Controller)
+	if site == nil {
+		return
+	}
+
+	set, err := models.GetGRPCDescriptorSetBySiteID(site.ID)
+	if err != nil {
+		c.Ctx.Output.SetStatus(http.StatusNotFound)
+		c.Data["json"] = map[string]string{"error": "No descriptor set uploaded"}
+		c.ServeJSON()
+		return
+	}
+
+	c.Ctx.Output.SetStatus(http.StatusOK)
+	c.Data["json"] = descriptorSetResponse(set)
+	c.ServeJSON()
+}
+
+// UploadDescriptorSet stores the descriptor set used to decode the gRPC messages of a site
+func (c *GRPCController) UploadDescriptorSet() {
+	site := getManagedSite(&c.Controller)
+	if site == nil {
+		return
+	}
+
+	// Parse request body
+	var req DescriptorSetRequest
+	if err := json.Unmarshal(c.Ctx.Input.RequestBody, &req); err != nil {
+		c.Ctx.Output.SetStatus(http.StatusBadRequest)
+		c.Data["json"] = map[string]string{"error": "Invalid request format"}
+		c.ServeJSON()
+		return
+	}
+
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(req.DescriptorSet))
+	if err != nil || len(data) == 0 {
+		c.Ctx.Output.SetStatus(http.StatusBadRequest)
+		c.Data["json"] = map[string]string{"error": "A base64 encoded descriptor set is required"}
+		c.ServeJSON()
+		return
+	}
+	if len(data) > maxDescriptorSetSize {
+		c.Ctx.Output.SetStatus(http.StatusBadRequest)
+		c.Data["json"] = map[string]string{"error": "Descriptor set is too large"}
+		c.ServeJSON()
+		return
+	}
+
+	_, services, err := proxy.ParseGRPCDescriptorSet(data)
+	if err != nil {
+		c.Ctx.Output.SetStatus(http.StatusBadRequest)
+		c.Data["json"] = map[string]string{"error": err.Error()}
+		c.ServeJSON()
+		return
+	}
+
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		name = "descriptor set"
+	}
+
+	// Replace the previous descriptor set of the site
+	o := orm.NewOrm()
+	set, err := models.GetGRPCDescriptorSetBySiteID(site.ID)
+	if err != nil {
+		set = &models.GRPCDescriptorSet{SiteID: site.ID}
+	}
+	set.Name = name
+	set.Data = base64.StdEncoding.EncodeToString(data)
+	set.Services = strings.Join(services, ",")
+
+	if set.ID == 0 {
+		_, err = o.Insert(set)
+	} else {
+		_, err = o.Update(set)
+	}
+	if err != nil {
+		c.Ctx.Output.SetStatus(http.StatusInternalServerError)
+		c.Data["json"] = map[string]string{"error": "Failed to save descriptor set: " + err.Error()}
+		c.ServeJSON()
+		return
+	}
+
+	proxy.ReloadGRPCDescriptors(site.ID)
+
+	c.Ctx.Output.SetStatus(http.StatusOK)
+	c.Data["json"] = descriptorSetResponse(set)
+	c.ServeJSON()
+}
+
+// DeleteDescriptorSet removes the descriptor set of a site
+func (c *GRPCController) DeleteDescriptorSet() {
+	site := getManagedSite(&c.Controller)
+	if site == nil {
+		return
+	}
+
+	if err := models.DeleteGRPCDescriptorSetBySiteID(site.ID); err != nil {
+		c.Ctx.Output.SetStatus(http.StatusInternalServerError)
+		c.Data["json"] = map[string]string{"error": "Failed to delete descriptor set: " + err.Error()}
+		c.ServeJSON()
+		return
+	}
+
+	proxy.ReloadGRPCDescriptors(site.ID)
+
+	c.Ctx.Output.SetStatus(http.StatusOK)
+	c.Data["json"] = map[string]string{"message": "Descriptor set deleted successfully"}
+	c.ServeJSON()
+}
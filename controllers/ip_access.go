@@ -0,0 +1,406 @@
+package controllers
+
+import (
+	"SeproWAF/models"
+	"SeproWAF/proxy"
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/beego/beego/v2/client/orm"
+	"github.com/beego/beego/v2/core/logs"
+	"github.com/beego/beego/v2/server/web"
+)
+
+const (
+	ipAccessImportBatchSize = 500 // New entries inserted per statement during an import
+	ipAccessImportMaxErrors = 100 // Errors reported for the skipped lines of an import
+)
+
+// IPAccessController handles the global IP access list and the lists of the sites
+type IPAccessController struct {
+	web.Controller
+}
+
+// IPAccessRequest represents the request body for adding an entry
+type IPAccessRequest struct {
+	CIDR      string              `json:"cidr"`
+	Mode      models.IPAccessMode `json:"mode"`
+	Comment   string              `json:"comment"`
+	ExpiresAt *time.Time          `json:"expiresAt"`
+	ExpiresIn string              `json:"expiresIn"` // Duration such as "24h", used when ExpiresAt is not set
+}
+
+// scope returns the site the request applies to, 0 for the global list. Changing the
+// global list requires an administrator, a site's list requires permission to manage the site.
+func (c *IPAccessController) scope(write bool) (int, bool) {
+	if c.Ctx.Input.Param(":id") != "" {
+		site := getManagedSite(&c.Controller)
+		if site == nil {
+			return 0, false
+		}
+		return site.ID, true
+	}
+
+	if role, _ := c.Ctx.Input.GetData("userRole").(models.Role); write && role != models.RoleAdmin {
+		c.Ctx.Output.SetStatus(http.StatusForbidden)
+		c.Data["json"] = map[string]string{"error": "Only administrators can change the global IP access list"}
+		c.ServeJSON()
+		return 0, false
+	}
+	return 0, true
+}
+
+// reload applies the changed entries to the proxy
+func (c *IPAccessController) reload() {
+	if err := proxy.ReloadIPAccessList(); err != nil {
+		logs.Error("Failed to reload IP access lists: %v", err)
+	}
+}
+
+// parseExpiry returns the expiry of an entry from a timestamp or a duration from now
+func parseExpiry(expiresAt *time.Time, expiresIn string) (*time.Time, error) {
+	if expiresAt != nil {
+		return expiresAt, nil
+	}
+	if expiresIn == "" {
+		return nil, nil
+	}
+
+	duration, err := time.ParseDuration(expiresIn)
+	if err != nil || duration <= 0 {
+		return nil, fmt.Errorf("invalid expiry duration: %s", expiresIn)
+	}
+	expiry := time.Now().Add(duration)
+	return &expiry, nil
+}
+
+// ListEntries returns the entries of the IP access list
+func (c *IPAccessController) ListEntries() {
+	siteID, ok := c.scope(false)
+	if !ok {
+		return
+	}
+
+	entries, err := models.GetIPAccessEntries(siteID)
+	if err != nil {
+		c.Ctx.Output.SetStatus(http.StatusInternalServerError)
+		c.Data["json"] = map[string]string{"error": "Failed to get IP access entries: " + err.Error()}
+		c.ServeJSON()
+		return
+	}
+	if entries == nil {
+		entries = []*models.IPAccessEntry{}
+	}
+
+	c.Ctx.Output.SetStatus(http.StatusOK)
+	c.Data["json"] = entries
+	c.ServeJSON()
+}
+
+// AddEntry adds an address or network to the IP access list, replacing the entry for the same network
+func (c *IPAccessController) AddEntry() {
+	siteID, ok := c.scope(true)
+	if !ok {
+		return
+	}
+
+	var req IPAccessRequest
+	if err := json.Unmarshal(c.Ctx.Input.RequestBody, &req); err != nil {
+		c.Ctx.Output.SetStatus(http.StatusBadRequest)
+		c.Data["json"] = map[string]string{"error": "Invalid request format"}
+		c.ServeJSON()
+		return
+	}
+
+	prefix, err := models.ParseIPAccessPrefix(req.CIDR)
+	if err != nil {
+		c.Ctx.Output.SetStatus(http.StatusBadRequest)
+		c.Data["json"] = map[string]string{"error": err.Error()}
+		c.ServeJSON()
+		return
+	}
+	if req.Mode == "" {
+		req.Mode = models.IPAccessDeny
+	}
+	if !req.Mode.IsValid() {
+		c.Ctx.Output.SetStatus(http.StatusBadRequest)
+		c.Data["json"] = map[string]string{"error": "Mode must be allow, deny or monitor"}
+		c.ServeJSON()
+		return
+	}
+	expiresAt, err := parseExpiry(req.ExpiresAt, req.ExpiresIn)
+	if err != nil {
+		c.Ctx.Output.SetStatus(http.StatusBadRequest)
+		c.Data["json"] = map[string]string{"error": err.Error()}
+		c.ServeJSON()
+		return
+	}
+
+	entry := &models.IPAccessEntry{
+		SiteID:    siteID,
+		CIDR:      prefix.String(),
+		Mode:      req.Mode,
+		Comment:   req.Comment,
+		ExpiresAt: expiresAt,
+		CreatedBy: c.Ctx.Input.GetData("userID").(int),
+	}
+
+	o := orm.NewOrm()
+	status := http.StatusCreated
+	existing := &models.IPAccessEntry{SiteID: siteID, CIDR: entry.CIDR}
+	if err := o.Read(existing, "SiteID", "CIDR"); err == nil {
+		entry.ID, entry.CreatedAt = existing.ID, existing.CreatedAt
+		_, err = o.Update(entry, "Mode", "Comment", "ExpiresAt", "CreatedBy")
+		if err != nil {
+			c.Ctx.Output.SetStatus(http.StatusInternalServerError)
+			c.Data["json"] = map[string]string{"error": "Failed to update IP access entry: " + err.Error()}
+			c.ServeJSON()
+			return
+		}
+		status = http.StatusOK
+	} else if _, err := o.Insert(entry); err != nil {
+		c.Ctx.Output.SetStatus(http.StatusInternalServerError)
+		c.Data["json"] = map[string]string{"error": "Failed to add IP access entry: " + err.Error()}
+		c.ServeJSON()
+		return
+	}
+
+	c.reload()
+
+	c.Ctx.Output.SetStatus(status)
+	c.Data["json"] = entry
+	c.ServeJSON()
+}
+
+// DeleteEntry removes an entry from the IP access list
+func (c *IPAccessController) DeleteEntry() {
+	siteID, ok := c.scope(true)
+	if !ok {
+		return
+	}
+
+	entryID, err := strconv.Atoi(c.Ctx.Input.Param(":entryId"))
+	if err != nil {
+		c.Ctx.Output.SetStatus(http.StatusBadRequest)
+		c.Data["json"] = map[string]string{"error": "Invalid entry ID"}
+		c.ServeJSON()
+		return
+	}
+
+	o := orm.NewOrm()
+	entry := &models.IPAccessEntry{ID: entryID}
+	if err := o.Read(entry); err != nil || entry.SiteID != siteID {
+		c.Ctx.Output.SetStatus(http.StatusNotFound)
+		c.Data["json"] = map[string]string{"error": "IP access entry not found"}
+		c.ServeJSON()
+		return
+	}
+
+	if _, err := o.Delete(entry); err != nil {
+		c.Ctx.Output.SetStatus(http.StatusInternalServerError)
+		c.Data["json"] = map[string]string{"error": "Failed to delete IP access entry: " + err.Error()}
+		c.ServeJSON()
+		return
+	}
+
+	c.reload()
+
+	c.Ctx.Output.SetStatus(http.StatusOK)
+	c.Data["json"] = map[string]string{"message": "IP access entry deleted successfully"}
+	c.ServeJSON()
+}
+
+// ImportEntries adds the entries of a plain text or CSV body to the IP access list.
+// Each line holds "cidr[,mode[,expires_at[,comment]]]"; blank lines and lines starting with #
+// are skipped. The mode, expires_in and comment query parameters apply to lines that leave
+// them out, and replace=true removes the entries that are not part of the import.
+func (c *IPAccessController) ImportEntries() {
+	siteID, ok := c.scope(true)
+	if !ok {
+		return
+	}
+
+	defaultMode := models.IPAccessMode(c.GetString("mode", string(models.IPAccessDeny)))
+	if !defaultMode.IsValid() {
+		c.Ctx.Output.SetStatus(http.StatusBadRequest)
+		c.Data["json"] = map[string]string{"error": "Mode must be allow, deny or monitor"}
+		c.ServeJSON()
+		return
+	}
+	defaultExpiry, err := parseExpiry(nil, c.GetString("expires_in"))
+	if err != nil {
+		c.Ctx.Output.SetStatus(http.StatusBadRequest)
+		c.Data["json"] = map[string]string{"error": err.Error()}
+		c.ServeJSON()
+		return
+	}
+	defaultComment := c.GetString("comment")
+	replace, _ := c.GetBool("replace", false)
+	userID := c.Ctx.Input.GetData("userID").(int)
+
+	// Parse the body, keeping the last line for each network
+	imported := make(map[string]*models.IPAccessEntry)
+	var order []string
+	var errors []string
+	skipped := 0
+	skip := func(lineNumber int, message string) {
+		skipped++
+		if len(errors) < ipAccessImportMaxErrors {
+			errors = append(errors, fmt.Sprintf("line %d: %s", lineNumber, message))
+		}
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(c.Ctx.Input.RequestBody))
+	lineNumber, parsed := 0, 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parsed++
+		fields, err := csv.NewReader(strings.NewReader(line)).Read()
+		if err != nil {
+			skip(lineNumber, err.Error())
+			continue
+		}
+		for i := range fields {
+			fields[i] = strings.TrimSpace(fields[i])
+		}
+
+		prefix, err := models.ParseIPAccessPrefix(fields[0])
+		if err != nil {
+			// A CSV header names its columns
+			if parsed > 1 || !strings.EqualFold(fields[0], "cidr") && !strings.EqualFold(fields[0], "ip") {
+				skip(lineNumber, err.Error())
+			}
+			continue
+		}
+
+		entry := &models.IPAccessEntry{
+			SiteID:    siteID,
+			CIDR:      prefix.String(),
+			Mode:      defaultMode,
+			Comment:   defaultComment,
+			ExpiresAt: defaultExpiry,
+			CreatedBy: userID,
+		}
+		if len(fields) > 1 && fields[1] != "" {
+			entry.Mode = models.IPAccessMode(strings.ToLower(fields[1]))
+			if !entry.Mode.IsValid() {
+				skip(lineNumber, "invalid mode "+fields[1])
+				continue
+			}
+		}
+		if len(fields) > 2 && fields[2] != "" {
+			expiresAt, err := time.Parse(time.RFC3339, fields[2])
+			if err != nil {
+				skip(lineNumber, "invalid expiry "+fields[2])
+				continue
+			}
+			entry.ExpiresAt = &expiresAt
+		}
+		if len(fields) > 3 {
+			entry.Comment = strings.Join(fields[3:], ",")
+		}
+		if len(entry.Comment) > 255 {
+			entry.Comment = entry.Comment[:255]
+		}
+
+		if _, seen := imported[entry.CIDR]; !seen {
+			order = append(order, entry.CIDR)
+		}
+		imported[entry.CIDR] = entry
+	}
+	if err := scanner.Err(); err != nil {
+		c.Ctx.Output.SetStatus(http.StatusBadRequest)
+		c.Data["json"] = map[string]string{"error": "Failed to read import: " + err.Error()}
+		c.ServeJSON()
+		return
+	}
+
+	existing, err := models.GetIPAccessEntries(siteID)
+	if err != nil {
+		c.Ctx.Output.SetStatus(http.StatusInternalServerError)
+		c.Data["json"] = map[string]string{"error": "Failed to get IP access entries: " + err.Error()}
+		c.ServeJSON()
+		return
+	}
+
+	o := orm.NewOrm()
+	tx, err := o.Begin()
+	if err != nil {
+		c.Ctx.Output.SetStatus(http.StatusInternalServerError)
+		c.Data["json"] = map[string]string{"error": "Failed to import IP access entries: " + err.Error()}
+		c.ServeJSON()
+		return
+	}
+
+	// Update the networks already on the list and drop the others when replacing
+	updated, removed := 0, 0
+	for _, current := range existing {
+		entry, ok := imported[current.CIDR]
+		if !ok {
+			if replace {
+				if _, err = tx.Delete(current); err != nil {
+					break
+				}
+				removed++
+			}
+			continue
+		}
+
+		entry.ID, entry.CreatedAt = current.ID, current.CreatedAt
+		if _, err = tx.Update(entry, "Mode", "Comment", "ExpiresAt", "CreatedBy"); err != nil {
+			break
+		}
+		updated++
+	}
+
+	// Insert the new networks in batches
+	var added []*models.IPAccessEntry
+	for _, cidr := range order {
+		if entry := imported[cidr]; entry.ID == 0 {
+			added = append(added, entry)
+		}
+	}
+	if err == nil && len(added) > 0 {
+		_, err = tx.InsertMulti(ipAccessImportBatchSize, added)
+	}
+
+	if err != nil {
+		tx.Rollback()
+		c.Ctx.Output.SetStatus(http.StatusInternalServerError)
+		c.Data["json"] = map[string]string{"error": "Failed to import IP access entries: " + err.Error()}
+		c.ServeJSON()
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.Ctx.Output.SetStatus(http.StatusInternalServerError)
+		c.Data["json"] = map[string]string{"error": "Failed to import IP access entries: " + err.Error()}
+		c.ServeJSON()
+		return
+	}
+
+	c.reload()
+
+	if errors == nil {
+		errors = []string{}
+	}
+	c.Ctx.Output.SetStatus(http.StatusOK)
+	c.Data["json"] = map[string]interface{}{
+		"added":   len(added),
+		"updated": updated,
+		"removed": removed,
+		"skipped": skipped,
+		"errors":  errors,
+	}
+	c.ServeJSON()
+}
@@ -0,0 +1,285 @@
+package controllers
+
+import (
+	"SeproWAF/models"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/beego/beego/v2/client/orm"
+	"github.com/beego/beego/v2/server/web"
+)
+
+// RouteController handles the routing rules of a site
+type RouteController struct {
+	web.Controller
+}
+
+// RouteRequest represents the request body for creating/updating routes
+type RouteRequest struct {
+	Name          *string           `json:"name"`
+	Priority      *int              `json:"priority"`
+	PathPrefix    *string           `json:"path_prefix"`
+	PathRegex     *string           `json:"path_regex"`
+	Methods       []string          `json:"methods"`
+	Headers       map[string]string `json:"headers"`
+	UpstreamIDs   []int             `json:"upstream_ids"`
+	RewritePrefix *string           `json:"rewrite_prefix"`
+	WAFEnabled    *bool             `json:"waf_enabled"`
+	Enabled       *bool             `json:"enabled"`
+}
+
+// applyTo copies the provided fields of the request onto the route, returning an error message for invalid values
+func (r *RouteRequest) applyTo(route *models.Route, site *models.Site) string {
+	if r.Name != nil {
+		route.Name = strings.TrimSpace(*r.Name)
+	}
+
+	if r.Priority != nil {
+		route.Priority = *r.Priority
+	}
+
+	if r.PathPrefix != nil {
+		prefix := strings.TrimSpace(*r.PathPrefix)
+		if prefix != "" && !strings.HasPrefix(prefix, "/") {
+			return "Path prefix must start with /"
+		}
+		route.PathPrefix = prefix
+	}
+
+	if r.PathRegex != nil {
+		pattern := strings.TrimSpace(*r.PathRegex)
+		if pattern != "" {
+			if _, err := regexp.Compile(pattern); err != nil {
+				return "Invalid path regex: " + err.Error()
+			}
+		}
+		route.PathRegex = pattern
+	}
+
+	if r.Methods != nil {
+		var methods []string
+		for _, method := range r.Methods {
+			method = strings.ToUpper(strings.TrimSpace(method))
+			if method != "" {
+				methods = append(methods, method)
+			}
+		}
+		route.Methods = strings.Join(methods, ",")
+	}
+
+	if r.Headers != nil {
+		headers := make(map[string]string)
+		for name, pattern := range r.Headers {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				return "Header name cannot be empty"
+			}
+			if _, err := regexp.Compile(pattern); err != nil {
+				return "Invalid regex for header " + name + ": " + err.Error()
+			}
+			headers[name] = pattern
+		}
+
+		route.Headers = ""
+		if len(headers) > 0 {
+			data, _ := json.Marshal(headers)
+			route.Headers = string(data)
+		}
+	}
+
+	if r.UpstreamIDs != nil {
+		var ids []string
+		for _, id := range r.UpstreamIDs {
+			upstream, err := models.GetUpstreamByID(id)
+			if err != nil || upstream.SiteID != site.ID {
+				return "Upstream " + strconv.Itoa(id) + " does not belong to this site"
+			}
+			ids = append(ids, strconv.Itoa(id))
+		}
+		route.UpstreamIDs = strings.Join(ids, ",")
+	}
+
+	if r.RewritePrefix != nil {
+		rewrite := strings.TrimSpace(*r.RewritePrefix)
+		if rewrite != "" && !strings.HasPrefix(rewrite, "/") {
+			return "Rewrite prefix must start with /"
+		}
+		route.RewritePrefix = rewrite
+	}
+
+	if r.WAFEnabled != nil {
+		route.WAFEnabled = *r.WAFEnabled
+	}
+
+	if r.Enabled != nil {
+		route.Enabled = *r.Enabled
+	}
+
+	if route.Name == "" {
+		return "Route name is required"
+	}
+
+	if route.RewritePrefix != "" && route.PathPrefix == "" {
+		return "A rewrite prefix requires a path prefix"
+	}
+
+	return ""
+}
+
+// getSiteRoute loads the route from the URL and checks that it belongs to the site
+func (c *RouteController) getSiteRoute(site *models.Site) *models.Route {
+	routeID, err := strconv.Atoi(c.Ctx.Input.Param(":routeId"))
+	if err != nil {
+		c.Ctx.Output.SetStatus(http.StatusBadRequest)
+		c.Data["json"] = map[string]string{"error": "Invalid route ID"}
+		c.ServeJSON()
+		return nil
+	}
+
+	route, err := models.GetRouteByID(routeID)
+	if err != nil || route.SiteID != site.ID {
+		c.Ctx.Output.SetStatus(http.StatusNotFound)
+		c.Data["json"] = map[string]string{"error": "Route not found"}
+		c.ServeJSON()
+		return nil
+	}
+
+	return route
+}
+
+// ListRoutes returns the routes of a site in evaluation order
+func (c *RouteController) ListRoutes() {
+	site := getManagedSite(&c.Controller)
+	if site == nil {
+		return
+	}
+
+	routes, err := models.GetRoutesBySiteID(site.ID)
+	if err != nil {
+		c.Ctx.Output.SetStatus(http.StatusInternalServerError)
+		c.Data["json"] = map[string]string{"error": "Failed to fetch routes: " + err.Error()}
+		c.ServeJSON()
+		return
+	}
+
+	c.Ctx.Output.SetStatus(http.StatusOK)
+	c.Data["json"] = routes
+	c.ServeJSON()
+}
+
+// CreateRoute adds a routing rule to a site
+func (c *RouteController) CreateRoute() {
+	site := getManagedSite(&c.Controller)
+	if site == nil {
+		return
+	}
+
+	// Parse request body
+	var req RouteRequest
+	if err := json.Unmarshal(c.Ctx.Input.RequestBody, &req); err != nil {
+		c.Ctx.Output.SetStatus(http.StatusBadRequest)
+		c.Data["json"] = map[string]string{"error": "Invalid request format"}
+		c.ServeJSON()
+		return
+	}
+
+	route := &models.Route{
+		SiteID:     site.ID,
+		WAFEnabled: true,
+		Enabled:    true,
+	}
+
+	if msg := req.applyTo(route, site); msg != "" {
+		c.Ctx.Output.SetStatus(http.StatusBadRequest)
+		c.Data["json"] = map[string]string{"error": msg}
+		c.ServeJSON()
+		return
+	}
+
+	o := orm.NewOrm()
+	if _, err := o.Insert(route); err != nil {
+		c.Ctx.Output.SetStatus(http.StatusInternalServerError)
+		c.Data["json"] = map[string]string{"error": "Failed to create route: " + err.Error()}
+		c.ServeJSON()
+		return
+	}
+
+	refreshSiteProxy(site)
+
+	c.Ctx.Output.SetStatus(http.StatusCreated)
+	c.Data["json"] = route
+	c.ServeJSON()
+}
+
+// UpdateRoute updates a routing rule of a site
+func (c *RouteController) UpdateRoute() {
+	site := getManagedSite(&c.Controller)
+	if site == nil {
+		return
+	}
+
+	route := c.getSiteRoute(site)
+	if route == nil {
+		return
+	}
+
+	// Parse request body
+	var req RouteRequest
+	if err := json.Unmarshal(c.Ctx.Input.RequestBody, &req); err != nil {
+		c.Ctx.Output.SetStatus(http.StatusBadRequest)
+		c.Data["json"] = map[string]string{"error": "Invalid request format"}
+		c.ServeJSON()
+		return
+	}
+
+	if msg := req.applyTo(route, site); msg != "" {
+		c.Ctx.Output.SetStatus(http.StatusBadRequest)
+		c.Data["json"] = map[string]string{"error": msg}
+		c.ServeJSON()
+		return
+	}
+
+	o := orm.NewOrm()
+	if _, err := o.Update(route); err != nil {
+		c.Ctx.Output.SetStatus(http.StatusInternalServerError)
+		c.Data["json"] = map[string]string{"error": "Failed to update route: " + err.Error()}
+		c.ServeJSON()
+		return
+	}
+
+	refreshSiteProxy(site)
+
+	c.Ctx.Output.SetStatus(http.StatusOK)
+	c.Data["json"] = route
+	c.ServeJSON()
+}
+
+// DeleteRoute removes a routing rule from a site
+func (c *RouteController) DeleteRoute() {
+	site := getManagedSite(&c.Controller)
+	if site == nil {
+		return
+	}
+
+	route := c.getSiteRoute(site)
+	if route == nil {
+		return
+	}
+
+	o := orm.NewOrm()
+	if _, err := o.Delete(route); err != nil {
+		c.Ctx.Output.SetStatus(http.StatusInternalServerError)
+		c.Data["json"] = map[string]string{"error": "Failed to delete route: " + err.Error()}
+		c.ServeJSON()
+		return
+	}
+
+	refreshSiteProxy(site)
+
+	c.Ctx.Output.SetStatus(http.StatusOK)
+	c.Data["json"] = map[string]string{"message": "Route deleted successfully"}
+	c.ServeJSON()
+}
@@ -21,11 +21,57 @@ type SiteController struct {
 
 // SiteRequest represents the request body for creating/updating sites
 type SiteRequest struct {
-	Name          string `json:"name"`
-	Domain        string `json:"domain"`
-	TargetURL     string `json:"target_url"`
-	Status        string `json:"status,omitempty"`
-	CertificateID *int   `json:"certificate_id"`
+	Name          string  `json:"name"`
+	Domain        string  `json:"domain"`
+	TargetURL     string  `json:"target_url"`
+	Status        string  `json:"status,omitempty"`
+	CertificateID *int    `json:"certificate_id"`
+	LoadBalancing string  `json:"load_balancing,omitempty"`
+	HashCookie    *string `json:"hash_cookie,omitempty"`
+
+	WebSocketInspection *bool   `json:"websocket_inspection,omitempty"`
+	WebSocketRuleIDs    *string `json:"websocket_rule_ids,omitempty"`
+
+	GRPCInspection *bool `json:"grpc_inspection,omitempty"`
+
+	TrustedProxies *string `json:"trusted_proxies,omitempty"`
+	ClientIPHeader *string `json:"client_ip_header,omitempty"`
+}
+
+// getManagedSite loads the site from the URL and checks that the current user can manage it.
+// It writes the error response and returns nil if the site can't be used.
+func getManagedSite(c *web.Controller) *models.Site {
+	// Get user ID and role from context (set by middleware)
+	userID := c.Ctx.Input.GetData("userID").(int)
+	userRole := c.Ctx.Input.GetData("userRole").(models.Role)
+
+	// Get site ID from URL parameter
+	siteID, err := strconv.Atoi(c.Ctx.Input.Param(":id"))
+	if err != nil {
+		c.Ctx.Output.SetStatus(http.StatusBadRequest)
+		c.Data["json"] = map[string]string{"error": "Invalid site ID"}
+		c.ServeJSON()
+		return nil
+	}
+
+	// Get the site
+	site, err := models.GetSiteByID(siteID)
+	if err != nil {
+		c.Ctx.Output.SetStatus(http.StatusNotFound)
+		c.Data["json"] = map[string]string{"error": "Site not found"}
+		c.ServeJSON()
+		return nil
+	}
+
+	// Check if user has permission to manage the site
+	if !site.CanUserManageSite(userID, userRole) {
+		c.Ctx.Output.SetStatus(http.StatusForbidden)
+		c.Data["json"] = map[string]string{"error": "Access denied"}
+		c.ServeJSON()
+		return nil
+	}
+
+	return site
 }
 
 // ListSites returns all sites owned by the current user
@@ -243,6 +289,73 @@ func (c *SiteController) UpdateSite() {
 		site.TargetURL = targetURL
 	}
 
+	// Update load-balancing policy if provided
+	if req.LoadBalancing != "" {
+		policy := models.LoadBalancingPolicy(req.LoadBalancing)
+		if !policy.IsValid() {
+			c.Ctx.Output.SetStatus(http.StatusBadRequest)
+			c.Data["json"] = map[string]string{"error": "Invalid load balancing policy"}
+			c.ServeJSON()
+			return
+		}
+		site.LoadBalancing = string(policy)
+	}
+
+	if req.HashCookie != nil {
+		site.HashCookie = strings.TrimSpace(*req.HashCookie)
+	}
+
+	if models.LoadBalancingPolicy(site.LoadBalancing) == models.LBCookieHash && site.HashCookie == "" {
+		c.Ctx.Output.SetStatus(http.StatusBadRequest)
+		c.Data["json"] = map[string]string{"error": "Cookie hash policy requires a hash cookie name"}
+		c.ServeJSON()
+		return
+	}
+
+	// Update WebSocket frame inspection if provided
+	if req.WebSocketInspection != nil {
+		site.WebSocketInspection = *req.WebSocketInspection
+	}
+
+	if req.WebSocketRuleIDs != nil {
+		ruleIDs := strings.TrimSpace(*req.WebSocketRuleIDs)
+		if _, err := models.ParseRuleIDRanges(ruleIDs); err != nil {
+			c.Ctx.Output.SetStatus(http.StatusBadRequest)
+			c.Data["json"] = map[string]string{"error": "Invalid WebSocket rule IDs: " + err.Error()}
+			c.ServeJSON()
+			return
+		}
+		site.WebSocketRuleIDs = ruleIDs
+	}
+
+	// Update gRPC inspection if provided
+	if req.GRPCInspection != nil {
+		site.GRPCInspection = *req.GRPCInspection
+	}
+
+	// Update client IP resolution if provided
+	if req.TrustedProxies != nil {
+		trustedProxies := strings.TrimSpace(*req.TrustedProxies)
+		if _, err := models.ParseTrustedProxies(trustedProxies); err != nil {
+			c.Ctx.Output.SetStatus(http.StatusBadRequest)
+			c.Data["json"] = map[string]string{"error": "Invalid trusted proxies: " + err.Error()}
+			c.ServeJSON()
+			return
+		}
+		site.TrustedProxies = trustedProxies
+	}
+
+	if req.ClientIPHeader != nil {
+		header := strings.TrimSpace(*req.ClientIPHeader)
+		if strings.ContainsAny(header, " \t:,;") {
+			c.Ctx.Output.SetStatus(http.StatusBadRequest)
+			c.Data["json"] = map[string]string{"error": "Invalid client IP header name"}
+			c.ServeJSON()
+			return
+		}
+		site.ClientIPHeader = header
+	}
+
 	// Only admins can change status
 	if req.Status != "" && userRole == models.RoleAdmin {
 		site.Status = models.SiteStatus(req.Status)
@@ -344,6 +457,17 @@ func (c *SiteController) DeleteSite() {
 		return
 	}
 
+	// Delete the site's upstreams
+	if err := models.DeleteUpstreamsBySiteID(siteID); err != nil {
+		logs.Error("Failed to delete upstreams for site %d: %v", siteID, err)
+	}
+	if err := models.DeleteRoutesBySiteID(siteID); err != nil {
+		logs.Error("Failed to delete routes for site %d: %v", siteID, err)
+	}
+	if err := models.DeleteGRPCDescriptorSetBySiteID(siteID); err != nil {
+		logs.Error("Failed to delete gRPC descriptor set for site %d: %v", siteID, err)
+	}
+
 	// Remove from proxy
 	proxy.RemoveSiteFromProxy(domain)
 
@@ -472,6 +596,13 @@ func (c *SiteController) GetSiteStats() {
 		stats["block_rate"] = float64(site.BlockedCount) / float64(site.RequestCount) * 100
 	}
 
+	// Include the health of the upstreams currently served by the proxy
+	upstreams := proxy.GetSiteUpstreamHealth(site.Domain)
+	if upstreams == nil {
+		upstreams = []proxy.BackendHealth{}
+	}
+	stats["upstreams"] = upstreams
+
 	c.Ctx.Output.SetStatus(http.StatusOK)
 	c.Data["json"] = stats
 	c.ServeJSON()
@@ -542,3 +673,63 @@ func (c *SiteController) ToggleWAF() {
 	}
 	c.ServeJSON()
 }
+
+// GetSiteSettings returns the upstream transport, retry, WAF engine and gRPC settings of a site
+func (c *SiteController) GetSiteSettings() {
+	site := getManagedSite(&c.Controller)
+	if site == nil {
+		return
+	}
+
+	settings, err := site.GetSettings()
+	if err != nil {
+		logs.Warning("Site %d has invalid settings, returning defaults: %v", site.ID, err)
+	}
+
+	c.Ctx.Output.SetStatus(http.StatusOK)
+	c.Data["json"] = settings
+	c.ServeJSON()
+}
+
+// UpdateSiteSettings updates the upstream transport, retry, WAF engine and gRPC settings of a site.
+// Fields missing from the request keep their current values.
+func (c *SiteController) UpdateSiteSettings() {
+	site := getManagedSite(&c.Controller)
+	if site == nil {
+		return
+	}
+
+	settings, err := site.GetSettings()
+	if err != nil {
+		logs.Warning("Site %d has invalid settings, starting from defaults: %v", site.ID, err)
+	}
+
+	// Parse request body over the current settings
+	if err := json.Unmarshal(c.Ctx.Input.RequestBody, settings); err != nil {
+		c.Ctx.Output.SetStatus(http.StatusBadRequest)
+		c.Data["json"] = map[string]string{"error": "Invalid request format"}
+		c.ServeJSON()
+		return
+	}
+
+	if err := site.SetSettings(settings); err != nil {
+		c.Ctx.Output.SetStatus(http.StatusBadRequest)
+		c.Data["json"] = map[string]string{"error": "Invalid settings: " + err.Error()}
+		c.ServeJSON()
+		return
+	}
+
+	o := orm.NewOrm()
+	if _, err := o.Update(site, "Settings"); err != nil {
+		c.Ctx.Output.SetStatus(http.StatusInternalServerError)
+		c.Data["json"] = map[string]string{"error": "Failed to update settings: " + err.Error()}
+		c.ServeJSON()
+		return
+	}
+
+	refreshSiteProxy(site)
+
+	c.Ctx.Output.SetStatus(http.StatusOK)
+	c.Data["json"] = settings
+	c.ServeJSON()
+}
@@ -624,3 +624,24 @@ func (c *UIController) Settings() {
 	c.Layout = "layout.tpl"
 	c.TplName = "settings/settings.tpl"
 }
+
+// BanList renders the temporary bans and ban policies page (admin only)
+func (c *UIController) BanList() {
+	user := c.GetUserFromJWT()
+	if user == nil {
+		c.Redirect("/auth/login", 302)
+		return
+	}
+
+	if !user.IsAdmin() {
+		c.Redirect("/dashboard", 302)
+		return
+	}
+
+	c.Data["Title"] = "Bans"
+	c.Data["Username"] = user.Username
+	c.Data["IsAuthenticated"] = true
+	c.Data["IsAdmin"] = user.IsAdmin()
+	c.Layout = "layout.tpl"
+	c.TplName = "waf/bans.tpl"
+}
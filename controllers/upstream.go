@@ -0,0 +1,293 @@
+package controllers
+
+import (
+	"SeproWAF/models"
+	"SeproWAF/proxy"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/beego/beego/v2/client/orm"
+	"github.com/beego/beego/v2/core/logs"
+	"github.com/beego/beego/v2/server/web"
+)
+
+// UpstreamController handles the upstream pool of a site
+type UpstreamController struct {
+	web.Controller
+}
+
+// UpstreamRequest represents the request body for creating/updating upstreams
+type UpstreamRequest struct {
+	URL                 string  `json:"url"`
+	Weight              *int    `json:"weight"`
+	Enabled             *bool   `json:"enabled"`
+	HealthCheckPath     *string `json:"health_check_path"`
+	HealthCheckInterval *int    `json:"health_check_interval"`
+	HealthCheckTimeout  *int    `json:"health_check_timeout"`
+	HealthyThreshold    *int    `json:"healthy_threshold"`
+	UnhealthyThreshold  *int    `json:"unhealthy_threshold"`
+	MaxFails            *int    `json:"max_fails"`
+	EjectDuration       *int    `json:"eject_duration"`
+}
+
+// applyTo copies the provided fields of the request onto the upstream, returning an error message for invalid values
+func (r *UpstreamRequest) applyTo(upstream *models.Upstream) string {
+	if r.Weight != nil {
+		if *r.Weight < 1 {
+			return "Weight must be at least 1"
+		}
+		upstream.Weight = *r.Weight
+	}
+
+	if r.Enabled != nil {
+		upstream.Enabled = *r.Enabled
+	}
+
+	if r.HealthCheckPath != nil {
+		path := strings.TrimSpace(*r.HealthCheckPath)
+		if path != "" && !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+		upstream.HealthCheckPath = path
+	}
+
+	// All durations and thresholds must be positive, except max fails where 0 disables passive checks
+	positive := []struct {
+		value *int
+		field *int
+		name  string
+	}{
+		{r.HealthCheckInterval, &upstream.HealthCheckInterval, "Health check interval"},
+		{r.HealthCheckTimeout, &upstream.HealthCheckTimeout, "Health check timeout"},
+		{r.HealthyThreshold, &upstream.HealthyThreshold, "Healthy threshold"},
+		{r.UnhealthyThreshold, &upstream.UnhealthyThreshold, "Unhealthy threshold"},
+		{r.EjectDuration, &upstream.EjectDuration, "Eject duration"},
+	}
+	for _, p := range positive {
+		if p.value == nil {
+			continue
+		}
+		if *p.value < 1 {
+			return p.name + " must be at least 1"
+		}
+		*p.field = *p.value
+	}
+
+	if r.MaxFails != nil {
+		if *r.MaxFails < 0 {
+			return "Max fails cannot be negative"
+		}
+		upstream.MaxFails = *r.MaxFails
+	}
+
+	return ""
+}
+
+// getSiteUpstream loads the upstream from the URL and checks that it belongs to the site
+func (c *UpstreamController) getSiteUpstream(site *models.Site) *models.Upstream {
+	upstreamID, err := strconv.Atoi(c.Ctx.Input.Param(":upstreamId"))
+	if err != nil {
+		c.Ctx.Output.SetStatus(http.StatusBadRequest)
+		c.Data["json"] = map[string]string{"error": "Invalid upstream ID"}
+		c.ServeJSON()
+		return nil
+	}
+
+	upstream, err := models.GetUpstreamByID(upstreamID)
+	if err != nil || upstream.SiteID != site.ID {
+		c.Ctx.Output.SetStatus(http.StatusNotFound)
+		c.Data["json"] = map[string]string{"error": "Upstream not found"}
+		c.ServeJSON()
+		return nil
+	}
+
+	return upstream
+}
+
+// normalizeUpstreamURL ensures the upstream URL has a protocol and a host
+func normalizeUpstreamURL(rawURL string) (string, bool) {
+	rawURL = strings.TrimSpace(rawURL)
+	if !strings.HasPrefix(rawURL, "http://") && !strings.HasPrefix(rawURL, "https://") {
+		rawURL = "http://" + rawURL
+	}
+
+	parsed, err := url.Parse(rawURL)
+	if err != nil || parsed.Host == "" {
+		return "", false
+	}
+	return rawURL, true
+}
+
+// refreshSiteProxy reloads the site in the proxy so upstream changes take effect
+func refreshSiteProxy(site *models.Site) {
+	if site.Status != models.SiteStatusActive {
+		return
+	}
+	if err := proxy.RefreshSite(site); err != nil {
+		logs.Error("Failed to update site in proxy: %v", err)
+	}
+}
+
+// ListUpstreams returns the upstream pool of a site
+func (c *UpstreamController) ListUpstreams() {
+	site := getManagedSite(&c.Controller)
+	if site == nil {
+		return
+	}
+
+	upstreams, err := models.GetUpstreamsBySiteID(site.ID)
+	if err != nil {
+		c.Ctx.Output.SetStatus(http.StatusInternalServerError)
+		c.Data["json"] = map[string]string{"error": "Failed to fetch upstreams: " + err.Error()}
+		c.ServeJSON()
+		return
+	}
+
+	c.Ctx.Output.SetStatus(http.StatusOK)
+	c.Data["json"] = map[string]interface{}{
+		"load_balancing": site.GetLoadBalancingPolicy(),
+		"hash_cookie":    site.HashCookie,
+		"upstreams":      upstreams,
+	}
+	c.ServeJSON()
+}
+
+// CreateUpstream adds a backend to the upstream pool of a site
+func (c *UpstreamController) CreateUpstream() {
+	site := getManagedSite(&c.Controller)
+	if site == nil {
+		return
+	}
+
+	// Parse request body
+	var req UpstreamRequest
+	if err := json.Unmarshal(c.Ctx.Input.RequestBody, &req); err != nil {
+		c.Ctx.Output.SetStatus(http.StatusBadRequest)
+		c.Data["json"] = map[string]string{"error": "Invalid request format"}
+		c.ServeJSON()
+		return
+	}
+
+	upstreamURL, ok := normalizeUpstreamURL(req.URL)
+	if req.URL == "" || !ok {
+		c.Ctx.Output.SetStatus(http.StatusBadRequest)
+		c.Data["json"] = map[string]string{"error": "A valid upstream URL is required"}
+		c.ServeJSON()
+		return
+	}
+
+	upstream := &models.Upstream{
+		SiteID:   site.ID,
+		URL:      upstreamURL,
+		Weight:   1,
+		Enabled:  true,
+		MaxFails: 5,
+	}
+	upstream.ApplyHealthDefaults()
+
+	if msg := req.applyTo(upstream); msg != "" {
+		c.Ctx.Output.SetStatus(http.StatusBadRequest)
+		c.Data["json"] = map[string]string{"error": msg}
+		c.ServeJSON()
+		return
+	}
+
+	o := orm.NewOrm()
+	if _, err := o.Insert(upstream); err != nil {
+		c.Ctx.Output.SetStatus(http.StatusInternalServerError)
+		c.Data["json"] = map[string]string{"error": "Failed to create upstream: " + err.Error()}
+		c.ServeJSON()
+		return
+	}
+
+	refreshSiteProxy(site)
+
+	c.Ctx.Output.SetStatus(http.StatusCreated)
+	c.Data["json"] = upstream
+	c.ServeJSON()
+}
+
+// UpdateUpstream updates a backend in the upstream pool of a site
+func (c *UpstreamController) UpdateUpstream() {
+	site := getManagedSite(&c.Controller)
+	if site == nil {
+		return
+	}
+
+	upstream := c.getSiteUpstream(site)
+	if upstream == nil {
+		return
+	}
+
+	// Parse request body
+	var req UpstreamRequest
+	if err := json.Unmarshal(c.Ctx.Input.RequestBody, &req); err != nil {
+		c.Ctx.Output.SetStatus(http.StatusBadRequest)
+		c.Data["json"] = map[string]string{"error": "Invalid request format"}
+		c.ServeJSON()
+		return
+	}
+
+	// Update fields if provided
+	if req.URL != "" {
+		upstreamURL, ok := normalizeUpstreamURL(req.URL)
+		if !ok {
+			c.Ctx.Output.SetStatus(http.StatusBadRequest)
+			c.Data["json"] = map[string]string{"error": "Invalid upstream URL"}
+			c.ServeJSON()
+			return
+		}
+		upstream.URL = upstreamURL
+	}
+
+	if msg := req.applyTo(upstream); msg != "" {
+		c.Ctx.Output.SetStatus(http.StatusBadRequest)
+		c.Data["json"] = map[string]string{"error": msg}
+		c.ServeJSON()
+		return
+	}
+
+	o := orm.NewOrm()
+	if _, err := o.Update(upstream); err != nil {
+		c.Ctx.Output.SetStatus(http.StatusInternalServerError)
+		c.Data["json"] = map[string]string{"error": "Failed to update upstream: " + err.Error()}
+		c.ServeJSON()
+		return
+	}
+
+	refreshSiteProxy(site)
+
+	c.Ctx.Output.SetStatus(http.StatusOK)
+	c.Data["json"] = upstream
+	c.ServeJSON()
+}
+
+// DeleteUpstream removes a backend from the upstream pool of a site
+func (c *UpstreamController) DeleteUpstream() {
+	site := getManagedSite(&c.Controller)
+	if site == nil {
+		return
+	}
+
+	upstream := c.getSiteUpstream(site)
+	if upstream == nil {
+		return
+	}
+
+	o := orm.NewOrm()
+	if _, err := o.Delete(upstream); err != nil {
+		c.Ctx.Output.SetStatus(http.StatusInternalServerError)
+		c.Data["json"] = map[string]string{"error": "Failed to delete upstream: " + err.Error()}
+		c.ServeJSON()
+		return
+	}
+
+	refreshSiteProxy(site)
+
+	c.Ctx.Output.SetStatus(http.StatusOK)
+	c.Data["json"] = map[string]string{"message": "Upstream deleted successfully"}
+	c.ServeJSON()
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"SeproWAF/models"
@@ -224,6 +225,10 @@ func (c *WAFRuleController) CreateRule() {
 		c.ServeJSON()
 		return
 	}
+	c.recordRevision(&rule, models.RuleOperationCreate, userID)
+
+	// Rate limits are enforced by the proxy, outside the WAF
+	proxy.ReloadRateLimits(rule.SiteID)
 
 	// Reload WAF for the site
 	if c.wafManager == nil {
@@ -309,12 +314,17 @@ func (c *WAFRuleController) UpdateRule() {
 	}
 
 	// Update the rule
+	c.recordBaseline(existingRule)
 	if err := models.UpdateWAFRule(&updatedRule); err != nil {
 		c.Ctx.Output.SetStatus(500)
 		c.Data["json"] = map[string]string{"error": "Failed to update rule: " + err.Error()}
 		c.ServeJSON()
 		return
 	}
+	c.recordRevision(&updatedRule, models.RuleOperationUpdate, userID)
+
+	// Rate limits are enforced by the proxy, outside the WAF
+	proxy.ReloadRateLimits(updatedRule.SiteID)
 
 	// Reload WAF for the site
 	if c.wafManager == nil {
@@ -378,12 +388,17 @@ func (c *WAFRuleController) DeleteRule() {
 	siteID := rule.SiteID
 
 	// Delete the rule
+	c.recordBaseline(rule)
 	if err := models.DeleteWAFRule(ruleID); err != nil {
 		c.Ctx.Output.SetStatus(500)
 		c.Data["json"] = map[string]string{"error": "Failed to delete rule: " + err.Error()}
 		c.ServeJSON()
 		return
 	}
+	c.recordRevision(rule, models.RuleOperationDelete, userID)
+
+	// Rate limits are enforced by the proxy, outside the WAF
+	proxy.ReloadRateLimits(siteID)
 
 	// Reload WAF for the site
 	if c.wafManager == nil {
@@ -444,6 +459,7 @@ func (c *WAFRuleController) ToggleRuleStatus() {
 	}
 
 	// Toggle rule status
+	c.recordBaseline(rule)
 	if err := models.ToggleWAFRuleStatus(ruleID); err != nil {
 		c.Ctx.Output.SetStatus(500)
 		c.Data["json"] = map[string]string{"error": "Failed to toggle rule status: " + err.Error()}
@@ -459,6 +475,10 @@ func (c *WAFRuleController) ToggleRuleStatus() {
 		c.ServeJSON()
 		return
 	}
+	c.recordRevision(updatedRule, models.RuleOperationToggle, userID)
+
+	// Rate limits are enforced by the proxy, outside the WAF
+	proxy.ReloadRateLimits(updatedRule.SiteID)
 
 	// Reload WAF for the site
 	if c.wafManager != nil {
@@ -482,6 +502,336 @@ func (c *WAFRuleController) ToggleRuleStatus() {
 	c.ServeJSON()
 }
 
+// RollbackRequest represents the request body for rolling a rule back
+type RollbackRequest struct {
+	Revision int    `json:"revision"`
+	Comment  string `json:"comment"`
+}
+
+// revisionComment returns the comment describing a change, from the comment field of the
+// request body or the comment query parameter
+func (c *WAFRuleController) revisionComment() string {
+	var body struct {
+		Comment string `json:"comment"`
+	}
+	if len(c.Ctx.Input.RequestBody) > 0 {
+		json.Unmarshal(c.Ctx.Input.RequestBody, &body)
+	}
+	if body.Comment == "" {
+		body.Comment = c.GetString("comment")
+	}
+
+	comment := strings.TrimSpace(body.Comment)
+	if len(comment) > 500 {
+		comment = comment[:500]
+	}
+	return comment
+}
+
+// recordBaseline stores a rule about to change as its first revision when it has none yet,
+// which is the case for rules created before revisions were kept
+func (c *WAFRuleController) recordBaseline(rule *models.WAFRule) {
+	if err := models.RecordWAFRuleBaseline(rule); err != nil {
+		logs.Error("Failed to record baseline revision of rule %d: %v", rule.ID, err)
+	}
+}
+
+// recordRevision stores a revision of a changed rule. The change is already saved,
+// so a failure is logged rather than returned.
+func (c *WAFRuleController) recordRevision(rule *models.WAFRule, operation models.WAFRuleOperation, userID int) {
+	if _, err := models.RecordWAFRuleRevision(rule, operation, userID, c.revisionComment()); err != nil {
+		logs.Error("Failed to record %s revision of rule %d: %v", operation, rule.ID, err)
+	}
+}
+
+// getRuleRevisions loads the revisions of the rule in the URL, checking that the user may
+// manage its site. Deleted rules are found through their revisions.
+func (c *WAFRuleController) getRuleRevisions() (int, []*models.WAFRuleRevision, bool) {
+	// Get user ID and role from context (set by middleware)
+	userID := c.Ctx.Input.GetData("userID").(int)
+	userRole := c.Ctx.Input.GetData("userRole").(models.Role)
+
+	// Get rule ID from URL parameter
+	ruleID, err := strconv.Atoi(c.Ctx.Input.Param(":id"))
+	if err != nil {
+		c.Ctx.Output.SetStatus(400)
+		c.Data["json"] = map[string]string{"error": "Invalid rule ID"}
+		c.ServeJSON()
+		return 0, nil, false
+	}
+
+	revisions, err := models.GetWAFRuleRevisions(ruleID)
+	if err != nil {
+		c.Ctx.Output.SetStatus(500)
+		c.Data["json"] = map[string]string{"error": "Failed to get rule revisions: " + err.Error()}
+		c.ServeJSON()
+		return 0, nil, false
+	}
+
+	// Rules created before revisions were recorded have none
+	var siteID int
+	if rule, err := models.GetWAFRuleByID(ruleID); err == nil {
+		siteID = rule.SiteID
+	} else if len(revisions) > 0 {
+		siteID = revisions[len(revisions)-1].SiteID
+	} else {
+		c.Ctx.Output.SetStatus(404)
+		c.Data["json"] = map[string]string{"error": "Rule not found"}
+		c.ServeJSON()
+		return 0, nil, false
+	}
+
+	// Get the site
+	site, err := models.GetSiteByID(siteID)
+	if err != nil {
+		c.Ctx.Output.SetStatus(404)
+		c.Data["json"] = map[string]string{"error": "Site not found"}
+		c.ServeJSON()
+		return 0, nil, false
+	}
+
+	// Check if user has permission to manage the site
+	if !site.CanUserManageSite(userID, userRole) {
+		c.Ctx.Output.SetStatus(403)
+		c.Data["json"] = map[string]string{"error": "Access denied"}
+		c.ServeJSON()
+		return 0, nil, false
+	}
+
+	return ruleID, revisions, true
+}
+
+// findRevision returns the revision with a number, or nil
+func findRevision(revisions []*models.WAFRuleRevision, number int) *models.WAFRuleRevision {
+	for _, revision := range revisions {
+		if revision.Revision == number {
+			return revision
+		}
+	}
+	return nil
+}
+
+// GetRuleRevisions lists the revisions of a rule, oldest first
+func (c *WAFRuleController) GetRuleRevisions() {
+	_, revisions, ok := c.getRuleRevisions()
+	if !ok {
+		return
+	}
+
+	c.Data["json"] = revisions
+	c.ServeJSON()
+}
+
+// GetRuleRevision retrieves one revision of a rule
+func (c *WAFRuleController) GetRuleRevision() {
+	_, revisions, ok := c.getRuleRevisions()
+	if !ok {
+		return
+	}
+
+	number, _ := strconv.Atoi(c.Ctx.Input.Param(":revision"))
+	revision := findRevision(revisions, number)
+	if revision == nil {
+		c.Ctx.Output.SetStatus(404)
+		c.Data["json"] = map[string]string{"error": "Revision not found"}
+		c.ServeJSON()
+		return
+	}
+
+	c.Data["json"] = revision
+	c.ServeJSON()
+}
+
+// DiffRuleRevisions compares two revisions of a rule, given by the from and to query
+// parameters. to defaults to the latest revision.
+func (c *WAFRuleController) DiffRuleRevisions() {
+	_, revisions, ok := c.getRuleRevisions()
+	if !ok {
+		return
+	}
+	if len(revisions) == 0 {
+		c.Ctx.Output.SetStatus(404)
+		c.Data["json"] = map[string]string{"error": "Rule has no revisions"}
+		c.ServeJSON()
+		return
+	}
+
+	fromNumber, _ := c.GetInt("from")
+	from := findRevision(revisions, fromNumber)
+	to := revisions[len(revisions)-1]
+	if c.GetString("to") != "" {
+		toNumber, _ := c.GetInt("to")
+		to = findRevision(revisions, toNumber)
+	}
+	if from == nil || to == nil {
+		c.Ctx.Output.SetStatus(400)
+		c.Data["json"] = map[string]string{"error": "from and to must be revisions of the rule"}
+		c.ServeJSON()
+		return
+	}
+
+	c.Data["json"] = services.DiffRuleRevisions(from, to)
+	c.ServeJSON()
+}
+
+// RollbackRule restores a rule as it was in one of its revisions, recreating it if it was deleted
+func (c *WAFRuleController) RollbackRule() {
+	userID := c.Ctx.Input.GetData("userID").(int)
+
+	ruleID, revisions, ok := c.getRuleRevisions()
+	if !ok {
+		return
+	}
+
+	var req RollbackRequest
+	if err := json.Unmarshal(c.Ctx.Input.RequestBody, &req); err != nil {
+		c.Ctx.Output.SetStatus(400)
+		c.Data["json"] = map[string]string{"error": "Invalid request body: " + err.Error()}
+		c.ServeJSON()
+		return
+	}
+
+	target := findRevision(revisions, req.Revision)
+	if target == nil {
+		c.Ctx.Output.SetStatus(404)
+		c.Data["json"] = map[string]string{"error": "Revision not found"}
+		c.ServeJSON()
+		return
+	}
+	if target.Operation == models.RuleOperationDelete {
+		c.Ctx.Output.SetStatus(400)
+		c.Data["json"] = map[string]string{"error": fmt.Sprintf("Revision %d deleted the rule, roll back to an earlier revision", target.Revision)}
+		c.ServeJSON()
+		return
+	}
+
+	// Restore the rule
+	rule := target.Rule
+	rule.ID = ruleID
+	rule.UpdatedAt = time.Now()
+	if err := models.RestoreWAFRule(rule); err != nil {
+		c.Ctx.Output.SetStatus(500)
+		c.Data["json"] = map[string]string{"error": "Failed to roll back rule: " + err.Error()}
+		c.ServeJSON()
+		return
+	}
+
+	comment := strings.TrimSpace(req.Comment)
+	if comment == "" {
+		comment = fmt.Sprintf("Rolled back to revision %d", target.Revision)
+	}
+	revision, err := models.RecordWAFRuleRevision(rule, models.RuleOperationRollback, userID, comment)
+	if err != nil {
+		logs.Error("Failed to record rollback revision of rule %d: %v", ruleID, err)
+	}
+
+	// Rate limits are enforced by the proxy, outside the WAF
+	proxy.ReloadRateLimits(rule.SiteID)
+
+	// Reload WAF for the site
+	if c.wafManager == nil {
+		logs.Warning("WAF manager not available, rule rolled back but WAF not reloaded")
+	} else {
+		if err := c.wafManager.ReloadWAF(rule.SiteID); err != nil {
+			logs.Error("Failed to reload WAF for site %d: %v", rule.SiteID, err)
+			// Continue - don't fail the entire operation if just the reload fails
+		} else {
+			logs.Info("WAF rules reloaded for site %d", rule.SiteID)
+		}
+	}
+
+	c.Data["json"] = map[string]interface{}{
+		"message":  fmt.Sprintf("Rule rolled back to revision %d", target.Revision),
+		"rule":     rule,
+		"revision": revision,
+	}
+	c.ServeJSON()
+}
+
+// ReplayRulesRequest represents the request body for replaying requests through candidate rules
+type ReplayRulesRequest struct {
+	Candidate  proxy.ReplayCandidate `json:"candidate"`
+	Corpus     string                `json:"corpus"`     // JSONL, HAR or exported WAF log entries
+	RecentLogs int                   `json:"recentLogs"` // Replay the latest WAF log entries of the site instead
+}
+
+// ReplayRules replays a corpus of recorded requests through the rules of a site with and
+// without a candidate change, reporting the requests whose outcome would change
+func (c *WAFRuleController) ReplayRules() {
+	// Get user ID and role from context (set by middleware)
+	userID := c.Ctx.Input.GetData("userID").(int)
+	userRole := c.Ctx.Input.GetData("userRole").(models.Role)
+
+	// Get site ID from URL parameter
+	siteID, err := strconv.Atoi(c.Ctx.Input.Param(":siteId"))
+	if err != nil {
+		c.Ctx.Output.SetStatus(400)
+		c.Data["json"] = map[string]string{"error": "Invalid site ID"}
+		c.ServeJSON()
+		return
+	}
+
+	// Get the site
+	site, err := models.GetSiteByID(siteID)
+	if err != nil {
+		c.Ctx.Output.SetStatus(404)
+		c.Data["json"] = map[string]string{"error": "Site not found"}
+		c.ServeJSON()
+		return
+	}
+
+	// Check if user has permission to manage the site
+	if !site.CanUserManageSite(userID, userRole) {
+		c.Ctx.Output.SetStatus(403)
+		c.Data["json"] = map[string]string{"error": "Access denied"}
+		c.ServeJSON()
+		return
+	}
+
+	// Parse request body
+	var req ReplayRulesRequest
+	if err := json.Unmarshal(c.Ctx.Input.RequestBody, &req); err != nil {
+		c.Ctx.Output.SetStatus(400)
+		c.Data["json"] = map[string]string{"error": "Invalid request body: " + err.Error()}
+		c.ServeJSON()
+		return
+	}
+	for _, rule := range req.Candidate.Rules {
+		rule.SiteID = siteID
+	}
+
+	// Load the corpus
+	var corpus []*proxy.ReplayRequest
+	if req.RecentLogs > 0 {
+		corpus, err = proxy.ReplayCorpusFromLogs(siteID, req.RecentLogs)
+		if err != nil {
+			c.Ctx.Output.SetStatus(500)
+			c.Data["json"] = map[string]string{"error": err.Error()}
+			c.ServeJSON()
+			return
+		}
+	} else {
+		corpus, err = proxy.ParseReplayCorpus([]byte(req.Corpus))
+		if err != nil {
+			c.Ctx.Output.SetStatus(400)
+			c.Data["json"] = map[string]string{"error": "Invalid corpus: " + err.Error()}
+			c.ServeJSON()
+			return
+		}
+	}
+
+	report, err := proxy.ReplayCorpus(siteID, &req.Candidate, corpus)
+	if err != nil {
+		c.Ctx.Output.SetStatus(400)
+		c.Data["json"] = map[string]string{"error": "Replay failed: " + err.Error()}
+		c.ServeJSON()
+		return
+	}
+
+	c.Data["json"] = report
+	c.ServeJSON()
+}
+
 // GetRuleTemplates returns available rule templates
 func (c *WAFRuleController) GetRuleTemplates() {
 	templates := []map[string]interface{}{
@@ -498,10 +848,15 @@ func (c *WAFRuleController) GetRuleTemplates() {
 			"id":          "rate_limit",
 			"name":        "Rate Limit",
 			"type":        models.RateLimitRule,
-			"description": "Limit requests from an IP address within a time window",
+			"description": "Limit requests per client, fingerprint, header, cookie or path within a time window (actions: block, delay, challenge, log)",
 			"parameters": []map[string]interface{}{
 				{"name": "requestLimit", "type": "number", "description": "Maximum number of requests allowed"},
 				{"name": "timeWindow", "type": "number", "description": "Time window in seconds"},
+				{"name": "key", "type": "string", "description": "What requests are counted by: ip, ja4, path, header:<name>, cookie:<name> or a combination such as ip+path", "default": "ip"},
+				{"name": "algorithm", "type": "string", "description": "sliding_window or token_bucket", "default": "sliding_window"},
+				{"name": "burst", "type": "number", "description": "Bucket size for token_bucket, defaults to requestLimit"},
+				{"name": "routeId", "type": "number", "description": "Only count requests of this route, empty for the whole site"},
+				{"name": "delay", "type": "number", "description": "Milliseconds requests over the limit are held with the delay action", "default": 1000},
 			},
 		},
 		{
@@ -538,11 +893,34 @@ func (c *WAFRuleController) GetRuleTemplates() {
 			"id":          "custom",
 			"name":        "Custom Rule",
 			"type":        models.CustomRule,
-			"description": "Create a custom ModSecurity compatible rule",
+			"description": "Create a custom ModSecurity compatible rule, setvar:tx.challenge=1 challenges the browser instead of blocking",
 			"parameters": []map[string]interface{}{
 				{"name": "ruleText", "type": "text", "description": "Complete ModSecurity rule text"},
 			},
 		},
+		{
+			"id":          "exclusion",
+			"name":        "Rule Exclusion",
+			"type":        models.ExclusionRule,
+			"description": "Tune a false positive by removing rules, or a single argument, cookie or header from rules, for this site or some of its requests",
+			"parameters": []map[string]interface{}{
+				{"name": "removeBy", "type": "select", "description": "How the excluded rules are selected", "default": "id", "options": []map[string]string{
+					{"value": "id", "label": "Rule ID"},
+					{"value": "range", "label": "Rule ID range"},
+					{"value": "tag", "label": "Rule tag"},
+				}},
+				{"name": "rules", "type": "string", "description": "Rule ID (942100), range (942000-942999) or tag (attack-sqli)"},
+				{"name": "pathPrefix", "type": "string", "description": "Only requests whose path starts with this, empty for the whole site", "required": false},
+				{"name": "method", "type": "string", "description": "Only requests with this HTTP method, empty for every method", "required": false},
+				{"name": "targetType", "type": "select", "description": "Drop only this request part from the rules instead of removing them", "required": false, "options": []map[string]string{
+					{"value": "", "label": "Remove the rules completely"},
+					{"value": "arg", "label": "Argument"},
+					{"value": "cookie", "label": "Cookie"},
+					{"value": "header", "label": "Header"},
+				}},
+				{"name": "targetName", "type": "string", "description": "Argument, cookie or header name", "required": false},
+			},
+		},
 	}
 
 	c.Data["json"] = templates
@@ -592,7 +970,8 @@ func (c *WAFRuleController) TestRule() {
 		tmpFile, err := os.CreateTemp("", "wafrule-test-*.conf")
 		if err == nil {
 			defer os.Remove(tmpFile.Name())
-			if _, err := tmpFile.WriteString(ruleText); err == nil {
+			// Data list references are expanded the same way as when the rules are loaded
+			if _, err := tmpFile.WriteString(proxy.ExpandDataListMacros(ruleText)); err == nil {
 				tmpFile.Close()
 
 				// Try to create a WAF with this rule
@@ -0,0 +1,139 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/beego/beego/v2/client/orm"
+)
+
+// BanTarget defines what part of a client a ban policy bans
+type BanTarget string
+
+const (
+	BanTargetIP  BanTarget = "ip"  // The client IP address
+	BanTargetJA4 BanTarget = "ja4" // The JA4 TLS fingerprint, for clients rotating addresses
+)
+
+// IsValid checks if the ban target is known
+func (t BanTarget) IsValid() bool {
+	return t == BanTargetIP || t == BanTargetJA4
+}
+
+// banSeverities are the Coraza rule severities from most to least severe
+var banSeverities = []string{"EMERGENCY", "ALERT", "CRITICAL", "ERROR", "WARNING", "NOTICE", "INFO", "DEBUG"}
+
+// SeverityRank returns the rank of a rule severity, 0 for EMERGENCY and higher for less severe ones.
+// Unknown severities rank below DEBUG.
+func SeverityRank(severity string) int {
+	for i, name := range banSeverities {
+		if strings.EqualFold(severity, name) {
+			return i
+		}
+	}
+	return len(banSeverities)
+}
+
+// BanPolicy bans clients that were blocked by the WAF Threshold times within Window minutes.
+// Each ban lasts Multiplier times longer than the previous one of the same client, up to MaxBanDuration.
+type BanPolicy struct {
+	ID             int       `orm:"auto;pk" json:"id"`
+	Name           string    `orm:"size(100)" json:"name"`
+	SiteID         int       `orm:"column(site_id);default(0)" json:"siteId"` // Blocks on this site only, 0 for every site
+	Target         BanTarget `orm:"size(10)" json:"target"`
+	Threshold      int       `json:"threshold"`                       // Blocks that trigger a ban
+	Window         int       `json:"window"`                          // Minutes the blocks are counted over
+	MinSeverity    string    `orm:"size(20);null" json:"minSeverity"` // Least severe blocks counted, every block when empty
+	BanDuration    int       `json:"banDuration"`                     // Seconds of the first ban
+	MaxBanDuration int       `json:"maxBanDuration"`                  // Seconds bans are capped at
+	Multiplier     float64   `orm:"default(2)" json:"multiplier"`     // Growth of each further ban
+	ResetAfter     int       `orm:"default(1440)" json:"resetAfter"`  // Minutes without a ban after which bans start short again
+	Enabled        bool      `orm:"default(true)" json:"enabled"`
+	CreatedBy      int       `orm:"column(created_by)" json:"createdBy"`
+	CreatedAt      time.Time `orm:"auto_now_add;type(datetime)" json:"createdAt"`
+	UpdatedAt      time.Time `orm:"auto_now;type(datetime)" json:"updatedAt"`
+}
+
+// TableName returns the table name for the model
+func (p *BanPolicy) TableName() string {
+	return "ban_policies"
+}
+
+func init() {
+	orm.RegisterModel(new(BanPolicy))
+}
+
+// Validate checks the policy and fills in the defaults
+func (p *BanPolicy) Validate() error {
+	p.Name = strings.TrimSpace(p.Name)
+	if p.Name == "" || len(p.Name) > 100 {
+		return fmt.Errorf("name must be 1-100 characters")
+	}
+	if p.Target == "" {
+		p.Target = BanTargetIP
+	}
+	if !p.Target.IsValid() {
+		return fmt.Errorf("target must be ip or ja4")
+	}
+	if p.Threshold < 1 {
+		return fmt.Errorf("threshold must be at least 1")
+	}
+	if p.Window < 1 || p.Window > 1440 {
+		return fmt.Errorf("window must be between 1 and 1440 minutes")
+	}
+
+	p.MinSeverity = strings.ToUpper(strings.TrimSpace(p.MinSeverity))
+	if p.MinSeverity != "" && SeverityRank(p.MinSeverity) == len(banSeverities) {
+		return fmt.Errorf("minSeverity must be one of %s", strings.Join(banSeverities, ", "))
+	}
+
+	if p.BanDuration < 1 {
+		return fmt.Errorf("banDuration must be at least 1 second")
+	}
+	if p.MaxBanDuration == 0 {
+		p.MaxBanDuration = 7 * 24 * 3600
+	}
+	if p.MaxBanDuration < p.BanDuration {
+		return fmt.Errorf("maxBanDuration cannot be shorter than banDuration")
+	}
+	if p.Multiplier == 0 {
+		p.Multiplier = 2
+	}
+	if p.Multiplier < 1 || p.Multiplier > 100 {
+		return fmt.Errorf("multiplier must be between 1 and 100")
+	}
+	if p.ResetAfter == 0 {
+		p.ResetAfter = 1440
+	}
+	if p.ResetAfter < 1 {
+		return fmt.Errorf("resetAfter must be at least 1 minute")
+	}
+	return nil
+}
+
+// Counts checks if a block of the given severity on a site counts towards the policy
+func (p *BanPolicy) Counts(siteID int, severity string) bool {
+	if !p.Enabled || (p.SiteID != 0 && p.SiteID != siteID) {
+		return false
+	}
+	return p.MinSeverity == "" || SeverityRank(severity) <= SeverityRank(p.MinSeverity)
+}
+
+// GetBanPolicies returns all ban policies
+func GetBanPolicies() ([]*BanPolicy, error) {
+	var policies []*BanPolicy
+	o := orm.NewOrm()
+	_, err := o.QueryTable(new(BanPolicy).TableName()).OrderBy("id").All(&policies)
+	return policies, err
+}
+
+// GetBanPolicyByID returns a ban policy by ID
+func GetBanPolicyByID(id int) (*BanPolicy, error) {
+	o := orm.NewOrm()
+	policy := &BanPolicy{ID: id}
+	if err := o.Read(policy); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
@@ -0,0 +1,148 @@
+package models
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/beego/beego/v2/client/orm"
+)
+
+// DataListType defines what the entries of a data list are
+type DataListType string
+
+const (
+	DataListIP          DataListType = "ip"
+	DataListCIDR        DataListType = "cidr"
+	DataListFingerprint DataListType = "fingerprint"
+	DataListString      DataListType = "string"
+	DataListRegex       DataListType = "regex"
+)
+
+// IsValid checks if the data list type is known
+func (t DataListType) IsValid() bool {
+	switch t {
+	case DataListIP, DataListCIDR, DataListFingerprint, DataListString, DataListRegex:
+		return true
+	}
+	return false
+}
+
+// dataListNamePattern restricts list names to what can be used as a file name and in rules
+var dataListNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// DataList is a named list of IPs, CIDRs, fingerprints, strings or regexes that rules can reference
+type DataList struct {
+	ID          int          `orm:"auto;pk" json:"id"`
+	Name        string       `orm:"size(64);unique" json:"name"`
+	Type        DataListType `orm:"size(20)" json:"type"`
+	Description string       `orm:"type(text);null" json:"description"`
+	Entries     string       `orm:"type(longtext);null" json:"-"` // One entry per line
+	CreatedBy   int          `orm:"column(created_by)" json:"createdBy"`
+	CreatedAt   time.Time    `orm:"auto_now_add;type(datetime)" json:"createdAt"`
+	UpdatedAt   time.Time    `orm:"auto_now;type(datetime)" json:"updatedAt"`
+}
+
+// TableName returns the table name for the model
+func (l *DataList) TableName() string {
+	return "waf_data_lists"
+}
+
+func init() {
+	orm.RegisterModel(new(DataList))
+}
+
+// GetEntries returns the entries of the list
+func (l *DataList) GetEntries() []string {
+	var entries []string
+	for _, entry := range strings.Split(l.Entries, "\n") {
+		if entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// SetEntries validates the entries for the list type and stores them without duplicates
+func (l *DataList) SetEntries(entries []string) error {
+	seen := make(map[string]bool, len(entries))
+	var kept []string
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || seen[entry] {
+			continue
+		}
+		if err := l.validateEntry(entry); err != nil {
+			return err
+		}
+		seen[entry] = true
+		kept = append(kept, entry)
+	}
+
+	l.Entries = strings.Join(kept, "\n")
+	return nil
+}
+
+// validateEntry checks that an entry fits the list type
+func (l *DataList) validateEntry(entry string) error {
+	switch l.Type {
+	case DataListIP:
+		if net.ParseIP(entry) == nil {
+			return fmt.Errorf("invalid IP address: %s", entry)
+		}
+	case DataListCIDR:
+		if _, _, err := net.ParseCIDR(entry); err != nil && net.ParseIP(entry) == nil {
+			return fmt.Errorf("invalid CIDR: %s", entry)
+		}
+	case DataListFingerprint:
+		if strings.ContainsAny(entry, " \t") {
+			return fmt.Errorf("fingerprints cannot contain spaces: %s", entry)
+		}
+	case DataListRegex:
+		if _, err := regexp.Compile(entry); err != nil {
+			return fmt.Errorf("invalid regex %s: %v", entry, err)
+		}
+	}
+	return nil
+}
+
+// Validate checks the name and type of the list
+func (l *DataList) Validate() error {
+	if !dataListNamePattern.MatchString(l.Name) {
+		return fmt.Errorf("list name must be 1-64 letters, digits, dashes or underscores")
+	}
+	if !l.Type.IsValid() {
+		return fmt.Errorf("invalid list type: %s", l.Type)
+	}
+	return nil
+}
+
+// GetDataLists returns all data lists ordered by name
+func GetDataLists() ([]*DataList, error) {
+	var lists []*DataList
+	o := orm.NewOrm()
+	_, err := o.QueryTable(new(DataList).TableName()).OrderBy("name").All(&lists)
+	return lists, err
+}
+
+// GetDataListByID returns a data list by ID
+func GetDataListByID(id int) (*DataList, error) {
+	o := orm.NewOrm()
+	list := &DataList{ID: id}
+	if err := o.Read(list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// GetDataListByName returns a data list by name
+func GetDataListByName(name string) (*DataList, error) {
+	o := orm.NewOrm()
+	list := &DataList{Name: name}
+	if err := o.Read(list, "Name"); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
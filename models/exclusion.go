@@ -0,0 +1,137 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ExclusionKind defines how an EXCLUSION rule selects the rules it excludes
+type ExclusionKind string
+
+const (
+	ExclusionByID    ExclusionKind = "id"    // A single rule ID, e.g. 942100
+	ExclusionByRange ExclusionKind = "range" // A range of rule IDs, e.g. 942000-942999
+	ExclusionByTag   ExclusionKind = "tag"   // Every rule with a tag, e.g. attack-sqli
+)
+
+// ExclusionTargetKind defines the part of a request an exclusion drops from the excluded rules
+type ExclusionTargetKind string
+
+const (
+	ExclusionTargetNone   ExclusionTargetKind = ""       // The rules are removed completely
+	ExclusionTargetArg    ExclusionTargetKind = "arg"    // A query or body argument
+	ExclusionTargetCookie ExclusionTargetKind = "cookie" // A request cookie
+	ExclusionTargetHeader ExclusionTargetKind = "header" // A request header
+)
+
+// exclusionVariables are the rule variables the targets of an exclusion are written as
+var exclusionVariables = map[ExclusionTargetKind]string{
+	ExclusionTargetArg:    "ARGS",
+	ExclusionTargetCookie: "REQUEST_COOKIES",
+	ExclusionTargetHeader: "REQUEST_HEADERS",
+}
+
+var (
+	exclusionTagPattern  = regexp.MustCompile(`^[A-Za-z0-9_./-]+$`)
+	exclusionNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.\[\]-]+$`)
+	exclusionPathPattern = regexp.MustCompile(`^/[^\s"'\\,;]*$`)
+)
+
+// ExclusionConfig is the false positive exclusion described by the parameters of an EXCLUSION rule.
+// The rule's site scopes it; the path prefix and method narrow it to some requests.
+type ExclusionConfig struct {
+	Kind       ExclusionKind
+	Rules      string              // Rule ID, range or tag, as selected by Kind
+	PathPrefix string              // Only requests whose path starts with this, empty for every path
+	Method     string              // Only requests with this method, empty for every method
+	TargetKind ExclusionTargetKind // Drop only this request part from the rules instead of removing them
+	TargetName string              // Argument, cookie or header name
+}
+
+// Variable returns the rule variable of the excluded target, such as ARGS:password
+func (c *ExclusionConfig) Variable() string {
+	if c.TargetKind == ExclusionTargetNone {
+		return ""
+	}
+	return exclusionVariables[c.TargetKind] + ":" + c.TargetName
+}
+
+// ParseExclusionConfig reads an exclusion from rule parameters
+func ParseExclusionConfig(params map[string]interface{}) (*ExclusionConfig, error) {
+	str := func(name string) string {
+		value, _ := params[name].(string)
+		return strings.TrimSpace(value)
+	}
+
+	config := &ExclusionConfig{
+		Kind:       ExclusionKind(strings.ToLower(str("removeBy"))),
+		Rules:      str("rules"),
+		PathPrefix: str("pathPrefix"),
+		Method:     strings.ToUpper(str("method")),
+		TargetKind: ExclusionTargetKind(strings.ToLower(str("targetType"))),
+		TargetName: str("targetName"),
+	}
+	// Rule IDs may be given as JSON numbers
+	if id, ok := params["rules"].(float64); ok {
+		config.Rules = strconv.Itoa(int(id))
+	}
+
+	switch config.Kind {
+	case ExclusionByID:
+		if id, err := strconv.Atoi(config.Rules); err != nil || id < 1 {
+			return nil, fmt.Errorf("rules must be a rule ID such as 942100")
+		}
+	case ExclusionByRange:
+		first, last, ok := strings.Cut(config.Rules, "-")
+		start, err1 := strconv.Atoi(strings.TrimSpace(first))
+		end, err2 := strconv.Atoi(strings.TrimSpace(last))
+		if !ok || err1 != nil || err2 != nil || start < 1 || start > end {
+			return nil, fmt.Errorf("rules must be a rule ID range such as 942000-942999")
+		}
+		config.Rules = fmt.Sprintf("%d-%d", start, end)
+	case ExclusionByTag:
+		if !exclusionTagPattern.MatchString(config.Rules) {
+			return nil, fmt.Errorf("rules must be a rule tag such as attack-sqli")
+		}
+	default:
+		return nil, fmt.Errorf("removeBy must be id, range or tag")
+	}
+
+	if config.PathPrefix != "" && !exclusionPathPattern.MatchString(config.PathPrefix) {
+		return nil, fmt.Errorf("pathPrefix must start with / and cannot contain spaces, quotes, commas or semicolons")
+	}
+	if config.Method != "" && strings.Trim(config.Method, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") != "" {
+		return nil, fmt.Errorf("method must be an HTTP method such as POST")
+	}
+
+	switch config.TargetKind {
+	case ExclusionTargetNone:
+		if config.TargetName != "" {
+			return nil, fmt.Errorf("targetName requires a targetType of arg, cookie or header")
+		}
+	case ExclusionTargetArg, ExclusionTargetCookie, ExclusionTargetHeader:
+		if !exclusionNamePattern.MatchString(config.TargetName) {
+			return nil, fmt.Errorf("targetName must be the %s name, using letters, digits and _.-[]", config.TargetKind)
+		}
+	default:
+		return nil, fmt.Errorf("targetType must be arg, cookie or header")
+	}
+
+	return config, nil
+}
+
+// GetExclusionConfig returns the exclusion of an EXCLUSION rule
+func (r *WAFRule) GetExclusionConfig() (*ExclusionConfig, error) {
+	var params map[string]interface{}
+	if err := json.Unmarshal([]byte(r.Parameters), &params); err != nil {
+		// Parameters may be stored as a JSON encoded string
+		var quoted string
+		if json.Unmarshal([]byte(r.Parameters), &quoted) != nil || json.Unmarshal([]byte(quoted), &params) != nil {
+			return nil, fmt.Errorf("invalid rule parameters: %v", err)
+		}
+	}
+	return ParseExclusionConfig(params)
+}
@@ -0,0 +1,49 @@
+package models
+
+import (
+	"encoding/base64"
+	"time"
+
+	"github.com/beego/beego/v2/client/orm"
+)
+
+// GRPCDescriptorSet is a compiled protobuf descriptor set (protoc --descriptor_set_out)
+// used to decode the gRPC messages sent to a site
+type GRPCDescriptorSet struct {
+	ID        int       `orm:"pk;auto"`
+	SiteID    int       `orm:"column(site_id);unique"`
+	Name      string    `orm:"size(255)"`
+	Data      string    `orm:"type(text)"` // Base64 encoded FileDescriptorSet
+	Services  string    `orm:"type(text)"` // Comma-separated fully qualified service names
+	CreatedAt time.Time `orm:"auto_now_add"`
+	UpdatedAt time.Time `orm:"auto_now"`
+}
+
+// TableName provides the name of the table
+func (d *GRPCDescriptorSet) TableName() string {
+	return "grpc_descriptor_sets"
+}
+
+func init() {
+	orm.RegisterModel(new(GRPCDescriptorSet))
+}
+
+// Bytes returns the serialized FileDescriptorSet
+func (d *GRPCDescriptorSet) Bytes() ([]byte, error) {
+	return base64.StdEncoding.DecodeString(d.Data)
+}
+
+// GetGRPCDescriptorSetBySiteID returns the descriptor set uploaded for a site
+func GetGRPCDescriptorSetBySiteID(siteID int) (*GRPCDescriptorSet, error) {
+	o := orm.NewOrm()
+	set := &GRPCDescriptorSet{}
+	err := o.QueryTable(new(GRPCDescriptorSet).TableName()).Filter("site_id", siteID).One(set)
+	return set, err
+}
+
+// DeleteGRPCDescriptorSetBySiteID removes the descriptor set of a site
+func DeleteGRPCDescriptorSetBySiteID(siteID int) error {
+	o := orm.NewOrm()
+	_, err := o.QueryTable(new(GRPCDescriptorSet).TableName()).Filter("site_id", siteID).Delete()
+	return err
+}
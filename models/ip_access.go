@@ -0,0 +1,107 @@
+package models
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/beego/beego/v2/client/orm"
+)
+
+// IPAccessMode defines what happens to requests from an address on the IP access list
+type IPAccessMode string
+
+const (
+	IPAccessAllow   IPAccessMode = "allow"   // Forwarded without WAF inspection
+	IPAccessDeny    IPAccessMode = "deny"    // Rejected before the WAF
+	IPAccessMonitor IPAccessMode = "monitor" // Logged and inspected as usual
+)
+
+// IsValid checks if the IP access mode is known
+func (m IPAccessMode) IsValid() bool {
+	switch m {
+	case IPAccessAllow, IPAccessDeny, IPAccessMonitor:
+		return true
+	}
+	return false
+}
+
+// IPAccessEntry is an address or network on the IP access list of a site, or of all sites when SiteID is 0
+type IPAccessEntry struct {
+	ID        int          `orm:"auto;pk" json:"id"`
+	SiteID    int          `orm:"column(site_id);index" json:"siteId"`
+	CIDR      string       `orm:"column(cidr);size(64)" json:"cidr"`
+	Mode      IPAccessMode `orm:"size(20)" json:"mode"`
+	Comment   string       `orm:"size(255);null" json:"comment"`
+	ExpiresAt *time.Time   `orm:"type(datetime);null" json:"expiresAt,omitempty"`
+	CreatedBy int          `orm:"column(created_by)" json:"createdBy"`
+	CreatedAt time.Time    `orm:"auto_now_add;type(datetime)" json:"createdAt"`
+}
+
+// TableName returns the table name for the model
+func (e *IPAccessEntry) TableName() string {
+	return "ip_access_entries"
+}
+
+// TableUnique keeps one entry per network and scope
+func (e *IPAccessEntry) TableUnique() [][]string {
+	return [][]string{{"SiteID", "CIDR"}}
+}
+
+func init() {
+	orm.RegisterModel(new(IPAccessEntry))
+}
+
+// Expired checks if the entry stopped applying
+func (e *IPAccessEntry) Expired(now time.Time) bool {
+	return e.ExpiresAt != nil && !e.ExpiresAt.After(now)
+}
+
+// ParseIPAccessPrefix parses an address or CIDR into its canonical network, e.g. "10.1.2.3/8" becomes "10.0.0.0/8"
+func ParseIPAccessPrefix(value string) (netip.Prefix, error) {
+	value = strings.TrimSpace(value)
+	if strings.Contains(value, "/") {
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid CIDR: %s", value)
+		}
+		if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+		}
+		return prefix.Masked(), nil
+	}
+
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid IP address: %s", value)
+	}
+	addr = addr.Unmap().WithZone("")
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// GetIPAccessEntries returns the entries of a site, or the global entries for site 0
+func GetIPAccessEntries(siteID int) ([]*IPAccessEntry, error) {
+	var entries []*IPAccessEntry
+	o := orm.NewOrm()
+	_, err := o.QueryTable(new(IPAccessEntry).TableName()).
+		Filter("site_id", siteID).
+		OrderBy("cidr").
+		Limit(-1).
+		All(&entries)
+	return entries, err
+}
+
+// GetActiveIPAccessEntries returns the entries of all sites that did not expire
+func GetActiveIPAccessEntries() ([]*IPAccessEntry, error) {
+	var entries []*IPAccessEntry
+	o := orm.NewOrm()
+	cond := orm.NewCondition().
+		Or("expires_at__isnull", true).
+		Or("expires_at__gt", time.Now())
+	_, err := o.QueryTable(new(IPAccessEntry).TableName()).
+		SetCond(cond).
+		Limit(-1).
+		All(&entries)
+	return entries, err
+}
@@ -0,0 +1,185 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/beego/beego/v2/client/orm"
+)
+
+// RateLimitAlgorithm defines how requests are counted against a rate limit
+type RateLimitAlgorithm string
+
+const (
+	RateLimitSlidingWindow RateLimitAlgorithm = "sliding_window" // Weighted count over the current and previous window
+	RateLimitTokenBucket   RateLimitAlgorithm = "token_bucket"   // Tokens refilled at limit/window per second, up to burst
+)
+
+// RateLimitKeyKind defines what part of a request a rate limit counts by
+type RateLimitKeyKind string
+
+const (
+	RateLimitKeyIP     RateLimitKeyKind = "ip"
+	RateLimitKeyJA4    RateLimitKeyKind = "ja4"
+	RateLimitKeyPath   RateLimitKeyKind = "path"
+	RateLimitKeyHeader RateLimitKeyKind = "header" // Written as header:<name>
+	RateLimitKeyCookie RateLimitKeyKind = "cookie" // Written as cookie:<name>
+)
+
+// RateLimitKey is one part of the key requests are counted by
+type RateLimitKey struct {
+	Kind RateLimitKeyKind
+	Name string // Header or cookie name
+}
+
+// String returns the key as written in rule parameters
+func (k RateLimitKey) String() string {
+	if k.Name != "" {
+		return string(k.Kind) + ":" + k.Name
+	}
+	return string(k.Kind)
+}
+
+// RateLimitConfig is the rate limit described by the parameters of a RATE_LIMIT rule
+type RateLimitConfig struct {
+	Limit     int                // Requests allowed per window
+	Window    int                // Window length in seconds
+	Algorithm RateLimitAlgorithm // Sliding window unless set
+	Burst     int                // Bucket size of the token bucket, the limit unless set
+	Keys      []RateLimitKey     // Requests are counted per combination of these values, the client IP unless set
+	RouteID   int                // Only requests matching this route are counted, zero for every request of the site
+	Delay     int                // Milliseconds requests over the limit are held for the delay action
+}
+
+// ParseRateLimitKeys parses a key specification such as "ip", "ip+path" or "header:X-API-Key,cookie:session"
+func ParseRateLimitKeys(spec string) ([]RateLimitKey, error) {
+	var keys []RateLimitKey
+	for _, part := range strings.FieldsFunc(spec, func(r rune) bool { return r == '+' || r == ',' }) {
+		part = strings.TrimSpace(part)
+		kind, name, _ := strings.Cut(part, ":")
+		key := RateLimitKey{Kind: RateLimitKeyKind(strings.ToLower(strings.TrimSpace(kind))), Name: strings.TrimSpace(name)}
+
+		switch key.Kind {
+		case RateLimitKeyIP, RateLimitKeyJA4, RateLimitKeyPath:
+			if key.Name != "" {
+				return nil, fmt.Errorf("rate limit key %s takes no name", key.Kind)
+			}
+		case RateLimitKeyHeader, RateLimitKeyCookie:
+			if key.Name == "" {
+				return nil, fmt.Errorf("rate limit key %s requires a name, e.g. %s:X-API-Key", key.Kind, key.Kind)
+			}
+		default:
+			return nil, fmt.Errorf("unknown rate limit key %q, use ip, ja4, path, header:<name> or cookie:<name>", part)
+		}
+		keys = append(keys, key)
+	}
+
+	if len(keys) == 0 {
+		keys = []RateLimitKey{{Kind: RateLimitKeyIP}}
+	}
+	return keys, nil
+}
+
+// ParseRateLimitConfig reads a rate limit from rule parameters. Numbers may be given as JSON numbers or strings.
+func ParseRateLimitConfig(params map[string]interface{}) (*RateLimitConfig, error) {
+	config := &RateLimitConfig{Algorithm: RateLimitSlidingWindow}
+
+	var err error
+	if config.Limit, err = intParam(params, "requestLimit"); err != nil {
+		return nil, err
+	}
+	if config.Window, err = intParam(params, "timeWindow"); err != nil {
+		return nil, err
+	}
+	if config.Burst, err = intParam(params, "burst"); err != nil {
+		return nil, err
+	}
+	if config.RouteID, err = intParam(params, "routeId"); err != nil {
+		return nil, err
+	}
+	if config.Delay, err = intParam(params, "delay"); err != nil {
+		return nil, err
+	}
+
+	if config.Limit < 1 {
+		return nil, fmt.Errorf("requestLimit must be at least 1")
+	}
+	if config.Window < 1 || config.Window > 86400 {
+		return nil, fmt.Errorf("timeWindow must be between 1 and 86400 seconds")
+	}
+	if config.Burst < 0 {
+		return nil, fmt.Errorf("burst cannot be negative")
+	}
+	if config.Burst == 0 {
+		config.Burst = config.Limit
+	}
+	if config.Delay < 0 || config.Delay > 30000 {
+		return nil, fmt.Errorf("delay must be between 0 and 30000 milliseconds")
+	}
+	if config.Delay == 0 {
+		config.Delay = 1000
+	}
+
+	if algorithm, ok := params["algorithm"].(string); ok && algorithm != "" {
+		config.Algorithm = RateLimitAlgorithm(algorithm)
+	}
+	if config.Algorithm != RateLimitSlidingWindow && config.Algorithm != RateLimitTokenBucket {
+		return nil, fmt.Errorf("algorithm must be sliding_window or token_bucket")
+	}
+
+	key, _ := params["key"].(string)
+	if config.Keys, err = ParseRateLimitKeys(key); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// intParam reads an optional integer parameter, zero when it is missing
+func intParam(params map[string]interface{}, name string) (int, error) {
+	switch value := params[name].(type) {
+	case nil:
+		return 0, nil
+	case float64:
+		return int(value), nil
+	case string:
+		if value == "" {
+			return 0, nil
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			return 0, fmt.Errorf("%s must be a number", name)
+		}
+		return n, nil
+	default:
+		return 0, fmt.Errorf("%s must be a number", name)
+	}
+}
+
+// GetRateLimitConfig returns the rate limit of a RATE_LIMIT rule
+func (r *WAFRule) GetRateLimitConfig() (*RateLimitConfig, error) {
+	var params map[string]interface{}
+	if err := json.Unmarshal([]byte(r.Parameters), &params); err != nil {
+		// Parameters may be stored as a JSON encoded string
+		var quoted string
+		if json.Unmarshal([]byte(r.Parameters), &quoted) != nil || json.Unmarshal([]byte(quoted), &params) != nil {
+			return nil, fmt.Errorf("invalid rule parameters: %v", err)
+		}
+	}
+	return ParseRateLimitConfig(params)
+}
+
+// GetActiveRateLimitRules returns the enabled RATE_LIMIT rules of a site, including the global ones
+func GetActiveRateLimitRules(siteID int) ([]*WAFRule, error) {
+	var rules []*WAFRule
+	o := orm.NewOrm()
+	_, err := o.QueryTable(new(WAFRule)).
+		Filter("site_id__in", []int{0, siteID}).
+		Filter("type", RateLimitRule).
+		Filter("status", StatusEnabled).
+		OrderBy("-priority", "id").
+		All(&rules)
+	return rules, err
+}
@@ -0,0 +1,96 @@
+package models
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/beego/beego/v2/client/orm"
+)
+
+// Route forwards the matching requests of a site to a subset of its upstreams
+type Route struct {
+	ID            int       `orm:"pk;auto"`
+	SiteID        int       `orm:"column(site_id);index"`
+	Name          string    `orm:"size(100)"`
+	Priority      int       `orm:"default(0)"`                          // Routes are evaluated in ascending priority
+	PathPrefix    string    `orm:"size(255);null"`                      // Matches requests whose path starts with this prefix
+	PathRegex     string    `orm:"size(255);null"`                      // Matches requests whose path matches this regex
+	Methods       string    `orm:"size(100);null"`                      // Comma-separated list of HTTP methods, empty matches all
+	Headers       string    `orm:"type(text);null"`                     // JSON object of header name to value regex
+	UpstreamIDs   string    `orm:"column(upstream_ids);size(255);null"` // Comma-separated upstream IDs, empty uses the site pool
+	RewritePrefix string    `orm:"size(255);null"`                      // Replaces PathPrefix before forwarding when set
+	WAFEnabled    bool      `orm:"column(waf_enabled);default(true)"`
+	Enabled       bool      `orm:"default(true)"`
+	CreatedAt     time.Time `orm:"auto_now_add"`
+	UpdatedAt     time.Time `orm:"auto_now"`
+}
+
+// TableName provides the name of the table
+func (r *Route) TableName() string {
+	return "routes"
+}
+
+func init() {
+	orm.RegisterModel(new(Route))
+}
+
+// GetMethods returns the HTTP methods the route matches
+func (r *Route) GetMethods() []string {
+	var methods []string
+	for _, method := range strings.Split(r.Methods, ",") {
+		method = strings.ToUpper(strings.TrimSpace(method))
+		if method != "" {
+			methods = append(methods, method)
+		}
+	}
+	return methods
+}
+
+// GetHeaders returns the header matchers of the route
+func (r *Route) GetHeaders() (map[string]string, error) {
+	headers := make(map[string]string)
+	if r.Headers == "" {
+		return headers, nil
+	}
+	err := json.Unmarshal([]byte(r.Headers), &headers)
+	return headers, err
+}
+
+// GetUpstreamIDs returns the IDs of the upstreams the route forwards to
+func (r *Route) GetUpstreamIDs() []int {
+	var ids []int
+	for _, part := range strings.Split(r.UpstreamIDs, ",") {
+		if id, err := strconv.Atoi(strings.TrimSpace(part)); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// GetRoutesBySiteID returns the routes of a site in evaluation order
+func GetRoutesBySiteID(siteID int) ([]*Route, error) {
+	var routes []*Route
+	o := orm.NewOrm()
+	_, err := o.QueryTable(new(Route).TableName()).
+		Filter("site_id", siteID).
+		OrderBy("priority", "id").
+		All(&routes)
+	return routes, err
+}
+
+// GetRouteByID returns a route by its ID
+func GetRouteByID(id int) (*Route, error) {
+	o := orm.NewOrm()
+	route := &Route{ID: id}
+	err := o.Read(route)
+	return route, err
+}
+
+// DeleteRoutesBySiteID removes all routes of a site
+func DeleteRoutesBySiteID(siteID int) error {
+	o := orm.NewOrm()
+	_, err := o.QueryTable(new(Route).TableName()).Filter("site_id", siteID).Delete()
+	return err
+}
@@ -1,6 +1,9 @@
 package models
 
 import (
+	"fmt"
+	"net"
+	"strings"
 	"time"
 
 	"github.com/beego/beego/v2/client/orm"
@@ -17,21 +20,28 @@ const (
 
 // Site represents a website protected by the WAF
 type Site struct {
-	ID                int        `orm:"pk;auto"`
-	Name              string     `orm:"size(128)"`
-	Domain            string     `orm:"size(255);unique"`
-	TargetURL         string     `orm:"size(255)"` // Backend server URL to proxy to
-	Status            SiteStatus `orm:"size(16);default(pending)"`
-	UserID            int        `orm:"column(user_id)"`                   // Owner of the site
-	RequestCount      int64      `orm:"default(0)"`                        // Total requests processed
-	BlockedCount      int64      `orm:"default(0)"`                        // Total requests blocked
-	WAFEnabled        bool       `orm:"column(waf_enabled);default(true)"` // Whether WAF protection is enabled
-	CertificateID     *int       `orm:"column(certificate_id);null"`       // SSL certificate ID (if any)
-	CustomRulesIDs    string     `orm:"column(custom_rules_ids);null"`     // Comma-separated list of custom rule IDs
-	EnabledRulesetIDs string     `orm:"column(enabled_ruleset_ids);null"`  // Comma-separated list of enabled ruleset IDs
-	Settings          string     `orm:"type(text);null"`                   // JSON-encoded settings
-	CreatedAt         time.Time  `orm:"auto_now_add"`
-	UpdatedAt         time.Time  `orm:"auto_now"`
+	ID                  int        `orm:"pk;auto"`
+	Name                string     `orm:"size(128)"`
+	Domain              string     `orm:"size(255);unique"`
+	TargetURL           string     `orm:"size(255)"` // Backend server URL to proxy to
+	Status              SiteStatus `orm:"size(16);default(pending)"`
+	UserID              int        `orm:"column(user_id)"`                             // Owner of the site
+	RequestCount        int64      `orm:"default(0)"`                                  // Total requests processed
+	BlockedCount        int64      `orm:"default(0)"`                                  // Total requests blocked
+	WAFEnabled          bool       `orm:"column(waf_enabled);default(true)"`           // Whether WAF protection is enabled
+	CertificateID       *int       `orm:"column(certificate_id);null"`                 // SSL certificate ID (if any)
+	CustomRulesIDs      string     `orm:"column(custom_rules_ids);null"`               // Comma-separated list of custom rule IDs
+	EnabledRulesetIDs   string     `orm:"column(enabled_ruleset_ids);null"`            // Comma-separated list of enabled ruleset IDs
+	Settings            string     `orm:"type(text);null"`                             // JSON-encoded settings
+	LoadBalancing       string     `orm:"size(32);default(round_robin)"`               // Upstream load-balancing policy
+	HashCookie          string     `orm:"size(128);null"`                              // Cookie used by the cookie_hash policy
+	WebSocketInspection bool       `orm:"column(websocket_inspection);default(false)"` // Inspect WebSocket text frames with the WAF
+	WebSocketRuleIDs    string     `orm:"column(websocket_rule_ids);size(255);null"`   // Rule ID ranges applied to WebSocket frames, empty for all
+	GRPCInspection      bool       `orm:"column(grpc_inspection);default(false)"`      // Decode gRPC calls for the WAF
+	TrustedProxies      string     `orm:"size(1024);null"`                             // Comma-separated CIDRs of proxies whose forwarding headers are trusted
+	ClientIPHeader      string     `orm:"size(100);null"`                              // Header holding the client IP, empty for X-Forwarded-For/Forwarded
+	CreatedAt           time.Time  `orm:"auto_now_add"`
+	UpdatedAt           time.Time  `orm:"auto_now"`
 }
 
 // TableName provides the name of the table
@@ -103,6 +113,56 @@ func (s *Site) GetCertificate() (*Certificate, error) {
 	return GetCertificateByID(*s.CertificateID)
 }
 
+// GetUpstreams returns the upstream pool configured for this site
+func (s *Site) GetUpstreams() ([]*Upstream, error) {
+	return GetUpstreamsBySiteID(s.ID)
+}
+
+// GetLoadBalancingPolicy returns the site's load-balancing policy, falling back to round robin
+func (s *Site) GetLoadBalancingPolicy() LoadBalancingPolicy {
+	policy := LoadBalancingPolicy(s.LoadBalancing)
+	if !policy.IsValid() {
+		return LBRoundRobin
+	}
+	return policy
+}
+
+// GetTrustedProxies returns the networks of the proxies trusted by this site
+func (s *Site) GetTrustedProxies() ([]*net.IPNet, error) {
+	return ParseTrustedProxies(s.TrustedProxies)
+}
+
+// ParseTrustedProxies parses a comma-separated list of CIDRs or IP addresses
+func ParseTrustedProxies(spec string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		if !strings.Contains(part, "/") {
+			ip := net.ParseIP(part)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", part)
+			}
+			bits := 128
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", part)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
 // HasValidCertificate checks if the site has a valid certificate
 // This is a simple check without loading the certificate
 func (s *Site) HasValidCertificate() bool {
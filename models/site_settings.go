@@ -0,0 +1,377 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// SiteSettings holds the per-site settings stored as JSON in Site.Settings
+type SiteSettings struct {
+	Transport      TransportSettings      `json:"transport"`
+	Retry          RetrySettings          `json:"retry"`
+	CircuitBreaker CircuitBreakerSettings `json:"circuit_breaker"`
+	Fallback       FallbackSettings       `json:"fallback"`
+	Geo            GeoSettings            `json:"geo"`
+	WAF            WAFSettings            `json:"waf"`
+	GRPC           GRPCSettings           `json:"grpc"`
+}
+
+// TransportSettings configures the connections from the proxy to the site's upstreams.
+// Timeouts are in seconds; zero disables a timeout or limit.
+type TransportSettings struct {
+	Protocol              UpstreamProtocol `json:"protocol"`
+	DialTimeout           int              `json:"dial_timeout"`
+	TLSHandshakeTimeout   int              `json:"tls_handshake_timeout"`
+	ResponseHeaderTimeout int              `json:"response_header_timeout"`
+	IdleConnTimeout       int              `json:"idle_conn_timeout"`
+	MaxIdleConns          int              `json:"max_idle_conns"`
+	MaxIdleConnsPerHost   int              `json:"max_idle_conns_per_host"`
+	MaxConnsPerHost       int              `json:"max_conns_per_host"`
+}
+
+// UpstreamProtocol is the HTTP version the proxy speaks to a site's upstreams
+type UpstreamProtocol string
+
+const (
+	UpstreamProtocolAuto  UpstreamProtocol = "auto"  // HTTP/2 when a TLS upstream offers it, HTTP/1.1 otherwise
+	UpstreamProtocolHTTP1 UpstreamProtocol = "http1" // Always HTTP/1.1
+	UpstreamProtocolHTTP2 UpstreamProtocol = "h2"    // Always HTTP/2 over TLS, for https upstreams
+	UpstreamProtocolH2C   UpstreamProtocol = "h2c"   // HTTP/2 with prior knowledge for http upstreams, over TLS for https upstreams
+)
+
+// IsValid checks if the upstream protocol is supported
+func (p UpstreamProtocol) IsValid() bool {
+	switch p {
+	case UpstreamProtocolAuto, UpstreamProtocolHTTP1, UpstreamProtocolHTTP2, UpstreamProtocolH2C:
+		return true
+	}
+	return false
+}
+
+// RetrySettings configures retries of idempotent requests that failed to reach an upstream
+type RetrySettings struct {
+	Attempts   int `json:"attempts"`    // Retries after the first attempt, zero disables retries
+	Backoff    int `json:"backoff"`     // Delay before the first retry in milliseconds, doubled on every retry
+	MaxBackoff int `json:"max_backoff"` // Upper bound of the delay in milliseconds
+}
+
+// CircuitBreakerSettings configures the circuit breaker of each upstream of a site
+type CircuitBreakerSettings struct {
+	Enabled          bool `json:"enabled"`
+	Window           int  `json:"window"`             // Length of the window errors are counted in, in seconds
+	MinRequests      int  `json:"min_requests"`       // Requests needed in the window before the breaker can open
+	ErrorRate        int  `json:"error_rate"`         // Percentage of failed requests that opens the breaker
+	LatencyThreshold int  `json:"latency_threshold"`  // Responses slower than this many milliseconds count as failures, zero disables
+	OpenDuration     int  `json:"open_duration"`      // Seconds the breaker stays open before letting probe requests through
+	HalfOpenRequests int  `json:"half_open_requests"` // Successful probe requests needed to close the breaker
+}
+
+// FallbackMode is the response served while the circuit breaker of an upstream is open
+type FallbackMode string
+
+const (
+	FallbackMaintenance FallbackMode = "maintenance" // Static maintenance page
+	FallbackCached      FallbackMode = "cached"      // Last successful response for the URL
+	FallbackStatus      FallbackMode = "status"      // Custom status code and message
+)
+
+// IsValid checks if the fallback mode is supported
+func (m FallbackMode) IsValid() bool {
+	switch m {
+	case FallbackMaintenance, FallbackCached, FallbackStatus:
+		return true
+	}
+	return false
+}
+
+// FallbackSettings configures the responses served while an upstream's circuit breaker is open
+type FallbackSettings struct {
+	Mode       FallbackMode `json:"mode"`
+	StatusCode int          `json:"status_code"` // Status of maintenance and custom responses, and of cache misses
+	Message    string       `json:"message"`
+	CacheTTL   int          `json:"cache_ttl"` // Seconds successful responses are kept for the cached mode
+}
+
+// GeoPolicyMode is how a site treats the countries or networks listed in its geo settings
+type GeoPolicyMode string
+
+const (
+	GeoPolicyOff   GeoPolicyMode = "off"   // The list is ignored
+	GeoPolicyAllow GeoPolicyMode = "allow" // Only listed clients are let through
+	GeoPolicyDeny  GeoPolicyMode = "deny"  // Listed clients are blocked
+)
+
+// IsValid checks if the geo policy mode is supported
+func (m GeoPolicyMode) IsValid() bool {
+	switch m {
+	case GeoPolicyOff, GeoPolicyAllow, GeoPolicyDeny:
+		return true
+	}
+	return false
+}
+
+// GeoSettings configures the country and ASN policies of a site, enforced with the GeoIP databases.
+// Clients whose country or ASN is unknown, such as private addresses, are only blocked when BlockUnknown is set.
+type GeoSettings struct {
+	CountryMode  GeoPolicyMode `json:"country_mode"`
+	Countries    []string      `json:"countries"` // ISO 3166-1 alpha-2 codes
+	ASNMode      GeoPolicyMode `json:"asn_mode"`
+	ASNs         []uint        `json:"asns"`
+	BlockUnknown bool          `json:"block_unknown"` // Block clients the databases do not know when a list is in allow mode
+}
+
+// WAFEngineMode is the Coraza rule engine mode of a site
+type WAFEngineMode string
+
+const (
+	WAFEngineOn            WAFEngineMode = "On"            // Rules are evaluated and block requests
+	WAFEngineDetectionOnly WAFEngineMode = "DetectionOnly" // Rules are evaluated and logged, nothing is blocked
+	WAFEngineOff           WAFEngineMode = "Off"           // Rules are not evaluated
+)
+
+// IsValid checks if the engine mode is supported
+func (m WAFEngineMode) IsValid() bool {
+	switch m {
+	case WAFEngineOn, WAFEngineDetectionOnly, WAFEngineOff:
+		return true
+	}
+	return false
+}
+
+// WAFSettings configures the rule engine and the OWASP CRS for a site
+type WAFSettings struct {
+	EngineMode               WAFEngineMode `json:"engine_mode"`
+	ParanoiaLevel            int           `json:"paranoia_level"`             // CRS paranoia level 1-4, higher levels enable stricter rules
+	InboundAnomalyThreshold  int           `json:"inbound_anomaly_threshold"`  // CRS anomaly score at which requests are blocked
+	OutboundAnomalyThreshold int           `json:"outbound_anomaly_threshold"` // CRS anomaly score at which responses are blocked
+}
+
+// GRPCUninspectableAction is what happens to gRPC request messages the WAF cannot inspect
+type GRPCUninspectableAction string
+
+const (
+	GRPCUninspectableReject GRPCUninspectableAction = "reject" // The call fails with a gRPC error status
+	GRPCUninspectableAllow  GRPCUninspectableAction = "allow"  // The message reaches the upstream uninspected
+)
+
+// IsValid checks if the action is supported
+func (a GRPCUninspectableAction) IsValid() bool {
+	switch a {
+	case GRPCUninspectableReject, GRPCUninspectableAllow:
+		return true
+	}
+	return false
+}
+
+// GRPCSettings configures the request messages of gRPC calls, for sites with gRPC inspection enabled
+type GRPCSettings struct {
+	OversizedMessages     GRPCUninspectableAction `json:"oversized_messages"`      // Messages over 4 MiB, rejected with RESOURCE_EXHAUSTED
+	UnsupportedEncoding   GRPCUninspectableAction `json:"unsupported_encoding"`    // Messages not compressed with gzip or not decompressable, rejected with UNIMPLEMENTED
+	InspectStreamMessages bool                    `json:"inspect_stream_messages"` // Inspect every message of client streams, not only the first
+}
+
+// DefaultSiteSettings returns the settings used for values a site does not set
+func DefaultSiteSettings() *SiteSettings {
+	return &SiteSettings{
+		Transport: TransportSettings{
+			Protocol:              UpstreamProtocolAuto,
+			DialTimeout:           10,
+			TLSHandshakeTimeout:   10,
+			ResponseHeaderTimeout: 60,
+			IdleConnTimeout:       90,
+			MaxIdleConns:          100,
+			MaxIdleConnsPerHost:   10,
+			MaxConnsPerHost:       0,
+		},
+		Retry: RetrySettings{
+			Attempts:   0,
+			Backoff:    100,
+			MaxBackoff: 2000,
+		},
+		CircuitBreaker: CircuitBreakerSettings{
+			Enabled:          false,
+			Window:           30,
+			MinRequests:      20,
+			ErrorRate:        50,
+			LatencyThreshold: 0,
+			OpenDuration:     30,
+			HalfOpenRequests: 3,
+		},
+		Fallback: FallbackSettings{
+			Mode:       FallbackMaintenance,
+			StatusCode: 503,
+			Message:    "The service is temporarily unavailable. Please try again later.",
+			CacheTTL:   300,
+		},
+		Geo: GeoSettings{
+			CountryMode: GeoPolicyOff,
+			ASNMode:     GeoPolicyOff,
+		},
+		WAF: WAFSettings{
+			EngineMode:               WAFEngineOn,
+			ParanoiaLevel:            1,
+			InboundAnomalyThreshold:  5,
+			OutboundAnomalyThreshold: 4,
+		},
+		GRPC: GRPCSettings{
+			OversizedMessages:     GRPCUninspectableReject,
+			UnsupportedEncoding:   GRPCUninspectableReject,
+			InspectStreamMessages: true,
+		},
+	}
+}
+
+// Validate checks that the settings are within sane bounds
+func (ss *SiteSettings) Validate() error {
+	t := ss.Transport
+	if !t.Protocol.IsValid() {
+		return fmt.Errorf("transport.protocol must be one of auto, http1, h2 or h2c")
+	}
+
+	timeouts := []struct {
+		name  string
+		value int
+	}{
+		{"dial_timeout", t.DialTimeout},
+		{"tls_handshake_timeout", t.TLSHandshakeTimeout},
+		{"response_header_timeout", t.ResponseHeaderTimeout},
+		{"idle_conn_timeout", t.IdleConnTimeout},
+	}
+	for _, timeout := range timeouts {
+		if timeout.value < 0 || timeout.value > 3600 {
+			return fmt.Errorf("transport.%s must be between 0 and 3600 seconds", timeout.name)
+		}
+	}
+
+	limits := []struct {
+		name  string
+		value int
+	}{
+		{"max_idle_conns", t.MaxIdleConns},
+		{"max_idle_conns_per_host", t.MaxIdleConnsPerHost},
+		{"max_conns_per_host", t.MaxConnsPerHost},
+	}
+	for _, limit := range limits {
+		if limit.value < 0 || limit.value > 100000 {
+			return fmt.Errorf("transport.%s must be between 0 and 100000", limit.name)
+		}
+	}
+
+	r := ss.Retry
+	if r.Attempts < 0 || r.Attempts > 10 {
+		return fmt.Errorf("retry.attempts must be between 0 and 10")
+	}
+	if r.Backoff < 0 || r.Backoff > 60000 {
+		return fmt.Errorf("retry.backoff must be between 0 and 60000 milliseconds")
+	}
+	if r.MaxBackoff < r.Backoff || r.MaxBackoff > 60000 {
+		return fmt.Errorf("retry.max_backoff must be between retry.backoff and 60000 milliseconds")
+	}
+
+	cb := ss.CircuitBreaker
+	if cb.Window < 1 || cb.Window > 3600 {
+		return fmt.Errorf("circuit_breaker.window must be between 1 and 3600 seconds")
+	}
+	if cb.MinRequests < 1 {
+		return fmt.Errorf("circuit_breaker.min_requests must be at least 1")
+	}
+	if cb.ErrorRate < 1 || cb.ErrorRate > 100 {
+		return fmt.Errorf("circuit_breaker.error_rate must be between 1 and 100")
+	}
+	if cb.LatencyThreshold < 0 || cb.LatencyThreshold > 3600000 {
+		return fmt.Errorf("circuit_breaker.latency_threshold must be between 0 and 3600000 milliseconds")
+	}
+	if cb.OpenDuration < 1 || cb.OpenDuration > 86400 {
+		return fmt.Errorf("circuit_breaker.open_duration must be between 1 and 86400 seconds")
+	}
+	if cb.HalfOpenRequests < 1 || cb.HalfOpenRequests > 1000 {
+		return fmt.Errorf("circuit_breaker.half_open_requests must be between 1 and 1000")
+	}
+
+	fb := ss.Fallback
+	if !fb.Mode.IsValid() {
+		return fmt.Errorf("fallback.mode must be one of maintenance, cached or status")
+	}
+	if fb.StatusCode < 200 || fb.StatusCode > 599 {
+		return fmt.Errorf("fallback.status_code must be a valid HTTP status code")
+	}
+	if len(fb.Message) > 4096 {
+		return fmt.Errorf("fallback.message must be at most 4096 characters")
+	}
+	if fb.CacheTTL < 1 || fb.CacheTTL > 86400 {
+		return fmt.Errorf("fallback.cache_ttl must be between 1 and 86400 seconds")
+	}
+
+	geo := &ss.Geo
+	if !geo.CountryMode.IsValid() {
+		return fmt.Errorf("geo.country_mode must be one of off, allow or deny")
+	}
+	if !geo.ASNMode.IsValid() {
+		return fmt.Errorf("geo.asn_mode must be one of off, allow or deny")
+	}
+	for i, country := range geo.Countries {
+		// Country codes are stored upper case, as the databases return them
+		country = strings.ToUpper(strings.TrimSpace(country))
+		if len(country) != 2 || country[0] < 'A' || country[0] > 'Z' || country[1] < 'A' || country[1] > 'Z' {
+			return fmt.Errorf("geo.countries must contain ISO 3166-1 alpha-2 country codes, got %q", country)
+		}
+		geo.Countries[i] = country
+	}
+	for _, asn := range geo.ASNs {
+		if asn == 0 {
+			return fmt.Errorf("geo.asns must contain AS numbers, got %d", asn)
+		}
+	}
+
+	w := ss.WAF
+	if !w.EngineMode.IsValid() {
+		return fmt.Errorf("waf.engine_mode must be one of On, DetectionOnly or Off")
+	}
+	if w.ParanoiaLevel < 1 || w.ParanoiaLevel > 4 {
+		return fmt.Errorf("waf.paranoia_level must be between 1 and 4")
+	}
+	if w.InboundAnomalyThreshold < 1 || w.InboundAnomalyThreshold > 10000 {
+		return fmt.Errorf("waf.inbound_anomaly_threshold must be between 1 and 10000")
+	}
+	if w.OutboundAnomalyThreshold < 1 || w.OutboundAnomalyThreshold > 10000 {
+		return fmt.Errorf("waf.outbound_anomaly_threshold must be between 1 and 10000")
+	}
+
+	g := ss.GRPC
+	if !g.OversizedMessages.IsValid() {
+		return fmt.Errorf("grpc.oversized_messages must be one of reject or allow")
+	}
+	if !g.UnsupportedEncoding.IsValid() {
+		return fmt.Errorf("grpc.unsupported_encoding must be one of reject or allow")
+	}
+
+	return nil
+}
+
+// GetSettings returns the site's settings, with defaults for the values it does not set
+func (s *Site) GetSettings() (*SiteSettings, error) {
+	settings := DefaultSiteSettings()
+	if s.Settings == "" {
+		return settings, nil
+	}
+
+	if err := json.Unmarshal([]byte(s.Settings), settings); err != nil {
+		return DefaultSiteSettings(), fmt.Errorf("invalid settings: %v", err)
+	}
+	return settings, nil
+}
+
+// SetSettings validates and stores the site's settings
+func (s *Site) SetSettings(settings *SiteSettings) error {
+	if err := settings.Validate(); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	s.Settings = string(data)
+	return nil
+}
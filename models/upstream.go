@@ -0,0 +1,104 @@
+package models
+
+import (
+	"time"
+
+	"github.com/beego/beego/v2/client/orm"
+)
+
+// LoadBalancingPolicy defines how requests are spread across a site's upstreams
+type LoadBalancingPolicy string
+
+const (
+	LBRoundRobin LoadBalancingPolicy = "round_robin"
+	LBLeastConn  LoadBalancingPolicy = "least_conn"
+	LBWeighted   LoadBalancingPolicy = "weighted"
+	LBIPHash     LoadBalancingPolicy = "ip_hash"
+	LBCookieHash LoadBalancingPolicy = "cookie_hash"
+)
+
+// IsValid checks if the policy is one of the supported policies
+func (p LoadBalancingPolicy) IsValid() bool {
+	switch p {
+	case LBRoundRobin, LBLeastConn, LBWeighted, LBIPHash, LBCookieHash:
+		return true
+	}
+	return false
+}
+
+// Upstream represents a backend server in a site's upstream pool
+type Upstream struct {
+	ID      int    `orm:"pk;auto"`
+	SiteID  int    `orm:"column(site_id);index"`
+	URL     string `orm:"column(url);size(255)"` // Backend server URL
+	Weight  int    `orm:"default(1)"`            // Relative weight for the weighted policy
+	Enabled bool   `orm:"default(true)"`         // Disabled upstreams are kept but never picked
+
+	// Active health checking, disabled when HealthCheckPath is empty
+	HealthCheckPath     string `orm:"size(255);null"`
+	HealthCheckInterval int    `orm:"default(10)"` // Seconds between probes
+	HealthCheckTimeout  int    `orm:"default(2)"`  // Probe timeout in seconds
+	HealthyThreshold    int    `orm:"default(2)"`  // Consecutive successful probes to re-admit
+	UnhealthyThreshold  int    `orm:"default(3)"`  // Consecutive failed probes to eject
+
+	// Passive outlier detection, disabled when MaxFails is 0
+	MaxFails      int `orm:"default(5)"`  // Consecutive 5xx or connection errors to eject
+	EjectDuration int `orm:"default(30)"` // Seconds an ejected upstream stays out of rotation
+
+	CreatedAt time.Time `orm:"auto_now_add"`
+	UpdatedAt time.Time `orm:"auto_now"`
+}
+
+// TableName provides the name of the table
+func (u *Upstream) TableName() string {
+	return "upstreams"
+}
+
+func init() {
+	orm.RegisterModel(new(Upstream))
+}
+
+// ApplyHealthDefaults fills unset health check settings with their defaults
+func (u *Upstream) ApplyHealthDefaults() {
+	if u.HealthCheckInterval <= 0 {
+		u.HealthCheckInterval = 10
+	}
+	if u.HealthCheckTimeout <= 0 {
+		u.HealthCheckTimeout = 2
+	}
+	if u.HealthyThreshold <= 0 {
+		u.HealthyThreshold = 2
+	}
+	if u.UnhealthyThreshold <= 0 {
+		u.UnhealthyThreshold = 3
+	}
+	if u.EjectDuration <= 0 {
+		u.EjectDuration = 30
+	}
+}
+
+// GetUpstreamsBySiteID returns all upstreams configured for a site
+func GetUpstreamsBySiteID(siteID int) ([]*Upstream, error) {
+	var upstreams []*Upstream
+	o := orm.NewOrm()
+	_, err := o.QueryTable(new(Upstream).TableName()).
+		Filter("site_id", siteID).
+		OrderBy("id").
+		All(&upstreams)
+	return upstreams, err
+}
+
+// GetUpstreamByID returns an upstream by its ID
+func GetUpstreamByID(id int) (*Upstream, error) {
+	o := orm.NewOrm()
+	upstream := &Upstream{ID: id}
+	err := o.Read(upstream)
+	return upstream, err
+}
+
+// DeleteUpstreamsBySiteID removes all upstreams of a site
+func DeleteUpstreamsBySiteID(siteID int) error {
+	o := orm.NewOrm()
+	_, err := o.QueryTable(new(Upstream).TableName()).Filter("site_id", siteID).Delete()
+	return err
+}
@@ -13,6 +13,8 @@ type WAFLog struct {
 	SiteID          int       `orm:"index;column(site_id)"`
 	Domain          string    `orm:"size(255);index;column(domain)"`
 	ClientIP        string    `orm:"size(45);index;column(client_ip)"`
+	Country         string    `orm:"size(2);index;null;column(country)"`
+	ASN             uint      `orm:"index;null;column(asn)"`
 	Method          string    `orm:"size(10);index;column(method)"`
 	URI             string    `orm:"size(1024);column(uri)"`
 	QueryString     string    `orm:"type(text);null;column(query_string)"`
@@ -20,6 +22,9 @@ type WAFLog struct {
 	UserAgent       string    `orm:"size(512);column(user_agent)"`
 	Referer         string    `orm:"type(longtext);null;column(referer)"`
 	JA4Fingerprint  string    `orm:"size(64);index;null;column(ja4_fingerprint)"`
+	JA4SFingerprint string    `orm:"size(64);null;column(ja4s_fingerprint)"`
+	JA4HFingerprint string    `orm:"size(64);index;null;column(ja4h_fingerprint)"`
+	JA4TFingerprint string    `orm:"size(128);null;column(ja4t_fingerprint)"`
 	Action          string    `orm:"size(20);index;column(action)"`
 	StatusCode      int       `orm:"index;column(status_code)"`
 	BlockStatusCode int       `orm:"index;null;column(block_status_code)"`
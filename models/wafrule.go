@@ -2,6 +2,9 @@ package models
 
 import (
 	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/beego/beego/v2/client/orm"
@@ -27,6 +30,7 @@ const (
 	XSSRule           WAFRuleType = "XSS"
 	PathTraversalRule WAFRuleType = "PATH_TRAVERSAL"
 	CustomRule        WAFRuleType = "CUSTOM"
+	ExclusionRule     WAFRuleType = "EXCLUSION" // Removes rules or rule targets to tune false positives
 )
 
 // WAFRuleAction defines possible actions for WAF rules
@@ -36,6 +40,11 @@ const (
 	ActionBlock WAFRuleAction = "block"
 	ActionAllow WAFRuleAction = "allow"
 	ActionLog   WAFRuleAction = "log"
+	ActionDelay WAFRuleAction = "delay" // Rate limits only: requests over the limit are slowed down instead of blocked
+
+	// ActionChallenge makes the browser solve a proof of work before the request is let through.
+	// SecRule text picks it with setvar:tx.challenge=1.
+	ActionChallenge WAFRuleAction = "challenge"
 )
 
 // WAFRuleStatus defines the status of a WAF rule
@@ -199,3 +208,37 @@ func ToggleWAFRuleStatus(id int) error {
 	_, err := o.Update(&rule, "Status")
 	return err
 }
+
+// RuleIDRange is an inclusive range of rule IDs
+type RuleIDRange struct {
+	Start int
+	End   int
+}
+
+// ParseRuleIDRanges parses a comma-separated list of rule IDs and ranges, e.g. "941000-942999,100005"
+func ParseRuleIDRanges(spec string) ([]RuleIDRange, error) {
+	var ranges []RuleIDRange
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		bounds := strings.SplitN(part, "-", 2)
+		start, err := strconv.Atoi(strings.TrimSpace(bounds[0]))
+		if err != nil || start <= 0 {
+			return nil, fmt.Errorf("invalid rule ID %q", part)
+		}
+
+		end := start
+		if len(bounds) == 2 {
+			end, err = strconv.Atoi(strings.TrimSpace(bounds[1]))
+			if err != nil || end < start {
+				return nil, fmt.Errorf("invalid rule ID range %q", part)
+			}
+		}
+
+		ranges = append(ranges, RuleIDRange{Start: start, End: end})
+	}
+	return ranges, nil
+}
@@ -0,0 +1,207 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/beego/beego/v2/client/orm"
+)
+
+// WAFRuleOperation defines the change a rule revision records
+type WAFRuleOperation string
+
+const (
+	RuleOperationCreate   WAFRuleOperation = "create"
+	RuleOperationUpdate   WAFRuleOperation = "update"
+	RuleOperationToggle   WAFRuleOperation = "toggle"
+	RuleOperationDelete   WAFRuleOperation = "delete"
+	RuleOperationRollback WAFRuleOperation = "rollback"
+	RuleOperationBaseline WAFRuleOperation = "baseline" // The rule before its first recorded change
+)
+
+// maxRevisionAttempts bounds how often a revision is renumbered when concurrent changes of
+// a rule race for the same revision number
+const maxRevisionAttempts = 5
+
+// WAFRuleRevision is an immutable copy of a WAF rule taken after each change to it.
+// Delete revisions hold the rule as it was when it was deleted.
+type WAFRuleRevision struct {
+	ID        int              `orm:"auto;pk" json:"id"`
+	RuleID    int              `orm:"column(rule_id);index" json:"ruleId"`
+	SiteID    int              `orm:"column(site_id)" json:"siteId"`
+	Revision  int              `json:"revision"` // Numbered from 1 for each rule
+	Operation WAFRuleOperation `orm:"size(20)" json:"operation"`
+	Snapshot  string           `orm:"type(text)" json:"-"` // The rule as JSON
+	Rule      *WAFRule         `orm:"-" json:"rule"`
+	Comment   string           `orm:"size(500);null" json:"comment"`
+	CreatedBy int              `orm:"column(created_by)" json:"createdBy"`
+	CreatedAt time.Time        `orm:"auto_now_add;type(datetime)" json:"createdAt"`
+}
+
+// TableName returns the table name for the model
+func (r *WAFRuleRevision) TableName() string {
+	return "waf_rule_revisions"
+}
+
+// TableUnique keeps the revision numbers of a rule unique
+func (r *WAFRuleRevision) TableUnique() [][]string {
+	return [][]string{{"RuleID", "Revision"}}
+}
+
+func init() {
+	orm.RegisterModel(new(WAFRuleRevision))
+}
+
+// decode fills in the rule stored in the revision
+func (r *WAFRuleRevision) decode() error {
+	var rule WAFRule
+	if err := json.Unmarshal([]byte(r.Snapshot), &rule); err != nil {
+		return fmt.Errorf("invalid snapshot in revision %d of rule %d: %v", r.Revision, r.RuleID, err)
+	}
+	r.Rule = &rule
+	return nil
+}
+
+// RecordWAFRuleRevision stores the current state of a rule as its next revision. Concurrent
+// changes of the rule may take the same number, the revision is then numbered again.
+func RecordWAFRuleRevision(rule *WAFRule, operation WAFRuleOperation, userID int, comment string) (*WAFRuleRevision, error) {
+	snapshot, err := json.Marshal(rule)
+	if err != nil {
+		return nil, err
+	}
+
+	o := orm.NewOrm()
+	for attempt := 1; ; attempt++ {
+		last, err := lastWAFRuleRevision(o, rule.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		revision := &WAFRuleRevision{
+			RuleID:    rule.ID,
+			SiteID:    rule.SiteID,
+			Revision:  last + 1,
+			Operation: operation,
+			Snapshot:  string(snapshot),
+			Comment:   comment,
+			CreatedBy: userID,
+			CreatedAt: time.Now(),
+		}
+		if _, err := o.Insert(revision); err != nil {
+			if attempt < maxRevisionAttempts && wafRuleRevisionExists(o, rule.ID, revision.Revision) {
+				continue
+			}
+			return nil, err
+		}
+		return revision, revision.decode()
+	}
+}
+
+// RecordWAFRuleBaseline stores a rule without revisions as its first revision. It is called
+// before changing a rule, so that rules created before revisions were kept can still be
+// compared with and rolled back to their state before the change.
+func RecordWAFRuleBaseline(rule *WAFRule) error {
+	o := orm.NewOrm()
+	if o.QueryTable(new(WAFRuleRevision)).Filter("rule_id", rule.ID).Exist() {
+		return nil
+	}
+
+	snapshot, err := json.Marshal(rule)
+	if err != nil {
+		return err
+	}
+
+	revision := &WAFRuleRevision{
+		RuleID:    rule.ID,
+		SiteID:    rule.SiteID,
+		Revision:  1,
+		Operation: RuleOperationBaseline,
+		Snapshot:  string(snapshot),
+		CreatedBy: rule.CreatedBy,
+		CreatedAt: time.Now(),
+	}
+	if _, err := o.Insert(revision); err != nil {
+		// A concurrent change recorded the first revision already
+		if wafRuleRevisionExists(o, rule.ID, 1) {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// lastWAFRuleRevision returns the number of the latest revision of a rule, 0 when it has none
+func lastWAFRuleRevision(o orm.Ormer, ruleID int) (int, error) {
+	var last []*WAFRuleRevision
+	if _, err := o.QueryTable(new(WAFRuleRevision)).
+		Filter("rule_id", ruleID).
+		OrderBy("-revision").
+		Limit(1).
+		All(&last, "Revision"); err != nil {
+		return 0, err
+	}
+	if len(last) == 0 {
+		return 0, nil
+	}
+	return last[0].Revision, nil
+}
+
+// wafRuleRevisionExists checks if a rule has a revision with the given number
+func wafRuleRevisionExists(o orm.Ormer, ruleID, revision int) bool {
+	return o.QueryTable(new(WAFRuleRevision)).
+		Filter("rule_id", ruleID).
+		Filter("revision", revision).
+		Exist()
+}
+
+// GetWAFRuleRevisions retrieves the revisions of a rule, oldest first
+func GetWAFRuleRevisions(ruleID int) ([]*WAFRuleRevision, error) {
+	o := orm.NewOrm()
+	var revisions []*WAFRuleRevision
+
+	_, err := o.QueryTable(new(WAFRuleRevision)).
+		Filter("rule_id", ruleID).
+		OrderBy("revision").
+		All(&revisions)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, revision := range revisions {
+		if err := revision.decode(); err != nil {
+			return nil, err
+		}
+	}
+	return revisions, nil
+}
+
+// GetWAFRuleRevision retrieves one revision of a rule
+func GetWAFRuleRevision(ruleID, revision int) (*WAFRuleRevision, error) {
+	o := orm.NewOrm()
+	rev := &WAFRuleRevision{}
+
+	err := o.QueryTable(new(WAFRuleRevision)).
+		Filter("rule_id", ruleID).
+		Filter("revision", revision).
+		One(rev)
+	if err != nil {
+		return nil, err
+	}
+
+	return rev, rev.decode()
+}
+
+// RestoreWAFRule writes a rule from a revision back, inserting it again with its old ID if it was deleted
+func RestoreWAFRule(rule *WAFRule) error {
+	o := orm.NewOrm()
+	if err := o.Read(&WAFRule{ID: rule.ID}); err == orm.ErrNoRows {
+		_, err = o.Insert(rule)
+		return err
+	} else if err != nil {
+		return err
+	}
+
+	_, err := o.Update(rule)
+	return err
+}
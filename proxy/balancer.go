@@ -0,0 +1,371 @@
+package proxy
+
+import (
+	"SeproWAF/models"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// backendContextKey is used to pass the picked backend from the pool to the reverse proxy director
+type backendContextKey struct{}
+
+// proxyAttempt is a request being forwarded to a backend
+type proxyAttempt struct {
+	backend  *Backend
+	start    time.Time
+	probe    bool   // The request probes a half-open circuit breaker
+	cacheKey string // Key for the fallback response cache, empty if the response is not cached
+}
+
+// Backend represents a single upstream server in a site's pool
+type Backend struct {
+	Upstream    *models.Upstream // nil when the backend comes from the legacy Site.TargetURL
+	URL         *url.URL
+	Weight      int
+	activeConns int64
+	requests    int64
+	siteID      int
+	siteDomain  string
+	health      backendHealth
+	breaker     *circuitBreaker
+}
+
+// ID returns the upstream ID of the backend, or 0 for the legacy target URL
+func (b *Backend) ID() int {
+	if b.Upstream == nil {
+		return 0
+	}
+	return b.Upstream.ID
+}
+
+// ActiveConnections returns the number of in-flight requests to this backend
+func (b *Backend) ActiveConnections() int64 {
+	return atomic.LoadInt64(&b.activeConns)
+}
+
+// TotalRequests returns the number of requests forwarded to this backend
+func (b *Backend) TotalRequests() int64 {
+	return atomic.LoadInt64(&b.requests)
+}
+
+// acquire marks the start of a request to this backend
+func (b *Backend) acquire() {
+	atomic.AddInt64(&b.activeConns, 1)
+	atomic.AddInt64(&b.requests, 1)
+}
+
+// release marks the end of a request to this backend
+func (b *Backend) release() {
+	atomic.AddInt64(&b.activeConns, -1)
+}
+
+// Balancer picks a backend for a request from a list of candidates
+type Balancer interface {
+	Pick(r *http.Request, backends []*Backend) *Backend
+}
+
+// roundRobinBalancer cycles through the backends in order
+type roundRobinBalancer struct {
+	counter uint64
+}
+
+func (b *roundRobinBalancer) Pick(r *http.Request, backends []*Backend) *Backend {
+	if len(backends) == 0 {
+		return nil
+	}
+	n := atomic.AddUint64(&b.counter, 1)
+	return backends[(n-1)%uint64(len(backends))]
+}
+
+// leastConnBalancer picks the backend with the fewest in-flight requests relative to its weight
+type leastConnBalancer struct {
+	rr roundRobinBalancer
+}
+
+func (b *leastConnBalancer) Pick(r *http.Request, backends []*Backend) *Backend {
+	if len(backends) == 0 {
+		return nil
+	}
+
+	// Start from a rotating offset so ties are spread across backends
+	offset := int(atomic.AddUint64(&b.rr.counter, 1) % uint64(len(backends)))
+
+	var best *Backend
+	var bestScore float64
+	for i := range backends {
+		backend := backends[(offset+i)%len(backends)]
+		score := float64(backend.ActiveConnections()) / float64(backend.Weight)
+		if best == nil || score < bestScore {
+			best = backend
+			bestScore = score
+		}
+	}
+	return best
+}
+
+// weightedBalancer implements smooth weighted round robin
+type weightedBalancer struct {
+	mutex   sync.Mutex
+	current map[*Backend]int
+}
+
+func (b *weightedBalancer) Pick(r *http.Request, backends []*Backend) *Backend {
+	if len(backends) == 0 {
+		return nil
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.current == nil {
+		b.current = make(map[*Backend]int)
+	}
+
+	total := 0
+	var best *Backend
+	for _, backend := range backends {
+		b.current[backend] += backend.Weight
+		total += backend.Weight
+		if best == nil || b.current[backend] > b.current[best] {
+			best = backend
+		}
+	}
+	b.current[best] -= total
+
+	return best
+}
+
+// hashBalancer maps a request key to a backend using rendezvous hashing,
+// so that only the keys of a removed backend move when the pool changes
+type hashBalancer struct {
+	cookie   string
+	fallback roundRobinBalancer
+}
+
+func (b *hashBalancer) Pick(r *http.Request, backends []*Backend) *Backend {
+	if len(backends) == 0 {
+		return nil
+	}
+
+	key := ""
+	if b.cookie != "" {
+		if cookie, err := r.Cookie(b.cookie); err == nil {
+			key = cookie.Value
+		}
+	}
+	if key == "" {
+		key = clientIP(r)
+	}
+	if key == "" {
+		return b.fallback.Pick(r, backends)
+	}
+
+	var best *Backend
+	var bestScore float64
+	for _, backend := range backends {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte(backend.URL.String()))
+		// Weighted rendezvous hashing: with the hash mapped to u in (0, 1), -weight/ln(u)
+		// gives each backend a share of the keys proportional to its weight
+		u := (float64(mix64(h.Sum64())>>11) + 0.5) / (1 << 53)
+		score := -float64(backend.Weight) / math.Log(u)
+		if best == nil || score > bestScore {
+			best = backend
+			bestScore = score
+		}
+	}
+	return best
+}
+
+// mix64 spreads the bits of an FNV hash, whose high bits barely depend on the last bytes hashed
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// newBalancer creates a balancer for the given load-balancing policy
+func newBalancer(policy models.LoadBalancingPolicy, hashCookie string) Balancer {
+	switch policy {
+	case models.LBLeastConn:
+		return &leastConnBalancer{}
+	case models.LBWeighted:
+		return &weightedBalancer{}
+	case models.LBIPHash:
+		return &hashBalancer{}
+	case models.LBCookieHash:
+		return &hashBalancer{cookie: hashCookie}
+	default:
+		return &roundRobinBalancer{}
+	}
+}
+
+// UpstreamPool holds a set of backends and the balancer used to pick between them
+type UpstreamPool struct {
+	backends []*Backend
+	balancer Balancer
+}
+
+// NewUpstreamPool creates a pool balancing across the given backends with the site's policy
+func NewUpstreamPool(site *models.Site, backends []*Backend) *UpstreamPool {
+	return &UpstreamPool{
+		backends: backends,
+		balancer: newBalancer(site.GetLoadBalancingPolicy(), site.HashCookie),
+	}
+}
+
+// newBackend creates the backend of an upstream
+func newBackend(site *models.Site, upstream *models.Upstream) (*Backend, error) {
+	target, err := parseBackendURL(upstream.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream URL %q for site %s: %v", upstream.URL, site.Domain, err)
+	}
+
+	weight := upstream.Weight
+	if weight <= 0 {
+		weight = 1
+	}
+	upstream.ApplyHealthDefaults()
+
+	return &Backend{
+		Upstream:   upstream,
+		URL:        target,
+		Weight:     weight,
+		siteID:     site.ID,
+		siteDomain: site.Domain,
+		health:     backendHealth{healthy: true},
+		breaker:    newCircuitBreaker(fmt.Sprintf("upstream %s of site %s", target, site.Domain)),
+	}, nil
+}
+
+// newTargetBackend creates a backend for the legacy single target URL of a site
+func newTargetBackend(site *models.Site) (*Backend, error) {
+	target, err := parseBackendURL(site.TargetURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target URL for site %s: %v", site.Domain, err)
+	}
+
+	return &Backend{
+		URL:        target,
+		Weight:     1,
+		siteID:     site.ID,
+		siteDomain: site.Domain,
+		health:     backendHealth{healthy: true},
+		breaker:    newCircuitBreaker(fmt.Sprintf("upstream %s of site %s", target, site.Domain)),
+	}, nil
+}
+
+// Backends returns all backends of the pool
+func (p *UpstreamPool) Backends() []*Backend {
+	return p.backends
+}
+
+// Pick selects a backend for the request among the healthy backends whose circuit
+// breaker is not open. If there is none the whole pool is used, so an outage of the
+// health checks alone never takes the site down; open breakers still answer with
+// the site's fallback.
+func (p *UpstreamPool) Pick(r *http.Request) *Backend {
+	available := make([]*Backend, 0, len(p.backends))
+	for _, backend := range p.backends {
+		if backend.Available() && !backend.breaker.isOpen() {
+			available = append(available, backend)
+		}
+	}
+
+	if len(available) == 0 {
+		available = p.backends
+	}
+
+	return p.balancer.Pick(r, available)
+}
+
+// parseBackendURL parses and validates a backend URL
+func parseBackendURL(rawURL string) (*url.URL, error) {
+	target, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if target.Scheme != "http" && target.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme %q", target.Scheme)
+	}
+	if target.Host == "" {
+		return nil, fmt.Errorf("missing host")
+	}
+	return target, nil
+}
+
+// backendFromContext returns the backend picked for a request
+func backendFromContext(ctx context.Context) *Backend {
+	if attempt := attemptFromContext(ctx); attempt != nil {
+		return attempt.backend
+	}
+	return nil
+}
+
+// attemptFromContext returns the attempt the request belongs to
+func attemptFromContext(ctx context.Context) *proxyAttempt {
+	attempt, _ := ctx.Value(backendContextKey{}).(*proxyAttempt)
+	return attempt
+}
+
+// directToBackend rewrites the request URL to point at the backend,
+// mirroring the director of httputil.NewSingleHostReverseProxy
+func directToBackend(req *http.Request, target *url.URL) {
+	targetQuery := target.RawQuery
+	req.URL.Scheme = target.Scheme
+	req.URL.Host = target.Host
+	req.URL.Path, req.URL.RawPath = joinURLPath(target, req.URL)
+	if targetQuery == "" || req.URL.RawQuery == "" {
+		req.URL.RawQuery = targetQuery + req.URL.RawQuery
+	} else {
+		req.URL.RawQuery = targetQuery + "&" + req.URL.RawQuery
+	}
+
+	// Update the Host header to the target host
+	req.Host = target.Host
+}
+
+// joinURLPath joins the backend base path with the request path
+func joinURLPath(a, b *url.URL) (path, rawpath string) {
+	if a.RawPath == "" && b.RawPath == "" {
+		return singleJoiningSlash(a.Path, b.Path), ""
+	}
+
+	apath := a.EscapedPath()
+	bpath := b.EscapedPath()
+
+	aslash := strings.HasSuffix(apath, "/")
+	bslash := strings.HasPrefix(bpath, "/")
+
+	switch {
+	case aslash && bslash:
+		return a.Path + b.Path[1:], apath + bpath[1:]
+	case !aslash && !bslash:
+		return a.Path + "/" + b.Path, apath + "/" + bpath
+	}
+	return a.Path + b.Path, apath + bpath
+}
+
+func singleJoiningSlash(a, b string) string {
+	aslash := strings.HasSuffix(a, "/")
+	bslash := strings.HasPrefix(b, "/")
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+	return a + b
+}
@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func testBackend(t *testing.T, rawURL string, weight int) *Backend {
+	t.Helper()
+	target, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Backend{URL: target, Weight: weight}
+}
+
+func cookieRequest(value string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(&http.Cookie{Name: "sid", Value: value})
+	return r
+}
+
+func TestHashBalancerWeightedShare(t *testing.T) {
+	tests := []struct {
+		name    string
+		weights []int
+	}{
+		{"equal", []int{1, 1}},
+		{"two to one", []int{2, 1}},
+		{"three backends", []int{3, 2, 1}},
+		{"heavy", []int{9, 1}},
+	}
+
+	const keys = 20000
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var backends []*Backend
+			total := 0
+			for i, weight := range tt.weights {
+				backends = append(backends, testBackend(t, fmt.Sprintf("http://10.0.0.%d:8080", i+1), weight))
+				total += weight
+			}
+
+			counts := make(map[*Backend]int)
+			b := &hashBalancer{cookie: "sid"}
+			for i := 0; i < keys; i++ {
+				counts[b.Pick(cookieRequest(fmt.Sprintf("session-%d", i)), backends)]++
+			}
+
+			for _, backend := range backends {
+				want := float64(backend.Weight) / float64(total)
+				got := float64(counts[backend]) / keys
+				if got < want-0.02 || got > want+0.02 {
+					t.Errorf("backend %s with weight %d got %.3f of the keys, want %.3f", backend.URL, backend.Weight, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestHashBalancerStableWhenBackendRemoved(t *testing.T) {
+	backends := []*Backend{
+		testBackend(t, "http://10.0.0.1:8080", 1),
+		testBackend(t, "http://10.0.0.2:8080", 2),
+		testBackend(t, "http://10.0.0.3:8080", 1),
+	}
+	b := &hashBalancer{cookie: "sid"}
+
+	for i := 0; i < 5000; i++ {
+		r := cookieRequest(fmt.Sprintf("session-%d", i))
+		before := b.Pick(r, backends)
+		if before == backends[1] {
+			continue
+		}
+		if after := b.Pick(r, []*Backend{backends[0], backends[2]}); after != before {
+			t.Fatalf("key %d moved from %s to %s although its backend stayed", i, before.URL, after.URL)
+		}
+	}
+}
+
+func TestHashBalancerWithoutKeyFallsBack(t *testing.T) {
+	backends := []*Backend{testBackend(t, "http://10.0.0.1:8080", 1)}
+	b := &hashBalancer{cookie: "sid"}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = ""
+	if got := b.Pick(r, backends); got != backends[0] {
+		t.Fatalf("Pick without a key returned %v", got)
+	}
+	if got := b.Pick(r, nil); got != nil {
+		t.Fatalf("Pick without backends returned %v", got)
+	}
+}
@@ -0,0 +1,247 @@
+package proxy
+
+import (
+	"SeproWAF/models"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/beego/beego/v2/core/logs"
+)
+
+// BreakerState is the state of an upstream's circuit breaker
+type BreakerState string
+
+const (
+	BreakerClosed   BreakerState = "closed"    // Requests flow normally
+	BreakerOpen     BreakerState = "open"      // Requests are answered with the fallback
+	BreakerHalfOpen BreakerState = "half_open" // A few probe requests test if the upstream recovered
+)
+
+// maxBreakerTransitions is the number of state changes kept for the stats API
+const maxBreakerTransitions = 10
+
+// BreakerTransition records a state change of a circuit breaker
+type BreakerTransition struct {
+	From   BreakerState `json:"from"`
+	To     BreakerState `json:"to"`
+	Reason string       `json:"reason"`
+	At     time.Time    `json:"at"`
+}
+
+// BreakerStatus is the circuit breaker snapshot exposed by the stats API
+type BreakerStatus struct {
+	State       BreakerState        `json:"state"`
+	Since       time.Time           `json:"since"`
+	OpenUntil   *time.Time          `json:"open_until,omitempty"`
+	Requests    int                 `json:"requests"` // Requests in the current window
+	Failures    int                 `json:"failures"` // Failed requests in the current window
+	Transitions []BreakerTransition `json:"transitions"`
+}
+
+// circuitBreaker stops traffic to an upstream whose error rate or latency is too high
+type circuitBreaker struct {
+	mutex    sync.Mutex
+	settings models.CircuitBreakerSettings
+	name     string // Used in log messages
+
+	state       BreakerState
+	since       time.Time
+	windowStart time.Time
+	requests    int
+	failures    int
+
+	probesInFlight int
+	probeSuccesses int
+
+	transitions []BreakerTransition
+}
+
+// newCircuitBreaker creates a closed, disabled circuit breaker
+func newCircuitBreaker(name string) *circuitBreaker {
+	now := time.Now()
+	return &circuitBreaker{
+		name:        name,
+		state:       BreakerClosed,
+		since:       now,
+		windowStart: now,
+	}
+}
+
+// configure applies the site's breaker settings, closing the breaker when it gets disabled
+func (cb *circuitBreaker) configure(settings models.CircuitBreakerSettings) {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	cb.settings = settings
+	if !settings.Enabled && cb.state != BreakerClosed {
+		cb.transition(BreakerClosed, "circuit breaker disabled")
+	}
+}
+
+// isOpen reports whether the breaker rejects all requests right now
+func (cb *circuitBreaker) isOpen() bool {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	return cb.settings.Enabled && cb.state == BreakerOpen && time.Now().Before(cb.openUntil())
+}
+
+// allow checks if a request may be sent to the upstream. Probe is set for the
+// requests that test a half-open breaker and must be passed back to record.
+func (cb *circuitBreaker) allow() (allowed bool, probe bool) {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	if !cb.settings.Enabled {
+		return true, false
+	}
+
+	switch cb.state {
+	case BreakerOpen:
+		if time.Now().Before(cb.openUntil()) {
+			return false, false
+		}
+		cb.transition(BreakerHalfOpen, "open duration elapsed")
+		fallthrough
+	case BreakerHalfOpen:
+		if cb.probesInFlight >= cb.settings.HalfOpenRequests {
+			return false, false
+		}
+		cb.probesInFlight++
+		return true, true
+	}
+
+	return true, false
+}
+
+// record feeds the outcome of a request into the breaker
+func (cb *circuitBreaker) record(success bool, probe bool, reason string) {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	if !cb.settings.Enabled {
+		return
+	}
+
+	if probe {
+		if cb.probesInFlight > 0 {
+			cb.probesInFlight--
+		}
+		if cb.state != BreakerHalfOpen {
+			return
+		}
+
+		if !success {
+			cb.transition(BreakerOpen, "probe request failed: "+reason)
+			return
+		}
+
+		cb.probeSuccesses++
+		if cb.probeSuccesses >= cb.settings.HalfOpenRequests {
+			cb.transition(BreakerClosed, fmt.Sprintf("%d probe requests succeeded", cb.probeSuccesses))
+		}
+		return
+	}
+
+	if cb.state != BreakerClosed {
+		// Requests allowed before the breaker opened are not counted
+		return
+	}
+
+	now := time.Now()
+	if now.Sub(cb.windowStart) > time.Duration(cb.settings.Window)*time.Second {
+		cb.windowStart = now
+		cb.requests = 0
+		cb.failures = 0
+	}
+
+	cb.requests++
+	if !success {
+		cb.failures++
+	}
+
+	if cb.requests >= cb.settings.MinRequests && cb.failures*100 >= cb.settings.ErrorRate*cb.requests {
+		cb.transition(BreakerOpen, fmt.Sprintf("%d of %d requests failed, last error: %s", cb.failures, cb.requests, reason))
+	}
+}
+
+// cancel releases the probe slot of a request that ended without an outcome
+func (cb *circuitBreaker) cancel(probe bool) {
+	if !probe {
+		return
+	}
+
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	if cb.probesInFlight > 0 {
+		cb.probesInFlight--
+	}
+}
+
+// retryAfter returns how long the breaker stays open
+func (cb *circuitBreaker) retryAfter() time.Duration {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	if cb.state != BreakerOpen {
+		return 0
+	}
+	return time.Until(cb.openUntil())
+}
+
+// status returns a snapshot of the breaker, or nil when it is disabled
+func (cb *circuitBreaker) status() *BreakerStatus {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	if !cb.settings.Enabled {
+		return nil
+	}
+
+	status := &BreakerStatus{
+		State:       cb.state,
+		Since:       cb.since,
+		Requests:    cb.requests,
+		Failures:    cb.failures,
+		Transitions: append([]BreakerTransition{}, cb.transitions...),
+	}
+	if cb.state == BreakerOpen {
+		openUntil := cb.openUntil()
+		status.OpenUntil = &openUntil
+	}
+	return status
+}
+
+// openUntil returns the end of the open period, the caller must hold the mutex
+func (cb *circuitBreaker) openUntil() time.Time {
+	return cb.since.Add(time.Duration(cb.settings.OpenDuration) * time.Second)
+}
+
+// transition changes the state and resets the counters, the caller must hold the mutex
+func (cb *circuitBreaker) transition(to BreakerState, reason string) {
+	from := cb.state
+	now := time.Now()
+
+	cb.state = to
+	cb.since = now
+	cb.windowStart = now
+	cb.requests = 0
+	cb.failures = 0
+	cb.probeSuccesses = 0
+	if to != BreakerHalfOpen {
+		cb.probesInFlight = 0
+	}
+
+	cb.transitions = append(cb.transitions, BreakerTransition{From: from, To: to, Reason: reason, At: now})
+	if len(cb.transitions) > maxBreakerTransitions {
+		cb.transitions = cb.transitions[len(cb.transitions)-maxBreakerTransitions:]
+	}
+
+	if to == BreakerOpen {
+		logs.Warning("Circuit breaker for %s opened: %s", cb.name, reason)
+	} else {
+		logs.Info("Circuit breaker for %s is now %s: %s", cb.name, to, reason)
+	}
+}
@@ -0,0 +1,247 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"math/bits"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/beego/beego/v2/core/logs"
+	"github.com/beego/beego/v2/server/web"
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+	"github.com/corazawaf/coraza/v3/types"
+)
+
+const (
+	// challengePath is the reserved path the challenge page posts its proof of work to
+	challengePath = "/.seprowaf/challenge"
+
+	// clearanceCookie holds the proof that a client solved the challenge
+	clearanceCookie = "seprowaf_clearance"
+
+	// challengeTokenTTL is how long a client has to solve a challenge
+	challengeTokenTTL = 5 * time.Minute
+)
+
+// challengeSettings configures the browser challenge
+type challengeSettings struct {
+	secret     []byte        // Key signing challenges and clearance cookies
+	difficulty int           // Leading zero bits the proof of work needs
+	clearance  time.Duration // How long a solved challenge lets the client through
+}
+
+var (
+	challengeOnce   sync.Once
+	challengeConfig challengeSettings
+)
+
+// getChallengeSettings reads the challenge settings from app.conf. Replicas must share
+// ChallengeSecret, or JWTSecret it is derived from, to accept each other's cookies.
+func getChallengeSettings() *challengeSettings {
+	challengeOnce.Do(func() {
+		secret := web.AppConfig.DefaultString("ChallengeSecret", "")
+		switch {
+		case secret != "":
+			challengeConfig.secret = []byte(secret)
+		case web.AppConfig.DefaultString("JWTSecret", "") != "":
+			mac := hmac.New(sha256.New, []byte(web.AppConfig.DefaultString("JWTSecret", "")))
+			mac.Write([]byte("seprowaf challenge"))
+			challengeConfig.secret = mac.Sum(nil)
+		default:
+			challengeConfig.secret = make([]byte, 32)
+			rand.Read(challengeConfig.secret)
+			logs.Warning("Neither ChallengeSecret nor JWTSecret is set, challenge clearances will not survive a restart")
+		}
+
+		challengeConfig.difficulty = web.AppConfig.DefaultInt("ChallengeDifficulty", 16)
+		if challengeConfig.difficulty < 1 || challengeConfig.difficulty > 32 {
+			logs.Warning("Invalid ChallengeDifficulty %d, using 16", challengeConfig.difficulty)
+			challengeConfig.difficulty = 16
+		}
+
+		challengeConfig.clearance = time.Duration(web.AppConfig.DefaultInt("ChallengeClearanceTTL", 3600)) * time.Second
+		if challengeConfig.clearance <= 0 {
+			challengeConfig.clearance = time.Hour
+		}
+	})
+	return &challengeConfig
+}
+
+// sign returns the signature of values bound to the site, client IP and JA4 fingerprint
+// of a request, so that a clearance solved for one site is not accepted by another
+func (s *challengeSettings) sign(r *http.Request, kind string, values ...string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(strings.Join(append([]string{kind, challengeHost(r), clientIP(r), clientJA4(r)}, values...), "|")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// challengeHost returns the site domain of a request, without port and in lower case
+func challengeHost(r *http.Request) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
+
+// newChallengeToken issues a challenge for the client of a request. The token is
+// "expiry.difficulty.salt.signature", the page finds a nonce so that SHA-256 of
+// "token:nonce" starts with difficulty zero bits.
+func newChallengeToken(r *http.Request) string {
+	settings := getChallengeSettings()
+
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	payload := fmt.Sprintf("%d.%d.%s", time.Now().Add(challengeTokenTTL).Unix(), settings.difficulty, hex.EncodeToString(salt))
+	return payload + "." + settings.sign(r, "challenge", payload)
+}
+
+// verifyChallenge checks that a nonce solves an unexpired challenge issued to the client of a request
+func verifyChallenge(r *http.Request, token, nonce string) bool {
+	parts := strings.Split(token, ".")
+	if len(parts) != 4 || nonce == "" || len(nonce) > 32 {
+		return false
+	}
+
+	payload := strings.Join(parts[:3], ".")
+	if !hmac.Equal([]byte(parts[3]), []byte(getChallengeSettings().sign(r, "challenge", payload))) {
+		return false
+	}
+	expiry, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || time.Now().Unix() > expiry {
+		return false
+	}
+	difficulty, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return false
+	}
+
+	sum := sha256.Sum256([]byte(token + ":" + nonce))
+	zeros := 0
+	for _, b := range sum {
+		zeros += bits.LeadingZeros8(b)
+		if b != 0 {
+			break
+		}
+	}
+	return zeros >= difficulty
+}
+
+// hasClearance checks if the request carries an unexpired clearance cookie issued to its client
+func hasClearance(r *http.Request) bool {
+	cookie, err := r.Cookie(clearanceCookie)
+	if err != nil {
+		return false
+	}
+
+	expiry, signature, ok := strings.Cut(cookie.Value, ".")
+	if !ok {
+		return false
+	}
+	if !hmac.Equal([]byte(signature), []byte(getChallengeSettings().sign(r, "clearance", expiry))) {
+		return false
+	}
+	unix, err := strconv.ParseInt(expiry, 10, 64)
+	return err == nil && time.Now().Unix() <= unix
+}
+
+// challengeRequested checks if a rule asked for the client to be challenged by setting TX:challenge.
+// Sites in DetectionOnly mode, marked with TX:detection_only, never challenge.
+func challengeRequested(tx types.Transaction) bool {
+	state, ok := tx.(plugintypes.TransactionState)
+	if !ok {
+		return false
+	}
+	variables := state.Variables().TX()
+	if values := variables.Get("detection_only"); len(values) > 0 && values[0] == "1" {
+		return false
+	}
+	values := variables.Get("challenge")
+	return len(values) > 0 && values[0] != "" && values[0] != "0"
+}
+
+// safeReturnURL only lets the challenge redirect back to a path of the same site
+func safeReturnURL(target string) string {
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") || strings.HasPrefix(target, "/\\") {
+		return "/"
+	}
+	return target
+}
+
+// serveChallenge answers a request with the proof of work page. gRPC clients cannot run it
+// and get an error instead.
+func serveChallenge(w http.ResponseWriter, r *http.Request, statusCode int) {
+	if isGRPCRequest(r) {
+		serveGRPCError(w, grpcContentType(r), statusCode, "Browser verification required")
+		return
+	}
+
+	content, err := os.ReadFile("proxy/challenge.html")
+	if err != nil {
+		logs.Error("Failed to read challenge page: %v", err)
+		serveWAFErrorPage(w, "Verification Required", statusCode, "Your browser could not be verified")
+		return
+	}
+
+	htmlContent := string(content)
+	htmlContent = strings.Replace(htmlContent, "{{.Action}}", challengePath, -1)
+	htmlContent = strings.Replace(htmlContent, "{{.Token}}", newChallengeToken(r), -1)
+	htmlContent = strings.Replace(htmlContent, "{{.Return}}", html.EscapeString(r.URL.RequestURI()), -1)
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(statusCode)
+	w.Write([]byte(htmlContent))
+}
+
+// handleChallenge verifies the proof of work posted by the challenge page, then sets the
+// clearance cookie and sends the browser back to the page it asked for
+func handleChallenge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, 4096)
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid challenge response", http.StatusBadRequest)
+		return
+	}
+
+	target := safeReturnURL(r.PostForm.Get("return"))
+	if !verifyChallenge(r, r.PostForm.Get("token"), r.PostForm.Get("nonce")) {
+		// Expired or forged, the browser gets a fresh challenge for the original page
+		if u, err := url.ParseRequestURI(target); err == nil {
+			r.URL = u
+		}
+		serveChallenge(w, r, http.StatusForbidden)
+		return
+	}
+
+	settings := getChallengeSettings()
+	expiry := time.Now().Add(settings.clearance)
+	unix := strconv.FormatInt(expiry.Unix(), 10)
+	http.SetCookie(w, &http.Cookie{
+		Name:     clearanceCookie,
+		Value:    unix + "." + settings.sign(r, "clearance", unix),
+		Path:     "/",
+		Expires:  expiry,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, target, http.StatusSeeOther)
+}
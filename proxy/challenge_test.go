@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// clearanceFor mints a clearance cookie for the client of a request
+func clearanceFor(r *http.Request) *http.Cookie {
+	unix := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	return &http.Cookie{Name: clearanceCookie, Value: unix + "." + getChallengeSettings().sign(r, "clearance", unix)}
+}
+
+func TestClearanceBoundToSite(t *testing.T) {
+	minted := httptest.NewRequest(http.MethodGet, "http://shop.example.com/", nil)
+	cookie := clearanceFor(minted)
+
+	tests := []struct {
+		name string
+		host string
+		want bool
+	}{
+		{"same site", "shop.example.com", true},
+		{"same site with port", "shop.example.com:8443", true},
+		{"same site in upper case", "Shop.Example.com", true},
+		{"other site", "bank.example.com", false},
+		{"parent domain", "example.com", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://"+tt.host+"/", nil)
+			r.AddCookie(cookie)
+			if got := hasClearance(r); got != tt.want {
+				t.Errorf("clearance minted for shop.example.com accepted on %s = %v, want %v", tt.host, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChallengeTokenBoundToSite(t *testing.T) {
+	minted := httptest.NewRequest(http.MethodPost, "http://shop.example.com/", nil)
+	token := newChallengeToken(minted)
+
+	nonce := ""
+	for i := 0; i < 1<<26 && nonce == ""; i++ {
+		if candidate := strconv.Itoa(i); verifyChallenge(minted, token, candidate) {
+			nonce = candidate
+		}
+	}
+	if nonce == "" {
+		t.Fatal("no nonce solves the challenge")
+	}
+
+	other := httptest.NewRequest(http.MethodPost, "http://bank.example.com/", nil)
+	if verifyChallenge(other, token, nonce) {
+		t.Error("challenge solved for shop.example.com verified on bank.example.com")
+	}
+}
@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"SeproWAF/models"
+	"SeproWAF/services"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/beego/beego/v2/core/logs"
+	"github.com/beego/beego/v2/server/web"
+	"github.com/corazawaf/coraza/v3/types"
+)
+
+// clientIPResolver resolves the real client IP of requests forwarded by trusted proxies
+type clientIPResolver struct {
+	trusted []*net.IPNet
+	header  string // Header holding the client IP, empty for Forwarded/X-Forwarded-For
+}
+
+// newClientIPResolver combines the global trusted proxies from app.conf with the site's own
+func newClientIPResolver(site *models.Site) *clientIPResolver {
+	resolver := &clientIPResolver{
+		header: http.CanonicalHeaderKey(strings.TrimSpace(web.AppConfig.DefaultString("ClientIPHeader", ""))),
+	}
+
+	global, err := models.ParseTrustedProxies(web.AppConfig.DefaultString("TrustedProxies", ""))
+	if err != nil {
+		logs.Error("Invalid TrustedProxies configuration: %v", err)
+	}
+	resolver.trusted = append(resolver.trusted, global...)
+
+	networks, err := site.GetTrustedProxies()
+	if err != nil {
+		logs.Error("Invalid trusted proxies for site %s: %v", site.Domain, err)
+	}
+	resolver.trusted = append(resolver.trusted, networks...)
+
+	if header := strings.TrimSpace(site.ClientIPHeader); header != "" {
+		resolver.header = http.CanonicalHeaderKey(header)
+	}
+
+	return resolver
+}
+
+// isTrusted checks if the address belongs to a trusted proxy
+func (cr *clientIPResolver) isTrusted(ip net.IP) bool {
+	for _, network := range cr.trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve returns the client IP of the request. Forwarding headers are only read when
+// the request comes from a trusted proxy, and the chain is walked from the right so
+// that addresses prepended by the client are ignored.
+func (cr *clientIPResolver) resolve(r *http.Request) string {
+	remoteIP := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(remoteIP); err == nil {
+		remoteIP = host
+	}
+
+	peer := net.ParseIP(remoteIP)
+	if peer == nil || len(cr.trusted) == 0 || !cr.isTrusted(peer) {
+		return remoteIP
+	}
+
+	var hops []string
+	switch {
+	case cr.header == "Forwarded":
+		hops = forwardedFor(r.Header.Values("Forwarded"))
+	case cr.header != "":
+		hops = splitHops(r.Header.Values(cr.header))
+	case len(r.Header.Values("Forwarded")) > 0:
+		hops = forwardedFor(r.Header.Values("Forwarded"))
+	default:
+		hops = splitHops(r.Header.Values("X-Forwarded-For"))
+	}
+
+	client := remoteIP
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := parseHop(hops[i])
+		if ip == nil {
+			// Unknown or obfuscated identifiers end the chain
+			break
+		}
+
+		client = ip.String()
+		if !cr.isTrusted(ip) {
+			break
+		}
+	}
+	return client
+}
+
+// splitHops splits comma-separated header values into addresses
+func splitHops(values []string) []string {
+	var hops []string
+	for _, value := range values {
+		for _, hop := range strings.Split(value, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	return hops
+}
+
+// forwardedFor returns the "for" parameters of RFC 7239 Forwarded header values
+func forwardedFor(values []string) []string {
+	var hops []string
+	for _, element := range splitHops(values) {
+		for _, pair := range strings.Split(element, ";") {
+			name, value, found := strings.Cut(strings.TrimSpace(pair), "=")
+			if found && strings.EqualFold(strings.TrimSpace(name), "for") {
+				hops = append(hops, strings.Trim(strings.TrimSpace(value), `"`))
+			}
+		}
+	}
+	return hops
+}
+
+// parseHop parses an address from a forwarding header, which may carry a port
+// and, for IPv6, brackets
+func parseHop(hop string) net.IP {
+	if ip := net.ParseIP(hop); ip != nil {
+		return ip
+	}
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		return net.ParseIP(strings.Trim(host, "[]"))
+	}
+	return net.ParseIP(strings.Trim(hop, "[]"))
+}
+
+// clientIP returns the IP address of the client that sent the request
+func clientIP(r *http.Request) string {
+	return services.ClientIP(r)
+}
+
+// processConnection feeds the client and server addresses of the request to the transaction
+func processConnection(tx types.Transaction, r *http.Request) {
+	ip := clientIP(r)
+
+	// The peer port only belongs to the client when it connected directly
+	var clientPort int
+	if host, port, err := net.SplitHostPort(r.RemoteAddr); err == nil && host == ip {
+		clientPort, _ = strconv.Atoi(port)
+	}
+
+	var serverIP string
+	var serverPort int
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		if host, port, err := net.SplitHostPort(addr.String()); err == nil {
+			serverIP = host
+			serverPort, _ = strconv.Atoi(port)
+		}
+	}
+
+	tx.ProcessConnection(ip, clientPort, serverIP, serverPort)
+}
@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"SeproWAF/models"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/beego/beego/v2/client/orm"
+	"github.com/beego/beego/v2/core/logs"
+	"github.com/beego/beego/v2/server/web"
+)
+
+// dataListMacroPattern matches data list references in custom rules, e.g. "@inList blocked_ips"
+var dataListMacroPattern = regexp.MustCompile(`(!?)@inList\s+([A-Za-z0-9_-]+)`)
+
+// seededDataLists are imported from the files shipped in rules/lists when they are missing from the database
+var seededDataLists = map[string]models.DataListType{
+	"ja4_blocklist": models.DataListFingerprint,
+	"ldap_payloads": models.DataListString,
+}
+
+// dataListPath returns the file a data list is written to for @pmFromFile and @ipMatchFromFile
+func dataListPath(name string) string {
+	rulesDir, err := web.AppConfig.String("WAFRulesDir")
+	if err != nil || rulesDir == "" {
+		rulesDir = "rules"
+	}
+	return filepath.Join(rulesDir, "lists", name+".txt")
+}
+
+// writeDataListFile writes the entries of a list to its file, one per line
+func writeDataListFile(list *models.DataList) error {
+	path := dataListPath(list.Name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	content := list.Entries
+	if content != "" {
+		content += "\n"
+	}
+
+	// WAF instances may be built while the list is written, so replace the file at once
+	tmpFile := path + ".tmp"
+	if err := os.WriteFile(tmpFile, []byte(content), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, path)
+}
+
+// SyncDataLists imports the shipped lists that are missing from the database and writes
+// every list to its file, so that rules referencing the files find them on startup
+func SyncDataLists() error {
+	o := orm.NewOrm()
+	for name, listType := range seededDataLists {
+		if _, err := models.GetDataListByName(name); err != orm.ErrNoRows {
+			continue
+		}
+
+		data, err := os.ReadFile(dataListPath(name))
+		if err != nil || strings.TrimSpace(string(data)) == "" {
+			continue
+		}
+
+		list := &models.DataList{
+			Name:        name,
+			Type:        listType,
+			Description: "Imported from " + dataListPath(name),
+		}
+		if err := list.SetEntries(strings.Split(string(data), "\n")); err != nil {
+			logs.Warning("Failed to import data list %s: %v", name, err)
+			continue
+		}
+		if _, err := o.Insert(list); err != nil {
+			logs.Warning("Failed to import data list %s: %v", name, err)
+			continue
+		}
+		logs.Info("Imported data list %s with %d entries", name, len(list.GetEntries()))
+	}
+
+	lists, err := models.GetDataLists()
+	if err != nil {
+		return err
+	}
+	for _, list := range lists {
+		if err := writeDataListFile(list); err != nil {
+			logs.Error("Failed to write data list %s: %v", list.Name, err)
+		}
+	}
+	return nil
+}
+
+// ExpandDataListMacros replaces the data list references of a rule with the operator for the list type
+func ExpandDataListMacros(ruleText string) string {
+	return expandDataListMacros(ruleText, newDataListLookup())
+}
+
+// newDataListLookup returns a lookup that loads each referenced list from the database once
+func newDataListLookup() func(name string) *models.DataList {
+	lists := make(map[string]*models.DataList)
+	return func(name string) *models.DataList {
+		if list, loaded := lists[name]; loaded {
+			return list
+		}
+		list, err := models.GetDataListByName(name)
+		if err != nil {
+			list = nil
+		}
+		lists[name] = list
+		return list
+	}
+}
+
+// expandDataListMacros expands "@inList <name>" to @ipMatchFromFile for IP and CIDR lists,
+// @rx for regex lists and @pmFromFile for fingerprint and string lists
+func expandDataListMacros(ruleText string, lookup func(name string) *models.DataList) string {
+	return dataListMacroPattern.ReplaceAllStringFunc(ruleText, func(macro string) string {
+		match := dataListMacroPattern.FindStringSubmatch(macro)
+		negate, name := match[1], match[2]
+
+		list := lookup(name)
+		if list == nil {
+			logs.Warning("Rule references unknown data list %s, it never matches", name)
+			return neverMatchOperator(negate)
+		}
+
+		path, err := filepath.Abs(dataListPath(list.Name))
+		if err != nil {
+			path = dataListPath(list.Name)
+		}
+
+		switch list.Type {
+		case models.DataListIP, models.DataListCIDR:
+			return negate + "@ipMatchFromFile " + path
+		case models.DataListRegex:
+			entries := list.GetEntries()
+			if len(entries) == 0 {
+				return neverMatchOperator(negate)
+			}
+			patterns := make([]string, len(entries))
+			for i, entry := range entries {
+				patterns[i] = "(?:" + entry + ")"
+			}
+			return negate + "@rx " + strings.ReplaceAll(strings.Join(patterns, "|"), `"`, `\"`)
+		default:
+			return negate + "@pmFromFile " + path
+		}
+	})
+}
+
+// neverMatchOperator returns an operator that never matches, or always does when negated
+func neverMatchOperator(negate string) string {
+	if negate != "" {
+		return "@unconditionalMatch"
+	}
+	return "!@unconditionalMatch"
+}
@@ -0,0 +1,207 @@
+package proxy
+
+import (
+	"SeproWAF/models"
+	"bytes"
+	"fmt"
+	"html"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/beego/beego/v2/core/logs"
+)
+
+const (
+	// maxCachedResponseSize caps the size of a response kept for the cached fallback
+	maxCachedResponseSize = 1 << 20
+
+	// maxCachedResponses caps the number of responses kept per site
+	maxCachedResponses = 1000
+)
+
+// cachedResponse is a successful upstream response kept for the cached fallback
+type cachedResponse struct {
+	statusCode int
+	header     http.Header
+	body       []byte
+	expires    time.Time
+}
+
+// fallbackHandler answers requests whose upstream has an open circuit breaker
+type fallbackHandler struct {
+	settings models.FallbackSettings
+
+	mutex sync.RWMutex
+	cache map[string]*cachedResponse
+}
+
+// newFallbackHandler creates the fallback handler of a site
+func newFallbackHandler(settings models.FallbackSettings) *fallbackHandler {
+	return &fallbackHandler{
+		settings: settings,
+		cache:    make(map[string]*cachedResponse),
+	}
+}
+
+// cacheKey returns the key under which the response to the request is cached,
+// or an empty string if the response must not be shared with other clients
+func (fh *fallbackHandler) cacheKey(r *http.Request) string {
+	if fh.settings.Mode != models.FallbackCached || r.Method != http.MethodGet {
+		return ""
+	}
+	// Responses to authenticated requests may be personal
+	if r.Header.Get("Authorization") != "" || r.Header.Get("Cookie") != "" || isWebSocketUpgrade(r) {
+		return ""
+	}
+	return r.Host + r.URL.RequestURI()
+}
+
+// capture stores a successful response while it is streamed to the client
+func (fh *fallbackHandler) capture(key string, resp *http.Response) {
+	if key == "" || resp.StatusCode != http.StatusOK || resp.ContentLength > maxCachedResponseSize {
+		return
+	}
+
+	// Personalized responses are never served to other clients
+	cacheControl := strings.ToLower(resp.Header.Get("Cache-Control"))
+	if resp.Header.Get("Set-Cookie") != "" || strings.Contains(cacheControl, "private") || strings.Contains(cacheControl, "no-store") {
+		return
+	}
+
+	// The key does not include request headers, so only the encoding may vary
+	for _, value := range resp.Header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" && !strings.EqualFold(name, "Accept-Encoding") {
+				return
+			}
+		}
+	}
+
+	resp.Body = &capturingBody{
+		ReadCloser: resp.Body,
+		onComplete: func(body []byte) {
+			fh.store(key, &cachedResponse{
+				statusCode: resp.StatusCode,
+				header:     resp.Header.Clone(),
+				body:       body,
+				expires:    time.Now().Add(time.Duration(fh.settings.CacheTTL) * time.Second),
+			})
+		},
+	}
+}
+
+// store adds a response to the cache, evicting expired entries when it is full
+func (fh *fallbackHandler) store(key string, response *cachedResponse) {
+	fh.mutex.Lock()
+	defer fh.mutex.Unlock()
+
+	if _, exists := fh.cache[key]; !exists && len(fh.cache) >= maxCachedResponses {
+		now := time.Now()
+		for k, cached := range fh.cache {
+			if now.After(cached.expires) {
+				delete(fh.cache, k)
+			}
+		}
+		if len(fh.cache) >= maxCachedResponses {
+			return
+		}
+	}
+
+	fh.cache[key] = response
+}
+
+// lookup returns the cached response for the key if it did not expire
+func (fh *fallbackHandler) lookup(key string) *cachedResponse {
+	fh.mutex.RLock()
+	defer fh.mutex.RUnlock()
+
+	cached, ok := fh.cache[key]
+	if !ok || time.Now().After(cached.expires) {
+		return nil
+	}
+	return cached
+}
+
+// serve writes the fallback response for a request to an upstream with an open breaker
+func (fh *fallbackHandler) serve(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	if fh.settings.Mode == models.FallbackCached {
+		if cached := fh.lookup(fh.cacheKey(r)); cached != nil {
+			header := w.Header()
+			for name, values := range cached.header {
+				header[name] = values
+			}
+			header.Set("X-Fallback", "cached")
+			w.WriteHeader(cached.statusCode)
+			w.Write(cached.body)
+			return
+		}
+	}
+
+	if retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	}
+	if fh.settings.Mode == models.FallbackStatus {
+		w.Header().Set("X-Fallback", string(models.FallbackStatus))
+		http.Error(w, fh.settings.Message, fh.settings.StatusCode)
+		return
+	}
+
+	// Cache misses get the maintenance page
+	w.Header().Set("X-Fallback", string(models.FallbackMaintenance))
+	serveMaintenancePage(w, fh.settings.StatusCode, fh.settings.Message)
+}
+
+// serveMaintenancePage renders the static maintenance page
+func serveMaintenancePage(w http.ResponseWriter, statusCode int, message string) {
+	// Path to the maintenance page
+	maintenancePagePath := "proxy/maintenance.html"
+
+	content, err := os.ReadFile(maintenancePagePath)
+	if err != nil {
+		// If we can't read the file, fall back to a simple error message
+		logs.Error("Failed to read maintenance page: %v", err)
+		http.Error(w, message, statusCode)
+		return
+	}
+
+	htmlContent := string(content)
+	htmlContent = strings.Replace(htmlContent, "{{.StatusCode}}", fmt.Sprintf("%d", statusCode), -1)
+	htmlContent = strings.Replace(htmlContent, "{{.Message}}", html.EscapeString(message), -1)
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(statusCode)
+	w.Write([]byte(htmlContent))
+}
+
+// capturingBody copies a response body while it is read, up to maxCachedResponseSize
+type capturingBody struct {
+	io.ReadCloser
+	buf        bytes.Buffer
+	overflow   bool
+	onComplete func(body []byte)
+}
+
+// Read reads from the body, handing the copy over once the body was read completely
+func (cb *capturingBody) Read(p []byte) (int, error) {
+	n, err := cb.ReadCloser.Read(p)
+	if !cb.overflow {
+		if cb.buf.Len()+n > maxCachedResponseSize {
+			cb.overflow = true
+			cb.buf = bytes.Buffer{}
+		} else {
+			cb.buf.Write(p[:n])
+		}
+	}
+
+	if err == io.EOF && !cb.overflow && cb.onComplete != nil {
+		cb.onComplete(cb.buf.Bytes())
+		cb.onComplete = nil
+	}
+	return n, err
+}
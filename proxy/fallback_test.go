@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"SeproWAF/models"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fetchThrough captures an upstream response for the request like the proxy does
+func fetchThrough(fh *fallbackHandler, r *http.Request, header http.Header) {
+	resp := &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        header,
+		Body:          io.NopCloser(strings.NewReader("page of " + r.URL.Path)),
+		ContentLength: -1,
+	}
+	fh.capture(fh.cacheKey(r), resp)
+	io.ReadAll(resp.Body)
+	resp.Body.Close()
+}
+
+func TestFallbackCacheSkipsPersonalResponses(t *testing.T) {
+	tests := []struct {
+		name       string
+		header     http.Header // Request headers
+		respHeader http.Header
+		cached     bool
+	}{
+		{"anonymous request", nil, nil, true},
+		{"cookie", http.Header{"Cookie": {"session=abc"}}, nil, false},
+		{"authorization", http.Header{"Authorization": {"Bearer abc"}}, nil, false},
+		{"set cookie", nil, http.Header{"Set-Cookie": {"session=abc"}}, false},
+		{"private", nil, http.Header{"Cache-Control": {"private, max-age=60"}}, false},
+		{"vary accept encoding", nil, http.Header{"Vary": {"Accept-Encoding"}}, true},
+		{"vary cookie", nil, http.Header{"Vary": {"Accept-Encoding, Cookie"}}, false},
+		{"vary in several headers", nil, http.Header{"Vary": {"accept-encoding", "Accept-Language"}}, false},
+		{"vary everything", nil, http.Header{"Vary": {"*"}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fh := newFallbackHandler(models.FallbackSettings{Mode: models.FallbackCached, CacheTTL: 60, StatusCode: 503})
+			r := httptest.NewRequest(http.MethodGet, "http://example.com/account", nil)
+			for name, values := range tt.header {
+				r.Header[name] = values
+			}
+			respHeader := tt.respHeader
+			if respHeader == nil {
+				respHeader = http.Header{}
+			}
+
+			fetchThrough(fh, r, respHeader)
+			if got := len(fh.cache) == 1; got != tt.cached {
+				t.Errorf("response cached = %v, want %v", got, tt.cached)
+			}
+		})
+	}
+}
+
+func TestFallbackCacheNotServedToCookieRequests(t *testing.T) {
+	fh := newFallbackHandler(models.FallbackSettings{Mode: models.FallbackCached, CacheTTL: 60, StatusCode: 503})
+
+	// A visitor with a session cookie loads their page, which is not stored
+	personal := httptest.NewRequest(http.MethodGet, "http://example.com/account", nil)
+	personal.Header.Set("Cookie", "session=alice")
+	fetchThrough(fh, personal, http.Header{})
+	if len(fh.cache) != 0 {
+		t.Fatalf("response to a cookie request was cached under %v", fh.cache)
+	}
+
+	// An anonymous response for the same URL is stored, but not served to clients with cookies
+	fetchThrough(fh, httptest.NewRequest(http.MethodGet, "http://example.com/account", nil), http.Header{})
+	if len(fh.cache) != 1 {
+		t.Fatalf("anonymous response was not cached")
+	}
+
+	other := httptest.NewRequest(http.MethodGet, "http://example.com/account", nil)
+	other.Header.Set("Cookie", "session=bob")
+	w := httptest.NewRecorder()
+	fh.serve(w, other, 0)
+	if w.Header().Get("X-Fallback") == "cached" || strings.Contains(w.Body.String(), "page of") {
+		t.Errorf("cached response served to a cookie request: %d %q", w.Code, w.Body.String())
+	}
+	if w.Code != 503 {
+		t.Errorf("cookie request got status %d, want the maintenance status 503", w.Code)
+	}
+
+	// Anonymous clients still get the cached page
+	w = httptest.NewRecorder()
+	fh.serve(w, httptest.NewRequest(http.MethodGet, "http://example.com/account", nil), 0)
+	if w.Header().Get("X-Fallback") != "cached" || w.Body.String() != "page of /account" {
+		t.Errorf("anonymous request got %q %q, want the cached page", w.Header().Get("X-Fallback"), w.Body.String())
+	}
+}
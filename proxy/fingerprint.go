@@ -0,0 +1,475 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+	"github.com/corazawaf/coraza/v3/types"
+	"github.com/exaring/ja4plus"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+const (
+	tlsRecordHeaderSize    = 5
+	tlsRecordTypeHandshake = 0x16
+	tlsMaxRecordSize       = 16384 + 2048
+
+	tlsHandshakeServerHello = 0x02
+
+	tlsExtensionALPN              = 0x0010
+	tlsExtensionPreSharedKey      = 0x0029
+	tlsExtensionSupportedVersions = 0x002b
+	tlsExtensionKeyShare          = 0x0033
+
+	// ja4EmptyHash replaces the hash of an empty list in JA4+ fingerprints
+	ja4EmptyHash = "000000000000"
+)
+
+// Request headers carrying the fingerprints to rules and upstreams. Values sent by clients are dropped.
+const (
+	headerJA4  = "X-JA4"
+	headerJA4S = "X-JA4S"
+	headerJA4H = "X-JA4H"
+	headerJA4T = "X-JA4T"
+)
+
+// connFingerprintContextKey stores the fingerprint of a connection in its context
+type connFingerprintContextKey struct{}
+
+// requestFingerprintsContextKey stores the fingerprints of a request in its context
+type requestFingerprintsContextKey struct{}
+
+// connFingerprint holds what is captured about a client connection while it is set up
+type connFingerprint struct {
+	quic  bool
+	hello atomic.Pointer[tls.ClientHelloInfo] // Stored by captureClientHello during the handshake
+	ja4s  atomic.Pointer[string]              // Stored once the ServerHello was written
+	ja4t  string                              // Computed from the saved SYN, empty when unavailable
+}
+
+// requestFingerprints are the JA4+ fingerprints of a request
+type requestFingerprints struct {
+	JA4  string
+	JA4S string
+	JA4H string
+	JA4T string
+}
+
+// captureClientHello stores the ClientHello in the fingerprint of its connection.
+// It is the first callback of every handshake and keeps the configuration unchanged.
+func captureClientHello(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	if fp, ok := hello.Context().Value(connFingerprintContextKey{}).(*connFingerprint); ok {
+		fp.hello.Store(hello)
+	}
+	return nil, nil
+}
+
+// fingerprintListener reads the SYN of accepted connections and watches their ServerHello
+type fingerprintListener struct {
+	net.Listener
+}
+
+// Accept wraps the next connection
+func (l *fingerprintListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	fp := &connFingerprint{}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		fp.ja4t = computeJA4T(readSavedSYN(tcpConn))
+	}
+	return &fingerprintConn{Conn: conn, fingerprint: fp}, nil
+}
+
+// fingerprintConn is a connection whose first TLS record is fingerprinted as it is written
+type fingerprintConn struct {
+	net.Conn
+	fingerprint *connFingerprint
+	sniffed     bool
+	record      []byte
+}
+
+// Write writes to the connection, collecting the ServerHello record on the way
+func (c *fingerprintConn) Write(b []byte) (int, error) {
+	if !c.sniffed {
+		c.sniffServerHello(b)
+	}
+	return c.Conn.Write(b)
+}
+
+// sniffServerHello collects the first record written to the client and computes
+// the JA4S fingerprint of the ServerHello it carries
+func (c *fingerprintConn) sniffServerHello(b []byte) {
+	c.record = append(c.record, b...)
+	if len(c.record) < tlsRecordHeaderSize {
+		return
+	}
+
+	length := int(binary.BigEndian.Uint16(c.record[3:5]))
+	if c.record[0] != tlsRecordTypeHandshake || length > tlsMaxRecordSize {
+		// Plain HTTP, nothing to fingerprint
+		c.sniffed, c.record = true, nil
+		return
+	}
+	if len(c.record) < tlsRecordHeaderSize+length {
+		return
+	}
+
+	if ja4s, ok := parseServerHelloJA4S(c.record[tlsRecordHeaderSize : tlsRecordHeaderSize+length]); ok {
+		c.fingerprint.ja4s.Store(&ja4s)
+	}
+	c.sniffed, c.record = true, nil
+}
+
+// unwrapFingerprintConn finds the fingerprintConn below TLS and PROXY protocol connections
+func unwrapFingerprintConn(conn net.Conn) *fingerprintConn {
+	if netConn, ok := conn.(interface{ NetConn() net.Conn }); ok {
+		conn = netConn.NetConn()
+	}
+	if ppConn, ok := conn.(*proxyProtocolConn); ok {
+		conn = ppConn.Conn
+	}
+	fc, _ := conn.(*fingerprintConn)
+	return fc
+}
+
+// serverConnContext prepares the context of connections accepted by the HTTP and HTTPS servers
+func serverConnContext(ctx context.Context, conn net.Conn) context.Context {
+	ctx = proxyProtocolConnContext(ctx, conn)
+	if fc := unwrapFingerprintConn(conn); fc != nil {
+		ctx = context.WithValue(ctx, connFingerprintContextKey{}, fc.fingerprint)
+	}
+	return ctx
+}
+
+// tlsFingerprints returns the JA4 and JA4S fingerprints of a TLS connection
+func (fp *connFingerprint) tlsFingerprints(state *tls.ConnectionState) (ja4, ja4s string) {
+	if state == nil {
+		return "", ""
+	}
+
+	if hello := fp.hello.Load(); hello != nil {
+		ja4 = ja4plus.JA4(hello)
+		// JA4 marks QUIC ClientHellos with a "q" instead of the "t" used for TCP
+		if fp.quic && ja4 != "" {
+			ja4 = "q" + ja4[1:]
+		}
+	}
+
+	if fp.quic {
+		ja4s = quicJA4S(state)
+	} else if sniffed := fp.ja4s.Load(); sniffed != nil {
+		ja4s = *sniffed
+	}
+	return ja4, ja4s
+}
+
+// parseServerHelloJA4S computes the JA4S fingerprint of a ServerHello handshake record
+func parseServerHelloJA4S(record []byte) (string, bool) {
+	s := cryptobyte.String(record)
+
+	var msgType uint8
+	var body cryptobyte.String
+	if !s.ReadUint8(&msgType) || msgType != tlsHandshakeServerHello || !s.ReadUint24LengthPrefixed(&body) {
+		return "", false
+	}
+
+	var version, cipher uint16
+	var sessionID cryptobyte.String
+	if !body.ReadUint16(&version) || !body.Skip(32) || !body.ReadUint8LengthPrefixed(&sessionID) ||
+		!body.ReadUint16(&cipher) || !body.Skip(1) {
+		return "", false
+	}
+
+	var extensions []uint16
+	var alpn string
+	if !body.Empty() {
+		var data cryptobyte.String
+		if !body.ReadUint16LengthPrefixed(&data) {
+			return "", false
+		}
+		for !data.Empty() {
+			var extension uint16
+			var value cryptobyte.String
+			if !data.ReadUint16(&extension) || !data.ReadUint16LengthPrefixed(&value) {
+				return "", false
+			}
+			extensions = append(extensions, extension)
+
+			switch extension {
+			case tlsExtensionSupportedVersions:
+				value.ReadUint16(&version)
+			case tlsExtensionALPN:
+				var protocols, protocol cryptobyte.String
+				if value.ReadUint16LengthPrefixed(&protocols) && protocols.ReadUint8LengthPrefixed(&protocol) {
+					alpn = string(protocol)
+				}
+			}
+		}
+	}
+
+	return formatJA4S('t', version, cipher, extensions, alpn), true
+}
+
+// quicJA4S computes the JA4S fingerprint of a QUIC connection. QUIC only speaks TLS 1.3,
+// whose ServerHello carries supported_versions and key_share, plus pre_shared_key on resumption.
+func quicJA4S(state *tls.ConnectionState) string {
+	extensions := []uint16{tlsExtensionSupportedVersions, tlsExtensionKeyShare}
+	if state.DidResume {
+		extensions = append(extensions, tlsExtensionPreSharedKey)
+	}
+	return formatJA4S('q', state.Version, state.CipherSuite, extensions, "")
+}
+
+// formatJA4S builds a JA4S fingerprint, extensions are hashed in the order they were sent
+func formatJA4S(transport byte, version, cipher uint16, extensions []uint16, alpn string) string {
+	names := make([]string, len(extensions))
+	for i, extension := range extensions {
+		names[i] = fmt.Sprintf("%04x", extension)
+	}
+
+	return fmt.Sprintf("%c%s%02d%s_%04x_%s",
+		transport, ja4Version(version), min(len(extensions), 99), ja4ALPN(alpn),
+		cipher, ja4Hash(strings.Join(names, ",")))
+}
+
+// ja4Version returns the two character TLS version of JA4+ fingerprints
+func ja4Version(version uint16) string {
+	switch version {
+	case tls.VersionTLS13:
+		return "13"
+	case tls.VersionTLS12:
+		return "12"
+	case tls.VersionTLS11:
+		return "11"
+	case tls.VersionTLS10:
+		return "10"
+	case 0x0300:
+		return "s3"
+	}
+	return "00"
+}
+
+// ja4ALPN returns the first and last characters of an ALPN protocol
+func ja4ALPN(alpn string) string {
+	if alpn == "" {
+		return "00"
+	}
+
+	first, last := alpn[0], alpn[len(alpn)-1]
+	if !isAlphanumeric(first) || !isAlphanumeric(last) {
+		// Non-printable protocols use the first and last hex digits instead
+		encoded := hex.EncodeToString([]byte(alpn))
+		return encoded[:1] + encoded[len(encoded)-1:]
+	}
+	return string([]byte{first, last})
+}
+
+// isAlphanumeric checks if the byte is an ASCII letter or digit
+func isAlphanumeric(b byte) bool {
+	return (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || (b >= '0' && b <= '9')
+}
+
+// ja4Hash returns the truncated SHA-256 of a JA4+ list
+func ja4Hash(list string) string {
+	if list == "" {
+		return ja4EmptyHash
+	}
+	sum := sha256.Sum256([]byte(list))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// computeJA4H computes the HTTP client fingerprint of a request. Go does not keep
+// the order in which headers were sent, so header names are hashed sorted.
+func computeJA4H(r *http.Request) string {
+	method := strings.ToLower(r.Method)
+	if len(method) > 2 {
+		method = method[:2]
+	}
+
+	var version string
+	switch {
+	case r.ProtoMajor == 1 && r.ProtoMinor == 0:
+		version = "10"
+	case r.ProtoMajor == 1:
+		version = "11"
+	default:
+		version = fmt.Sprintf("%d0", r.ProtoMajor)
+	}
+
+	cookieFlag, refererFlag := "n", "n"
+	if r.Header.Get("Cookie") != "" {
+		cookieFlag = "c"
+	}
+	if r.Header.Get("Referer") != "" {
+		refererFlag = "r"
+	}
+
+	// Cookie and Referer are left out of the header list, HTTP/1 requests sent Host as a header
+	var names []string
+	for name := range r.Header {
+		if name != "Cookie" && name != "Referer" {
+			names = append(names, name)
+		}
+	}
+	if r.ProtoMajor == 1 && r.Host != "" {
+		names = append(names, "Host")
+	}
+	sort.Strings(names)
+
+	var cookieNames, cookiePairs []string
+	for _, cookie := range r.Cookies() {
+		cookieNames = append(cookieNames, cookie.Name)
+		cookiePairs = append(cookiePairs, cookie.Name+"="+cookie.Value)
+	}
+	sort.Strings(cookieNames)
+	sort.Strings(cookiePairs)
+
+	return fmt.Sprintf("%s%s%s%s%02d%s_%s_%s_%s",
+		method, version, cookieFlag, refererFlag, min(len(names), 99), ja4Language(r.Header.Get("Accept-Language")),
+		ja4Hash(strings.Join(names, ",")),
+		ja4Hash(strings.Join(cookieNames, ",")),
+		ja4Hash(strings.Join(cookiePairs, ",")))
+}
+
+// ja4Language returns the first four characters of the primary Accept-Language
+func ja4Language(acceptLanguage string) string {
+	primary := strings.ToLower(acceptLanguage)
+	if i := strings.IndexAny(primary, ",;"); i >= 0 {
+		primary = primary[:i]
+	}
+	primary = strings.ReplaceAll(strings.TrimSpace(primary), "-", "")
+
+	if len(primary) > 4 {
+		primary = primary[:4]
+	}
+	return primary + strings.Repeat("0", 4-len(primary))
+}
+
+// computeJA4T computes the TCP client fingerprint from the IP and TCP headers of a SYN:
+// window size, option kinds in order, maximum segment size and window scale
+func computeJA4T(syn []byte) string {
+	if len(syn) == 0 {
+		return ""
+	}
+
+	var tcp []byte
+	switch syn[0] >> 4 {
+	case 4:
+		headerLength := int(syn[0]&0x0f) * 4
+		if len(syn) < headerLength {
+			return ""
+		}
+		tcp = syn[headerLength:]
+	case 6:
+		// Extension headers are not expected on a SYN
+		if len(syn) < 40 || syn[6] != 6 {
+			return ""
+		}
+		tcp = syn[40:]
+	default:
+		return ""
+	}
+
+	if len(tcp) < 20 {
+		return ""
+	}
+	dataOffset := int(tcp[12]>>4) * 4
+	if dataOffset < 20 || len(tcp) < dataOffset {
+		return ""
+	}
+	window := binary.BigEndian.Uint16(tcp[14:16])
+
+	var kinds []string
+	mss, windowScale := "00", "00"
+	options := tcp[20:dataOffset]
+	for i := 0; i < len(options); {
+		kind := options[i]
+		kinds = append(kinds, strconv.Itoa(int(kind)))
+		if kind == 0 {
+			// End of option list
+			break
+		}
+		if kind == 1 {
+			// No-operation padding
+			i++
+			continue
+		}
+
+		if i+1 >= len(options) {
+			break
+		}
+		length := int(options[i+1])
+		if length < 2 || i+length > len(options) {
+			break
+		}
+		switch {
+		case kind == 2 && length == 4:
+			mss = strconv.Itoa(int(binary.BigEndian.Uint16(options[i+2:])))
+		case kind == 3 && length == 3:
+			windowScale = strconv.Itoa(int(options[i+2]))
+		}
+		i += length
+	}
+
+	optionList := "00"
+	if len(kinds) > 0 {
+		optionList = strings.Join(kinds, "-")
+	}
+	return fmt.Sprintf("%d_%s_%s_%s", window, optionList, mss, windowScale)
+}
+
+// requestFingerprintsFromContext returns the fingerprints computed by JA4Middleware
+func requestFingerprintsFromContext(ctx context.Context) *requestFingerprints {
+	fp, _ := ctx.Value(requestFingerprintsContextKey{}).(*requestFingerprints)
+	if fp == nil {
+		return &requestFingerprints{}
+	}
+	return fp
+}
+
+// clientJA4 returns the JA4 fingerprint of the connection a request came on, also before JA4Middleware ran
+func clientJA4(r *http.Request) string {
+	if fp, ok := r.Context().Value(requestFingerprintsContextKey{}).(*requestFingerprints); ok {
+		return fp.JA4
+	}
+	if conn, ok := r.Context().Value(connFingerprintContextKey{}).(*connFingerprint); ok {
+		ja4, _ := conn.tlsFingerprints(r.TLS)
+		return ja4
+	}
+	return ""
+}
+
+// setFingerprintVariables exposes the fingerprints of a request as TX:ja4, TX:ja4s, TX:ja4h and TX:ja4t
+func setFingerprintVariables(tx types.Transaction, r *http.Request) {
+	state, ok := tx.(plugintypes.TransactionState)
+	if !ok {
+		return
+	}
+
+	fp := requestFingerprintsFromContext(r.Context())
+	variables := state.Variables().TX()
+	for key, value := range map[string]string{
+		"ja4":  fp.JA4,
+		"ja4s": fp.JA4S,
+		"ja4h": fp.JA4H,
+		"ja4t": fp.JA4T,
+	} {
+		if value != "" {
+			variables.Set(key, []string{value})
+		}
+	}
+}
@@ -0,0 +1,51 @@
+//go:build linux
+
+package proxy
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+
+	"github.com/beego/beego/v2/core/logs"
+	"golang.org/x/sys/unix"
+)
+
+// maxSavedSYNSize covers an IPv6 header and a TCP header with the maximum options
+const maxSavedSYNSize = 512
+
+// enableSavedSYN asks the kernel to keep the SYN of connections accepted by a listener
+func enableSavedSYN(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	if err := c.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_SAVE_SYN, 1)
+	}); err != nil {
+		return err
+	}
+
+	if sockErr != nil {
+		logs.Warning("Failed to save SYN packets on %s, JA4T fingerprints are unavailable: %v", address, sockErr)
+	}
+	return nil
+}
+
+// readSavedSYN returns the IP and TCP headers of the SYN that opened the connection.
+// The kernel hands them out once, so this is called right after the connection is accepted.
+func readSavedSYN(conn *net.TCPConn) []byte {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil
+	}
+
+	buf := make([]byte, maxSavedSYNSize)
+	n := 0
+	raw.Control(func(fd uintptr) {
+		size := uint32(len(buf))
+		_, _, errno := unix.Syscall6(unix.SYS_GETSOCKOPT, fd, unix.IPPROTO_TCP, unix.TCP_SAVED_SYN,
+			uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&size)), 0)
+		if errno == 0 {
+			n = int(size)
+		}
+	})
+	return buf[:n]
+}
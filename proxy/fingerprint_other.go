@@ -0,0 +1,18 @@
+//go:build !linux
+
+package proxy
+
+import (
+	"net"
+	"syscall"
+)
+
+// enableSavedSYN does nothing, saving SYN packets is only supported on Linux
+func enableSavedSYN(network, address string, c syscall.RawConn) error {
+	return nil
+}
+
+// readSavedSYN returns nil, JA4T fingerprints are only available on Linux
+func readSavedSYN(conn *net.TCPConn) []byte {
+	return nil
+}
@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"SeproWAF/models"
+	"SeproWAF/services"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+	"github.com/corazawaf/coraza/v3/types"
+)
+
+// geoPolicy enforces the country and ASN lists of a site
+type geoPolicy struct {
+	countryMode  models.GeoPolicyMode
+	countries    map[string]bool
+	asnMode      models.GeoPolicyMode
+	asns         map[uint]bool
+	blockUnknown bool
+}
+
+// newGeoPolicy builds the policy of a site, nil when neither list is enabled
+func newGeoPolicy(settings models.GeoSettings) *geoPolicy {
+	if settings.CountryMode == models.GeoPolicyOff && settings.ASNMode == models.GeoPolicyOff {
+		return nil
+	}
+
+	policy := &geoPolicy{
+		countryMode:  settings.CountryMode,
+		countries:    make(map[string]bool, len(settings.Countries)),
+		asnMode:      settings.ASNMode,
+		asns:         make(map[uint]bool, len(settings.ASNs)),
+		blockUnknown: settings.BlockUnknown,
+	}
+	for _, country := range settings.Countries {
+		policy.countries[country] = true
+	}
+	for _, asn := range settings.ASNs {
+		policy.asns[asn] = true
+	}
+	return policy
+}
+
+// check returns why a client is blocked, or an empty string when it may pass
+func (p *geoPolicy) check(info *services.GeoInfo) string {
+	if p == nil {
+		return ""
+	}
+
+	var country string
+	var asn uint
+	if info != nil {
+		country, asn = info.CountryCode, info.ASN
+	}
+
+	switch {
+	case p.countryMode == models.GeoPolicyOff:
+	case country == "":
+		if p.countryMode == models.GeoPolicyAllow && p.blockUnknown {
+			return "Client country is unknown"
+		}
+	case p.countryMode == models.GeoPolicyAllow && !p.countries[country]:
+		return fmt.Sprintf("Country %s is not allowed", country)
+	case p.countryMode == models.GeoPolicyDeny && p.countries[country]:
+		return fmt.Sprintf("Country %s is blocked", country)
+	}
+
+	switch {
+	case p.asnMode == models.GeoPolicyOff:
+	case asn == 0:
+		if p.asnMode == models.GeoPolicyAllow && p.blockUnknown {
+			return "Client ASN is unknown"
+		}
+	case p.asnMode == models.GeoPolicyAllow && !p.asns[asn]:
+		return fmt.Sprintf("AS%d is not allowed", asn)
+	case p.asnMode == models.GeoPolicyDeny && p.asns[asn]:
+		return fmt.Sprintf("AS%d is blocked", asn)
+	}
+
+	return ""
+}
+
+// logGeoBlock records a request blocked by the geo policy of a site
+func logGeoBlock(r *http.Request, site *models.Site, reason string) {
+	if wafLogService == nil {
+		return
+	}
+
+	decision := &services.Decision{
+		Source:   "geo",
+		Message:  reason,
+		Severity: "WARNING",
+		Category: "geo-blocking",
+	}
+	wafLogService.LogDecisionEvent(r, decision, "blocked", http.StatusForbidden, http.StatusForbidden, site.ID, site.Domain)
+}
+
+// setGeoVariables exposes the GeoIP data of the client as GEO:COUNTRY_CODE, GEO:COUNTRY_NAME,
+// GEO:COUNTRY_CONTINENT, GEO:REGION, GEO:CITY, GEO:POSTAL_CODE, GEO:LATITUDE, GEO:LONGITUDE,
+// GEO:ASN and GEO:ASN_ORG
+func setGeoVariables(tx types.Transaction, r *http.Request) {
+	info := services.GeoInfoFromRequest(r)
+	if info == nil {
+		return
+	}
+	state, ok := tx.(plugintypes.TransactionState)
+	if !ok {
+		return
+	}
+
+	variables := state.Variables().Geo()
+	for key, value := range map[string]string{
+		"COUNTRY_CODE":      info.CountryCode,
+		"COUNTRY_NAME":      info.CountryName,
+		"COUNTRY_CONTINENT": info.ContinentCode,
+		"REGION":            info.Region,
+		"CITY":              info.City,
+		"POSTAL_CODE":       info.PostalCode,
+		"ASN_ORG":           info.ASOrg,
+	} {
+		if value != "" {
+			variables.Set(key, []string{value})
+		}
+	}
+	if info.Latitude != 0 || info.Longitude != 0 {
+		variables.Set("LATITUDE", []string{strconv.FormatFloat(info.Latitude, 'f', -1, 64)})
+		variables.Set("LONGITUDE", []string{strconv.FormatFloat(info.Longitude, 'f', -1, 64)})
+	}
+	if info.ASN != 0 {
+		variables.Set("ASN", []string{strconv.FormatUint(uint64(info.ASN), 10)})
+	}
+}
@@ -0,0 +1,564 @@
+package proxy
+
+import (
+	"SeproWAF/models"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/beego/beego/v2/client/orm"
+	"github.com/beego/beego/v2/core/logs"
+	"github.com/corazawaf/coraza/v3"
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+	"github.com/corazawaf/coraza/v3/types"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+const (
+	// grpcFrameHeaderSize is the size of the compressed flag and length prefix of a gRPC message
+	grpcFrameHeaderSize = 5
+
+	// maxGRPCInspectedMessage caps the size of the request messages decoded for the WAF,
+	// the site's gRPC settings decide about larger ones. It matches gRPC's default limit.
+	maxGRPCInspectedMessage = 4 << 20
+
+	// maxGRPCArgs caps the number of message fields added to ARGS
+	maxGRPCArgs = 1000
+)
+
+// gRPC status codes used for blocked calls
+const (
+	grpcStatusPermissionDenied  = 7
+	grpcStatusResourceExhausted = 8
+	grpcStatusUnimplemented     = 12
+	grpcStatusUnauthenticated   = 16
+)
+
+var (
+	// errGRPCMessageTooLarge is returned for messages over maxGRPCInspectedMessage, compressed or not
+	errGRPCMessageTooLarge = errors.New("gRPC message is too large to inspect")
+
+	// errGRPCMessageEncoding is returned for compressed messages that are not valid gzip
+	errGRPCMessageEncoding = errors.New("gRPC message encoding can't be inspected")
+)
+
+// grpcRejectedError ends a gRPC call whose request message was blocked or could not be inspected
+type grpcRejectedError struct {
+	code       int    // gRPC status code sent to the client
+	httpStatus int    // Status recorded in the WAF log
+	message    string // grpc-message sent to the client
+}
+
+func (e *grpcRejectedError) Error() string {
+	return "gRPC call rejected: " + e.message
+}
+
+// grpcUninspectable checks if err reports a message the WAF could not inspect. If so, it returns
+// the rejection to answer with, or nil when the site's settings let such messages through.
+func grpcUninspectable(err error, settings models.GRPCSettings) (*grpcRejectedError, bool) {
+	switch {
+	case errors.Is(err, errGRPCMessageTooLarge):
+		if settings.OversizedMessages == models.GRPCUninspectableAllow {
+			return nil, true
+		}
+		return &grpcRejectedError{
+			code:       grpcStatusResourceExhausted,
+			httpStatus: http.StatusRequestEntityTooLarge,
+			message:    "Request message is too large to inspect",
+		}, true
+	case errors.Is(err, errGRPCMessageEncoding):
+		if settings.UnsupportedEncoding == models.GRPCUninspectableAllow {
+			return nil, true
+		}
+		return &grpcRejectedError{
+			code:       grpcStatusUnimplemented,
+			httpStatus: http.StatusUnsupportedMediaType,
+			message:    "Request message encoding is not supported",
+		}, true
+	}
+	return nil, false
+}
+
+// isGRPCRequest checks if the request is a gRPC or binary gRPC-Web call
+func isGRPCRequest(r *http.Request) bool {
+	contentType := strings.ToLower(r.Header.Get("Content-Type"))
+	if r.Method != http.MethodPost || strings.HasPrefix(contentType, "application/grpc-web-text") {
+		return false
+	}
+	return strings.HasPrefix(contentType, "application/grpc")
+}
+
+// grpcContentType returns the content type of responses to a gRPC or gRPC-Web call
+func grpcContentType(r *http.Request) string {
+	if strings.HasPrefix(strings.ToLower(r.Header.Get("Content-Type")), "application/grpc-web") {
+		return "application/grpc-web"
+	}
+	return "application/grpc"
+}
+
+// parseGRPCPath splits a gRPC request path of the form /package.Service/Method
+func parseGRPCPath(path string) (service, method string, ok bool) {
+	service, method, ok = strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	if !ok || service == "" || method == "" || strings.Contains(method, "/") {
+		return "", "", false
+	}
+	return service, method, true
+}
+
+// setGRPCVariables exposes the service and method of a gRPC call as TX:grpc_service and TX:grpc_method
+func setGRPCVariables(tx types.Transaction, service, method string) {
+	state, ok := tx.(plugintypes.TransactionState)
+	if !ok {
+		return
+	}
+	variables := state.Variables().TX()
+	variables.Set("grpc_service", []string{service})
+	variables.Set("grpc_method", []string{method})
+}
+
+// readGRPCMessage reads the next length-prefixed message of a gRPC request body. It returns
+// the bytes read, which must be replayed to the upstream, and the decompressed message, which
+// is nil for an empty or truncated body. Messages that can't be inspected are reported with
+// errGRPCMessageTooLarge, after reading only their header, or errGRPCMessageEncoding.
+func readGRPCMessage(body io.Reader, encoding string) (raw []byte, message []byte, err error) {
+	header := make([]byte, grpcFrameHeaderSize)
+	n, err := io.ReadFull(body, header)
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			// Empty or truncated body, the upstream reports the error
+			return header[:n], nil, nil
+		}
+		return header[:n], nil, err
+	}
+
+	compressed := header[0] == 1
+	length := binary.BigEndian.Uint32(header[1:])
+	if length > maxGRPCInspectedMessage {
+		return header, nil, errGRPCMessageTooLarge
+	}
+
+	raw = make([]byte, grpcFrameHeaderSize+int(length))
+	copy(raw, header)
+	n, err = io.ReadFull(body, raw[grpcFrameHeaderSize:])
+	if err != nil {
+		raw = raw[:grpcFrameHeaderSize+n]
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return raw, nil, nil
+		}
+		return raw, nil, err
+	}
+
+	message = raw[grpcFrameHeaderSize:]
+	if !compressed {
+		return raw, message, nil
+	}
+
+	if !strings.EqualFold(encoding, "gzip") {
+		return raw, nil, errGRPCMessageEncoding
+	}
+
+	reader, err := gzip.NewReader(bytes.NewReader(message))
+	if err != nil {
+		return raw, nil, errGRPCMessageEncoding
+	}
+	message, err = io.ReadAll(io.LimitReader(reader, maxGRPCInspectedMessage+1))
+	if err != nil {
+		return raw, nil, errGRPCMessageEncoding
+	}
+	if len(message) > maxGRPCInspectedMessage {
+		return raw, nil, errGRPCMessageTooLarge
+	}
+	return raw, message, nil
+}
+
+// grpcFrameRemaining returns how many payload bytes of the message starting with raw are still unread
+func grpcFrameRemaining(raw []byte) uint64 {
+	if len(raw) < grpcFrameHeaderSize {
+		return 0
+	}
+	length := uint64(binary.BigEndian.Uint32(raw[1:grpcFrameHeaderSize]))
+	return length - uint64(len(raw)-grpcFrameHeaderSize)
+}
+
+// inspectGRPCMessage feeds the first message of a gRPC call into the transaction. It returns the
+// bytes read from the body, and errGRPCMessageTooLarge or errGRPCMessageEncoding for messages
+// that could not be inspected.
+func (wm *WAFManager) inspectGRPCMessage(tx types.Transaction, r *http.Request, siteID int, service, method string) ([]byte, *types.Interruption, error) {
+	raw, message, err := readGRPCMessage(r.Body, r.Header.Get("Grpc-Encoding"))
+	if err != nil || message == nil {
+		return raw, nil, err
+	}
+
+	it, err := wm.writeGRPCMessage(tx, siteID, service, method, message)
+	return raw, it, err
+}
+
+// writeGRPCMessage writes a request message to the transaction body, decoding its fields into
+// ARGS when the site has a descriptor set
+func (wm *WAFManager) writeGRPCMessage(tx types.Transaction, siteID int, service, method string, message []byte) (*types.Interruption, error) {
+	if !tx.IsRequestBodyAccessible() {
+		return nil, nil
+	}
+
+	if it, _, err := tx.WriteRequestBody(message); it != nil || err != nil {
+		return it, err
+	}
+
+	files := wm.getGRPCDescriptors(siteID)
+	if files == nil {
+		return nil, nil
+	}
+
+	input, err := grpcInputDescriptor(files, service, method)
+	if err != nil {
+		logs.Debug("gRPC message of %s/%s not decoded: %v", service, method, err)
+		return nil, nil
+	}
+
+	msg := dynamicpb.NewMessage(input)
+	if err := proto.Unmarshal(message, msg); err != nil {
+		logs.Debug("Failed to decode gRPC message of %s/%s: %v", service, method, err)
+		return nil, nil
+	}
+
+	count := 0
+	addGRPCMessageArgs("", msg, func(name, value string) {
+		if count < maxGRPCArgs {
+			tx.AddPostRequestArgument(name, value)
+			count++
+		}
+	})
+	return nil, nil
+}
+
+// inspectGRPCStreamMessage runs a later message of a client stream through its own transaction,
+// like the messages of WebSocket connections. It returns the rejection if the WAF blocked it.
+func (wm *WAFManager) inspectGRPCStreamMessage(waf coraza.WAF, r *http.Request, siteID int, siteDomain, service, method string, message []byte) *grpcRejectedError {
+	startTime := time.Now()
+
+	tx := waf.NewTransaction()
+	defer func() {
+		tx.ProcessLogging()
+		tx.Close()
+	}()
+
+	processConnection(tx, r)
+	setFingerprintVariables(tx, r)
+	setGeoVariables(tx, r)
+	tx.ProcessURI(r.URL.String(), r.Method, r.Proto)
+	tx.AddRequestHeader("Host", r.Host)
+	tx.AddRequestHeader("X-Real-IP", clientIP(r))
+	setGRPCVariables(tx, service, method)
+	for name, values := range r.Header {
+		for _, value := range values {
+			tx.AddRequestHeader(name, value)
+		}
+	}
+	tx.ProcessRequestHeaders()
+
+	if tx.Interruption() == nil {
+		if _, err := wm.writeGRPCMessage(tx, siteID, service, method, message); err != nil {
+			logs.Error("WAF gRPC message processing error: %v", err)
+		}
+		if _, err := tx.ProcessRequestBody(); err != nil {
+			logs.Error("WAF gRPC message processing error: %v", err)
+		}
+	}
+
+	intervention := tx.Interruption()
+	if intervention == nil {
+		return nil
+	}
+
+	logs.Warning("WAF blocked gRPC stream message of %s/%s to %s: %s (rule: %d)",
+		service, method, siteDomain, intervention.Action, intervention.RuleID)
+
+	wafLogService.LogWAFEvent(
+		tx,
+		r,
+		"blocked",
+		intervention.Status,
+		intervention.Status,
+		0,
+		time.Since(startTime),
+		siteID,
+		siteDomain,
+	)
+
+	return &grpcRejectedError{
+		code:       grpcStatusFromHTTP(intervention.Status),
+		httpStatus: intervention.Status,
+		message:    "The WAF has blocked this request due to a security violation in the body content",
+	}
+}
+
+// grpcStreamBody forwards the request body of a gRPC call after its first message. Every further
+// message of a client stream is inspected before it is forwarded; a rejected message ends the body
+// with a *grpcRejectedError, which makes the proxy answer with its gRPC status.
+type grpcStreamBody struct {
+	body     io.ReadCloser
+	pending  []byte // Bytes read from the body but not forwarded yet
+	skip     uint64 // Bytes of an uninspected message still to forward as they are
+	encoding string
+	settings models.GRPCSettings
+	inspect  func(message []byte) *grpcRejectedError
+	err      error // Returned once the pending bytes are forwarded
+}
+
+// newGRPCStreamBody continues a body after the bytes of its first message that were read already
+func newGRPCStreamBody(first []byte, body io.ReadCloser, encoding string, settings models.GRPCSettings, inspect func(message []byte) *grpcRejectedError) *grpcStreamBody {
+	return &grpcStreamBody{
+		body:     body,
+		pending:  first,
+		skip:     grpcFrameRemaining(first),
+		encoding: encoding,
+		settings: settings,
+		inspect:  inspect,
+	}
+}
+
+func (b *grpcStreamBody) Read(p []byte) (int, error) {
+	for {
+		if len(b.pending) > 0 {
+			n := copy(p, b.pending)
+			b.pending = b.pending[n:]
+			return n, nil
+		}
+		if b.err != nil {
+			return 0, b.err
+		}
+
+		if b.skip > 0 {
+			if uint64(len(p)) > b.skip {
+				p = p[:b.skip]
+			}
+			n, err := b.body.Read(p)
+			b.skip -= uint64(n)
+			return n, err
+		}
+
+		raw, message, err := readGRPCMessage(b.body, b.encoding)
+		if rejection, ok := grpcUninspectable(err, b.settings); ok {
+			if rejection != nil {
+				b.err = rejection
+				continue
+			}
+			// Forwarded uninspected as the site allows
+			b.pending = raw
+			b.skip = grpcFrameRemaining(raw)
+			continue
+		}
+
+		switch {
+		case err != nil:
+			b.pending = raw
+			b.err = err
+		case len(raw) == 0:
+			b.err = io.EOF
+		case message != nil:
+			if rejection := b.inspect(message); rejection != nil {
+				b.err = rejection
+				continue
+			}
+			b.pending = raw
+		default:
+			// Truncated message, the upstream reports the error
+			b.pending = raw
+			b.err = io.EOF
+		}
+	}
+}
+
+func (b *grpcStreamBody) Close() error {
+	return b.body.Close()
+}
+
+// grpcInputDescriptor looks up the request message type of a method
+func grpcInputDescriptor(files *protoregistry.Files, service, method string) (protoreflect.MessageDescriptor, error) {
+	descriptor, err := files.FindDescriptorByName(protoreflect.FullName(service))
+	if err != nil {
+		return nil, err
+	}
+	sd, ok := descriptor.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a service", service)
+	}
+	md := sd.Methods().ByName(protoreflect.Name(method))
+	if md == nil {
+		return nil, fmt.Errorf("service %s has no method %s", service, method)
+	}
+	return md.Input(), nil
+}
+
+// addGRPCMessageArgs adds the set fields of a message, named by their dotted path
+func addGRPCMessageArgs(prefix string, msg protoreflect.Message, add func(name, value string)) {
+	msg.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		name := string(fd.Name())
+		if prefix != "" {
+			name = prefix + "." + name
+		}
+
+		switch {
+		case fd.IsList():
+			list := v.List()
+			for i := 0; i < list.Len(); i++ {
+				addGRPCFieldArg(name, fd, list.Get(i), add)
+			}
+		case fd.IsMap():
+			v.Map().Range(func(key protoreflect.MapKey, value protoreflect.Value) bool {
+				addGRPCFieldArg(name+"."+key.String(), fd.MapValue(), value, add)
+				return true
+			})
+		default:
+			addGRPCFieldArg(name, fd, v, add)
+		}
+		return true
+	})
+}
+
+// addGRPCFieldArg adds a single field value, recursing into nested messages
+func addGRPCFieldArg(name string, fd protoreflect.FieldDescriptor, v protoreflect.Value, add func(name, value string)) {
+	switch fd.Kind() {
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		addGRPCMessageArgs(name, v.Message(), add)
+	case protoreflect.EnumKind:
+		if ev := fd.Enum().Values().ByNumber(v.Enum()); ev != nil {
+			add(name, string(ev.Name()))
+		} else {
+			add(name, strconv.Itoa(int(v.Enum())))
+		}
+	case protoreflect.BytesKind:
+		add(name, string(v.Bytes()))
+	default:
+		add(name, v.String())
+	}
+}
+
+// ParseGRPCDescriptorSet parses a serialized FileDescriptorSet and returns the services it defines.
+// The set must include its imports (protoc --include_imports).
+func ParseGRPCDescriptorSet(data []byte) (*protoregistry.Files, []string, error) {
+	set := &descriptorpb.FileDescriptorSet{}
+	if err := proto.Unmarshal(data, set); err != nil {
+		return nil, nil, fmt.Errorf("invalid descriptor set: %v", err)
+	}
+
+	files, err := protodesc.NewFiles(set)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid descriptor set: %v", err)
+	}
+
+	services := make([]string, 0)
+	files.RangeFiles(func(fd protoreflect.FileDescriptor) bool {
+		for i := 0; i < fd.Services().Len(); i++ {
+			services = append(services, string(fd.Services().Get(i).FullName()))
+		}
+		return true
+	})
+	sort.Strings(services)
+
+	return files, services, nil
+}
+
+// getGRPCDescriptors returns the parsed descriptor set of a site, or nil if none was uploaded
+func (wm *WAFManager) getGRPCDescriptors(siteID int) *protoregistry.Files {
+	wm.mutex.RLock()
+	files, exists := wm.grpcDescriptors[siteID]
+	wm.mutex.RUnlock()
+
+	if exists {
+		return files
+	}
+
+	set, err := models.GetGRPCDescriptorSetBySiteID(siteID)
+	switch {
+	case err == orm.ErrNoRows:
+		files = nil
+	case err != nil:
+		// Try again on the next call
+		logs.Error("Failed to load gRPC descriptor set for site %d: %v", siteID, err)
+		return nil
+	default:
+		files, err = loadGRPCDescriptorSet(set)
+		if err != nil {
+			logs.Error("Failed to parse gRPC descriptor set for site %d: %v", siteID, err)
+		}
+	}
+
+	wm.mutex.Lock()
+	wm.grpcDescriptors[siteID] = files
+	wm.mutex.Unlock()
+
+	return files
+}
+
+// loadGRPCDescriptorSet parses a stored descriptor set
+func loadGRPCDescriptorSet(set *models.GRPCDescriptorSet) (*protoregistry.Files, error) {
+	data, err := set.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	files, _, err := ParseGRPCDescriptorSet(data)
+	return files, err
+}
+
+// ReloadGRPCDescriptors drops the cached descriptor set of a site, it is loaded again on the next call
+func (wm *WAFManager) ReloadGRPCDescriptors(siteID int) {
+	wm.mutex.Lock()
+	defer wm.mutex.Unlock()
+
+	delete(wm.grpcDescriptors, siteID)
+}
+
+// grpcStatusFromHTTP maps the status of a WAF interruption to a gRPC status code
+func grpcStatusFromHTTP(status int) int {
+	switch status {
+	case http.StatusUnauthorized:
+		return grpcStatusUnauthenticated
+	case http.StatusTooManyRequests:
+		return grpcStatusResourceExhausted
+	default:
+		return grpcStatusPermissionDenied
+	}
+}
+
+// serveGRPCError answers a blocked gRPC call with a Trailers-Only response, which carries
+// grpc-status and grpc-message in the only HEADERS frame as the gRPC protocol allows
+func serveGRPCError(w http.ResponseWriter, contentType string, status int, message string) {
+	serveGRPCStatus(w, contentType, grpcStatusFromHTTP(status), message)
+}
+
+// serveGRPCStatus answers a gRPC call with a Trailers-Only response carrying the given status code
+func serveGRPCStatus(w http.ResponseWriter, contentType string, code int, message string) {
+	header := w.Header()
+	header.Set("Content-Type", contentType)
+	header.Set("Grpc-Status", strconv.Itoa(code))
+	header.Set("Grpc-Message", encodeGRPCMessage(message))
+	w.WriteHeader(http.StatusOK)
+}
+
+// encodeGRPCMessage percent-encodes a grpc-message value
+func encodeGRPCMessage(message string) string {
+	var sb strings.Builder
+	for i := 0; i < len(message); i++ {
+		c := message[i]
+		if c >= 0x20 && c <= 0x7e && c != '%' {
+			sb.WriteByte(c)
+		} else {
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,538 @@
+package proxy
+
+import (
+	"SeproWAF/models"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// grpcFrame encodes a length-prefixed gRPC message
+func grpcFrame(compressed bool, message []byte) []byte {
+	frame := []byte{0}
+	if compressed {
+		frame[0] = 1
+	}
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(message)))
+	return append(frame, message...)
+}
+
+func gzipBytes(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestReadGRPCMessage(t *testing.T) {
+	hello := []byte("hello")
+	compressed := gzipBytes(t, hello)
+	bomb := gzipBytes(t, make([]byte, maxGRPCInspectedMessage+1))
+	oversized := binary.BigEndian.AppendUint32([]byte{0}, maxGRPCInspectedMessage+1)
+
+	tests := []struct {
+		name        string
+		body        []byte
+		encoding    string
+		wantRaw     []byte
+		wantMessage []byte
+		wantErr     error
+	}{
+		{"plain message", grpcFrame(false, hello), "", grpcFrame(false, hello), hello, nil},
+		{"empty message", grpcFrame(false, nil), "", grpcFrame(false, nil), []byte{}, nil},
+		{"only the first message", append(grpcFrame(false, hello), grpcFrame(false, []byte("next"))...), "", grpcFrame(false, hello), hello, nil},
+		{"gzip message", grpcFrame(true, compressed), "gzip", grpcFrame(true, compressed), hello, nil},
+		{"gzip encoding is case insensitive", grpcFrame(true, compressed), "GZIP", grpcFrame(true, compressed), hello, nil},
+		{"uncompressed message with an encoding", grpcFrame(false, hello), "snappy", grpcFrame(false, hello), hello, nil},
+		{"empty body", nil, "", []byte{}, nil, nil},
+		{"truncated header", grpcFrame(false, hello)[:3], "", grpcFrame(false, hello)[:3], nil, nil},
+		{"truncated payload", grpcFrame(false, hello)[:7], "", grpcFrame(false, hello)[:7], nil, nil},
+		{"oversized message", append(oversized, "payload"...), "", oversized, nil, errGRPCMessageTooLarge},
+		{"unsupported encoding", grpcFrame(true, hello), "snappy", grpcFrame(true, hello), nil, errGRPCMessageEncoding},
+		{"missing encoding", grpcFrame(true, compressed), "", grpcFrame(true, compressed), nil, errGRPCMessageEncoding},
+		{"corrupt gzip", grpcFrame(true, hello), "gzip", grpcFrame(true, hello), nil, errGRPCMessageEncoding},
+		{"truncated gzip", grpcFrame(true, compressed[:len(compressed)-4]), "gzip", grpcFrame(true, compressed[:len(compressed)-4]), nil, errGRPCMessageEncoding},
+		{"gzip bomb", grpcFrame(true, bomb), "gzip", grpcFrame(true, bomb), nil, errGRPCMessageTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, message, err := readGRPCMessage(bytes.NewReader(tt.body), tt.encoding)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if !bytes.Equal(raw, tt.wantRaw) {
+				t.Errorf("raw = %.40q, want %.40q", raw, tt.wantRaw)
+			}
+			if !bytes.Equal(message, tt.wantMessage) || (message == nil) != (tt.wantMessage == nil) {
+				t.Errorf("message = %.40q, want %.40q", message, tt.wantMessage)
+			}
+		})
+	}
+}
+
+func TestReadGRPCMessageReadError(t *testing.T) {
+	failure := errors.New("connection reset")
+	body := io.MultiReader(bytes.NewReader(grpcFrame(false, []byte("hello"))[:7]), &failingReader{err: failure})
+	if _, _, err := readGRPCMessage(body, ""); !errors.Is(err, failure) {
+		t.Fatalf("err = %v, want the read error", err)
+	}
+}
+
+type failingReader struct {
+	err error
+}
+
+func (r *failingReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
+
+func TestGRPCFrameRemaining(t *testing.T) {
+	frame := grpcFrame(false, []byte("hello"))
+	tests := []struct {
+		raw  []byte
+		want uint64
+	}{
+		{frame, 0},
+		{frame[:7], 3},
+		{frame[:5], 5},
+		{frame[:3], 0},
+		{nil, 0},
+	}
+
+	for _, tt := range tests {
+		if got := grpcFrameRemaining(tt.raw); got != tt.want {
+			t.Errorf("grpcFrameRemaining(%q) = %d, want %d", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestGRPCUninspectable(t *testing.T) {
+	reject := models.DefaultSiteSettings().GRPC
+	allow := models.GRPCSettings{
+		OversizedMessages:   models.GRPCUninspectableAllow,
+		UnsupportedEncoding: models.GRPCUninspectableAllow,
+	}
+
+	tests := []struct {
+		name     string
+		err      error
+		settings models.GRPCSettings
+		wantOK   bool
+		wantCode int
+	}{
+		{"inspected", nil, reject, false, 0},
+		{"read error", io.ErrClosedPipe, reject, false, 0},
+		{"oversized rejected", errGRPCMessageTooLarge, reject, true, grpcStatusResourceExhausted},
+		{"encoding rejected", errGRPCMessageEncoding, reject, true, grpcStatusUnimplemented},
+		{"oversized allowed", errGRPCMessageTooLarge, allow, true, 0},
+		{"encoding allowed", errGRPCMessageEncoding, allow, true, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rejection, ok := grpcUninspectable(tt.err, tt.settings)
+			if ok != tt.wantOK {
+				t.Fatalf("ok = %v, want %v", ok, tt.wantOK)
+			}
+			code := 0
+			if rejection != nil {
+				code = rejection.code
+			}
+			if code != tt.wantCode {
+				t.Errorf("code = %d, want %d", code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestGRPCStreamBody(t *testing.T) {
+	reject := models.DefaultSiteSettings().GRPC
+	allow := models.GRPCSettings{
+		OversizedMessages:   models.GRPCUninspectableAllow,
+		UnsupportedEncoding: models.GRPCUninspectableAllow,
+	}
+	blocked := &grpcRejectedError{code: grpcStatusPermissionDenied, message: "blocked"}
+
+	first := grpcFrame(false, []byte("first"))
+	second := grpcFrame(false, []byte("second"))
+	attack := grpcFrame(false, []byte("attack"))
+	oversized := append(binary.BigEndian.AppendUint32([]byte{0}, maxGRPCInspectedMessage+1), make([]byte, maxGRPCInspectedMessage+1)...)
+	snappy := grpcFrame(true, []byte("snappy"))
+
+	tests := []struct {
+		name      string
+		read      int // Bytes of the stream read before the body is wrapped
+		stream    []byte
+		settings  models.GRPCSettings
+		wantBody  []byte
+		wantSeen  []string
+		wantError error
+	}{
+		{
+			name:     "later messages are inspected",
+			read:     len(first),
+			stream:   concatFrames(first, second, grpcFrame(false, []byte("third"))),
+			settings: reject,
+			wantBody: concatFrames(first, second, grpcFrame(false, []byte("third"))),
+			wantSeen: []string{"second", "third"},
+		},
+		{
+			name:      "blocked message ends the body",
+			read:      len(first),
+			stream:    concatFrames(first, attack, second),
+			settings:  reject,
+			wantBody:  first,
+			wantSeen:  []string{"attack"},
+			wantError: blocked,
+		},
+		{
+			name:     "rest of a partly read message passes through",
+			read:     len(first) - 2,
+			stream:   concatFrames(first, second),
+			settings: reject,
+			wantBody: concatFrames(first, second),
+			wantSeen: []string{"second"},
+		},
+		{
+			name:      "oversized message rejected",
+			read:      len(first),
+			stream:    concatFrames(first, oversized),
+			settings:  reject,
+			wantBody:  first,
+			wantError: &grpcRejectedError{code: grpcStatusResourceExhausted},
+		},
+		{
+			name:     "oversized message allowed",
+			read:     len(first),
+			stream:   concatFrames(first, oversized, second),
+			settings: allow,
+			wantBody: concatFrames(first, oversized, second),
+			wantSeen: []string{"second"},
+		},
+		{
+			name:      "unsupported encoding rejected",
+			read:      len(first),
+			stream:    concatFrames(first, snappy),
+			settings:  reject,
+			wantBody:  first,
+			wantError: &grpcRejectedError{code: grpcStatusUnimplemented},
+		},
+		{
+			name:     "unsupported encoding allowed",
+			read:     len(first),
+			stream:   concatFrames(first, snappy, second),
+			settings: allow,
+			wantBody: concatFrames(first, snappy, second),
+			wantSeen: []string{"second"},
+		},
+		{
+			name:     "truncated message is forwarded",
+			read:     len(first),
+			stream:   concatFrames(first, second[:8]),
+			settings: reject,
+			wantBody: concatFrames(first, second[:8]),
+		},
+		{
+			name:     "empty first read",
+			read:     0,
+			stream:   second,
+			settings: reject,
+			wantBody: second,
+			wantSeen: []string{"second"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var seen []string
+			inspect := func(message []byte) *grpcRejectedError {
+				seen = append(seen, string(message))
+				if string(message) == "attack" {
+					return blocked
+				}
+				return nil
+			}
+
+			rest := io.NopCloser(bytes.NewReader(tt.stream[tt.read:]))
+			body := newGRPCStreamBody(tt.stream[:tt.read:tt.read], rest, "snappy", tt.settings, inspect)
+
+			var got bytes.Buffer
+			_, err := io.CopyBuffer(&got, body, make([]byte, 1000))
+
+			var rejected, want *grpcRejectedError
+			switch {
+			case tt.wantError == nil && err != nil:
+				t.Fatalf("read error %v", err)
+			case tt.wantError != nil && !errors.As(err, &rejected):
+				t.Fatalf("err = %v, want a rejection", err)
+			case errors.As(tt.wantError, &want) && rejected.code != want.code:
+				t.Fatalf("rejected with code %d, want %d", rejected.code, want.code)
+			}
+			if !bytes.Equal(got.Bytes(), tt.wantBody) {
+				t.Errorf("forwarded %d bytes, want %d", got.Len(), len(tt.wantBody))
+			}
+			if strings.Join(seen, ",") != strings.Join(tt.wantSeen, ",") {
+				t.Errorf("inspected %q, want %q", seen, tt.wantSeen)
+			}
+		})
+	}
+}
+
+func TestParseGRPCPath(t *testing.T) {
+	tests := []struct {
+		path        string
+		wantService string
+		wantMethod  string
+		wantOK      bool
+	}{
+		{"/helloworld.Greeter/SayHello", "helloworld.Greeter", "SayHello", true},
+		{"/Greeter/SayHello", "Greeter", "SayHello", true},
+		{"/helloworld.Greeter/", "", "", false},
+		{"//SayHello", "", "", false},
+		{"/helloworld.Greeter", "", "", false},
+		{"/a/b/c", "", "", false},
+		{"/", "", "", false},
+		{"", "", "", false},
+	}
+
+	for _, tt := range tests {
+		service, method, ok := parseGRPCPath(tt.path)
+		if service != tt.wantService || method != tt.wantMethod || ok != tt.wantOK {
+			t.Errorf("parseGRPCPath(%q) = %q, %q, %v, want %q, %q, %v",
+				tt.path, service, method, ok, tt.wantService, tt.wantMethod, tt.wantOK)
+		}
+	}
+}
+
+func TestIsGRPCRequest(t *testing.T) {
+	tests := []struct {
+		method      string
+		contentType string
+		want        bool
+	}{
+		{http.MethodPost, "application/grpc", true},
+		{http.MethodPost, "application/grpc+proto", true},
+		{http.MethodPost, "Application/GRPC", true},
+		{http.MethodPost, "application/grpc-web+proto", true},
+		{http.MethodPost, "application/grpc-web-text", false},
+		{http.MethodGet, "application/grpc", false},
+		{http.MethodPost, "application/json", false},
+		{http.MethodPost, "", false},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, "/helloworld.Greeter/SayHello", nil)
+		r.Header.Set("Content-Type", tt.contentType)
+		if got := isGRPCRequest(r); got != tt.want {
+			t.Errorf("isGRPCRequest(%s, %q) = %v, want %v", tt.method, tt.contentType, got, tt.want)
+		}
+	}
+}
+
+func TestEncodeGRPCMessage(t *testing.T) {
+	tests := []struct {
+		message string
+		want    string
+	}{
+		{"Request blocked", "Request blocked"},
+		{"100% blocked", "100%25 blocked"},
+		{"line\nbreak", "line%0Abreak"},
+		{"café", "caf%C3%A9"},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		if got := encodeGRPCMessage(tt.message); got != tt.want {
+			t.Errorf("encodeGRPCMessage(%q) = %q, want %q", tt.message, got, tt.want)
+		}
+	}
+}
+
+func TestServeGRPCStatus(t *testing.T) {
+	w := httptest.NewRecorder()
+	serveGRPCStatus(w, "application/grpc", grpcStatusUnimplemented, "Request message encoding is not supported")
+
+	if w.Code != http.StatusOK {
+		t.Errorf("HTTP status = %d, want 200", w.Code)
+	}
+	if got := w.Header().Get("Grpc-Status"); got != "12" {
+		t.Errorf("grpc-status = %q, want 12", got)
+	}
+	if got := w.Header().Get("Content-Type"); got != "application/grpc" {
+		t.Errorf("content type = %q", got)
+	}
+}
+
+// testDescriptorSet describes a greeter service whose request has scalar, enum, bytes,
+// repeated, map and nested fields
+func testDescriptorSet() *descriptorpb.FileDescriptorSet {
+	field := func(name string, number int32, kind descriptorpb.FieldDescriptorProto_Type, label descriptorpb.FieldDescriptorProto_Label, typeName string) *descriptorpb.FieldDescriptorProto {
+		f := &descriptorpb.FieldDescriptorProto{
+			Name:   proto.String(name),
+			Number: proto.Int32(number),
+			Type:   kind.Enum(),
+			Label:  label.Enum(),
+		}
+		if typeName != "" {
+			f.TypeName = proto.String(typeName)
+		}
+		return f
+	}
+	optional := descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL
+	repeated := descriptorpb.FieldDescriptorProto_LABEL_REPEATED
+
+	return &descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{{
+		Name:    proto.String("greeter.proto"),
+		Package: proto.String("test"),
+		Syntax:  proto.String("proto3"),
+		EnumType: []*descriptorpb.EnumDescriptorProto{{
+			Name: proto.String("Mood"),
+			Value: []*descriptorpb.EnumValueDescriptorProto{
+				{Name: proto.String("MOOD_UNKNOWN"), Number: proto.Int32(0)},
+				{Name: proto.String("MOOD_HAPPY"), Number: proto.Int32(1)},
+			},
+		}},
+		MessageType: []*descriptorpb.DescriptorProto{
+			{
+				Name: proto.String("User"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					field("email", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, optional, ""),
+				},
+			},
+			{
+				Name: proto.String("HelloRequest"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					field("name", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, optional, ""),
+					field("count", 2, descriptorpb.FieldDescriptorProto_TYPE_INT32, optional, ""),
+					field("mood", 3, descriptorpb.FieldDescriptorProto_TYPE_ENUM, optional, ".test.Mood"),
+					field("data", 4, descriptorpb.FieldDescriptorProto_TYPE_BYTES, optional, ""),
+					field("tags", 5, descriptorpb.FieldDescriptorProto_TYPE_STRING, repeated, ""),
+					field("user", 6, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, optional, ".test.User"),
+					field("labels", 7, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, repeated, ".test.HelloRequest.LabelsEntry"),
+				},
+				NestedType: []*descriptorpb.DescriptorProto{{
+					Name: proto.String("LabelsEntry"),
+					Field: []*descriptorpb.FieldDescriptorProto{
+						field("key", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, optional, ""),
+						field("value", 2, descriptorpb.FieldDescriptorProto_TYPE_STRING, optional, ""),
+					},
+					Options: &descriptorpb.MessageOptions{MapEntry: proto.Bool(true)},
+				}},
+			},
+		},
+		Service: []*descriptorpb.ServiceDescriptorProto{{
+			Name: proto.String("Greeter"),
+			Method: []*descriptorpb.MethodDescriptorProto{{
+				Name:       proto.String("SayHello"),
+				InputType:  proto.String(".test.HelloRequest"),
+				OutputType: proto.String(".test.User"),
+			}},
+		}},
+	}}}
+}
+
+func TestParseGRPCDescriptorSet(t *testing.T) {
+	data, err := proto.Marshal(testDescriptorSet())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, services, err := ParseGRPCDescriptorSet(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(services, ",") != "test.Greeter" {
+		t.Errorf("services = %q, want test.Greeter", services)
+	}
+
+	if input, err := grpcInputDescriptor(files, "test.Greeter", "SayHello"); err != nil || input.FullName() != "test.HelloRequest" {
+		t.Errorf("input of SayHello = %v, %v", input, err)
+	}
+	for _, call := range [][2]string{{"test.Greeter", "SayGoodbye"}, {"test.Missing", "SayHello"}, {"test.User", "SayHello"}} {
+		if _, err := grpcInputDescriptor(files, call[0], call[1]); err == nil {
+			t.Errorf("grpcInputDescriptor(%s/%s) succeeded", call[0], call[1])
+		}
+	}
+
+	if _, _, err := ParseGRPCDescriptorSet([]byte("not a descriptor set")); err == nil {
+		t.Error("ParseGRPCDescriptorSet accepted garbage")
+	}
+}
+
+func TestAddGRPCMessageArgs(t *testing.T) {
+	data, err := proto.Marshal(testDescriptorSet())
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, _, err := ParseGRPCDescriptorSet(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input, err := grpcInputDescriptor(files, "test.Greeter", "SayHello")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Encode the request like a client would and decode it like the WAF does
+	msg := dynamicpb.NewMessage(input)
+	fields := input.Fields()
+	msg.Set(fields.ByName("name"), protoreflect.ValueOfString("' OR 1=1 --"))
+	msg.Set(fields.ByName("count"), protoreflect.ValueOfInt32(3))
+	msg.Set(fields.ByName("mood"), protoreflect.ValueOfEnum(1))
+	msg.Set(fields.ByName("data"), protoreflect.ValueOfBytes([]byte("<script>")))
+	tags := msg.Mutable(fields.ByName("tags")).List()
+	tags.Append(protoreflect.ValueOfString("a"))
+	tags.Append(protoreflect.ValueOfString("b"))
+	user := msg.Mutable(fields.ByName("user")).Message()
+	user.Set(user.Descriptor().Fields().ByName("email"), protoreflect.ValueOfString("x@example.com"))
+	labels := msg.Mutable(fields.ByName("labels")).Map()
+	labels.Set(protoreflect.ValueOfString("env").MapKey(), protoreflect.ValueOfString("prod"))
+
+	wire, err := proto.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := dynamicpb.NewMessage(input)
+	if err := proto.Unmarshal(wire, decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	addGRPCMessageArgs("", decoded, func(name, value string) {
+		got = append(got, name+"="+value)
+	})
+	sort.Strings(got)
+
+	want := []string{
+		"count=3",
+		"data=<script>",
+		"labels.env=prod",
+		"mood=MOOD_HAPPY",
+		"name=' OR 1=1 --",
+		"tags=a",
+		"tags=b",
+		"user.email=x@example.com",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("args:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
@@ -0,0 +1,284 @@
+package proxy
+
+import (
+	"SeproWAF/services"
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/beego/beego/v2/core/logs"
+)
+
+// backendHealth tracks the active and passive health state of a backend
+type backendHealth struct {
+	mutex         sync.RWMutex
+	healthy       bool      // Result of active probes
+	probeSuccess  int       // Consecutive successful probes
+	probeFailures int       // Consecutive failed probes
+	passiveFails  int       // Consecutive failed proxied requests
+	ejectedUntil  time.Time // Set by passive outlier detection
+	lastError     string
+	lastCheck     time.Time
+}
+
+// BackendHealth is the health snapshot of a backend exposed by the stats API
+type BackendHealth struct {
+	UpstreamID          int            `json:"upstream_id"`
+	URL                 string         `json:"url"`
+	Healthy             bool           `json:"healthy"`
+	Ejected             bool           `json:"ejected"`
+	EjectedUntil        *time.Time     `json:"ejected_until,omitempty"`
+	ConsecutiveFailures int            `json:"consecutive_failures"`
+	LastError           string         `json:"last_error,omitempty"`
+	LastCheck           *time.Time     `json:"last_check,omitempty"`
+	ActiveConnections   int64          `json:"active_connections"`
+	TotalRequests       int64          `json:"total_requests"`
+	CircuitBreaker      *BreakerStatus `json:"circuit_breaker,omitempty"`
+}
+
+// Available reports whether the backend can receive traffic
+func (b *Backend) Available() bool {
+	b.health.mutex.RLock()
+	defer b.health.mutex.RUnlock()
+
+	return b.health.healthy && time.Now().After(b.health.ejectedUntil)
+}
+
+// Health returns a snapshot of the backend health state
+func (b *Backend) Health() BackendHealth {
+	b.health.mutex.RLock()
+	defer b.health.mutex.RUnlock()
+
+	snapshot := BackendHealth{
+		UpstreamID:          b.ID(),
+		URL:                 b.URL.String(),
+		Healthy:             b.health.healthy,
+		ConsecutiveFailures: b.health.passiveFails,
+		LastError:           b.health.lastError,
+		ActiveConnections:   b.ActiveConnections(),
+		TotalRequests:       b.TotalRequests(),
+		CircuitBreaker:      b.breaker.status(),
+	}
+
+	if time.Now().Before(b.health.ejectedUntil) {
+		ejectedUntil := b.health.ejectedUntil
+		snapshot.Ejected = true
+		snapshot.EjectedUntil = &ejectedUntil
+	}
+
+	if !b.health.lastCheck.IsZero() {
+		lastCheck := b.health.lastCheck
+		snapshot.LastCheck = &lastCheck
+	}
+
+	return snapshot
+}
+
+// ReportSuccess records a successful proxied request for passive outlier detection
+func (b *Backend) ReportSuccess() {
+	b.health.mutex.Lock()
+	defer b.health.mutex.Unlock()
+
+	b.health.passiveFails = 0
+
+	// The first success after an ejection ended marks the recovery
+	if !b.health.ejectedUntil.IsZero() && time.Now().After(b.health.ejectedUntil) {
+		b.health.ejectedUntil = time.Time{}
+		b.logHealthChange("ejected", "healthy", "request succeeded after the ejection ended")
+	}
+}
+
+// ReportFailure records a 5xx response or connection error for passive outlier detection
+func (b *Backend) ReportFailure(reason string) {
+	if b.Upstream == nil || b.Upstream.MaxFails <= 0 {
+		return
+	}
+
+	b.health.mutex.Lock()
+	defer b.health.mutex.Unlock()
+
+	b.health.passiveFails++
+	b.health.lastError = reason
+
+	// Only eject once per failure streak
+	if b.health.passiveFails < b.Upstream.MaxFails || time.Now().Before(b.health.ejectedUntil) {
+		return
+	}
+
+	b.health.ejectedUntil = time.Now().Add(time.Duration(b.Upstream.EjectDuration) * time.Second)
+	b.health.passiveFails = 0
+	logs.Warning("Upstream %s of site %s ejected for %ds after %d consecutive failures: %s",
+		b.URL, b.siteDomain, b.Upstream.EjectDuration, b.Upstream.MaxFails, reason)
+	b.logHealthChange("healthy", "ejected",
+		fmt.Sprintf("%d consecutive failures, ejected for %ds: %s", b.Upstream.MaxFails, b.Upstream.EjectDuration, reason))
+}
+
+// recordProbe updates the active health state with the result of a probe
+func (b *Backend) recordProbe(err error) {
+	b.health.mutex.Lock()
+	defer b.health.mutex.Unlock()
+
+	b.health.lastCheck = time.Now()
+
+	if err != nil {
+		b.health.probeSuccess = 0
+		b.health.probeFailures++
+		b.health.lastError = err.Error()
+
+		if b.health.healthy && b.health.probeFailures >= b.Upstream.UnhealthyThreshold {
+			b.health.healthy = false
+			logs.Warning("Upstream %s of site %s marked unhealthy: %v", b.URL, b.siteDomain, err)
+			b.logHealthChange("healthy", "unhealthy",
+				fmt.Sprintf("%d failed health checks: %v", b.health.probeFailures, err))
+		}
+		return
+	}
+
+	b.health.probeFailures = 0
+	b.health.probeSuccess++
+
+	if !b.health.healthy && b.health.probeSuccess >= b.Upstream.HealthyThreshold {
+		b.health.healthy = true
+		b.health.lastError = ""
+		logs.Info("Upstream %s of site %s is healthy again", b.URL, b.siteDomain)
+		b.logHealthChange("unhealthy", "healthy",
+			fmt.Sprintf("%d successful health checks", b.health.probeSuccess))
+	}
+}
+
+// logHealthChange records a health state change of the backend as a log event
+func (b *Backend) logHealthChange(from, to, reason string) {
+	if wafLogService == nil {
+		return
+	}
+
+	// The event has no client request, it is logged against the upstream URL
+	req, err := http.NewRequest(http.MethodGet, b.URL.String(), nil)
+	if err != nil {
+		logs.Error("Failed to log health change of upstream %s: %v", b.URL, err)
+		return
+	}
+
+	severity := "WARNING"
+	if to == "healthy" {
+		severity = "NOTICE"
+	}
+	decision := &services.Decision{
+		Source:   "health",
+		Message:  fmt.Sprintf("Upstream %s changed from %s to %s: %s", b.URL, from, to, reason),
+		Severity: severity,
+		Category: "health",
+	}
+	wafLogService.LogDecisionEvent(req, decision, "health", 0, 0, b.siteID, b.siteDomain)
+}
+
+// probe performs a single active health check against the backend
+func (b *Backend) probe(client *http.Client) error {
+	target := *b.URL
+	target.Path = strings.TrimSuffix(target.Path, "/") + "/" + strings.TrimPrefix(b.Upstream.HealthCheckPath, "/")
+	target.RawPath = ""
+	target.RawQuery = ""
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(b.Upstream.HealthCheckTimeout)*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "SeproWAF-HealthCheck")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("health check returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// runHealthChecks probes the backend periodically until stop is closed
+func (b *Backend) runHealthChecks(client *http.Client, stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Duration(b.Upstream.HealthCheckInterval) * time.Second)
+	defer ticker.Stop()
+
+	b.recordProbe(b.probe(client))
+
+	for {
+		select {
+		case <-ticker.C:
+			b.recordProbe(b.probe(client))
+		case <-stop:
+			return
+		}
+	}
+}
+
+// startHealthChecks starts active health probes for backends that configure a health check path
+func startHealthChecks(backends []*Backend, stop <-chan struct{}) {
+	client := &http.Client{
+		// Redirects are treated as a healthy response
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	for _, backend := range backends {
+		if backend.Upstream == nil || backend.Upstream.HealthCheckPath == "" {
+			continue
+		}
+		go backend.runHealthChecks(client, stop)
+	}
+}
+
+// adoptBackend returns the matching backend of the previous configuration if it is
+// unchanged, so that health state and connection counts survive the periodic site reloads
+func adoptBackend(backend *Backend, previous []*Backend) *Backend {
+	for _, old := range previous {
+		if sameBackendConfig(backend, old) {
+			return old
+		}
+	}
+	return backend
+}
+
+// sameBackendConfig checks if two backends were built from the same configuration
+func sameBackendConfig(a, b *Backend) bool {
+	if a.URL.String() != b.URL.String() || a.Weight != b.Weight {
+		return false
+	}
+	if a.Upstream == nil || b.Upstream == nil {
+		return a.Upstream == nil && b.Upstream == nil
+	}
+
+	// Compare the upstream settings, ignoring the timestamps
+	x, y := *a.Upstream, *b.Upstream
+	x.CreatedAt, x.UpdatedAt = time.Time{}, time.Time{}
+	y.CreatedAt, y.UpdatedAt = time.Time{}, time.Time{}
+	return x == y
+}
+
+// Close stops the health checks of the site proxy
+func (sp *SiteProxy) Close() {
+	sp.closeOnce.Do(func() {
+		close(sp.stopCh)
+		if sp.transport != nil {
+			sp.transport.CloseIdleConnections()
+		}
+	})
+}
+
+// UpstreamHealth returns the health snapshot of all backends of the site
+func (sp *SiteProxy) UpstreamHealth() []BackendHealth {
+	health := make([]BackendHealth, 0, len(sp.backends))
+	for _, backend := range sp.backends {
+		health = append(health, backend.Health())
+	}
+	return health
+}
@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/beego/beego/v2/core/logs"
+	"github.com/beego/beego/v2/server/web"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// loadHTTP3Port returns the UDP port of the HTTP/3 listener, or 0 when it is disabled
+func loadHTTP3Port(httpsPort int) int {
+	if !web.AppConfig.DefaultBool("ProxyHTTP3", false) {
+		return 0
+	}
+	return web.AppConfig.DefaultInt("ProxyHTTP3Port", httpsPort)
+}
+
+// newHTTP3Server creates the HTTP/3 server, requests go through the same handler as HTTP/1 and HTTP/2
+func newHTTP3Server(port int, handler http.Handler) *http3.Server {
+	return &http3.Server{
+		Addr:    fmt.Sprintf(":%d", port),
+		Handler: handler,
+	}
+}
+
+// serveHTTP3 runs the HTTP/3 server until it is shut down
+func (ps *ProxyServer) serveHTTP3() {
+	udpConn, err := net.ListenPacket("udp", ps.http3Server.Addr)
+	if err != nil {
+		logs.Error("HTTP/3 server error: %v", err)
+		return
+	}
+	defer udpConn.Close()
+
+	transport := &quic.Transport{
+		Conn: udpConn,
+		// Every connection gets a fingerprint, its ClientHello is filled in during the handshake
+		ConnContext: func(ctx context.Context, _ *quic.ClientInfo) (context.Context, error) {
+			return context.WithValue(ctx, connFingerprintContextKey{}, &connFingerprint{quic: true}), nil
+		},
+	}
+	defer transport.Close()
+
+	// Certificates and the ClientHello capture are shared with the HTTPS server
+	tlsConfig := http3.ConfigureTLSConfig(ps.tlsConfig)
+
+	ln, err := transport.ListenEarly(tlsConfig, &quic.Config{})
+	if err != nil {
+		logs.Error("HTTP/3 server error: %v", err)
+		return
+	}
+
+	logs.Info("HTTP/3 server listening on UDP %s", ps.http3Server.Addr)
+	if err := ps.http3Server.ServeListener(ln); err != nil && err != http.ErrServerClosed {
+		logs.Error("HTTP/3 server error: %v", err)
+	}
+}
+
+// setAltSvc advertises the HTTP/3 listener on responses to TLS requests
+func (ps *ProxyServer) setAltSvc(w http.ResponseWriter, r *http.Request) {
+	if ps.http3Server == nil || r.TLS == nil || r.ProtoMajor >= 3 {
+		return
+	}
+	w.Header().Set("Alt-Svc", fmt.Sprintf(`h3=":%d"; ma=86400`, ps.http3Port))
+}
@@ -0,0 +1,223 @@
+package proxy
+
+import (
+	"SeproWAF/models"
+	"SeproWAF/services"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/beego/beego/v2/core/logs"
+)
+
+// ipAccessRule is an entry of the IP access list as loaded into a trie
+type ipAccessRule struct {
+	prefix    netip.Prefix
+	mode      models.IPAccessMode
+	expiresAt time.Time // Zero when the entry does not expire
+}
+
+// ipTrieNode is a node of a path-compressed binary trie, holding the bits of its prefix
+type ipTrieNode struct {
+	prefix   netip.Prefix
+	rule     *ipAccessRule // Nil for nodes that only join their children
+	children [2]*ipTrieNode
+}
+
+// ipTrie is a radix trie finding the most specific network that contains an address
+type ipTrie struct {
+	v4, v6 *ipTrieNode
+}
+
+// root returns the root of the IPv4 or IPv6 tree
+func (t *ipTrie) root(addr netip.Addr) **ipTrieNode {
+	if addr.Is4() {
+		return &t.v4
+	}
+	return &t.v6
+}
+
+// insert adds a rule for its prefix, replacing the rule of an identical prefix
+func (t *ipTrie) insert(rule *ipAccessRule) {
+	prefix := rule.prefix
+	node := t.root(prefix.Addr())
+	for {
+		current := *node
+		if current == nil {
+			*node = &ipTrieNode{prefix: prefix, rule: rule}
+			return
+		}
+
+		common := commonPrefixBits(current.prefix, prefix)
+		if common == current.prefix.Bits() && common == prefix.Bits() {
+			current.rule = rule
+			return
+		}
+		if common == current.prefix.Bits() {
+			// The prefix lies below the current node
+			node = &current.children[addrBit(prefix.Addr(), common)]
+			continue
+		}
+
+		// The prefixes diverge, join them under their common prefix
+		split := &ipTrieNode{prefix: netip.PrefixFrom(prefix.Addr(), common).Masked()}
+		split.children[addrBit(current.prefix.Addr(), common)] = current
+		if common == prefix.Bits() {
+			split.rule = rule
+		} else {
+			split.children[addrBit(prefix.Addr(), common)] = &ipTrieNode{prefix: prefix, rule: rule}
+		}
+		*node = split
+		return
+	}
+}
+
+// lookup returns the rule of the most specific prefix containing the address that did not expire
+func (t *ipTrie) lookup(addr netip.Addr, now time.Time) *ipAccessRule {
+	var match *ipAccessRule
+	node := *t.root(addr)
+	for node != nil && node.prefix.Contains(addr) {
+		if node.rule != nil && (node.rule.expiresAt.IsZero() || now.Before(node.rule.expiresAt)) {
+			match = node.rule
+		}
+		if node.prefix.Bits() == addr.BitLen() {
+			break
+		}
+		node = node.children[addrBit(addr, node.prefix.Bits())]
+	}
+	return match
+}
+
+// addrBit returns the bit of the address at the given position, counted from the most significant bit
+func addrBit(addr netip.Addr, position int) int {
+	bytes := addr.AsSlice()
+	return int(bytes[position/8]>>(7-position%8)) & 1
+}
+
+// commonPrefixBits returns the number of leading bits two prefixes of the same family share
+func commonPrefixBits(a, b netip.Prefix) int {
+	limit := min(a.Bits(), b.Bits())
+	aBytes, bBytes := a.Addr().AsSlice(), b.Addr().AsSlice()
+
+	bits := 0
+	for i := range aBytes {
+		diff := aBytes[i] ^ bBytes[i]
+		if diff == 0 {
+			bits += 8
+		} else {
+			for diff&0x80 == 0 {
+				bits++
+				diff <<= 1
+			}
+			break
+		}
+		if bits >= limit {
+			break
+		}
+	}
+	return min(bits, limit)
+}
+
+// ipAccessList holds the global IP access list and the lists of the sites
+type ipAccessList struct {
+	mutex  sync.RWMutex
+	global *ipTrie
+	sites  map[int]*ipTrie
+}
+
+// newIPAccessList creates an empty IP access list
+func newIPAccessList() *ipAccessList {
+	return &ipAccessList{
+		global: &ipTrie{},
+		sites:  make(map[int]*ipTrie),
+	}
+}
+
+// load replaces the tries with the entries from the database that did not expire
+func (l *ipAccessList) load() error {
+	entries, err := models.GetActiveIPAccessEntries()
+	if err != nil {
+		return err
+	}
+
+	global := &ipTrie{}
+	sites := make(map[int]*ipTrie)
+	for _, entry := range entries {
+		prefix, err := models.ParseIPAccessPrefix(entry.CIDR)
+		if err != nil {
+			logs.Warning("Skipping IP access entry %d: %v", entry.ID, err)
+			continue
+		}
+
+		rule := &ipAccessRule{prefix: prefix, mode: entry.Mode}
+		if entry.ExpiresAt != nil {
+			rule.expiresAt = *entry.ExpiresAt
+		}
+
+		trie := global
+		if entry.SiteID != 0 {
+			if sites[entry.SiteID] == nil {
+				sites[entry.SiteID] = &ipTrie{}
+			}
+			trie = sites[entry.SiteID]
+		}
+		trie.insert(rule)
+	}
+
+	l.mutex.Lock()
+	l.global, l.sites = global, sites
+	l.mutex.Unlock()
+
+	logs.Info("Loaded %d IP access entries", len(entries))
+	return nil
+}
+
+// match returns the rule for a client of a site. Entries of the site take precedence over global ones.
+func (l *ipAccessList) match(siteID int, ip string) *ipAccessRule {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return nil
+	}
+	addr = addr.Unmap().WithZone("")
+	now := time.Now()
+
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	if trie, ok := l.sites[siteID]; ok {
+		if rule := trie.lookup(addr, now); rule != nil {
+			return rule
+		}
+	}
+	return l.global.lookup(addr, now)
+}
+
+// logIPAccess records a request that was denied or monitored by the IP access list
+func logIPAccess(r *http.Request, site *models.Site, rule *ipAccessRule, action string, statusCode int) {
+	if wafLogService == nil {
+		return
+	}
+
+	severity, blockStatus := "NOTICE", 0
+	if rule.mode == models.IPAccessDeny {
+		severity, blockStatus = "WARNING", statusCode
+	}
+	decision := &services.Decision{
+		Source:   "ip_access",
+		Message:  fmt.Sprintf("Client IP matches %s entry %s of the IP access list", rule.mode, rule.prefix),
+		Severity: severity,
+		Category: "ip-access",
+	}
+	wafLogService.LogDecisionEvent(r, decision, action, statusCode, blockStatus, site.ID, site.Domain)
+}
+
+// serveAccessDenied rejects a request before the WAF, with a gRPC status for gRPC calls
+func serveAccessDenied(w http.ResponseWriter, r *http.Request, message string) {
+	if isGRPCRequest(r) {
+		serveGRPCError(w, grpcContentType(r), http.StatusForbidden, message)
+		return
+	}
+	serveWAFErrorPage(w, "Access Denied", http.StatusForbidden, message)
+}
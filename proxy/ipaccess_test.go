@@ -0,0 +1,273 @@
+package proxy
+
+import (
+	"SeproWAF/models"
+	"math/rand"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func testIPRule(t *testing.T, cidr string, mode models.IPAccessMode) *ipAccessRule {
+	t.Helper()
+	prefix, err := models.ParseIPAccessPrefix(cidr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &ipAccessRule{prefix: prefix, mode: mode}
+}
+
+func TestIPTrieLookup(t *testing.T) {
+	cidrs := []string{
+		"10.0.0.0/8",
+		"10.1.0.0/16",
+		"10.1.2.0/24",
+		"10.1.2.3",
+		"192.168.0.0/16",
+		"192.168.128.0/17",
+		"172.16.0.0/12",
+		"0.0.0.0/1",
+		"2001:db8::/32",
+		"2001:db8:1::/48",
+		"2001:db8:1::1",
+		"fe80::/10",
+	}
+
+	tests := []struct {
+		ip   string
+		want string // CIDR of the expected rule, empty for no match
+	}{
+		{"10.200.0.1", "10.0.0.0/8"},
+		{"10.1.200.1", "10.1.0.0/16"},
+		{"10.1.2.4", "10.1.2.0/24"},
+		{"10.1.2.3", "10.1.2.3"},
+		{"10.1.3.3", "10.1.0.0/16"},
+		{"192.168.1.1", "192.168.0.0/16"},
+		{"192.168.200.1", "192.168.128.0/17"},
+		{"192.169.0.1", ""},
+		{"172.31.255.255", "172.16.0.0/12"},
+		{"172.32.0.0", ""},
+		{"127.0.0.1", "0.0.0.0/1"},
+		{"128.0.0.1", ""},
+		{"255.255.255.255", ""},
+		{"2001:db8::1", "2001:db8::/32"},
+		{"2001:db8:1::2", "2001:db8:1::/48"},
+		{"2001:db8:1::1", "2001:db8:1::1"},
+		{"2001:db9::1", ""},
+		{"fe80::1", "fe80::/10"},
+		{"::1", ""},
+		{"::ffff:10.1.2.3", ""}, // Callers unmap addresses, the IPv6 tree has no IPv4 entries
+	}
+
+	// The trie must not depend on the order prefixes were added in
+	orders := [][]string{cidrs, make([]string, len(cidrs)), make([]string, len(cidrs))}
+	for i := range cidrs {
+		orders[1][i] = cidrs[len(cidrs)-1-i]
+	}
+	copy(orders[2], cidrs)
+	rand.New(rand.NewSource(1)).Shuffle(len(orders[2]), func(i, j int) {
+		orders[2][i], orders[2][j] = orders[2][j], orders[2][i]
+	})
+
+	now := time.Now()
+	for _, order := range orders {
+		trie := &ipTrie{}
+		for _, cidr := range order {
+			trie.insert(testIPRule(t, cidr, models.IPAccessDeny))
+		}
+
+		for _, tt := range tests {
+			got := trie.lookup(netip.MustParseAddr(tt.ip), now)
+			switch {
+			case tt.want == "" && got != nil:
+				t.Errorf("lookup(%s) after inserting %v = %s, want no match", tt.ip, order, got.prefix)
+			case tt.want != "" && got == nil:
+				t.Errorf("lookup(%s) after inserting %v found no match, want %s", tt.ip, order, tt.want)
+			case tt.want != "" && got.prefix != testIPRule(t, tt.want, "").prefix:
+				t.Errorf("lookup(%s) after inserting %v = %s, want %s", tt.ip, order, got.prefix, tt.want)
+			}
+		}
+	}
+}
+
+func TestIPTrieMatchesLinearScan(t *testing.T) {
+	rng := rand.New(rand.NewSource(42))
+	randomAddr := func(v6 bool) netip.Addr {
+		if v6 {
+			var b [16]byte
+			rng.Read(b[:2])
+			b[0], b[1] = 0x20, 0x01 // Keep addresses close so prefixes nest
+			rng.Read(b[2:4])
+			return netip.AddrFrom16(b)
+		}
+		var b [4]byte
+		b[0] = byte(10 + rng.Intn(2))
+		rng.Read(b[1:])
+		return netip.AddrFrom4(b)
+	}
+
+	trie := &ipTrie{}
+	var rules []*ipAccessRule
+	for i := 0; i < 500; i++ {
+		v6 := i%2 == 1
+		addr := randomAddr(v6)
+		prefix := netip.PrefixFrom(addr, rng.Intn(addr.BitLen()+1)).Masked()
+		rule := &ipAccessRule{prefix: prefix, mode: models.IPAccessDeny}
+
+		// Identical prefixes replace each other, as in the trie
+		replaced := false
+		for j, existing := range rules {
+			if existing.prefix == prefix {
+				rules[j] = rule
+				replaced = true
+			}
+		}
+		if !replaced {
+			rules = append(rules, rule)
+		}
+		trie.insert(rule)
+	}
+
+	now := time.Now()
+	for i := 0; i < 5000; i++ {
+		addr := randomAddr(i%2 == 1)
+
+		var want *ipAccessRule
+		for _, rule := range rules {
+			if rule.prefix.Contains(addr) && (want == nil || rule.prefix.Bits() > want.prefix.Bits()) {
+				want = rule
+			}
+		}
+		if got := trie.lookup(addr, now); got != want {
+			t.Fatalf("lookup(%s) = %v, linear scan found %v", addr, got, want)
+		}
+	}
+}
+
+func TestIPTrieReplacesIdenticalPrefix(t *testing.T) {
+	trie := &ipTrie{}
+	trie.insert(testIPRule(t, "10.0.0.0/8", models.IPAccessDeny))
+	trie.insert(testIPRule(t, "10.0.0.0/8", models.IPAccessAllow))
+
+	if got := trie.lookup(netip.MustParseAddr("10.1.1.1"), time.Now()); got == nil || got.mode != models.IPAccessAllow {
+		t.Fatalf("lookup after replacing = %v, want the allow rule", got)
+	}
+}
+
+func TestIPTrieExpiry(t *testing.T) {
+	now := time.Now()
+
+	network := testIPRule(t, "10.0.0.0/8", models.IPAccessAllow)
+	host := testIPRule(t, "10.0.0.1", models.IPAccessDeny)
+	host.expiresAt = now.Add(time.Minute)
+
+	trie := &ipTrie{}
+	trie.insert(network)
+	trie.insert(host)
+
+	addr := netip.MustParseAddr("10.0.0.1")
+	tests := []struct {
+		name string
+		at   time.Time
+		want *ipAccessRule
+	}{
+		{"before expiry", now, host},
+		{"at expiry", host.expiresAt, network},
+		{"after expiry", now.Add(time.Hour), network},
+	}
+
+	for _, tt := range tests {
+		if got := trie.lookup(addr, tt.at); got != tt.want {
+			t.Errorf("%s: lookup = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestIPTrieEmpty(t *testing.T) {
+	trie := &ipTrie{}
+	for _, ip := range []string{"10.0.0.1", "2001:db8::1"} {
+		if got := trie.lookup(netip.MustParseAddr(ip), time.Now()); got != nil {
+			t.Errorf("lookup(%s) in an empty trie = %v", ip, got)
+		}
+	}
+}
+
+func TestCommonPrefixBits(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"10.0.0.0/8", "10.0.0.0/8", 8},
+		{"10.0.0.0/8", "10.1.0.0/16", 8},
+		{"10.1.0.0/16", "10.2.0.0/16", 14},
+		{"10.0.0.0/8", "11.0.0.0/8", 7},
+		{"0.0.0.0/1", "128.0.0.0/1", 0},
+		{"0.0.0.0/0", "10.0.0.0/8", 0},
+		{"10.1.2.3/32", "10.1.2.3/32", 32},
+		{"10.1.2.3/32", "10.1.2.2/32", 31},
+		{"2001:db8::/32", "2001:db8:1::/48", 32},
+		{"2001:db8::1/128", "2001:db8::/128", 127},
+	}
+
+	for _, tt := range tests {
+		a, b := netip.MustParsePrefix(tt.a), netip.MustParsePrefix(tt.b)
+		if got := commonPrefixBits(a, b); got != tt.want {
+			t.Errorf("commonPrefixBits(%s, %s) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+		if got := commonPrefixBits(b, a); got != tt.want {
+			t.Errorf("commonPrefixBits(%s, %s) = %d, want %d", tt.b, tt.a, got, tt.want)
+		}
+	}
+}
+
+func TestAddrBit(t *testing.T) {
+	addr := netip.MustParseAddr("128.0.0.1")
+	tests := []struct {
+		position int
+		want     int
+	}{
+		{0, 1},
+		{1, 0},
+		{30, 0},
+		{31, 1},
+	}
+
+	for _, tt := range tests {
+		if got := addrBit(addr, tt.position); got != tt.want {
+			t.Errorf("addrBit(%s, %d) = %d, want %d", addr, tt.position, got, tt.want)
+		}
+	}
+}
+
+func TestIPAccessListMatch(t *testing.T) {
+	l := newIPAccessList()
+	l.global.insert(testIPRule(t, "10.0.0.0/8", models.IPAccessDeny))
+	l.global.insert(testIPRule(t, "2001:db8::/32", models.IPAccessMonitor))
+	l.sites[1] = &ipTrie{}
+	l.sites[1].insert(testIPRule(t, "10.1.0.0/16", models.IPAccessAllow))
+
+	tests := []struct {
+		siteID int
+		ip     string
+		want   models.IPAccessMode
+	}{
+		{1, "10.1.2.3", models.IPAccessAllow},
+		{1, "10.2.2.3", models.IPAccessDeny},
+		{2, "10.1.2.3", models.IPAccessDeny},
+		{1, "::ffff:10.1.2.3", models.IPAccessAllow},
+		{2, "2001:db8::1%eth0", models.IPAccessMonitor},
+		{1, "192.168.1.1", ""},
+		{1, "not an address", ""},
+		{1, "", ""},
+	}
+
+	for _, tt := range tests {
+		var got models.IPAccessMode
+		if rule := l.match(tt.siteID, tt.ip); rule != nil {
+			got = rule.mode
+		}
+		if got != tt.want {
+			t.Errorf("match(%d, %q) = %q, want %q", tt.siteID, tt.ip, got, tt.want)
+		}
+	}
+}
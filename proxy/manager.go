@@ -4,6 +4,7 @@ import (
 	"SeproWAF/models"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/beego/beego/v2/core/logs"
 	"github.com/beego/beego/v2/server/web"
@@ -35,6 +36,11 @@ func InitializeProxyServer() error {
 		httpsPort = 8443 // Default HTTPS port if not specified
 	}
 
+	// Write the data lists before rules referencing them are loaded
+	if err := SyncDataLists(); err != nil {
+		logs.Error("Failed to sync data lists: %v", err)
+	}
+
 	// Create and start the proxy server
 	proxyServer = NewProxyServer(httpPort, httpsPort)
 
@@ -88,3 +94,76 @@ func RemoveSiteFromProxy(domain string) {
 		proxyServer.RemoveSite(domain)
 	}
 }
+
+// GetSiteUpstreamHealth returns the health of the upstreams of a site served by the proxy
+func GetSiteUpstreamHealth(domain string) []BackendHealth {
+	proxyMutex.Lock()
+	defer proxyMutex.Unlock()
+
+	if proxyServer == nil {
+		return nil
+	}
+	return proxyServer.GetUpstreamHealth(domain)
+}
+
+// GetCircuitBreakers returns the circuit breakers that are not closed or changed their state since the given time
+func GetCircuitBreakers(since time.Time) []CircuitBreakerInfo {
+	proxyMutex.Lock()
+	defer proxyMutex.Unlock()
+
+	if proxyServer == nil {
+		return nil
+	}
+	return proxyServer.GetCircuitBreakers(since)
+}
+
+// ReloadGRPCDescriptors makes the proxy load the gRPC descriptor set of a site again
+func ReloadGRPCDescriptors(siteID int) {
+	proxyMutex.Lock()
+	defer proxyMutex.Unlock()
+
+	if proxyServer != nil && proxyServer.wafManager != nil {
+		proxyServer.wafManager.ReloadGRPCDescriptors(siteID)
+	}
+}
+
+// ReloadDataList writes a created or updated data list and rebuilds the WAF instances of the proxy in the background
+func ReloadDataList(list *models.DataList) error {
+	if err := writeDataListFile(list); err != nil {
+		return err
+	}
+
+	proxyMutex.Lock()
+	defer proxyMutex.Unlock()
+
+	if proxyServer != nil && proxyServer.wafManager != nil {
+		go proxyServer.wafManager.ReloadAllWAFs()
+	}
+	return nil
+}
+
+// RemoveDataList empties the file of a deleted data list, so that rules still reading it match nothing
+func RemoveDataList(name string) error {
+	return ReloadDataList(&models.DataList{Name: name})
+}
+
+// ReloadIPAccessList makes the proxy load the IP access lists again
+func ReloadIPAccessList() error {
+	proxyMutex.Lock()
+	defer proxyMutex.Unlock()
+
+	if proxyServer == nil {
+		return nil
+	}
+	return proxyServer.ipAccess.load()
+}
+
+// ReloadRateLimits makes the proxy load the RATE_LIMIT rules of a site again, or of every site for site 0
+func ReloadRateLimits(siteID int) {
+	proxyMutex.Lock()
+	defer proxyMutex.Unlock()
+
+	if proxyServer != nil {
+		proxyServer.rateLimiter.reload(siteID)
+	}
+}
@@ -3,48 +3,62 @@ package proxy
 import (
 	db "SeproWAF/database"
 	"SeproWAF/models"
+	"SeproWAF/services"
 	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
-	"log"
 	"net"
 	"net/http"
 	"net/http/httputil"
-	"net/url"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/beego/beego/v2/client/orm"
 	"github.com/beego/beego/v2/core/logs"
-	"github.com/exaring/ja4plus"
+	"github.com/quic-go/quic-go/http3"
 )
 
 // ProxyServer represents the reverse proxy server
 type ProxyServer struct {
 	httpServer        *http.Server
 	httpsServer       *http.Server
+	http3Server       *http3.Server // nil when HTTP/3 is disabled
 	domainMap         map[string]*SiteProxy
 	mapMutex          sync.RWMutex
 	httpPort          int
 	httpsPort         int
+	http3Port         int
 	certManager       *CertificateManager
 	defaultHost       string
 	tlsConfig         *tls.Config
 	wafManager        *WAFManager   // Added WAF manager
 	requestCounters   map[int]int64 // Maps site ID to request count
 	countersMutex     sync.Mutex
-	counterUpdateTick *time.Ticker // Update DB every 30 seconds
+	counterUpdateTick *time.Ticker         // Update DB every 30 seconds
+	proxyProtocol     *proxyProtocolConfig // PROXY protocol listener settings, nil when disabled
+	ipAccess          *ipAccessList        // IP allow/deny lists checked before the WAF
+	rateLimiter       *rateLimiter         // Enforces the RATE_LIMIT rules of the sites
 }
 
 // SiteProxy represents a site's proxy configuration
 type SiteProxy struct {
 	Site             *models.Site
 	ReverseProxy     *httputil.ReverseProxy
+	Pool             *UpstreamPool // Default pool for requests that match no route
 	Certificate      *models.Certificate
 	LastAccessedTime time.Time
 	UseHTTPS         bool
 	WAFEnabled       bool // Added WAF enabled flag
+	backends         []*Backend
+	routes           []*routeProxy
+	clientIPs        *clientIPResolver
+	geo              *geoPolicy // nil when the site has no country or ASN policy
+	transport        *http.Transport
+	fallback         *fallbackHandler
+	stopCh           chan struct{}
+	closeOnce        sync.Once
 }
 
 // CertificateManager manages TLS certificates
@@ -53,41 +67,36 @@ type CertificateManager struct {
 	mutex        sync.RWMutex
 }
 
-// JA4Middleware extracts JA4 fingerprints from the TLS connection and adds them to the request headers.
+// JA4Middleware computes the JA4+ fingerprints of a request from what was captured while its
+// connection was set up, and adds them to the request context and headers.
 func JA4Middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Check if the request is over TLS
-		if r.TLS != nil {
-			// Assuming you have a way to extract ClientHelloInfo
-			clientHelloInfo := extractClientHelloInfo(r.TLS) // Extract ClientHelloInfo
-			// Compute JA4 hash from the client hello info
-			ja4Hash := ja4plus.JA4(clientHelloInfo)
-
-			if ja4Hash != "" {
-				// Add JA4 header to the request
-				r.Header.Set("X-JA4", ja4Hash)
-			} else {
-				log.Printf("Error computing JA4 hash")
+		fp := &requestFingerprints{JA4H: computeJA4H(r)}
+		if conn, ok := r.Context().Value(connFingerprintContextKey{}).(*connFingerprint); ok {
+			fp.JA4, fp.JA4S = conn.tlsFingerprints(r.TLS)
+
+			// Behind a PROXY protocol load balancer the SYN came from the balancer
+			if _, proxied := ProxyProtocolFromContext(r.Context()); !proxied {
+				fp.JA4T = conn.ja4t
 			}
 		}
-		// Pass the request to the next handler in the chain
-		next.ServeHTTP(w, r)
-	})
-}
 
-// extractClientHelloInfo intercepts the ClientHello information during the handshake
-func extractClientHelloInfo(connState *tls.ConnectionState) *tls.ClientHelloInfo {
-	// In a real implementation, you'd need to hook into the handshake process
-	// and capture the ClientHelloInfo. This is a simplified approach.
-
-	// Example logic for creating a mock ClientHelloInfo (you'll need to capture real info)
-	clientHelloInfo := &tls.ClientHelloInfo{
-		SupportedVersions: []uint16{tls.VersionTLS13, tls.VersionTLS12},
-		CipherSuites:      []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384},
-		// Add other fields as needed (SNI, ALPN, etc.)
-	}
+		// Fingerprint headers sent by the client are never trusted
+		for header, value := range map[string]string{
+			headerJA4:  fp.JA4,
+			headerJA4S: fp.JA4S,
+			headerJA4H: fp.JA4H,
+			headerJA4T: fp.JA4T,
+		} {
+			r.Header.Del(header)
+			if value != "" {
+				r.Header.Set(header, value)
+			}
+		}
 
-	return clientHelloInfo
+		// Pass the request to the next handler in the chain
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestFingerprintsContextKey{}, fp)))
+	})
 }
 
 // NewCertificateManager creates a new certificate manager
@@ -153,8 +162,9 @@ func NewProxyServer(httpPort, httpsPort int) *ProxyServer {
 	certManager := NewCertificateManager()
 
 	tlsConfig := &tls.Config{
-		GetCertificate: certManager.GetCertificate,
-		MinVersion:     tls.VersionTLS12,
+		GetCertificate:     certManager.GetCertificate,
+		GetConfigForClient: captureClientHello, // Keeps the ClientHello for JA4
+		MinVersion:         tls.VersionTLS12,
 		CipherSuites: []uint16{
 			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
 			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
@@ -162,6 +172,7 @@ func NewProxyServer(httpPort, httpsPort int) *ProxyServer {
 			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
 		},
 		PreferServerCipherSuites: true,
+		NextProtos:               []string{"h2", "http/1.1"},
 	}
 
 	// Initialize WAF manager
@@ -186,22 +197,43 @@ func NewProxyServer(httpPort, httpsPort int) *ProxyServer {
 		requestCounters:   make(map[int]int64),
 		countersMutex:     sync.Mutex{},
 		counterUpdateTick: time.NewTicker(30 * time.Second), // Update DB every 30 seconds
+		proxyProtocol:     loadProxyProtocolConfig(),
+		ipAccess:          newIPAccessList(),
+		rateLimiter:       newRateLimiter(services.GetStateStore()),
 	}
 
 	// Start the counter update goroutine
 	go server.updateRequestCounters()
 
-	// Create HTTP server
+	// Create HTTP server, accepting HTTP/2 with prior knowledge (h2c) next to HTTP/1.x
+	httpProtocols := new(http.Protocols)
+	httpProtocols.SetHTTP1(true)
+	httpProtocols.SetUnencryptedHTTP2(true)
+
 	server.httpServer = &http.Server{
-		Addr:    fmt.Sprintf(":%d", httpPort),
-		Handler: server,
+		Addr:        fmt.Sprintf(":%d", httpPort),
+		Handler:     server,
+		Protocols:   httpProtocols,
+		ConnContext: serverConnContext,
 	}
 
-	// Create HTTPS server
+	// Create HTTPS server, negotiating HTTP/2 over ALPN
+	httpsProtocols := new(http.Protocols)
+	httpsProtocols.SetHTTP1(true)
+	httpsProtocols.SetHTTP2(true)
+
 	server.httpsServer = &http.Server{
-		Addr:      fmt.Sprintf(":%d", httpsPort),
-		Handler:   server,
-		TLSConfig: tlsConfig,
+		Addr:        fmt.Sprintf(":%d", httpsPort),
+		Handler:     server,
+		TLSConfig:   tlsConfig,
+		Protocols:   httpsProtocols,
+		ConnContext: serverConnContext,
+	}
+
+	// Create HTTP/3 server if enabled
+	if port := loadHTTP3Port(httpsPort); port > 0 {
+		server.http3Port = port
+		server.http3Server = newHTTP3Server(port, server)
 	}
 
 	return server
@@ -215,6 +247,11 @@ func (ps *ProxyServer) Start() error {
 		return fmt.Errorf("failed to load active sites: %v", err)
 	}
 
+	// Load the IP access lists
+	if err := ps.ipAccess.load(); err != nil {
+		logs.Error("Failed to load IP access lists: %v", err)
+	}
+
 	// Start monitoring for site changes
 	go ps.MonitorSiteChanges()
 
@@ -223,7 +260,11 @@ func (ps *ProxyServer) Start() error {
 
 	// Start HTTP server in a goroutine
 	go func() {
-		if err := ps.httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		ln, err := ps.listen(ps.httpServer.Addr)
+		if err == nil {
+			err = ps.httpServer.Serve(ln)
+		}
+		if err != nil && err != http.ErrServerClosed {
 			logs.Error("HTTP server error: %v", err)
 		}
 	}()
@@ -235,17 +276,27 @@ func (ps *ProxyServer) Start() error {
 
 	if hasCertificates {
 		// Start HTTPS server in a goroutine - make it non-fatal if it fails
-		go func() {
-			if err := ps.httpsServer.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
-				logs.Error("HTTPS server error: %v", err)
-				logs.Warning("HTTPS server failed to start. SSL functionality will be unavailable.")
-			}
-		}()
+		go ps.serveHTTPS()
+		if ps.http3Server != nil {
+			go ps.serveHTTP3()
+		}
 	}
 
 	return nil
 }
 
+// serveHTTPS runs the HTTPS server until it is shut down
+func (ps *ProxyServer) serveHTTPS() {
+	ln, err := ps.listen(ps.httpsServer.Addr)
+	if err == nil {
+		err = ps.httpsServer.ServeTLS(ln, "", "")
+	}
+	if err != nil && err != http.ErrServerClosed {
+		logs.Error("HTTPS server error: %v", err)
+		logs.Warning("HTTPS server failed to start. SSL functionality will be unavailable.")
+	}
+}
+
 // Stop stops the proxy server
 func (ps *ProxyServer) Stop() error {
 	// Stop the counter ticker
@@ -258,6 +309,12 @@ func (ps *ProxyServer) Stop() error {
 		logs.Error("HTTP server shutdown error: %v", err)
 	}
 
+	if ps.http3Server != nil {
+		if err := ps.http3Server.Shutdown(ctx); err != nil {
+			logs.Error("HTTP/3 server shutdown error: %v", err)
+		}
+	}
+
 	if err := ps.httpsServer.Shutdown(ctx); err != nil {
 		logs.Error("HTTPS server shutdown error: %v", err)
 		return err
@@ -319,12 +376,10 @@ func (ps *ProxyServer) MonitorCertificates() {
 
 				if hasCertificates {
 					// Start HTTPS server
-					go func() {
-						if err := ps.httpsServer.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
-							logs.Error("HTTPS server error: %v", err)
-							logs.Warning("HTTPS server failed to start. SSL functionality will be unavailable.")
-						}
-					}()
+					go ps.serveHTTPS()
+					if ps.http3Server != nil {
+						go ps.serveHTTP3()
+					}
 					httpsStarted = true
 				}
 			}
@@ -356,8 +411,20 @@ func (ps *ProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Update last access time
 	siteProxy.LastAccessedTime = time.Now()
 
-	// Check if we should redirect HTTP to HTTPS
-	if r.TLS == nil && siteProxy.UseHTTPS {
+	// Let clients switch to HTTP/3 for later requests
+	ps.setAltSvc(w, r)
+
+	// Resolve the real client IP behind trusted proxies
+	r = services.WithClientIP(r, siteProxy.clientIPs.resolve(r))
+
+	// Check if we should redirect HTTP to HTTPS. A load balancer speaking the
+	// PROXY protocol may already have terminated TLS for the client.
+	secure := r.TLS != nil
+	if info, ok := ProxyProtocolFromContext(r.Context()); ok && info.TLS != nil {
+		secure = true
+	}
+
+	if !secure && siteProxy.UseHTTPS {
 		// Create the HTTPS URL with the correct port
 		target := fmt.Sprintf("https://%s:%d", hostWithoutPort, ps.httpsPort)
 
@@ -377,9 +444,57 @@ func (ps *ProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ps.requestCounters[siteProxy.Site.ID]++
 	ps.countersMutex.Unlock()
 
+	// Match the site's routes; a route can turn the WAF off for its requests
+	route := siteProxy.matchRoute(r)
+	r = withRoute(r, route)
+	wafEnabled := siteProxy.WAFEnabled && (route == nil || route.Route.WAFEnabled)
+
+	// Look up the client's country and network once for the geo policy, the WAF and the logs
+	r = services.WithGeoInfo(r, services.LookupGeoIP(clientIP(r)))
+
+	// Apply the IP access lists before any WAF transaction is created
+	rule := ps.ipAccess.match(siteProxy.Site.ID, clientIP(r))
+	if rule != nil {
+		switch rule.mode {
+		case models.IPAccessDeny:
+			logIPAccess(r, siteProxy.Site, rule, "blocked", http.StatusForbidden)
+			serveAccessDenied(w, r, "Your IP address is not allowed to access this site.")
+			return
+		case models.IPAccessMonitor:
+			logIPAccess(r, siteProxy.Site, rule, "detected", http.StatusOK)
+		case models.IPAccessAllow:
+			wafEnabled = false
+		}
+	}
+
+	// Refuse temporarily banned clients and enforce the site's country and ASN policy, which allowed IPs bypass
+	if rule == nil || rule.mode != models.IPAccessAllow {
+		if ban := activeBan(r); ban != nil {
+			logBan(r, siteProxy.Site, ban)
+			serveAccessDenied(w, r, "Your client has been temporarily banned from this site.")
+			return
+		}
+		if reason := siteProxy.geo.check(services.GeoInfoFromRequest(r)); reason != "" {
+			logGeoBlock(r, siteProxy.Site, reason)
+			serveAccessDenied(w, r, "Access from your location is not allowed.")
+			return
+		}
+	}
+
+	// Answer the proof of work posted by the challenge page before rate limits or the WAF challenge it again
+	if r.URL.Path == challengePath {
+		handleChallenge(w, r)
+		return
+	}
+
+	// Count the request against the site's rate limits
+	if !ps.applyRateLimits(w, r, siteProxy, route) {
+		return
+	}
+
 	// Apply WAF if enabled for this site and WAF manager is available
-	if siteProxy.WAFEnabled && ps.wafManager != nil {
-		wafHandler := ps.wafManager.WAFHandler(siteProxy.ReverseProxy, siteProxy.Site.ID, siteProxy.Site.Domain)
+	if wafEnabled && ps.wafManager != nil {
+		wafHandler := ps.wafManager.WAFHandler(siteProxy, siteProxy.Site)
 
 		// لف WAF handler مع JA4+ middleware
 		ja4plusWrapped := JA4Middleware(wafHandler)
@@ -388,7 +503,47 @@ func (ps *ProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Forward the request to the backend server if WAF is not enabled
-	siteProxy.ReverseProxy.ServeHTTP(w, r)
+	siteProxy.ServeHTTP(w, r)
+}
+
+// ServeHTTP picks a backend from the pool of the matched route, or the site's
+// default pool, and forwards the request to it
+func (sp *SiteProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	route, matched := routeFromContext(r.Context())
+	if !matched {
+		route = sp.matchRoute(r)
+	}
+
+	pool := sp.Pool
+	if route != nil {
+		pool = route.pool
+		r = route.rewritePath(r)
+	}
+
+	backend := pool.Pick(r)
+	if backend == nil {
+		http.Error(w, "No upstream available", http.StatusServiceUnavailable)
+		return
+	}
+
+	// Answer with the site's fallback while the backend's circuit breaker is open
+	allowed, probe := backend.breaker.allow()
+	if !allowed {
+		sp.fallback.serve(w, r, backend.breaker.retryAfter())
+		return
+	}
+
+	backend.acquire()
+	defer backend.release()
+
+	attempt := &proxyAttempt{
+		backend:  backend,
+		start:    time.Now(),
+		probe:    probe,
+		cacheKey: sp.fallback.cacheKey(r),
+	}
+	ctx := context.WithValue(r.Context(), backendContextKey{}, attempt)
+	sp.ReverseProxy.ServeHTTP(w, r.WithContext(ctx))
 }
 
 // AddOrUpdateSite adds or updates a site in the proxy
@@ -400,37 +555,151 @@ func (ps *ProxyServer) AddOrUpdateSite(site *models.Site) error {
 		return nil
 	}
 
-	// Parse the target URL
-	targetURL, err := url.Parse(site.TargetURL)
+	// Build the upstream pools, falling back to the target URL when no upstreams are configured
+	upstreams, err := models.GetUpstreamsBySiteID(site.ID)
 	if err != nil {
-		return fmt.Errorf("invalid target URL for site %s: %v", site.Domain, err)
+		return fmt.Errorf("failed to load upstreams for site %s: %v", site.Domain, err)
 	}
 
-	// Create a reverse proxy
-	proxy := httputil.NewSingleHostReverseProxy(targetURL)
+	routes, err := models.GetRoutesBySiteID(site.ID)
+	if err != nil {
+		return fmt.Errorf("failed to load routes for site %s: %v", site.Domain, err)
+	}
+
+	var previous []*Backend
+	var previousTransport *http.Transport
+	var previousFallback *fallbackHandler
+	var previousSettings *models.SiteSettings
+	ps.mapMutex.RLock()
+	if existing, ok := ps.domainMap[site.Domain]; ok {
+		previous = existing.backends
+		if existing.Site.Settings == site.Settings {
+			previousTransport = existing.transport
+			previousFallback = existing.fallback
+		} else {
+			previousSettings, _ = existing.Site.GetSettings()
+		}
+	}
+	ps.mapMutex.RUnlock()
+
+	backends, pool, routeProxies, err := buildSiteRouting(site, upstreams, routes, previous)
+	if err != nil {
+		return err
+	}
+
+	// Build a dedicated transport from the site's timeouts and connection limits,
+	// keeping the previous one and its idle connections if the settings are unchanged
+	settings, err := site.GetSettings()
+	if err != nil {
+		logs.Error("Using default settings for site %s: %v", site.Domain, err)
+	}
+	transport := previousTransport
+	if transport == nil {
+		transport = newSiteTransport(settings)
+	}
+
+	// Rebuild the site's WAF when its engine mode or CRS settings changed
+	if previousSettings != nil && previousSettings.WAF != settings.WAF && ps.wafManager != nil {
+		go func() {
+			if err := ps.wafManager.ReloadWAF(site.ID); err != nil {
+				logs.Error("Failed to reload WAF for site %s: %v", site.Domain, err)
+			}
+		}()
+	}
+
+	// Keep the cached fallback responses as long as the settings are unchanged
+	fallback := previousFallback
+	if fallback == nil {
+		fallback = newFallbackHandler(settings.Fallback)
+	}
+
+	for _, backend := range backends {
+		backend.breaker.configure(settings.CircuitBreaker)
+
+		if settings.Transport.Protocol == models.UpstreamProtocolHTTP2 && backend.URL.Scheme != "https" {
+			logs.Warning("Upstream %s of site %s is not https, requests to it fail with the h2 protocol setting (use h2c)",
+				backend.URL, site.Domain)
+		}
+	}
+	latencyThreshold := time.Duration(settings.CircuitBreaker.LatencyThreshold) * time.Millisecond
+
+	// Create a reverse proxy that routes each request to the backend picked by the pool
+	proxy := &httputil.ReverseProxy{
+		Transport: newRetryTransport(transport, settings),
+		Director: func(req *http.Request) {
+			backend := backendFromContext(req.Context())
+			if backend == nil {
+				backend = pool.Backends()[0]
+			}
+			directToBackend(req, backend.URL)
+			stripH2CUpgrade(req)
+		},
+	}
+
+	// Feed backend responses into passive outlier detection and the circuit breaker
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		attempt := attemptFromContext(resp.Request.Context())
+		if attempt == nil {
+			return nil
+		}
+
+		backend := attempt.backend
+		latency := time.Since(attempt.start)
+
+		switch {
+		case resp.StatusCode >= http.StatusInternalServerError:
+			reason := fmt.Sprintf("backend returned status %d", resp.StatusCode)
+			backend.ReportFailure(reason)
+			backend.breaker.record(false, attempt.probe, reason)
+		case latencyThreshold > 0 && latency > latencyThreshold:
+			backend.ReportSuccess()
+			backend.breaker.record(false, attempt.probe, fmt.Sprintf("response took %s", latency.Round(time.Millisecond)))
+		default:
+			backend.ReportSuccess()
+			backend.breaker.record(true, attempt.probe, "")
+			fallback.capture(attempt.cacheKey, resp)
+		}
+		return nil
+	}
 
 	// Configure custom error handling for the proxy
 	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		// gRPC stream messages the WAF rejected end the request body, it is not a backend failure
+		var rejected *grpcRejectedError
+		if errors.As(err, &rejected) {
+			if attempt := attemptFromContext(r.Context()); attempt != nil {
+				attempt.backend.breaker.cancel(attempt.probe)
+			}
+			if w.Header().Get("Content-Type") == "" {
+				serveGRPCStatus(w, grpcContentType(r), rejected.code, rejected.message)
+			}
+			return
+		}
+
 		// Don't log context canceled errors as they're usually just client disconnections
+		attempt := attemptFromContext(r.Context())
 		if !errors.Is(err, context.Canceled) {
 			logs.Error("Proxy error for %s: %v", site.Domain, err)
+
+			if attempt != nil {
+				attempt.backend.ReportFailure(err.Error())
+				attempt.backend.breaker.record(false, attempt.probe, err.Error())
+			}
+		} else if attempt != nil {
+			attempt.backend.breaker.cancel(attempt.probe)
 		}
 
 		// Only send error response if headers weren't written yet
 		if w.Header().Get("Content-Type") == "" {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				http.Error(w, "Backend server timeout", http.StatusGatewayTimeout)
+				return
+			}
 			http.Error(w, "Backend server error", http.StatusBadGateway)
 		}
 	}
 
-	// Modify the director to update the Host header
-	originalDirector := proxy.Director
-	proxy.Director = func(req *http.Request) {
-		originalDirector(req)
-
-		// Update the Host header to the target host
-		req.Host = targetURL.Host
-	}
-
 	// Check if site has a certificate - make this optional
 	useHTTPS := false
 	var certificate *models.Certificate = nil
@@ -458,20 +727,92 @@ func (ps *ProxyServer) AddOrUpdateSite(site *models.Site) error {
 	siteProxy := &SiteProxy{
 		Site:             site,
 		ReverseProxy:     proxy,
+		Pool:             pool,
 		Certificate:      certificate,
 		LastAccessedTime: time.Now(),
 		UseHTTPS:         useHTTPS,
 		WAFEnabled:       site.WAFEnabled, // Set WAF enabled flag
+		backends:         backends,
+		routes:           routeProxies,
+		clientIPs:        newClientIPResolver(site),
+		geo:              newGeoPolicy(settings.Geo),
+		transport:        transport,
+		fallback:         fallback,
+		stopCh:           make(chan struct{}),
 	}
 
-	// Add to domain map
+	// Add to domain map, stopping the health checks of the site proxy being replaced
 	ps.mapMutex.Lock()
+	if existing, ok := ps.domainMap[site.Domain]; ok {
+		if existing.transport == transport {
+			// The pooled connections are kept by the new site proxy
+			existing.transport = nil
+		}
+		existing.Close()
+	}
 	ps.domainMap[site.Domain] = siteProxy
 	ps.mapMutex.Unlock()
 
+	startHealthChecks(backends, siteProxy.stopCh)
+
+	// Pick up changed rate limits along with the site
+	if err := ps.rateLimiter.load(site.ID); err != nil {
+		logs.Error("Failed to load rate limits for site %s: %v", site.Domain, err)
+	}
+
 	return nil
 }
 
+// GetUpstreamHealth returns the health of the upstreams of a site
+func (ps *ProxyServer) GetUpstreamHealth(domain string) []BackendHealth {
+	ps.mapMutex.RLock()
+	siteProxy, exists := ps.domainMap[domain]
+	ps.mapMutex.RUnlock()
+
+	if !exists {
+		return nil
+	}
+	return siteProxy.UpstreamHealth()
+}
+
+// CircuitBreakerInfo describes the circuit breaker of an upstream for the dashboard
+type CircuitBreakerInfo struct {
+	SiteID     int    `json:"site_id"`
+	Domain     string `json:"domain"`
+	UpstreamID int    `json:"upstream_id"`
+	URL        string `json:"url"`
+	*BreakerStatus
+}
+
+// GetCircuitBreakers returns the circuit breakers of all sites that are not closed
+// or changed their state recently
+func (ps *ProxyServer) GetCircuitBreakers(since time.Time) []CircuitBreakerInfo {
+	ps.mapMutex.RLock()
+	defer ps.mapMutex.RUnlock()
+
+	breakers := make([]CircuitBreakerInfo, 0)
+	for _, siteProxy := range ps.domainMap {
+		for _, backend := range siteProxy.backends {
+			status := backend.breaker.status()
+			if status == nil || (status.State == BreakerClosed && status.Since.Before(since)) {
+				continue
+			}
+			breakers = append(breakers, CircuitBreakerInfo{
+				SiteID:        siteProxy.Site.ID,
+				Domain:        siteProxy.Site.Domain,
+				UpstreamID:    backend.ID(),
+				URL:           backend.URL.String(),
+				BreakerStatus: status,
+			})
+		}
+	}
+
+	sort.Slice(breakers, func(i, j int) bool {
+		return breakers[i].Since.After(breakers[j].Since)
+	})
+	return breakers
+}
+
 // RemoveSite removes a site from the proxy
 func (ps *ProxyServer) RemoveSite(domain string) {
 	ps.mapMutex.Lock()
@@ -483,6 +824,8 @@ func (ps *ProxyServer) RemoveSite(domain string) {
 			ps.certManager.RemoveCertificate(domain)
 		}
 
+		siteProxy.Close()
+		ps.rateLimiter.remove(siteProxy.Site.ID)
 		delete(ps.domainMap, domain)
 	}
 }
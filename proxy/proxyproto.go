@@ -0,0 +1,437 @@
+package proxy
+
+import (
+	"SeproWAF/models"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/beego/beego/v2/core/logs"
+	"github.com/beego/beego/v2/server/web"
+)
+
+// PROXY protocol v2 constants, see https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	proxyProtocolV1Prefix    = "PROXY "
+	proxyProtocolV1MaxLength = 107
+
+	pp2CommandLocal = 0x0
+	pp2CommandProxy = 0x1
+
+	pp2FamilyTCP4 = 0x11
+	pp2FamilyTCP6 = 0x21
+
+	pp2TypeALPN       = 0x01
+	pp2TypeAuthority  = 0x02
+	pp2TypeSSL        = 0x20
+	pp2SubtypeVersion = 0x21
+	pp2SubtypeCN      = 0x22
+	pp2SubtypeCipher  = 0x23
+
+	pp2ClientSSL      = 0x01
+	pp2ClientCertConn = 0x02
+)
+
+// errProxyProtocolRejected is returned for connections whose PROXY header is not accepted
+var errProxyProtocolRejected = errors.New("PROXY protocol header rejected")
+
+// proxyProtocolContextKey stores the PROXY protocol metadata of a connection
+type proxyProtocolContextKey struct{}
+
+// ProxyProtocolInfo is the metadata a load balancer sent in the PROXY protocol header
+type ProxyProtocolInfo struct {
+	SourceAddr net.Addr
+	DestAddr   net.Addr
+	ALPN       string
+	Authority  string        // Server name requested by the client
+	TLS        *ProxyTLSInfo // Set when the client connected to the load balancer over TLS
+}
+
+// ProxyTLSInfo describes the TLS connection terminated or passed through by the load balancer
+type ProxyTLSInfo struct {
+	Version    string
+	Cipher     string
+	CommonName string // Subject CN of the client certificate
+	ClientCert bool   // The client presented a certificate
+	Verified   bool   // The client certificate was verified
+}
+
+// proxyProtocolConfig holds the PROXY protocol listener settings from app.conf
+type proxyProtocolConfig struct {
+	allowed       []*net.IPNet
+	headerTimeout time.Duration
+}
+
+// loadProxyProtocolConfig reads the PROXY protocol settings, returning nil when disabled
+func loadProxyProtocolConfig() *proxyProtocolConfig {
+	if !web.AppConfig.DefaultBool("ProxyProtocol", false) {
+		return nil
+	}
+
+	allowed, err := models.ParseTrustedProxies(web.AppConfig.DefaultString("ProxyProtocolAllowedCIDRs", ""))
+	if err != nil {
+		logs.Error("Invalid ProxyProtocolAllowedCIDRs configuration: %v", err)
+	}
+	if len(allowed) == 0 {
+		logs.Warning("PROXY protocol is enabled but no source is allowed to send headers")
+	}
+
+	timeout := web.AppConfig.DefaultInt("ProxyProtocolHeaderTimeout", 5)
+	if timeout <= 0 {
+		timeout = 5
+	}
+
+	return &proxyProtocolConfig{
+		allowed:       allowed,
+		headerTimeout: time.Duration(timeout) * time.Second,
+	}
+}
+
+// isAllowed checks if the address may send PROXY protocol headers
+func (c *proxyProtocolConfig) isAllowed(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, network := range c.allowed {
+		if network.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyProtocolListener reads the PROXY protocol header of accepted connections
+type proxyProtocolListener struct {
+	net.Listener
+	config *proxyProtocolConfig
+}
+
+// Accept wraps the next connection. The header is read lazily so that a slow
+// client cannot hold up the accept loop.
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return &proxyProtocolConn{
+		Conn:   conn,
+		config: l.config,
+		reader: bufio.NewReader(conn),
+	}, nil
+}
+
+// proxyProtocolConn is a connection whose addresses come from its PROXY protocol header
+type proxyProtocolConn struct {
+	net.Conn
+	config *proxyProtocolConfig
+	reader *bufio.Reader
+	once   sync.Once
+	info   *ProxyProtocolInfo
+	err    error
+}
+
+// readHeader reads the PROXY protocol header once, rejecting the connection on errors
+func (c *proxyProtocolConn) readHeader() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(c.config.headerTimeout))
+		defer c.Conn.SetReadDeadline(time.Time{})
+
+		peer := c.Conn.RemoteAddr()
+		if !c.config.isAllowed(peer) {
+			// Untrusted sources are served directly, unless they try to send a header
+			if prefix, _ := c.reader.Peek(len(proxyProtocolV1Prefix)); isProxyProtocolPrefix(prefix) {
+				c.err = errProxyProtocolRejected
+				logs.Warning("Rejected PROXY protocol header from untrusted source %s", peer)
+			}
+		} else {
+			c.info, c.err = readProxyProtocolHeader(c.reader)
+			if c.err != nil {
+				logs.Warning("Invalid PROXY protocol header from %s: %v", peer, c.err)
+			}
+		}
+
+		if c.err != nil {
+			c.Conn.Close()
+		}
+	})
+}
+
+// Read reads from the connection after its header
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+// RemoteAddr returns the client address sent by the load balancer
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.info != nil && c.info.SourceAddr != nil {
+		return c.info.SourceAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the address the client connected to on the load balancer
+func (c *proxyProtocolConn) LocalAddr() net.Addr {
+	c.readHeader()
+	if c.info != nil && c.info.DestAddr != nil {
+		return c.info.DestAddr
+	}
+	return c.Conn.LocalAddr()
+}
+
+// isProxyProtocolPrefix checks if the data starts like a v1 or v2 header
+func isProxyProtocolPrefix(prefix []byte) bool {
+	if len(prefix) < len(proxyProtocolV1Prefix) {
+		return false
+	}
+	return bytes.HasPrefix(prefix, []byte(proxyProtocolV1Prefix)) ||
+		bytes.HasPrefix(prefix, proxyProtocolV2Signature[:len(prefix)])
+}
+
+// readProxyProtocolHeader reads a v1 or v2 header
+func readProxyProtocolHeader(r *bufio.Reader) (*ProxyProtocolInfo, error) {
+	prefix, err := r.Peek(len(proxyProtocolV2Signature))
+	if err != nil && !bytes.HasPrefix(prefix, []byte(proxyProtocolV1Prefix)) {
+		return nil, fmt.Errorf("missing header: %v", err)
+	}
+
+	switch {
+	case bytes.Equal(prefix, proxyProtocolV2Signature):
+		return readProxyProtocolV2(r)
+	case bytes.HasPrefix(prefix, []byte(proxyProtocolV1Prefix)):
+		return readProxyProtocolV1(r)
+	default:
+		return nil, errors.New("missing header")
+	}
+}
+
+// readProxyProtocolV1 reads a text header such as "PROXY TCP4 1.2.3.4 5.6.7.8 1234 443\r\n"
+func readProxyProtocolV1(r *bufio.Reader) (*ProxyProtocolInfo, error) {
+	var line []byte
+	for len(line) < proxyProtocolV1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if bytes.HasSuffix(line, []byte("\r\n")) {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("v1 header too long")
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		// The load balancer does not know the client, keep the connection addresses
+		return &ProxyProtocolInfo{}, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed v1 header %q", line)
+	}
+
+	ipv4 := fields[1] == "TCP4"
+	source, err := parseProxyProtocolV1Addr(fields[2], fields[4], ipv4)
+	if err != nil {
+		return nil, err
+	}
+	dest, err := parseProxyProtocolV1Addr(fields[3], fields[5], ipv4)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ProxyProtocolInfo{SourceAddr: source, DestAddr: dest}, nil
+}
+
+// parseProxyProtocolV1Addr parses an address and port of a v1 header, the address must be of the header's family
+func parseProxyProtocolV1Addr(host, port string, ipv4 bool) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil || (ip.To4() != nil && !strings.Contains(host, ":")) != ipv4 {
+		return nil, fmt.Errorf("invalid address %q", host)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 0 || p > 65535 || port[0] < '0' || port[0] > '9' {
+		return nil, fmt.Errorf("invalid port %q", port)
+	}
+	return &net.TCPAddr{IP: ip, Port: p}, nil
+}
+
+// readProxyProtocolV2 reads a binary header and its TLVs
+func readProxyProtocolV2(r *bufio.Reader) (*ProxyProtocolInfo, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	if header[12]>>4 != 0x2 {
+		return nil, fmt.Errorf("unsupported version %d", header[12]>>4)
+	}
+	command := header[12] & 0x0f
+	family := header[13]
+
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	info := &ProxyProtocolInfo{}
+	switch command {
+	case pp2CommandLocal:
+		// Health checks of the load balancer itself
+		return info, nil
+	case pp2CommandProxy:
+	default:
+		return nil, fmt.Errorf("unsupported command %d", command)
+	}
+
+	var tlvs []byte
+	switch family {
+	case pp2FamilyTCP4:
+		if len(payload) < 12 {
+			return nil, errors.New("truncated IPv4 addresses")
+		}
+		info.SourceAddr = &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}
+		info.DestAddr = &net.TCPAddr{IP: net.IP(payload[4:8]), Port: int(binary.BigEndian.Uint16(payload[10:12]))}
+		tlvs = payload[12:]
+	case pp2FamilyTCP6:
+		if len(payload) < 36 {
+			return nil, errors.New("truncated IPv6 addresses")
+		}
+		info.SourceAddr = &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}
+		info.DestAddr = &net.TCPAddr{IP: net.IP(payload[16:32]), Port: int(binary.BigEndian.Uint16(payload[34:36]))}
+		tlvs = payload[36:]
+	default:
+		// Unspecified or UNIX families keep the connection addresses
+		return info, nil
+	}
+
+	err := parseProxyProtocolTLVs(tlvs, func(typ byte, value []byte) error {
+		switch typ {
+		case pp2TypeALPN:
+			info.ALPN = string(value)
+		case pp2TypeAuthority:
+			info.Authority = string(value)
+		case pp2TypeSSL:
+			tlsInfo, err := parseProxyProtocolSSL(value)
+			if err != nil {
+				return err
+			}
+			info.TLS = tlsInfo
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+// parseProxyProtocolTLVs calls fn for every type-length-value entry
+func parseProxyProtocolTLVs(data []byte, fn func(typ byte, value []byte) error) error {
+	for len(data) > 0 {
+		if len(data) < 3 {
+			return errors.New("truncated TLV")
+		}
+		length := int(binary.BigEndian.Uint16(data[1:3]))
+		if len(data) < 3+length {
+			return errors.New("truncated TLV")
+		}
+		if err := fn(data[0], data[3:3+length]); err != nil {
+			return err
+		}
+		data = data[3+length:]
+	}
+	return nil
+}
+
+// parseProxyProtocolSSL parses the PP2_TYPE_SSL TLV
+func parseProxyProtocolSSL(value []byte) (*ProxyTLSInfo, error) {
+	if len(value) < 5 {
+		return nil, errors.New("truncated SSL TLV")
+	}
+
+	client := value[0]
+	if client&pp2ClientSSL == 0 {
+		// The client did not use TLS
+		return nil, nil
+	}
+
+	info := &ProxyTLSInfo{
+		ClientCert: client&pp2ClientCertConn != 0,
+		Verified:   binary.BigEndian.Uint32(value[1:5]) == 0,
+	}
+
+	err := parseProxyProtocolTLVs(value[5:], func(typ byte, sub []byte) error {
+		switch typ {
+		case pp2SubtypeVersion:
+			info.Version = string(sub)
+		case pp2SubtypeCipher:
+			info.Cipher = string(sub)
+		case pp2SubtypeCN:
+			info.CommonName = string(sub)
+		}
+		return nil
+	})
+	return info, err
+}
+
+// proxyProtocolConnContext stores the connection in its context. ConnContext runs on
+// the accept loop, so the header is only read once a request asks for it.
+func proxyProtocolConnContext(ctx context.Context, conn net.Conn) context.Context {
+	if netConn, ok := conn.(interface{ NetConn() net.Conn }); ok {
+		// Unwrap TLS connections
+		conn = netConn.NetConn()
+	}
+
+	if ppConn, ok := conn.(*proxyProtocolConn); ok {
+		return context.WithValue(ctx, proxyProtocolContextKey{}, ppConn)
+	}
+	return ctx
+}
+
+// ProxyProtocolFromContext returns the PROXY protocol metadata of the request's connection
+func ProxyProtocolFromContext(ctx context.Context) (*ProxyProtocolInfo, bool) {
+	ppConn, ok := ctx.Value(proxyProtocolContextKey{}).(*proxyProtocolConn)
+	if !ok {
+		return nil, false
+	}
+
+	ppConn.readHeader()
+	return ppConn.info, ppConn.info != nil
+}
+
+// listen opens a TCP listener fingerprinting its connections, reading PROXY protocol headers when enabled
+func (ps *ProxyServer) listen(addr string) (net.Listener, error) {
+	lc := net.ListenConfig{Control: enableSavedSYN}
+	ln, err := lc.Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	ln = &fingerprintListener{Listener: ln}
+
+	if ps.proxyProtocol == nil {
+		return ln, nil
+	}
+
+	logs.Info("PROXY protocol enabled on %s", addr)
+	return &proxyProtocolListener{Listener: ln, config: ps.proxyProtocol}, nil
+}
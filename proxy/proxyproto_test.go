@@ -0,0 +1,330 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// ppV2Header builds a v2 header with the given version/command byte, family and payload
+func ppV2Header(versionCommand, family byte, payload []byte) []byte {
+	header := append([]byte(nil), proxyProtocolV2Signature...)
+	header = append(header, versionCommand, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(payload)))
+	return append(header, payload...)
+}
+
+// ppTLV encodes a type-length-value entry
+func ppTLV(typ byte, value []byte) []byte {
+	tlv := []byte{typ}
+	tlv = binary.BigEndian.AppendUint16(tlv, uint16(len(value)))
+	return append(tlv, value...)
+}
+
+// ppTCP4 encodes the IPv4 addresses and ports of a v2 header
+func ppTCP4(src, dst string, srcPort, dstPort uint16) []byte {
+	payload := append([]byte(nil), net.ParseIP(src).To4()...)
+	payload = append(payload, net.ParseIP(dst).To4()...)
+	payload = binary.BigEndian.AppendUint16(payload, srcPort)
+	return binary.BigEndian.AppendUint16(payload, dstPort)
+}
+
+func TestReadProxyProtocolV1(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		source  string
+		dest    string
+		wantErr bool
+	}{
+		{name: "tcp4", input: "PROXY TCP4 192.0.2.10 198.51.100.1 56324 443\r\n", source: "192.0.2.10:56324", dest: "198.51.100.1:443"},
+		{name: "tcp6", input: "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", source: "[2001:db8::1]:56324", dest: "[2001:db8::2]:443"},
+		{name: "unknown", input: "PROXY UNKNOWN\r\n"},
+		{name: "unknown with addresses", input: "PROXY UNKNOWN ffff:f...f:ffff ffff:f...f:ffff 65535 65535\r\n"},
+		{name: "missing crlf", input: "PROXY TCP4 192.0.2.10 198.51.100.1 56324 443\n", wantErr: true},
+		{name: "truncated", input: "PROXY TCP4 192.0.2.10 198.5", wantErr: true},
+		{name: "too long", input: "PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n", wantErr: true},
+		{name: "missing field", input: "PROXY TCP4 192.0.2.10 198.51.100.1 56324\r\n", wantErr: true},
+		{name: "unknown protocol", input: "PROXY UDP4 192.0.2.10 198.51.100.1 56324 443\r\n", wantErr: true},
+		{name: "invalid address", input: "PROXY TCP4 192.0.2.300 198.51.100.1 56324 443\r\n", wantErr: true},
+		{name: "ipv6 address in tcp4", input: "PROXY TCP4 2001:db8::1 198.51.100.1 56324 443\r\n", wantErr: true},
+		{name: "ipv4 address in tcp6", input: "PROXY TCP6 192.0.2.10 2001:db8::2 56324 443\r\n", wantErr: true},
+		{name: "port out of range", input: "PROXY TCP4 192.0.2.10 198.51.100.1 65536 443\r\n", wantErr: true},
+		{name: "negative port", input: "PROXY TCP4 192.0.2.10 198.51.100.1 -1 443\r\n", wantErr: true},
+		{name: "signed port", input: "PROXY TCP4 192.0.2.10 198.51.100.1 +80 443\r\n", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := readProxyProtocolHeader(bufio.NewReader(strings.NewReader(tt.input + "GET / HTTP/1.1\r\n")))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", info)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkProxyProtocolAddrs(t, info, tt.source, tt.dest)
+		})
+	}
+}
+
+func TestReadProxyProtocolV2(t *testing.T) {
+	sslTLV := func(client byte, verify uint32, subs ...[]byte) []byte {
+		value := []byte{client}
+		value = binary.BigEndian.AppendUint32(value, verify)
+		for _, sub := range subs {
+			value = append(value, sub...)
+		}
+		return ppTLV(pp2TypeSSL, value)
+	}
+
+	tcp6 := append([]byte(nil), net.ParseIP("2001:db8::1")...)
+	tcp6 = append(tcp6, net.ParseIP("2001:db8::2")...)
+	tcp6 = binary.BigEndian.AppendUint16(tcp6, 56324)
+	tcp6 = binary.BigEndian.AppendUint16(tcp6, 443)
+
+	tests := []struct {
+		name    string
+		input   []byte
+		source  string
+		dest    string
+		check   func(t *testing.T, info *ProxyProtocolInfo)
+		wantErr bool
+	}{
+		{
+			name:   "tcp4",
+			input:  ppV2Header(0x21, pp2FamilyTCP4, ppTCP4("192.0.2.10", "198.51.100.1", 56324, 443)),
+			source: "192.0.2.10:56324",
+			dest:   "198.51.100.1:443",
+		},
+		{
+			name:   "tcp6",
+			input:  ppV2Header(0x21, pp2FamilyTCP6, tcp6),
+			source: "[2001:db8::1]:56324",
+			dest:   "[2001:db8::2]:443",
+		},
+		{
+			name:  "local command",
+			input: ppV2Header(0x20, 0x00, nil),
+		},
+		{
+			name:  "unspecified family",
+			input: ppV2Header(0x21, 0x00, []byte{1, 2, 3}),
+		},
+		{
+			name: "tlvs",
+			input: ppV2Header(0x21, pp2FamilyTCP4, bytes.Join([][]byte{
+				ppTCP4("192.0.2.10", "198.51.100.1", 56324, 443),
+				ppTLV(pp2TypeALPN, []byte("h2")),
+				ppTLV(pp2TypeAuthority, []byte("example.com")),
+				ppTLV(0x04, []byte{0xde, 0xad}), // CRC32c, ignored
+				sslTLV(pp2ClientSSL|pp2ClientCertConn, 0,
+					ppTLV(pp2SubtypeVersion, []byte("TLSv1.3")),
+					ppTLV(pp2SubtypeCipher, []byte("TLS_AES_128_GCM_SHA256")),
+					ppTLV(pp2SubtypeCN, []byte("client.example.com"))),
+			}, nil)),
+			source: "192.0.2.10:56324",
+			dest:   "198.51.100.1:443",
+			check: func(t *testing.T, info *ProxyProtocolInfo) {
+				if info.ALPN != "h2" || info.Authority != "example.com" {
+					t.Errorf("ALPN %q, authority %q", info.ALPN, info.Authority)
+				}
+				want := ProxyTLSInfo{Version: "TLSv1.3", Cipher: "TLS_AES_128_GCM_SHA256", CommonName: "client.example.com", ClientCert: true, Verified: true}
+				if info.TLS == nil || *info.TLS != want {
+					t.Errorf("TLS %+v, want %+v", info.TLS, want)
+				}
+			},
+		},
+		{
+			name: "plain connection in ssl tlv",
+			input: ppV2Header(0x21, pp2FamilyTCP4, append(ppTCP4("192.0.2.10", "198.51.100.1", 1, 2),
+				sslTLV(0, 0)...)),
+			source: "192.0.2.10:1",
+			dest:   "198.51.100.1:2",
+			check: func(t *testing.T, info *ProxyProtocolInfo) {
+				if info.TLS != nil {
+					t.Errorf("TLS %+v for a plain connection", info.TLS)
+				}
+			},
+		},
+		{
+			name:    "unsupported version",
+			input:   ppV2Header(0x11, pp2FamilyTCP4, ppTCP4("192.0.2.10", "198.51.100.1", 1, 2)),
+			wantErr: true,
+		},
+		{
+			name:    "unsupported command",
+			input:   ppV2Header(0x22, pp2FamilyTCP4, ppTCP4("192.0.2.10", "198.51.100.1", 1, 2)),
+			wantErr: true,
+		},
+		{
+			name:    "truncated fixed header",
+			input:   ppV2Header(0x21, pp2FamilyTCP4, nil)[:14],
+			wantErr: true,
+		},
+		{
+			name:    "payload shorter than its length",
+			input:   ppV2Header(0x21, pp2FamilyTCP4, ppTCP4("192.0.2.10", "198.51.100.1", 1, 2))[:20],
+			wantErr: true,
+		},
+		{
+			name:    "truncated ipv4 addresses",
+			input:   ppV2Header(0x21, pp2FamilyTCP4, []byte{192, 0, 2, 10, 198, 51}),
+			wantErr: true,
+		},
+		{
+			name:    "truncated ipv6 addresses",
+			input:   ppV2Header(0x21, pp2FamilyTCP6, tcp6[:30]),
+			wantErr: true,
+		},
+		{
+			name:    "truncated tlv header",
+			input:   ppV2Header(0x21, pp2FamilyTCP4, append(ppTCP4("192.0.2.10", "198.51.100.1", 1, 2), pp2TypeALPN, 0)),
+			wantErr: true,
+		},
+		{
+			name:    "tlv longer than the payload",
+			input:   ppV2Header(0x21, pp2FamilyTCP4, append(ppTCP4("192.0.2.10", "198.51.100.1", 1, 2), pp2TypeALPN, 0, 10, 'h')),
+			wantErr: true,
+		},
+		{
+			name:    "truncated ssl tlv",
+			input:   ppV2Header(0x21, pp2FamilyTCP4, append(ppTCP4("192.0.2.10", "198.51.100.1", 1, 2), ppTLV(pp2TypeSSL, []byte{pp2ClientSSL, 0})...)),
+			wantErr: true,
+		},
+		{
+			name: "truncated ssl sub-tlv",
+			input: ppV2Header(0x21, pp2FamilyTCP4, append(ppTCP4("192.0.2.10", "198.51.100.1", 1, 2),
+				sslTLV(pp2ClientSSL, 0, []byte{pp2SubtypeVersion, 0, 9, 'T'})...)),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := readProxyProtocolHeader(bufio.NewReader(bytes.NewReader(tt.input)))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", info)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkProxyProtocolAddrs(t, info, tt.source, tt.dest)
+			if tt.check != nil {
+				tt.check(t, info)
+			}
+		})
+	}
+}
+
+func TestReadProxyProtocolHeaderLeavesRequest(t *testing.T) {
+	inputs := [][]byte{
+		[]byte("PROXY TCP4 192.0.2.10 198.51.100.1 56324 443\r\n"),
+		ppV2Header(0x21, pp2FamilyTCP4, append(ppTCP4("192.0.2.10", "198.51.100.1", 1, 2), ppTLV(pp2TypeALPN, []byte("h2"))...)),
+	}
+
+	for _, input := range inputs {
+		r := bufio.NewReader(bytes.NewReader(append(input, "GET / HTTP/1.1\r\n"...)))
+		if _, err := readProxyProtocolHeader(r); err != nil {
+			t.Fatal(err)
+		}
+		rest, _ := io.ReadAll(r)
+		if string(rest) != "GET / HTTP/1.1\r\n" {
+			t.Errorf("request after the header = %q", rest)
+		}
+	}
+}
+
+func TestReadProxyProtocolHeaderMissing(t *testing.T) {
+	for _, input := range []string{"", "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", "\r\n\r\n\x00\r\nQU"} {
+		if info, err := readProxyProtocolHeader(bufio.NewReader(strings.NewReader(input))); err == nil {
+			t.Errorf("readProxyProtocolHeader(%q) = %+v, want an error", input, info)
+		}
+	}
+}
+
+func TestIsProxyProtocolPrefix(t *testing.T) {
+	tests := []struct {
+		prefix string
+		want   bool
+	}{
+		{"PROXY ", true},
+		{"\r\n\r\n\x00\r", true},
+		{"GET / ", false},
+		{"PROX", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		if got := isProxyProtocolPrefix([]byte(tt.prefix)); got != tt.want {
+			t.Errorf("isProxyProtocolPrefix(%q) = %v, want %v", tt.prefix, got, tt.want)
+		}
+	}
+}
+
+func TestProxyProtocolConnRejectsUntrustedHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		wantErr error
+	}{
+		{"header from untrusted source", "PROXY TCP4 192.0.2.10 198.51.100.1 56324 443\r\nGET / HTTP/1.1\r\n", errProxyProtocolRejected},
+		{"plain request from untrusted source", "GET / HTTP/1.1\r\n", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer client.Close()
+			go client.Write([]byte(tt.input))
+
+			// Pipe addresses are not TCP addresses, so the peer is never allowed
+			conn := &proxyProtocolConn{
+				Conn:   server,
+				config: &proxyProtocolConfig{headerTimeout: time.Second},
+				reader: bufio.NewReader(server),
+			}
+			defer conn.Close()
+
+			buf := make([]byte, 64)
+			n, err := conn.Read(buf)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Read returned %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || !strings.HasPrefix(tt.input, string(buf[:n])) || n == 0 {
+				t.Fatalf("Read returned %q, %v", buf[:n], err)
+			}
+		})
+	}
+}
+
+func checkProxyProtocolAddrs(t *testing.T, info *ProxyProtocolInfo, source, dest string) {
+	t.Helper()
+	addr := func(a net.Addr) string {
+		if a == nil {
+			return ""
+		}
+		return a.String()
+	}
+	if got := addr(info.SourceAddr); got != source {
+		t.Errorf("source address %q, want %q", got, source)
+	}
+	if got := addr(info.DestAddr); got != dest {
+		t.Errorf("destination address %q, want %q", got, dest)
+	}
+}
@@ -0,0 +1,354 @@
+package proxy
+
+import (
+	"SeproWAF/models"
+	"SeproWAF/services"
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/beego/beego/v2/core/logs"
+)
+
+// rateLimitPolicy is a RATE_LIMIT rule as enforced by the rate limiter
+type rateLimitPolicy struct {
+	ruleID int
+	name   string
+	action models.WAFRuleAction
+	config *models.RateLimitConfig
+	window time.Duration
+	delay  time.Duration
+}
+
+// newRateLimitPolicy builds the policy of a RATE_LIMIT rule
+func newRateLimitPolicy(rule *models.WAFRule) (*rateLimitPolicy, error) {
+	config, err := rule.GetRateLimitConfig()
+	if err != nil {
+		return nil, err
+	}
+	return &rateLimitPolicy{
+		ruleID: rule.ID,
+		name:   rule.Name,
+		action: rule.Action,
+		config: config,
+		window: time.Duration(config.Window) * time.Second,
+		delay:  time.Duration(config.Delay) * time.Millisecond,
+	}, nil
+}
+
+// matches checks if the policy counts requests of the matched route
+func (p *rateLimitPolicy) matches(route *routeProxy) bool {
+	if p.config.RouteID == 0 {
+		return true
+	}
+	return route != nil && route.Route.ID == p.config.RouteID
+}
+
+// key returns the value requests are counted by, false when the request lacks a part of it
+func (p *rateLimitPolicy) key(r *http.Request) (string, bool) {
+	parts := make([]string, 0, len(p.config.Keys)+1)
+	parts = append(parts, strconv.Itoa(p.ruleID))
+	for _, key := range p.config.Keys {
+		var value string
+		switch key.Kind {
+		case models.RateLimitKeyIP:
+			value = clientIP(r)
+		case models.RateLimitKeyJA4:
+			value = clientJA4(r)
+		case models.RateLimitKeyPath:
+			value = r.URL.Path
+		case models.RateLimitKeyHeader:
+			value = r.Header.Get(key.Name)
+		case models.RateLimitKeyCookie:
+			if cookie, err := r.Cookie(key.Name); err == nil {
+				value = cookie.Value
+			}
+		}
+		if value == "" {
+			return "", false
+		}
+		parts = append(parts, value)
+	}
+	return strings.Join(parts, "|"), true
+}
+
+// rateLimitResult is the state of a rate limit after counting a request
+type rateLimitResult struct {
+	policy    *rateLimitPolicy
+	allowed   bool
+	remaining int
+	reset     time.Duration // Until the quota is restored
+}
+
+// slidingWindow counts a request with the sliding window counter algorithm, which weights the
+// previous window by how much of it still overlaps the sliding window. The counters of both
+// windows live in the state store, so that replicas count together.
+func slidingWindow(ctx context.Context, store services.StateStore, key string, now time.Time, window time.Duration, limit int) (bool, int, time.Duration, error) {
+	start := now.Truncate(window)
+	index := start.UnixNano() / int64(window)
+	currentKey := fmt.Sprintf("%s:%d", key, index)
+
+	// Count the request first, so that concurrent requests on other replicas see it
+	current, err := store.IncrBy(ctx, currentKey, 1, 2*window)
+	if err != nil {
+		return false, 0, 0, err
+	}
+	var previous int64
+	if value, ok, err := store.Get(ctx, fmt.Sprintf("%s:%d", key, index-1)); err != nil {
+		return false, 0, 0, err
+	} else if ok {
+		previous, _ = strconv.ParseInt(value, 10, 64)
+	}
+
+	elapsed := now.Sub(start)
+	weight := 1 - float64(elapsed)/float64(window)
+	count := float64(previous)*weight + float64(current-1)
+
+	if count+1 > float64(limit) {
+		// Requests over the limit are not counted
+		if _, err := store.IncrBy(ctx, currentKey, -1, 2*window); err != nil {
+			return false, 0, 0, err
+		}
+
+		// Wait until enough of the previous window slid out, or for the next window
+		reset := window - elapsed
+		if previous > 0 && current-1 < int64(limit) {
+			excess := count + 1 - float64(limit)
+			reset = time.Duration(excess / float64(previous) * float64(window))
+		}
+		return false, 0, reset, nil
+	}
+
+	return true, int(float64(limit) - count - 1), window - elapsed, nil
+}
+
+// tokenBucket counts a request with the token bucket algorithm, refilling limit tokens per window up to burst
+func tokenBucket(ctx context.Context, store services.StateStore, key string, now time.Time, window time.Duration, limit, burst int) (bool, int, time.Duration, error) {
+	rate := float64(limit) / window.Seconds()
+	allowed, tokens, err := store.TakeToken(ctx, key, rate, burst, now)
+	if err != nil {
+		return false, 0, 0, err
+	}
+
+	if !allowed {
+		return false, 0, time.Duration((1 - tokens) / rate * float64(time.Second)), nil
+	}
+	return true, int(tokens), time.Duration((float64(burst) - tokens) / rate * float64(time.Second)), nil
+}
+
+// rateLimiter counts the requests of each site against its RATE_LIMIT rules
+type rateLimiter struct {
+	mutex    sync.RWMutex
+	policies map[int][]*rateLimitPolicy // By site ID
+	store    services.StateStore        // Holds the counters, shared by the replicas
+}
+
+// newRateLimiter creates a rate limiter counting requests in a state store
+func newRateLimiter(store services.StateStore) *rateLimiter {
+	return &rateLimiter{
+		policies: make(map[int][]*rateLimitPolicy),
+		store:    store,
+	}
+}
+
+// load reads the enabled RATE_LIMIT rules of a site
+func (rl *rateLimiter) load(siteID int) error {
+	rules, err := models.GetActiveRateLimitRules(siteID)
+	if err != nil {
+		return err
+	}
+
+	var policies []*rateLimitPolicy
+	for _, rule := range rules {
+		policy, err := newRateLimitPolicy(rule)
+		if err != nil {
+			logs.Warning("Skipping rate limit rule %d: %v", rule.ID, err)
+			continue
+		}
+		policies = append(policies, policy)
+	}
+
+	rl.mutex.Lock()
+	rl.policies[siteID] = policies
+	rl.mutex.Unlock()
+	return nil
+}
+
+// reload reads the rules of a site again, or of every site for global rules (site 0)
+func (rl *rateLimiter) reload(siteID int) {
+	siteIDs := []int{siteID}
+	if siteID == 0 {
+		rl.mutex.RLock()
+		siteIDs = siteIDs[:0]
+		for id := range rl.policies {
+			siteIDs = append(siteIDs, id)
+		}
+		rl.mutex.RUnlock()
+	}
+
+	for _, id := range siteIDs {
+		if err := rl.load(id); err != nil {
+			logs.Error("Failed to load rate limits for site %d: %v", id, err)
+		}
+	}
+}
+
+// remove forgets the policies of a removed site
+func (rl *rateLimiter) remove(siteID int) {
+	rl.mutex.Lock()
+	delete(rl.policies, siteID)
+	rl.mutex.Unlock()
+}
+
+// check counts a request against the policies of its site and route. When the state store
+// cannot be reached, requests pass in fail-open mode and exceed the limits in fail-closed mode.
+func (rl *rateLimiter) check(siteID int, route *routeProxy, r *http.Request) []rateLimitResult {
+	rl.mutex.RLock()
+	policies := rl.policies[siteID]
+	rl.mutex.RUnlock()
+
+	var results []rateLimitResult
+	now := time.Now()
+	for _, policy := range policies {
+		if !policy.matches(route) {
+			continue
+		}
+		key, ok := policy.key(r)
+		if !ok {
+			continue
+		}
+
+		result := rateLimitResult{policy: policy}
+		var err error
+		if policy.config.Algorithm == models.RateLimitTokenBucket {
+			result.allowed, result.remaining, result.reset, err = tokenBucket(r.Context(), rl.store,
+				stateKey("rl:tb:", key), now, policy.window, policy.config.Limit, policy.config.Burst)
+		} else {
+			result.allowed, result.remaining, result.reset, err = slidingWindow(r.Context(), rl.store,
+				stateKey("rl:sw:", key), now, policy.window, policy.config.Limit)
+		}
+		if err != nil {
+			if !stateStoreFailed("rate limit", err) {
+				continue
+			}
+			result = rateLimitResult{policy: policy, reset: policy.window}
+		}
+
+		results = append(results, result)
+	}
+	return results
+}
+
+// setRateLimitHeaders describes the most restrictive rate limit of a request with
+// RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset and RateLimit-Policy headers
+func setRateLimitHeaders(w http.ResponseWriter, results []rateLimitResult) {
+	if len(results) == 0 {
+		return
+	}
+
+	strictest := results[0]
+	for _, result := range results[1:] {
+		if result.remaining < strictest.remaining {
+			strictest = result
+		}
+	}
+
+	var policies []string
+	for _, result := range results {
+		policies = append(policies, fmt.Sprintf("%d;w=%d", result.policy.config.Limit, result.policy.config.Window))
+	}
+
+	header := w.Header()
+	header.Set("RateLimit-Limit", strconv.Itoa(strictest.policy.config.Limit))
+	header.Set("RateLimit-Remaining", strconv.Itoa(strictest.remaining))
+	header.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(strictest.reset)))
+	header.Set("RateLimit-Policy", strings.Join(policies, ", "))
+}
+
+// ceilSeconds rounds a duration up to whole seconds
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// logRateLimit records a request over the limit of a policy
+func logRateLimit(r *http.Request, site *models.Site, result rateLimitResult, action string, statusCode int) {
+	if wafLogService == nil {
+		return
+	}
+
+	config := result.policy.config
+	keys := make([]string, len(config.Keys))
+	for i, key := range config.Keys {
+		keys[i] = key.String()
+	}
+
+	blockStatus := 0
+	if action == "blocked" {
+		blockStatus = statusCode
+	}
+	decision := &services.Decision{
+		Source: "rate_limit",
+		Message: fmt.Sprintf("Rate limit %q exceeded: %d requests in %d seconds per %s",
+			result.policy.name, config.Limit, config.Window, strings.Join(keys, "+")),
+		Severity: "WARNING",
+		Category: "rate-limit",
+	}
+	wafLogService.LogDecisionEvent(r, decision, action, statusCode, blockStatus, site.ID, site.Domain)
+}
+
+// applyRateLimits counts a request against the rate limits of its site and applies the action
+// of the exceeded ones. It returns false when the request was answered and must not be forwarded.
+func (ps *ProxyServer) applyRateLimits(w http.ResponseWriter, r *http.Request, siteProxy *SiteProxy, route *routeProxy) bool {
+	results := ps.rateLimiter.check(siteProxy.Site.ID, route, r)
+	setRateLimitHeaders(w, results)
+
+	var delay time.Duration
+	for _, result := range results {
+		if result.allowed {
+			continue
+		}
+
+		switch result.policy.action {
+		case models.ActionBlock:
+			logRateLimit(r, siteProxy.Site, result, "blocked", http.StatusTooManyRequests)
+			w.Header().Set("Retry-After", strconv.Itoa(max(ceilSeconds(result.reset), 1)))
+			if isGRPCRequest(r) {
+				serveGRPCError(w, grpcContentType(r), http.StatusTooManyRequests, "Rate limit exceeded")
+			} else {
+				serveWAFErrorPage(w, "Too Many Requests", http.StatusTooManyRequests,
+					"You have sent too many requests. Please try again later.")
+			}
+			return false
+		case models.ActionChallenge:
+			// Clients that proved to be a browser may keep going over the limit
+			if hasClearance(r) {
+				continue
+			}
+			logRateLimit(r, siteProxy.Site, result, "challenged", http.StatusTooManyRequests)
+			serveChallenge(w, r, http.StatusTooManyRequests)
+			return false
+		case models.ActionDelay:
+			logRateLimit(r, siteProxy.Site, result, "detected", http.StatusOK)
+			delay = max(delay, result.policy.delay)
+		default:
+			logRateLimit(r, siteProxy.Site, result, "detected", http.StatusOK)
+		}
+	}
+
+	// Slow down requests over a limit with the delay action, unless the client gives up
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-r.Context().Done():
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,219 @@
+package proxy
+
+import (
+	"SeproWAF/models"
+	"SeproWAF/services"
+	"context"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// windowStart is aligned to the minute windows of the tests
+var windowStart = time.Unix(6000, 0)
+
+func TestSlidingWindow(t *testing.T) {
+	const window, limit = time.Minute, 10
+
+	tests := []struct {
+		name          string
+		previous      int64 // Requests counted in the previous window
+		current       int64 // Requests counted so far in the current window
+		elapsed       time.Duration
+		wantAllowed   bool
+		wantRemaining int
+		wantReset     time.Duration
+	}{
+		{"first request", 0, 0, 0, true, 9, time.Minute},
+		{"last request of the limit", 0, 9, 10 * time.Second, true, 0, 50 * time.Second},
+		{"over the limit without previous window", 0, 10, 10 * time.Second, false, 0, 50 * time.Second},
+		{"half of the previous window counts", 10, 0, 30 * time.Second, true, 4, 30 * time.Second},
+		{"previous window almost slid out", 10, 0, 59 * time.Second, true, 8, time.Second},
+		{"over the limit until the previous window slides out", 10, 5, 30 * time.Second, false, 0, 6 * time.Second},
+		{"previous window alone over the limit", 20, 0, 0, false, 0, 33 * time.Second},
+		{"current window full", 10, 10, 30 * time.Second, false, 0, 30 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := services.NewMemoryStateStore()
+			defer store.Close()
+			ctx := context.Background()
+
+			index := windowStart.UnixNano() / int64(window)
+			currentKey := fmt.Sprintf("k:%d", index)
+			store.Set(ctx, fmt.Sprintf("k:%d", index-1), strconv.FormatInt(tt.previous, 10), 0)
+			store.Set(ctx, currentKey, strconv.FormatInt(tt.current, 10), 0)
+
+			allowed, remaining, reset, err := slidingWindow(ctx, store, "k", windowStart.Add(tt.elapsed), window, limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if allowed != tt.wantAllowed || remaining != tt.wantRemaining || reset != tt.wantReset {
+				t.Errorf("slidingWindow = %v, %d, %v, want %v, %d, %v",
+					allowed, remaining, reset, tt.wantAllowed, tt.wantRemaining, tt.wantReset)
+			}
+
+			// Only allowed requests are counted
+			want := tt.current
+			if tt.wantAllowed {
+				want++
+			}
+			if value, _, _ := store.Get(ctx, currentKey); value != strconv.FormatInt(want, 10) {
+				t.Errorf("current window counter = %s, want %d", value, want)
+			}
+		})
+	}
+}
+
+func TestSlidingWindowAcrossWindows(t *testing.T) {
+	store := services.NewMemoryStateStore()
+	defer store.Close()
+	ctx := context.Background()
+
+	steps := []struct {
+		at          time.Duration
+		wantAllowed bool
+	}{
+		{0, true},
+		{time.Second, true},
+		{2 * time.Second, true},
+		{3 * time.Second, false},
+		// Half of the 3 requests of the previous window still count
+		{90 * time.Second, true},
+		{91 * time.Second, false},
+		// Two windows later nothing counts
+		{180 * time.Second, true},
+		{181 * time.Second, true},
+		{182 * time.Second, true},
+		{183 * time.Second, false},
+	}
+
+	for _, step := range steps {
+		allowed, _, _, err := slidingWindow(ctx, store, "k", windowStart.Add(step.at), time.Minute, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if allowed != step.wantAllowed {
+			t.Errorf("request at %v allowed = %v, want %v", step.at, allowed, step.wantAllowed)
+		}
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	store := services.NewMemoryStateStore()
+	defer store.Close()
+	ctx := context.Background()
+
+	// 60 requests per minute refill a token per second, up to 5
+	steps := []struct {
+		at            time.Duration
+		wantAllowed   bool
+		wantRemaining int
+		wantReset     time.Duration
+	}{
+		{0, true, 4, time.Second},
+		{0, true, 3, 2 * time.Second},
+		{0, true, 2, 3 * time.Second},
+		{0, true, 1, 4 * time.Second},
+		{0, true, 0, 5 * time.Second},
+		{0, false, 0, time.Second},
+		{500 * time.Millisecond, false, 0, 500 * time.Millisecond},
+		{2500 * time.Millisecond, true, 1, 3500 * time.Millisecond},
+		{2500 * time.Millisecond, true, 0, 4500 * time.Millisecond},
+		{2500 * time.Millisecond, false, 0, 500 * time.Millisecond},
+		// The bucket refills up to the burst, not beyond
+		{time.Hour, true, 4, time.Second},
+	}
+
+	for i, step := range steps {
+		allowed, remaining, reset, err := tokenBucket(ctx, store, "k", windowStart.Add(step.at), time.Minute, 60, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if allowed != step.wantAllowed || remaining != step.wantRemaining || reset != step.wantReset {
+			t.Errorf("request %d at %v = %v, %d, %v, want %v, %d, %v", i, step.at,
+				allowed, remaining, reset, step.wantAllowed, step.wantRemaining, step.wantReset)
+		}
+	}
+}
+
+// failingStateStore fails every operation, like an unreachable Redis server
+type failingStateStore struct {
+	services.StateStore
+}
+
+var errStoreDown = errors.New("connection refused")
+
+func (failingStateStore) Get(context.Context, string) (string, bool, error) {
+	return "", false, errStoreDown
+}
+
+func (failingStateStore) IncrBy(context.Context, string, int64, time.Duration) (int64, error) {
+	return 0, errStoreDown
+}
+
+func (failingStateStore) TakeToken(context.Context, string, float64, int, time.Time) (bool, float64, error) {
+	return false, 0, errStoreDown
+}
+
+func TestRateLimitStoreErrors(t *testing.T) {
+	ctx := context.Background()
+	if _, _, _, err := slidingWindow(ctx, failingStateStore{}, "k", windowStart, time.Minute, 10); !errors.Is(err, errStoreDown) {
+		t.Errorf("slidingWindow error = %v, want the store error", err)
+	}
+	if _, _, _, err := tokenBucket(ctx, failingStateStore{}, "k", windowStart, time.Minute, 10, 10); !errors.Is(err, errStoreDown) {
+		t.Errorf("tokenBucket error = %v, want the store error", err)
+	}
+}
+
+func TestCeilSeconds(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want int
+	}{
+		{0, 0},
+		{time.Millisecond, 1},
+		{time.Second, 1},
+		{1500 * time.Millisecond, 2},
+		{time.Minute, 60},
+	}
+
+	for _, tt := range tests {
+		if got := ceilSeconds(tt.d); got != tt.want {
+			t.Errorf("ceilSeconds(%v) = %d, want %d", tt.d, got, tt.want)
+		}
+	}
+}
+
+func TestSetRateLimitHeaders(t *testing.T) {
+	perMinute := &rateLimitPolicy{config: &models.RateLimitConfig{Limit: 100, Window: 60}}
+	perSecond := &rateLimitPolicy{config: &models.RateLimitConfig{Limit: 5, Window: 1}}
+
+	w := httptest.NewRecorder()
+	setRateLimitHeaders(w, []rateLimitResult{
+		{policy: perMinute, allowed: true, remaining: 40, reset: 30 * time.Second},
+		{policy: perSecond, allowed: true, remaining: 2, reset: 300 * time.Millisecond},
+	})
+
+	want := map[string]string{
+		"RateLimit-Limit":     "5",
+		"RateLimit-Remaining": "2",
+		"RateLimit-Reset":     "1",
+		"RateLimit-Policy":    "100;w=60, 5;w=1",
+	}
+	for name, value := range want {
+		if got := w.Header().Get(name); got != value {
+			t.Errorf("%s = %q, want %q", name, got, value)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	setRateLimitHeaders(w, nil)
+	if len(w.Header()) != 0 {
+		t.Errorf("headers set without results: %v", w.Header())
+	}
+}
@@ -0,0 +1,380 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"SeproWAF/models"
+
+	"github.com/corazawaf/coraza/v3"
+	"github.com/corazawaf/coraza/v3/types"
+)
+
+const (
+	// replayMaxRequests caps the size of a replayed corpus
+	replayMaxRequests = 10000
+
+	// replayClientIP is the client of recorded requests without one, a documentation address
+	replayClientIP = "192.0.2.1"
+)
+
+// ReplayRequest is a recorded request replayed through the rules of a site
+type ReplayRequest struct {
+	ID       string      `json:"id,omitempty"` // Name of the request in reports
+	Method   string      `json:"method"`
+	URL      string      `json:"url"` // Path with query string, or an absolute URL
+	Host     string      `json:"host,omitempty"`
+	Protocol string      `json:"protocol,omitempty"`
+	ClientIP string      `json:"clientIp,omitempty"`
+	Headers  http.Header `json:"headers,omitempty"`
+	Body     string      `json:"body,omitempty"`
+	JA4      string      `json:"ja4,omitempty"`
+	JA4H     string      `json:"ja4h,omitempty"`
+	Action   string      `json:"action,omitempty"` // Decision recorded with the request, for reference
+}
+
+// ReplayCandidate is a change to the rules of a site, tried out before it is saved
+type ReplayCandidate struct {
+	Rules      []*models.WAFRule `json:"rules"`      // Rules added, or replacing the saved rule with the same ID
+	Remove     []int             `json:"remove"`     // IDs of saved rules left out
+	Directives string            `json:"directives"` // SecLang directives loaded after the CRS, such as SecRuleRemoveById
+}
+
+// ReplayVerdict is what a rule set decided for a replayed request
+type ReplayVerdict struct {
+	Action  string `json:"action"`           // blocked, challenged or allowed
+	Status  int    `json:"status,omitempty"` // Status of the interruption
+	RuleID  int    `json:"ruleId,omitempty"` // Rule that interrupted the request
+	RuleIDs []int  `json:"ruleIds"`          // Rules that matched and reported a message
+}
+
+// ReplayChange describes how the outcome of a request changed with the candidate rules
+type ReplayChange string
+
+const (
+	ReplayUnchanged     ReplayChange = "unchanged"
+	ReplayNewlyBlocked  ReplayChange = "newly_blocked"  // Allowed before, blocked or challenged now
+	ReplayNewlyPassed   ReplayChange = "newly_passed"   // Blocked or challenged before, allowed now
+	ReplayActionChanged ReplayChange = "action_changed" // Blocked before and challenged now, or the other way round
+	ReplayRulesChanged  ReplayChange = "rules_changed"  // Same decision, different matching rules
+	ReplayError         ReplayChange = "error"
+)
+
+// ReplayResult is the outcome of one replayed request
+type ReplayResult struct {
+	Index        int            `json:"index"`
+	ID           string         `json:"id,omitempty"`
+	Method       string         `json:"method"`
+	URL          string         `json:"url"`
+	Change       ReplayChange   `json:"change"`
+	Baseline     *ReplayVerdict `json:"baseline,omitempty"`
+	Candidate    *ReplayVerdict `json:"candidate,omitempty"`
+	AddedRules   []int          `json:"addedRules,omitempty"`   // Rules matching only with the candidate rules
+	RemovedRules []int          `json:"removedRules,omitempty"` // Rules no longer matching with the candidate rules
+	Error        string         `json:"error,omitempty"`
+}
+
+// ReplayReport sums up a replay. Results only hold the requests whose outcome changed or that failed.
+type ReplayReport struct {
+	SiteID        int            `json:"siteId"`
+	Total         int            `json:"total"`
+	NewlyBlocked  int            `json:"newlyBlocked"`
+	NewlyPassed   int            `json:"newlyPassed"`
+	ActionChanged int            `json:"actionChanged"`
+	RulesChanged  int            `json:"rulesChanged"`
+	Unchanged     int            `json:"unchanged"`
+	Errors        int            `json:"errors"`
+	Results       []ReplayResult `json:"results"`
+}
+
+// Regressions returns the number of requests the candidate rules decide differently
+func (r *ReplayReport) Regressions() int {
+	return r.NewlyBlocked + r.NewlyPassed + r.ActionChanged
+}
+
+// ReplayCorpus replays recorded requests through the current rules of a site and through the
+// rules with a candidate change, in-process. Only the request phases are replayed: responses,
+// gRPC messages, rate limits, bans and IP access lists are left out.
+func ReplayCorpus(siteID int, candidate *ReplayCandidate, corpus []*ReplayRequest) (*ReplayReport, error) {
+	if len(corpus) == 0 {
+		return nil, fmt.Errorf("the corpus has no requests")
+	}
+	if len(corpus) > replayMaxRequests {
+		return nil, fmt.Errorf("the corpus has %d requests, at most %d can be replayed", len(corpus), replayMaxRequests)
+	}
+	if candidate == nil {
+		candidate = &ReplayCandidate{}
+	}
+
+	site, err := models.GetSiteByID(siteID)
+	if err != nil {
+		return nil, fmt.Errorf("site %d not found", siteID)
+	}
+
+	rules, err := activeSiteRules(siteID)
+	if err != nil {
+		return nil, err
+	}
+	changed, err := candidateRules(rules, candidate)
+	if err != nil {
+		return nil, err
+	}
+
+	baselineWAF, err := replayWAF(siteID, rules, "")
+	if err != nil {
+		return nil, err
+	}
+	candidateWAF, err := replayWAF(siteID, changed, candidate.Directives)
+	if err != nil {
+		return nil, fmt.Errorf("invalid candidate rules: %v", err)
+	}
+
+	report := &ReplayReport{SiteID: siteID, Total: len(corpus), Results: []ReplayResult{}}
+	report.compare(baselineWAF, candidateWAF, corpus, site.Domain)
+	return report, nil
+}
+
+// compare replays each request through both WAFs and records the requests whose outcome changed
+func (r *ReplayReport) compare(baselineWAF, candidateWAF coraza.WAF, corpus []*ReplayRequest, domain string) {
+	for i, req := range corpus {
+		result := ReplayResult{Index: i + 1, ID: req.ID, Method: req.Method, URL: req.URL}
+
+		baseline, err := replayRequest(baselineWAF, req, domain)
+		var verdict ReplayVerdict
+		if err == nil {
+			verdict, err = replayRequest(candidateWAF, req, domain)
+		}
+		if err != nil {
+			result.Change = ReplayError
+			result.Error = err.Error()
+			r.Errors++
+			r.Results = append(r.Results, result)
+			continue
+		}
+
+		result.Baseline, result.Candidate = &baseline, &verdict
+		result.AddedRules = missingRules(verdict.RuleIDs, baseline.RuleIDs)
+		result.RemovedRules = missingRules(baseline.RuleIDs, verdict.RuleIDs)
+		switch {
+		case baseline.Action == verdict.Action && len(result.AddedRules) == 0 && len(result.RemovedRules) == 0:
+			result.Change = ReplayUnchanged
+			r.Unchanged++
+			continue
+		case baseline.Action == verdict.Action:
+			result.Change = ReplayRulesChanged
+			r.RulesChanged++
+		case verdict.Action == "allowed":
+			result.Change = ReplayNewlyPassed
+			r.NewlyPassed++
+		case baseline.Action == "allowed":
+			result.Change = ReplayNewlyBlocked
+			r.NewlyBlocked++
+		default:
+			result.Change = ReplayActionChanged
+			r.ActionChanged++
+		}
+		r.Results = append(r.Results, result)
+	}
+}
+
+// candidateRules applies a candidate change to the enabled rules of a site. New rules
+// get IDs after the saved ones so that their generated rule IDs do not collide.
+func candidateRules(rules []*models.WAFRule, candidate *ReplayCandidate) ([]*models.WAFRule, error) {
+	nextID := 1
+	for _, rule := range rules {
+		if rule.ID >= nextID {
+			nextID = rule.ID + 1
+		}
+	}
+
+	replaced := make(map[int]*models.WAFRule)
+	var added []*models.WAFRule
+	for i, rule := range candidate.Rules {
+		if err := ruleGenerator.ValidateRuleParameters(rule); err != nil {
+			return nil, fmt.Errorf("candidate rule %d: %v", i+1, err)
+		}
+		if rule.ID == 0 {
+			rule.ID = nextID
+			nextID++
+		}
+		replaced[rule.ID] = rule
+		added = append(added, rule)
+	}
+
+	removed := make(map[int]bool, len(candidate.Remove))
+	for _, id := range candidate.Remove {
+		removed[id] = true
+	}
+
+	var result []*models.WAFRule
+	for _, rule := range rules {
+		if !removed[rule.ID] && replaced[rule.ID] == nil {
+			result = append(result, rule)
+		}
+	}
+	for _, rule := range added {
+		if !removed[rule.ID] && rule.Status != models.StatusDisabled {
+			result = append(result, rule)
+		}
+	}
+	return result, nil
+}
+
+// replayWAF builds a WAF for a site from a set of rules, followed by extra directives
+func replayWAF(siteID int, rules []*models.WAFRule, directives string) (coraza.WAF, error) {
+	content := customRulesContent(siteID, rules)
+	if directives != "" {
+		directives = expandDataListMacros(directives, newDataListLookup())
+	}
+
+	file, err := os.CreateTemp("", fmt.Sprintf("replay-site-%d-*.conf", siteID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create rules file: %v", err)
+	}
+	defer os.Remove(file.Name())
+
+	_, err = file.WriteString(content)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to write rules file: %v", err)
+	}
+
+	return buildSiteWAF(siteID, file.Name(), directives)
+}
+
+// replayRequest runs the request phases of a recorded request through a WAF, the same way WAFHandler does
+func replayRequest(waf coraza.WAF, req *ReplayRequest, domain string) (ReplayVerdict, error) {
+	r, err := req.httpRequest(domain)
+	if err != nil {
+		return ReplayVerdict{}, err
+	}
+
+	tx := waf.NewTransaction()
+	defer tx.Close()
+
+	processConnection(tx, r)
+	setFingerprintVariables(tx, r)
+	setGeoVariables(tx, r)
+
+	tx.ProcessURI(r.URL.String(), r.Method, r.Proto)
+	tx.AddRequestHeader("Host", r.Host)
+	tx.AddRequestHeader("X-Real-IP", clientIP(r))
+	for name, values := range r.Header {
+		for _, value := range values {
+			tx.AddRequestHeader(name, value)
+		}
+	}
+
+	interruption := tx.ProcessRequestHeaders()
+	if interruption == nil && req.Body != "" && tx.IsRequestBodyAccessible() {
+		if interruption, _, err = tx.ReadRequestBodyFrom(strings.NewReader(req.Body)); err != nil {
+			return ReplayVerdict{}, fmt.Errorf("failed to read request body: %v", err)
+		}
+	}
+	if interruption == nil {
+		if interruption, err = tx.ProcessRequestBody(); err != nil {
+			return ReplayVerdict{}, fmt.Errorf("failed to process request body: %v", err)
+		}
+	}
+
+	return newReplayVerdict(tx, interruption), nil
+}
+
+// newReplayVerdict reads the decision of a transaction
+func newReplayVerdict(tx types.Transaction, interruption *types.Interruption) ReplayVerdict {
+	verdict := ReplayVerdict{Action: "allowed", RuleIDs: []int{}}
+	switch {
+	case interruption != nil:
+		verdict.Action = "blocked"
+		verdict.Status = interruption.Status
+		verdict.RuleID = interruption.RuleID
+	case challengeRequested(tx):
+		verdict.Action = "challenged"
+	}
+
+	// Rules without a message only set variables, such as the CRS initialization and scoring rules
+	seen := make(map[int]bool)
+	for _, match := range tx.MatchedRules() {
+		id := match.Rule().ID()
+		if id == 0 || match.Message() == "" || seen[id] {
+			continue
+		}
+		seen[id] = true
+		verdict.RuleIDs = append(verdict.RuleIDs, id)
+	}
+	sort.Ints(verdict.RuleIDs)
+	return verdict
+}
+
+// missingRules returns the rule IDs of a that are not in b, both sorted
+func missingRules(a, b []int) []int {
+	var missing []int
+	for _, id := range a {
+		if i := sort.SearchInts(b, id); i == len(b) || b[i] != id {
+			missing = append(missing, id)
+		}
+	}
+	return missing
+}
+
+// httpRequest turns a recorded request into the request the proxy would have received
+func (req *ReplayRequest) httpRequest(domain string) (*http.Request, error) {
+	method := strings.ToUpper(req.Method)
+	if method == "" {
+		method = http.MethodGet
+	}
+	target := req.URL
+	if target == "" {
+		target = "/"
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL %q: %v", target, err)
+	}
+	host := req.Host
+	if host == "" {
+		host = u.Host
+	}
+	if host == "" {
+		host = domain
+	}
+
+	// The proxy sees the request URI, not the absolute URL
+	r, err := http.NewRequest(method, u.RequestURI(), bytes.NewReader([]byte(req.Body)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid request: %v", err)
+	}
+	r.Host = host
+
+	r.Proto = "HTTP/1.1"
+	if req.Protocol != "" {
+		if major, minor, ok := http.ParseHTTPVersion(strings.ToUpper(req.Protocol)); ok {
+			r.Proto, r.ProtoMajor, r.ProtoMinor = strings.ToUpper(req.Protocol), major, minor
+		}
+	}
+
+	r.Header = req.Headers.Clone()
+	if r.Header == nil {
+		r.Header = http.Header{}
+	}
+	r.Header.Del("Host")
+
+	ip := req.ClientIP
+	if net.ParseIP(ip) == nil {
+		ip = replayClientIP
+	}
+	r.RemoteAddr = net.JoinHostPort(ip, "0")
+
+	ctx := context.WithValue(r.Context(), requestFingerprintsContextKey{}, &requestFingerprints{JA4: req.JA4, JA4H: req.JA4H})
+	return r.WithContext(ctx), nil
+}
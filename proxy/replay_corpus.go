@@ -0,0 +1,268 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"SeproWAF/models"
+
+	"github.com/beego/beego/v2/client/orm"
+)
+
+// replayLine is a request of a JSONL corpus, or an exported WAF log entry or HAR entry
+type replayLine struct {
+	ID       string          `json:"id"`
+	Method   string          `json:"method"`
+	URL      string          `json:"url"`
+	Host     string          `json:"host"`
+	Protocol string          `json:"protocol"`
+	ClientIP string          `json:"clientIp"`
+	Headers  json.RawMessage `json:"headers"` // Object of strings or string arrays, or HAR name/value pairs
+	Body     string          `json:"body"`
+	JA4      string          `json:"ja4"`
+	JA4H     string          `json:"ja4h"`
+	Action   string          `json:"action"`
+
+	// An exported WAF log entry, as returned by the log detail API
+	Log     *models.WAFLog         `json:"log"`
+	Details []*models.WAFLogDetail `json:"details"`
+
+	// A HAR entry
+	Request *harRequest `json:"request"`
+}
+
+// harRequest is the request of a HAR entry
+type harRequest struct {
+	Method      string          `json:"method"`
+	URL         string          `json:"url"`
+	HTTPVersion string          `json:"httpVersion"`
+	Headers     json.RawMessage `json:"headers"`
+	PostData    *struct {
+		Text string `json:"text"`
+	} `json:"postData"`
+}
+
+// ParseReplayCorpus reads recorded requests from a HAR file, a JSON array or JSONL. Entries are
+// requests ({"method", "url", "headers", "body", ...}), WAF log entries exported with their
+// details ({"log": ..., "details": [...]}) or HAR entries.
+func ParseReplayCorpus(data []byte) ([]*ReplayRequest, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return nil, fmt.Errorf("the corpus is empty")
+	}
+
+	var entries []json.RawMessage
+	switch data[0] {
+	case '[':
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return nil, fmt.Errorf("invalid JSON array: %v", err)
+		}
+	case '{':
+		// A HAR file or a single entry, otherwise one entry per line
+		var har struct {
+			Log struct {
+				Entries []json.RawMessage `json:"entries"`
+			} `json:"log"`
+		}
+		switch {
+		case json.Unmarshal(data, &har) == nil && har.Log.Entries != nil:
+			entries = har.Log.Entries
+		case json.Valid(data):
+			entries = []json.RawMessage{data}
+		default:
+			for _, line := range bytes.Split(data, []byte("\n")) {
+				if line = bytes.TrimSpace(line); len(line) > 0 {
+					entries = append(entries, line)
+				}
+			}
+		}
+	default:
+		return nil, fmt.Errorf("the corpus must be JSONL, a JSON array or a HAR file")
+	}
+
+	corpus := make([]*ReplayRequest, 0, len(entries))
+	for i, entry := range entries {
+		req, err := parseReplayEntry(entry)
+		if err != nil {
+			return nil, fmt.Errorf("entry %d: %v", i+1, err)
+		}
+		corpus = append(corpus, req)
+	}
+	return corpus, nil
+}
+
+// parseReplayEntry reads one request of a corpus
+func parseReplayEntry(entry json.RawMessage) (*ReplayRequest, error) {
+	var line replayLine
+	if err := json.Unmarshal(entry, &line); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case line.Log != nil:
+		return replayRequestFromLog(line.Log, line.Details), nil
+	case line.Request != nil:
+		headers, err := parseReplayHeaders(line.Request.Headers)
+		if err != nil {
+			return nil, err
+		}
+		req := &ReplayRequest{
+			Method:   line.Request.Method,
+			URL:      line.Request.URL,
+			Protocol: line.Request.HTTPVersion,
+			Headers:  headers,
+		}
+		if line.Request.PostData != nil {
+			req.Body = line.Request.PostData.Text
+		}
+		return req, nil
+	}
+
+	headers, err := parseReplayHeaders(line.Headers)
+	if err != nil {
+		return nil, err
+	}
+	return &ReplayRequest{
+		ID:       line.ID,
+		Method:   line.Method,
+		URL:      line.URL,
+		Host:     line.Host,
+		Protocol: line.Protocol,
+		ClientIP: line.ClientIP,
+		Headers:  headers,
+		Body:     line.Body,
+		JA4:      line.JA4,
+		JA4H:     line.JA4H,
+		Action:   line.Action,
+	}, nil
+}
+
+// parseReplayHeaders reads headers given as an object of strings or string arrays, or as HAR name/value pairs.
+// HTTP/2 pseudo-headers are left out.
+func parseReplayHeaders(raw json.RawMessage) (http.Header, error) {
+	headers := http.Header{}
+	if len(raw) == 0 || string(raw) == "null" {
+		return headers, nil
+	}
+
+	var pairs []struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	}
+	if err := json.Unmarshal(raw, &pairs); err == nil {
+		for _, pair := range pairs {
+			if !strings.HasPrefix(pair.Name, ":") {
+				headers.Add(pair.Name, pair.Value)
+			}
+		}
+		return headers, nil
+	}
+
+	var object map[string]interface{}
+	if err := json.Unmarshal(raw, &object); err != nil {
+		return nil, fmt.Errorf("invalid headers: %v", err)
+	}
+	for name, value := range object {
+		if strings.HasPrefix(name, ":") {
+			continue
+		}
+		switch v := value.(type) {
+		case string:
+			headers.Add(name, v)
+		case []interface{}:
+			for _, item := range v {
+				if s, ok := item.(string); ok {
+					headers.Add(name, s)
+				}
+			}
+		default:
+			return nil, fmt.Errorf("invalid value of header %s", name)
+		}
+	}
+	return headers, nil
+}
+
+// replayRequestFromLog rebuilds a request from a WAF log entry. The headers come from the
+// request_headers detail, without it only the user agent and referer are known.
+// Request bodies are not logged, so they are not replayed.
+func replayRequestFromLog(log *models.WAFLog, details []*models.WAFLogDetail) *ReplayRequest {
+	req := &ReplayRequest{
+		ID:       log.TransactionID,
+		Method:   log.Method,
+		URL:      log.URI,
+		Host:     log.Domain,
+		Protocol: log.Protocol,
+		ClientIP: log.ClientIP,
+		Headers:  http.Header{},
+		JA4:      log.JA4Fingerprint,
+		JA4H:     log.JA4HFingerprint,
+		Action:   log.Action,
+	}
+	if log.QueryString != "" {
+		req.URL += "?" + log.QueryString
+	}
+
+	for _, detail := range details {
+		if detail.DetailType != "request_headers" {
+			continue
+		}
+		if err := json.Unmarshal([]byte(detail.Content), &req.Headers); err != nil {
+			req.Headers = http.Header{}
+		}
+	}
+	if len(req.Headers) == 0 {
+		if log.UserAgent != "" {
+			req.Headers.Set("User-Agent", log.UserAgent)
+		}
+		if log.Referer != "" {
+			req.Headers.Set("Referer", log.Referer)
+		}
+	}
+	return req
+}
+
+// ReplayCorpusFromLogs builds a corpus from the most recent WAF log entries of a site, oldest first
+func ReplayCorpusFromLogs(siteID, limit int) ([]*ReplayRequest, error) {
+	if limit <= 0 || limit > replayMaxRequests {
+		limit = replayMaxRequests
+	}
+
+	o := orm.NewOrm()
+	var entries []*models.WAFLog
+	if _, err := o.QueryTable(new(models.WAFLog)).
+		Filter("site_id", siteID).
+		OrderBy("-id").
+		Limit(limit).
+		All(&entries); err != nil {
+		return nil, fmt.Errorf("failed to get WAF logs: %v", err)
+	}
+	if len(entries) == 0 {
+		return nil, nil
+	}
+
+	ids := make([]int, len(entries))
+	for i, entry := range entries {
+		ids[i] = entry.ID
+	}
+	var details []*models.WAFLogDetail
+	if _, err := o.QueryTable(new(models.WAFLogDetail)).
+		Filter("waf_log_id__in", ids).
+		Filter("detail_type", "request_headers").
+		Limit(-1).
+		All(&details); err != nil {
+		return nil, fmt.Errorf("failed to get WAF log details: %v", err)
+	}
+	byLog := make(map[int64][]*models.WAFLogDetail, len(details))
+	for _, detail := range details {
+		byLog[detail.WAFLogID] = append(byLog[detail.WAFLogID], detail)
+	}
+
+	corpus := make([]*ReplayRequest, 0, len(entries))
+	for i := len(entries) - 1; i >= 0; i-- {
+		corpus = append(corpus, replayRequestFromLog(entries[i], byLog[int64(entries[i].ID)]))
+	}
+	return corpus, nil
+}
@@ -0,0 +1,277 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/beego/beego/v2/core/logs"
+	"github.com/corazawaf/coraza/v3/types"
+)
+
+// responseInterceptor inspects the upstream response with the WAF while it is written.
+// Only responses whose MIME type is listed in SecResponseBodyMimeType are held back, and
+// only up to SecResponseBodyLimit; every other response is streamed straight through.
+type responseInterceptor struct {
+	http.ResponseWriter
+	tx    types.Transaction
+	proto string
+
+	statusCode   int
+	wroteHeader  bool // WriteHeader was called by the handler
+	headerSent   bool // The status line was written to the client
+	inspecting   bool // The body is being buffered in the transaction
+	hijacked     bool
+	bytesWritten int64
+
+	interruption *types.Interruption
+
+	// hijackHook wraps hijacked connections, e.g. to inspect WebSocket frames
+	hijackHook func(net.Conn) net.Conn
+
+	// grpcContentType is set for inspected gRPC calls, whose blocks are answered with a gRPC status
+	grpcContentType string
+}
+
+// newResponseInterceptor creates a response interceptor for the transaction
+func newResponseInterceptor(w http.ResponseWriter, tx types.Transaction, proto string) *responseInterceptor {
+	return &responseInterceptor{
+		ResponseWriter: w,
+		tx:             tx,
+		proto:          proto,
+		statusCode:     http.StatusOK,
+	}
+}
+
+// WriteHeader processes the response headers and decides whether the body is inspected
+func (ri *responseInterceptor) WriteHeader(statusCode int) {
+	if ri.wroteHeader || ri.interruption != nil {
+		return
+	}
+
+	// Informational responses are forwarded as they are
+	if statusCode >= 100 && statusCode < 200 && statusCode != http.StatusSwitchingProtocols {
+		ri.ResponseWriter.WriteHeader(statusCode)
+		return
+	}
+
+	ri.wroteHeader = true
+	ri.statusCode = statusCode
+
+	for name, values := range ri.Header() {
+		for _, value := range values {
+			ri.tx.AddResponseHeader(name, value)
+		}
+	}
+
+	if it := ri.tx.ProcessResponseHeaders(statusCode, ri.proto); it != nil {
+		ri.block(it)
+		return
+	}
+
+	if ri.tx.IsResponseBodyAccessible() && ri.tx.IsResponseBodyProcessable() {
+		// Hold the status line back until the body has been inspected
+		ri.inspecting = true
+		return
+	}
+
+	ri.sendHeader()
+}
+
+// Write streams the body to the client or feeds it to the WAF while inspecting
+func (ri *responseInterceptor) Write(b []byte) (int, error) {
+	if ri.interruption != nil {
+		// Swallow the rest of a blocked response
+		return len(b), nil
+	}
+
+	if !ri.wroteHeader {
+		ri.WriteHeader(http.StatusOK)
+		if ri.interruption != nil {
+			return len(b), nil
+		}
+	}
+
+	if !ri.inspecting {
+		n, err := ri.ResponseWriter.Write(b)
+		ri.bytesWritten += int64(n)
+		return n, err
+	}
+
+	it, n, err := ri.tx.WriteResponseBody(b)
+	if err != nil {
+		return 0, err
+	}
+	if it != nil {
+		ri.block(it)
+		return len(b), nil
+	}
+
+	// The inspection limit was reached: release what was inspected and stream the rest
+	if n < len(b) {
+		if err := ri.release(); err != nil {
+			return n, err
+		}
+		if ri.interruption != nil {
+			return len(b), nil
+		}
+
+		m, err := ri.ResponseWriter.Write(b[n:])
+		ri.bytesWritten += int64(m)
+		return n + m, err
+	}
+
+	return n, nil
+}
+
+// ReadFrom lets the underlying writer use sendfile for streamed responses
+func (ri *responseInterceptor) ReadFrom(r io.Reader) (int64, error) {
+	if !ri.wroteHeader {
+		ri.WriteHeader(http.StatusOK)
+	}
+
+	if !ri.inspecting && ri.interruption == nil {
+		if rf, ok := ri.ResponseWriter.(io.ReaderFrom); ok {
+			n, err := rf.ReadFrom(r)
+			ri.bytesWritten += n
+			return n, err
+		}
+	}
+
+	// Hide ReadFrom from io.Copy to avoid calling ourselves again
+	return io.Copy(struct{ io.Writer }{ri}, r)
+}
+
+// Flush sends buffered data to the client. Bodies still under inspection are not flushed.
+func (ri *responseInterceptor) Flush() {
+	if !ri.wroteHeader {
+		ri.WriteHeader(http.StatusOK)
+	}
+
+	if ri.inspecting || ri.interruption != nil {
+		return
+	}
+
+	if flusher, ok := ri.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack hands the connection over to the handler, e.g. for WebSocket upgrades
+func (ri *responseInterceptor) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := ri.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if err == nil {
+		ri.hijacked = true
+		ri.statusCode = http.StatusSwitchingProtocols
+		if ri.hijackHook != nil {
+			conn = ri.hijackHook(conn)
+		}
+	}
+	return conn, rw, err
+}
+
+// Unwrap returns the underlying writer for http.ResponseController
+func (ri *responseInterceptor) Unwrap() http.ResponseWriter {
+	return ri.ResponseWriter
+}
+
+// sendHeader writes the status line to the client
+func (ri *responseInterceptor) sendHeader() {
+	if ri.headerSent {
+		return
+	}
+	ri.headerSent = true
+	ri.ResponseWriter.WriteHeader(ri.statusCode)
+}
+
+// release runs the response body phase on the inspected body and sends it to the client
+func (ri *responseInterceptor) release() error {
+	ri.inspecting = false
+
+	it, err := ri.tx.ProcessResponseBody()
+	if err != nil {
+		logs.Error("WAF response body processing error: %v", err)
+	}
+	if it != nil {
+		ri.block(it)
+		return nil
+	}
+
+	ri.sendHeader()
+
+	reader, err := ri.tx.ResponseBodyReader()
+	if err != nil {
+		return err
+	}
+
+	n, err := io.Copy(ri.ResponseWriter, reader)
+	ri.bytesWritten += n
+	return err
+}
+
+// block replaces the response with the WAF block page if nothing was sent yet
+func (ri *responseInterceptor) block(it *types.Interruption) {
+	ri.interruption = it
+	ri.inspecting = false
+
+	if ri.headerSent {
+		// Part of the response is already on the wire, it can only be cut short
+		logs.Warning("WAF interrupted a response that was already being streamed (rule %d)", it.RuleID)
+		return
+	}
+
+	status := it.Status
+	if status == 0 {
+		status = http.StatusForbidden
+	}
+
+	// Drop the upstream headers before rendering the block page
+	header := ri.Header()
+	for name := range header {
+		delete(header, name)
+	}
+
+	ri.headerSent = true
+	ri.statusCode = status
+	if ri.grpcContentType != "" {
+		serveGRPCError(ri.ResponseWriter, ri.grpcContentType, status,
+			"The WAF has blocked this response due to a security violation")
+		return
+	}
+	serveWAFErrorPage(ri.ResponseWriter, "Request Blocked", status,
+		"The WAF has blocked this response due to a security violation")
+}
+
+// finish completes the response once the handler returned
+func (ri *responseInterceptor) finish() error {
+	if ri.hijacked || ri.interruption != nil {
+		return nil
+	}
+
+	if !ri.wroteHeader {
+		ri.WriteHeader(http.StatusOK)
+		if ri.interruption != nil {
+			return nil
+		}
+	}
+
+	if ri.inspecting {
+		return ri.release()
+	}
+
+	// The body was streamed without inspection; still run the phase for phase 4 rules
+	if it, err := ri.tx.ProcessResponseBody(); err != nil {
+		logs.Error("WAF response body processing error: %v", err)
+	} else if it != nil && ri.interruption == nil {
+		ri.interruption = it
+	}
+
+	return nil
+}
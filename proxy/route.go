@@ -0,0 +1,243 @@
+package proxy
+
+import (
+	"SeproWAF/models"
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/beego/beego/v2/core/logs"
+)
+
+// routeContextKey is used to pass the matched route from the domain lookup to the site proxy
+type routeContextKey struct{}
+
+// routeProxy is a compiled route of a site
+type routeProxy struct {
+	Route     *models.Route
+	pathRegex *regexp.Regexp
+	methods   map[string]bool
+	headers   map[string]*regexp.Regexp
+	pool      *UpstreamPool
+}
+
+// compileRoute compiles the matchers of a route
+func compileRoute(route *models.Route) (*routeProxy, error) {
+	rp := &routeProxy{
+		Route:   route,
+		methods: make(map[string]bool),
+		headers: make(map[string]*regexp.Regexp),
+	}
+
+	if route.PathRegex != "" {
+		re, err := regexp.Compile(route.PathRegex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path regex: %v", err)
+		}
+		rp.pathRegex = re
+	}
+
+	for _, method := range route.GetMethods() {
+		rp.methods[method] = true
+	}
+
+	headers, err := route.GetHeaders()
+	if err != nil {
+		return nil, fmt.Errorf("invalid headers: %v", err)
+	}
+	for name, pattern := range headers {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex for header %s: %v", name, err)
+		}
+		rp.headers[http.CanonicalHeaderKey(name)] = re
+	}
+
+	return rp, nil
+}
+
+// cleanRoutePath resolves dot segments and repeated slashes in a request path the way the
+// upstream will, keeping a trailing slash. Routes are matched on it so that a path such as
+// /static/../api cannot select a route (and its WAF setting) meant for another path.
+func cleanRoutePath(p string) string {
+	if p == "" || p[0] != '/' {
+		p = "/" + p
+	}
+	cleaned := path.Clean(p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// hasPathPrefix checks if a clean path is the prefix itself or lies below it, on a segment boundary
+func hasPathPrefix(p, prefix string) bool {
+	return p == prefix || strings.HasPrefix(p, strings.TrimSuffix(prefix, "/")+"/")
+}
+
+// matches checks if the request matches every matcher of the route
+func (rp *routeProxy) matches(r *http.Request) bool {
+	p := cleanRoutePath(r.URL.Path)
+	if rp.Route.PathPrefix != "" && !hasPathPrefix(p, rp.Route.PathPrefix) {
+		return false
+	}
+
+	if rp.pathRegex != nil && !rp.pathRegex.MatchString(p) {
+		return false
+	}
+
+	if len(rp.methods) > 0 && !rp.methods[r.Method] {
+		return false
+	}
+
+	for name, re := range rp.headers {
+		values, ok := r.Header[name]
+		if !ok {
+			return false
+		}
+
+		matched := false
+		for _, value := range values {
+			if re.MatchString(value) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	return true
+}
+
+// rewritePath returns a copy of the request with the matched path prefix replaced
+// by the route's rewrite prefix. The incoming request keeps the client's path,
+// which the WAF logs.
+func (rp *routeProxy) rewritePath(r *http.Request) *http.Request {
+	if rp.Route.PathPrefix == "" || rp.Route.RewritePrefix == "" {
+		return r
+	}
+
+	rest := strings.TrimPrefix(cleanRoutePath(r.URL.Path), rp.Route.PathPrefix)
+	r = r.Clone(r.Context())
+	if rest == "" {
+		r.URL.Path = rp.Route.RewritePrefix
+	} else {
+		r.URL.Path = singleJoiningSlash(rp.Route.RewritePrefix, rest)
+	}
+	r.URL.RawPath = ""
+	return r
+}
+
+// buildSiteRouting creates the backends, default pool and routes of a site.
+// Upstreams referenced by a route are left out of the default pool, which falls
+// back to the site's target URL when no other upstream is enabled.
+func buildSiteRouting(site *models.Site, upstreams []*models.Upstream, routes []*models.Route, previous []*Backend) ([]*Backend, *UpstreamPool, []*routeProxy, error) {
+	var backends []*Backend
+	backendsByID := make(map[int]*Backend)
+
+	for _, upstream := range upstreams {
+		if !upstream.Enabled {
+			continue
+		}
+
+		backend, err := newBackend(site, upstream)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		// Keep the health state of unchanged backends
+		backend = adoptBackend(backend, previous)
+		backends = append(backends, backend)
+		backendsByID[upstream.ID] = backend
+	}
+
+	// Find the upstreams used by routes
+	routed := make(map[int]bool)
+	for _, route := range routes {
+		if !route.Enabled {
+			continue
+		}
+		for _, id := range route.GetUpstreamIDs() {
+			routed[id] = true
+		}
+	}
+
+	var defaultBackends []*Backend
+	for _, backend := range backends {
+		if !routed[backend.ID()] {
+			defaultBackends = append(defaultBackends, backend)
+		}
+	}
+
+	// Fall back to the legacy single target URL
+	if len(defaultBackends) == 0 {
+		backend, err := newTargetBackend(site)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		backend = adoptBackend(backend, previous)
+		backends = append(backends, backend)
+		defaultBackends = append(defaultBackends, backend)
+	}
+
+	defaultPool := NewUpstreamPool(site, defaultBackends)
+
+	var routeProxies []*routeProxy
+	for _, route := range routes {
+		if !route.Enabled {
+			continue
+		}
+
+		rp, err := compileRoute(route)
+		if err != nil {
+			logs.Error("Skipping route %q of site %s: %v", route.Name, site.Domain, err)
+			continue
+		}
+
+		var routeBackends []*Backend
+		for _, id := range route.GetUpstreamIDs() {
+			if backend, ok := backendsByID[id]; ok {
+				routeBackends = append(routeBackends, backend)
+			}
+		}
+
+		if len(routeBackends) > 0 {
+			rp.pool = NewUpstreamPool(site, routeBackends)
+		} else {
+			if len(route.GetUpstreamIDs()) > 0 {
+				logs.Warning("Route %q of site %s has no enabled upstream, using the site pool", route.Name, site.Domain)
+			}
+			rp.pool = defaultPool
+		}
+
+		routeProxies = append(routeProxies, rp)
+	}
+
+	return backends, defaultPool, routeProxies, nil
+}
+
+// matchRoute returns the first route of the site matching the request, or nil
+func (sp *SiteProxy) matchRoute(r *http.Request) *routeProxy {
+	for _, rp := range sp.routes {
+		if rp.matches(r) {
+			return rp
+		}
+	}
+	return nil
+}
+
+// withRoute stores the matched route in the request context
+func withRoute(r *http.Request, rp *routeProxy) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), routeContextKey{}, rp))
+}
+
+// routeFromContext returns the route matched for a request
+func routeFromContext(ctx context.Context) (*routeProxy, bool) {
+	rp, ok := ctx.Value(routeContextKey{}).(*routeProxy)
+	return rp, ok
+}
@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"SeproWAF/models"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCleanRoutePath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"", "/"},
+		{"/", "/"},
+		{"/static/app.js", "/static/app.js"},
+		{"/static/", "/static/"},
+		{"/static/../api/users", "/api/users"},
+		{"/static/./../../api", "/api"},
+		{"//static//app.js", "/static/app.js"},
+		{"/static/..", "/"},
+		{"static/app.js", "/static/app.js"},
+	}
+
+	for _, tt := range tests {
+		if got := cleanRoutePath(tt.path); got != tt.want {
+			t.Errorf("cleanRoutePath(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestRouteMatchesPathPrefix(t *testing.T) {
+	tests := []struct {
+		name   string
+		route  models.Route
+		target string
+		want   bool
+	}{
+		{"exact prefix", models.Route{PathPrefix: "/static"}, "/static", true},
+		{"below prefix", models.Route{PathPrefix: "/static"}, "/static/app.js", true},
+		{"below prefix with slash", models.Route{PathPrefix: "/static/"}, "/static/app.js", true},
+		{"same start of another segment", models.Route{PathPrefix: "/static"}, "/staticX/app.js", false},
+		{"dot segments leave the prefix", models.Route{PathPrefix: "/static"}, "/static/../api/users", false},
+		{"encoded dot segments leave the prefix", models.Route{PathPrefix: "/static"}, "/static/%2e%2e/api/users", false},
+		{"encoded slash and dots", models.Route{PathPrefix: "/static"}, "/static%2f..%2fapi", false},
+		{"dot segments into the prefix", models.Route{PathPrefix: "/static"}, "/api/../static/app.js", true},
+		{"repeated slashes", models.Route{PathPrefix: "/static"}, "//static//app.js", true},
+		{"root prefix", models.Route{PathPrefix: "/"}, "/anything", true},
+		{"regex on the clean path", models.Route{PathRegex: `^/static/[^/]+\.js$`}, "/static/../static/app.js", true},
+		{"regex rejects the resolved path", models.Route{PathRegex: `^/static/`}, "/static/../api", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			route := tt.route
+			rp, err := compileRoute(&route)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if got := rp.matches(r); got != tt.want {
+				t.Errorf("matches(%q) = %v, want %v", tt.target, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRouteRewritePath(t *testing.T) {
+	tests := []struct {
+		prefix  string
+		rewrite string
+		target  string
+		want    string
+	}{
+		{"/static", "/assets", "/static/app.js", "/assets/app.js"},
+		{"/static", "/assets", "/static", "/assets"},
+		{"/static/", "/assets/", "/static/css/site.css", "/assets/css/site.css"},
+		{"/static", "/assets", "/static/css/../app.js", "/assets/app.js"},
+		{"/static", "/assets", "/static//app.js", "/assets/app.js"},
+	}
+
+	for _, tt := range tests {
+		rp := &routeProxy{Route: &models.Route{PathPrefix: tt.prefix, RewritePrefix: tt.rewrite}}
+		r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+		rewritten := rp.rewritePath(r)
+		if rewritten.URL.Path != tt.want {
+			t.Errorf("rewritePath(%q) with %q -> %q = %q, want %q", tt.target, tt.prefix, tt.rewrite, rewritten.URL.Path, tt.want)
+		}
+		// The incoming request keeps the path the client sent
+		if r.URL.Path != tt.target {
+			t.Errorf("rewritePath(%q) changed the incoming path to %q", tt.target, r.URL.Path)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"SeproWAF/models"
+	"SeproWAF/services"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/beego/beego/v2/core/logs"
+)
+
+// stateErrorLogged is the Unix time the last state store error was logged
+var stateErrorLogged atomic.Int64
+
+// stateFailureMode returns how requests are treated when the state store cannot be reached
+var stateFailureMode = services.GetStateFailureMode
+
+// stateStoreFailed logs a state store error, at most every 10 seconds so that an unreachable
+// store does not flood the log, and returns whether the request must be treated as over its
+// limit or banned
+func stateStoreFailed(operation string, err error) bool {
+	now := time.Now().Unix()
+	if last := stateErrorLogged.Load(); now-last >= 10 && stateErrorLogged.CompareAndSwap(last, now) {
+		logs.Error("State store %s failed: %v", operation, err)
+	}
+	return stateFailureMode() == services.StateFailClosed
+}
+
+// stateKey turns a key made of client supplied values into a state store key of fixed length
+func stateKey(prefix, key string) string {
+	sum := sha1.Sum([]byte(key))
+	return prefix + hex.EncodeToString(sum[:])
+}
+
+// activeBan returns the temporary ban of the client IP or JA4 fingerprint of a request, nil
+// when the client is not banned. In fail-closed mode clients count as banned while the state
+// store cannot be reached.
+func activeBan(r *http.Request) *services.Ban {
+	for _, client := range []struct {
+		kind  models.BanTarget
+		value string
+	}{
+		{models.BanTargetIP, clientIP(r)},
+		{models.BanTargetJA4, clientJA4(r)},
+	} {
+		ban, err := services.GetBan(r.Context(), client.kind, client.value)
+		if err != nil {
+			if stateStoreFailed("ban lookup", err) {
+				return &services.Ban{Kind: client.kind, Value: client.value, Reason: "Ban state unavailable"}
+			}
+			return nil
+		}
+		if ban != nil {
+			return ban
+		}
+	}
+	return nil
+}
+
+// logBan records a request refused because its client is banned
+func logBan(r *http.Request, site *models.Site, ban *services.Ban) {
+	if wafLogService == nil {
+		return
+	}
+
+	message := fmt.Sprintf("Client %s %s is banned: %s", ban.Kind, ban.Value, ban.Reason)
+	if !ban.ExpiresAt.IsZero() {
+		message += fmt.Sprintf(" (until %s)", ban.ExpiresAt.UTC().Format(time.RFC3339))
+	}
+	decision := &services.Decision{
+		Source:   "ban",
+		Message:  message,
+		Severity: "WARNING",
+		Category: "ban",
+	}
+	wafLogService.LogDecisionEvent(r, decision, "blocked", http.StatusForbidden, http.StatusForbidden, site.ID, site.Domain)
+}
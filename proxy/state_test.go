@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"SeproWAF/models"
+	"SeproWAF/services"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// withStateFailureMode runs the rest of a test with the given failure mode
+func withStateFailureMode(t *testing.T, mode services.StateFailureMode) {
+	t.Helper()
+	previous := stateFailureMode
+	stateFailureMode = func() services.StateFailureMode { return mode }
+	t.Cleanup(func() { stateFailureMode = previous })
+}
+
+func TestStateStoreFailed(t *testing.T) {
+	tests := []struct {
+		mode services.StateFailureMode
+		want bool
+	}{
+		{services.StateFailOpen, false},
+		{services.StateFailClosed, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.mode), func(t *testing.T) {
+			withStateFailureMode(t, tt.mode)
+			if got := stateStoreFailed("test", errStoreDown); got != tt.want {
+				t.Errorf("stateStoreFailed = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimiterStoreFailure(t *testing.T) {
+	policy := &rateLimitPolicy{
+		ruleID: 1,
+		config: &models.RateLimitConfig{
+			Limit:  10,
+			Window: 60,
+			Keys:   []models.RateLimitKey{{Kind: models.RateLimitKeyIP}},
+		},
+		window: time.Minute,
+	}
+
+	tests := []struct {
+		name      string
+		mode      services.StateFailureMode
+		algorithm models.RateLimitAlgorithm
+		wantLimit bool // Whether the request counts as over the limit
+	}{
+		{"sliding window fail open", services.StateFailOpen, models.RateLimitSlidingWindow, false},
+		{"sliding window fail closed", services.StateFailClosed, models.RateLimitSlidingWindow, true},
+		{"token bucket fail open", services.StateFailOpen, models.RateLimitTokenBucket, false},
+		{"token bucket fail closed", services.StateFailClosed, models.RateLimitTokenBucket, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withStateFailureMode(t, tt.mode)
+
+			p := *policy
+			config := *policy.config
+			config.Algorithm = tt.algorithm
+			config.Burst = config.Limit
+			p.config = &config
+
+			rl := newRateLimiter(failingStateStore{})
+			rl.policies[1] = []*rateLimitPolicy{&p}
+
+			results := rl.check(1, nil, httptest.NewRequest(http.MethodGet, "/", nil))
+			if !tt.wantLimit {
+				if len(results) != 0 {
+					t.Fatalf("fail-open check returned %v", results)
+				}
+				return
+			}
+			if len(results) != 1 || results[0].allowed || results[0].reset != time.Minute {
+				t.Fatalf("fail-closed check returned %v, want the request over the limit for a window", results)
+			}
+		})
+	}
+}
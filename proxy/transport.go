@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"SeproWAF/models"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/beego/beego/v2/core/logs"
+)
+
+// newSiteTransport creates the transport used to reach the upstreams of a site
+func newSiteTransport(settings *models.SiteSettings) *http.Transport {
+	ts := settings.Transport
+
+	dialer := &net.Dialer{
+		Timeout:   seconds(ts.DialTimeout),
+		KeepAlive: 30 * time.Second,
+	}
+
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		Protocols:             upstreamProtocols(ts.Protocol),
+		TLSHandshakeTimeout:   seconds(ts.TLSHandshakeTimeout),
+		ResponseHeaderTimeout: seconds(ts.ResponseHeaderTimeout),
+		IdleConnTimeout:       seconds(ts.IdleConnTimeout),
+		MaxIdleConns:          ts.MaxIdleConns,
+		MaxIdleConnsPerHost:   ts.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       ts.MaxConnsPerHost,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
+// upstreamProtocols returns the HTTP versions the transport may use for the upstream protocol setting
+func upstreamProtocols(protocol models.UpstreamProtocol) *http.Protocols {
+	protocols := new(http.Protocols)
+	switch protocol {
+	case models.UpstreamProtocolHTTP1:
+		protocols.SetHTTP1(true)
+	case models.UpstreamProtocolHTTP2:
+		protocols.SetHTTP2(true)
+	case models.UpstreamProtocolH2C:
+		// Without HTTP/1 the transport uses prior knowledge for http:// URLs
+		protocols.SetHTTP2(true)
+		protocols.SetUnencryptedHTTP2(true)
+	default:
+		protocols.SetHTTP1(true)
+		protocols.SetHTTP2(true)
+	}
+	return protocols
+}
+
+// stripH2CUpgrade removes a client's HTTP/1.1 upgrade to h2c, the proxy does not relay it
+// to the upstream. Clients can speak h2c with prior knowledge instead.
+func stripH2CUpgrade(req *http.Request) {
+	if !strings.EqualFold(req.Header.Get("Upgrade"), "h2c") {
+		return
+	}
+	req.Header.Del("Upgrade")
+	req.Header.Del("HTTP2-Settings")
+}
+
+// seconds converts a setting in seconds to a duration
+func seconds(value int) time.Duration {
+	return time.Duration(value) * time.Second
+}
+
+// retryTransport retries idempotent requests that failed before a response was received
+type retryTransport struct {
+	base       http.RoundTripper
+	attempts   int
+	backoff    time.Duration
+	maxBackoff time.Duration
+}
+
+// newRetryTransport wraps the transport with the site's retry policy
+func newRetryTransport(base http.RoundTripper, settings *models.SiteSettings) http.RoundTripper {
+	if settings.Retry.Attempts <= 0 {
+		return base
+	}
+
+	return &retryTransport{
+		base:       base,
+		attempts:   settings.Retry.Attempts,
+		backoff:    time.Duration(settings.Retry.Backoff) * time.Millisecond,
+		maxBackoff: time.Duration(settings.Retry.MaxBackoff) * time.Millisecond,
+	}
+}
+
+// RoundTrip sends the request, retrying with exponential backoff on transport errors
+func (rt *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !isRetryable(req) {
+		return rt.base.RoundTrip(req)
+	}
+
+	delay := rt.backoff
+	for attempt := 0; ; attempt++ {
+		resp, err := rt.base.RoundTrip(req)
+		if err == nil || attempt >= rt.attempts || errors.Is(err, context.Canceled) {
+			return resp, err
+		}
+
+		logs.Debug("Retrying %s %s after upstream error (attempt %d/%d): %v",
+			req.Method, req.URL.Host, attempt+1, rt.attempts, err)
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(delay):
+		}
+
+		if delay *= 2; delay > rt.maxBackoff {
+			delay = rt.maxBackoff
+		}
+
+		// Requests with a body can only be retried if it can be read again
+		if req.Body != nil && req.Body != http.NoBody {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+}
+
+// isRetryable checks if a request can safely be sent again
+func isRetryable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+	default:
+		return false
+	}
+
+	// Protocol upgrades hand the connection over and are never retried
+	if req.Header.Get("Upgrade") != "" {
+		return false
+	}
+
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
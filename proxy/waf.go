@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -20,6 +21,7 @@ import (
 	"github.com/beego/beego/v2/core/logs"
 	"github.com/beego/beego/v2/server/web"
 	"github.com/corazawaf/coraza/v3"
+	"google.golang.org/protobuf/reflect/protoregistry"
 )
 
 var (
@@ -55,41 +57,25 @@ func init() {
 
 	// Initialize the try lock channel
 	ruleDbTryLock <- struct{}{}
-
-	// Add a background cleanup for the cache
-	go func() {
-		ticker := time.NewTicker(10 * time.Minute)
-		defer ticker.Stop()
-
-		for range ticker.C {
-			now := time.Now()
-			wafDecisionCacheMutex.Lock()
-
-			// Clean expired entries
-			for key, value := range wafDecisionCache {
-				if now.Sub(value.timestamp) > wafCacheTTL {
-					delete(wafDecisionCache, key)
-				}
-			}
-
-			wafDecisionCacheMutex.Unlock()
-		}
-	}()
 }
 
 // WAFManager manages Coraza WAF instances for each site
 type WAFManager struct {
-	wafInstances map[int]coraza.WAF
-	mutex        sync.RWMutex
-	shutdownCh   chan struct{}
+	wafInstances    map[int]coraza.WAF
+	wsInstances     map[int]*webSocketWAF        // WAF instances used for WebSocket frames
+	grpcDescriptors map[int]*protoregistry.Files // Parsed gRPC descriptor sets, nil for sites without one
+	mutex           sync.RWMutex
+	shutdownCh      chan struct{}
 }
 
 // NewWAFManager creates a new WAF manager
 func NewWAFManager() (*WAFManager, error) {
 	manager := &WAFManager{
-		wafInstances: make(map[int]coraza.WAF),
-		mutex:        sync.RWMutex{},
-		shutdownCh:   make(chan struct{}),
+		wafInstances:    make(map[int]coraza.WAF),
+		wsInstances:     make(map[int]*webSocketWAF),
+		grpcDescriptors: make(map[int]*protoregistry.Files),
+		mutex:           sync.RWMutex{},
+		shutdownCh:      make(chan struct{}),
 	}
 
 	// Start the rule update checker in a goroutine
@@ -116,6 +102,27 @@ func (wm *WAFManager) GenerateCustomRulesFile(siteID int) (string, error) {
 		return "", fmt.Errorf("failed to create rules directory: %v", err)
 	}
 
+	rules, err := activeSiteRules(siteID)
+	if err != nil {
+		return "", err
+	}
+
+	// Write rules to file
+	rulesFile := filepath.Join(siteDir, "custom_rules.conf")
+	if err := os.WriteFile(rulesFile, []byte(customRulesContent(siteID, rules)), 0644); err != nil {
+		return "", fmt.Errorf("failed to write rules file: %v", err)
+	}
+
+	// Update rule version
+	ruleMutex.Lock()
+	ruleVersions[siteID] = time.Now().UnixNano()
+	ruleMutex.Unlock()
+
+	return rulesFile, nil
+}
+
+// activeSiteRules returns the enabled rules of a site, including the global ones
+func activeSiteRules(siteID int) ([]*models.WAFRule, error) {
 	// Use connection from pool
 	o := db.GetPool().GetOrm()
 
@@ -124,46 +131,57 @@ func (wm *WAFManager) GenerateCustomRulesFile(siteID int) (string, error) {
 	defer cancel()
 
 	var rules []*models.WAFRule
-	_, err = o.QueryTable(new(models.WAFRule)).
-		Filter("status", models.RuleStatusActive).
+	_, err := o.QueryTable(new(models.WAFRule)).
+		Filter("status", models.StatusEnabled).
 		Filter("site_id__in", []int{0, siteID}).
 		OrderBy("priority").
 		AllWithCtx(ctx, &rules)
 
 	if err != nil {
-		return "", fmt.Errorf("failed to get active rules: %v", err)
+		return nil, fmt.Errorf("failed to get active rules: %v", err)
 	}
+	return rules, nil
+}
 
-	// Generate rules file content
+// customRulesContent writes the rules of a site as SecLang directives
+func customRulesContent(siteID int, rules []*models.WAFRule) string {
 	content := fmt.Sprintf("# Custom WAF rules for site %d\n", siteID)
 	content += "# Generated at " + time.Now().Format(time.RFC3339) + "\n\n"
 
+	// Exclusions come first so that they also apply to the custom rules
+	sort.SliceStable(rules, func(i, j int) bool {
+		return rules[i].Type == models.ExclusionRule && rules[j].Type != models.ExclusionRule
+	})
+
+	// Data list references are expanded to operators reading the list files
+	lookup := newDataListLookup()
 	for _, rule := range rules {
-		content += rule.RuleText + "\n\n"
-	}
+		// Rate limits are enforced by the rate limiter, older ones still carry SecRule text
+		if rule.Type == models.RateLimitRule {
+			continue
+		}
 
-	// Write rules to file
-	rulesFile := filepath.Join(siteDir, "custom_rules.conf")
-	if err := os.WriteFile(rulesFile, []byte(content), 0644); err != nil {
-		return "", fmt.Errorf("failed to write rules file: %v", err)
+		// Generated rules are built again, their stored text may predate the rule's ID
+		ruleText := rule.RuleText
+		if rule.Type != models.CustomRule {
+			if text, err := ruleGenerator.GenerateRule(rule); err != nil {
+				logs.Warning("Failed to generate rule %d, using its stored text: %v", rule.ID, err)
+			} else {
+				ruleText = text
+			}
+		}
+		content += expandDataListMacros(ruleText, lookup) + "\n\n"
 	}
-
-	// Update rule version
-	ruleMutex.Lock()
-	ruleVersions[siteID] = time.Now().UnixNano()
-	ruleMutex.Unlock()
-
-	return rulesFile, nil
+	return content
 }
 
 // LoadRulesWithCustomRules loads all rules including custom rules for a site
 func (wm *WAFManager) LoadRulesWithCustomRules(siteID int) (coraza.WAF, error) {
-	// Try to get rules directory from config
-	rulesDir, err := web.AppConfig.String("WAFRulesDir")
-	if err != nil || rulesDir == "" {
-		rulesDir = "rules"
-	}
+	return wm.loadRules(siteID, "")
+}
 
+// loadRules loads all rules for a site, followed by extra directives applied after the CRS
+func (wm *WAFManager) loadRules(siteID int, extraDirectives string) (coraza.WAF, error) {
 	// Generate custom rules file
 	customRulesFile, err := wm.GenerateCustomRulesFile(siteID)
 	if err != nil {
@@ -171,19 +189,38 @@ func (wm *WAFManager) LoadRulesWithCustomRules(siteID int) (coraza.WAF, error) {
 		// Continue without custom rules
 	}
 
-	// Create WAF configuration
+	return buildSiteWAF(siteID, customRulesFile, extraDirectives)
+}
+
+// buildSiteWAF creates a WAF for a site from the base configuration, a custom rules file and the CRS
+func buildSiteWAF(siteID int, customRulesFile, extraDirectives string) (coraza.WAF, error) {
+	// Try to get rules directory from config
+	rulesDir, err := web.AppConfig.String("WAFRulesDir")
+	if err != nil || rulesDir == "" {
+		rulesDir = "rules"
+	}
+
+	engineDirectives, crsDirectives := siteWAFDirectives(siteID)
+
+	// Create WAF configuration, with the site's engine mode overriding the one of coraza.conf
 	cfg := coraza.NewWAFConfig().
-		WithDirectivesFromFile(filepath.Join(rulesDir, "coraza.conf"))
+		WithDirectivesFromFile(filepath.Join(rulesDir, "coraza.conf")).
+		WithDirectives(engineDirectives)
 
 	// Add custom rules if available
 	if customRulesFile != "" {
 		cfg = cfg.WithDirectivesFromFile(customRulesFile)
 	}
 
-	// Add CRS rules
+	// Add CRS rules, the site's CRS settings go between the setup and the rules initializing them
 	cfg = cfg.WithDirectivesFromFile(filepath.Join(rulesDir, "coreruleset", "crs-setup.conf.example")).
+		WithDirectives(crsDirectives).
 		WithDirectivesFromFile(filepath.Join(rulesDir, "coreruleset", "rules", "*.conf"))
 
+	if extraDirectives != "" {
+		cfg = cfg.WithDirectives(extraDirectives)
+	}
+
 	// Create WAF instance
 	waf, err := coraza.NewWAF(cfg)
 	if err != nil {
@@ -193,6 +230,31 @@ func (wm *WAFManager) LoadRulesWithCustomRules(siteID int) (coraza.WAF, error) {
 	return waf, nil
 }
 
+// siteWAFDirectives returns the directives applying the WAF settings of a site: the rule engine
+// mode and the CRS paranoia level and anomaly thresholds
+func siteWAFDirectives(siteID int) (engine string, crs string) {
+	settings := models.DefaultSiteSettings()
+	site := &models.Site{ID: siteID}
+	if err := db.GetPool().GetOrm().Read(site); err != nil {
+		logs.Warning("Failed to load WAF settings of site %d, using defaults: %v", siteID, err)
+	} else if settings, err = site.GetSettings(); err != nil {
+		logs.Warning("Using default WAF settings for site %d: %v", siteID, err)
+	}
+
+	w := settings.WAF
+	engine = fmt.Sprintf("SecRuleEngine %s", w.EngineMode)
+	if w.EngineMode == models.WAFEngineDetectionOnly {
+		// Rules still set variables, this keeps TX:challenge from challenging clients
+		engine += "\nSecAction \"id:899000,phase:1,pass,nolog,t:none,setvar:tx.detection_only=1\""
+	}
+	crs = fmt.Sprintf(`SecAction "id:899001,phase:1,pass,nolog,t:none,`+
+		`setvar:tx.blocking_paranoia_level=%d,`+
+		`setvar:tx.inbound_anomaly_score_threshold=%d,`+
+		`setvar:tx.outbound_anomaly_score_threshold=%d"`,
+		w.ParanoiaLevel, w.InboundAnomalyThreshold, w.OutboundAnomalyThreshold)
+	return engine, crs
+}
+
 // RulesNeedReload checks if rules for a site need to be reloaded
 func (wm *WAFManager) RulesNeedReload(siteID int) bool {
 	// Check cache first to avoid excessive DB calls
@@ -258,6 +320,9 @@ func (wm *WAFManager) ReloadWAF(siteID int) error {
 	// Update the WAF instance in the map
 	wm.wafInstances[siteID] = waf
 
+	// WebSocket instances are rebuilt on their next use
+	delete(wm.wsInstances, siteID)
+
 	// Update rule version timestamp
 	ruleMutex.Lock()
 	ruleVersions[siteID] = time.Now().UnixNano()
@@ -266,6 +331,22 @@ func (wm *WAFManager) ReloadWAF(siteID int) error {
 	return nil
 }
 
+// ReloadAllWAFs rebuilds the WAF instances of every site that has one
+func (wm *WAFManager) ReloadAllWAFs() {
+	wm.mutex.RLock()
+	siteIDs := make([]int, 0, len(wm.wafInstances))
+	for siteID := range wm.wafInstances {
+		siteIDs = append(siteIDs, siteID)
+	}
+	wm.mutex.RUnlock()
+
+	for _, siteID := range siteIDs {
+		if err := wm.ReloadWAF(siteID); err != nil {
+			logs.Error("Failed to reload WAF for site %d: %v", siteID, err)
+		}
+	}
+}
+
 // GetWAF gets or creates a WAF instance for a site
 func (wm *WAFManager) GetWAF(siteID int) (coraza.WAF, error) {
 	wm.mutex.RLock()
@@ -293,45 +374,67 @@ func (wm *WAFManager) GetWAF(siteID int) (coraza.WAF, error) {
 	return waf, nil
 }
 
-// Cache to store previous WAF inspection results
-type wafruleCache struct {
-	decision  string
-	timestamp time.Time
-}
-
-var (
-	// Simple in-memory cache for identical requests
-	wafDecisionCache      = make(map[string]wafruleCache)
-	wafDecisionCacheMutex sync.RWMutex
-	wafCacheTTL           = 5 * time.Minute
-)
+// wafCacheTTL is how long the decision for identical requests is kept in the state store
+var wafCacheTTL = 5 * time.Minute
 
 // WAFHandler creates an HTTP handler with WAF protection
-func (wm *WAFManager) WAFHandler(next http.Handler, siteID int, siteDomain string) http.Handler {
+func (wm *WAFManager) WAFHandler(next http.Handler, site *models.Site) http.Handler {
+	siteID, siteDomain := site.ID, site.Domain
+
+	settings, err := site.GetSettings()
+	if err != nil {
+		logs.Warning("Using default gRPC settings for site %d: %v", siteID, err)
+	}
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Generate a more complete cache key including query parameters
-		cacheKey := fmt.Sprintf("%s:%s:%s%s:%s",
+		cacheKey := fmt.Sprintf("%s:%s:%s:%s:%s%s:%s",
 			siteDomain,
+			requestFingerprintsFromContext(r.Context()).JA4, // Rules check the TLS fingerprint
+			r.Proto, // Rules check the protocol version
 			r.Method,
 			r.URL.Path,
 			r.URL.RawQuery, // Include query parameters
-			r.RemoteAddr)
-
-		// Check cache for recent identical requests
-		wafDecisionCacheMutex.RLock()
-		cachedDecision, found := wafDecisionCache[cacheKey]
-		wafDecisionCacheMutex.RUnlock()
-
-		if found && time.Since(cachedDecision.timestamp) < wafCacheTTL {
-			// We've seen this exact request recently
-			if cachedDecision.decision == "blocked" {
-				serveWAFErrorPage(w, "Request Blocked", http.StatusForbidden,
-					"The WAF has blocked this request due to a security violation")
+			clientIP(r))
+
+		// Requests with a body are never cached, the key does not cover the body.
+		// Neither are WebSocket handshakes, whose frames may need inspection.
+		upgrade := isWebSocketUpgrade(r)
+		cacheable := r.ContentLength == 0 && len(r.TransferEncoding) == 0 && !upgrade
+
+		// gRPC calls are decoded for the WAF and blocked with a gRPC status
+		var grpcService, grpcMethod string
+		grpcCall := site.GRPCInspection && isGRPCRequest(r)
+		if grpcCall {
+			grpcService, grpcMethod, grpcCall = parseGRPCPath(r.URL.Path)
+		}
+
+		deny := func(status int, message string) {
+			if grpcCall {
+				serveGRPCError(w, grpcContentType(r), status, message)
+				return
+			}
+			serveWAFErrorPage(w, "Request Blocked", status, message)
+		}
+
+		// Check cache for recent identical requests, which the replicas share through the
+		// state store. The cache only saves work, so a store error just means inspecting.
+		store := services.GetStateStore()
+		decisionKey := stateKey("waf:decision:", cacheKey)
+		if cacheable {
+			decision, found, err := store.Get(r.Context(), decisionKey)
+			if err != nil {
+				stateStoreFailed("decision cache lookup", err)
+			} else if found {
+				// We've seen this exact request recently
+				if decision == "blocked" {
+					deny(http.StatusForbidden, "The WAF has blocked this request due to a security violation")
+					return
+				}
+				// If allowed, continue to next handler
+				next.ServeHTTP(w, r)
 				return
 			}
-			// If allowed, continue to next handler
-			next.ServeHTTP(w, r)
-			return
 		}
 
 		// For testing purposes, process all requests through the WAF
@@ -362,15 +465,20 @@ func (wm *WAFManager) WAFHandler(next http.Handler, siteID int, siteDomain strin
 			tx.Close()
 		}()
 
+		// Feed the resolved client IP to REMOTE_ADDR
+		processConnection(tx, r)
+		setFingerprintVariables(tx, r)
+		setGeoVariables(tx, r)
+
 		// Process request headers and URL
 		tx.ProcessURI(r.URL.String(), r.Method, r.Proto)
 		tx.AddRequestHeader("Host", r.Host) // Add host as a header
 
-		// Add remote address header for logging
-		if remoteAddr, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
-			tx.AddRequestHeader("X-Real-IP", remoteAddr)
-		} else {
-			tx.AddRequestHeader("X-Real-IP", r.RemoteAddr)
+		// Add client address header for logging
+		tx.AddRequestHeader("X-Real-IP", clientIP(r))
+
+		if grpcCall {
+			setGRPCVariables(tx, grpcService, grpcMethod)
 		}
 
 		// Process request headers
@@ -400,46 +508,109 @@ func (wm *WAFManager) WAFHandler(next http.Handler, siteID int, siteDomain strin
 			)
 
 			// Use error template instead of basic HTTP error
-			serveWAFErrorPage(w, "Request Blocked", intervention.Status,
-				"The WAF has blocked this request due to a security violation")
+			deny(intervention.Status, "The WAF has blocked this request due to a security violation")
 			return
 		}
 
-		// Process request body if available
-		if r.Body != nil && r.ContentLength > 0 {
-			bodyBytes, err := io.ReadAll(r.Body)
-			if err != nil {
-				logs.Error("Failed to read request body for WAF processing: %v", err)
-			} else {
-				// Create a new ReadCloser for the request body
-				r.Body = io.NopCloser(bytes.NewReader(bodyBytes))
-
-				// Process request body by writing it directly to transaction
-				interrupt, _, err := tx.WriteRequestBody(bodyBytes)
-				if err != nil {
-					logs.Error("WAF request body processing error: %v", err)
-				} else if interrupt != nil {
-					logs.Warning("WAF blocked request to %s during body processing", siteDomain)
+		// Stream the request body into the transaction. Coraza buffers it up to
+		// SecRequestBodyLimit, spilling to disk beyond SecRequestBodyInMemoryLimit,
+		// so chunked and unknown-length bodies are inspected as well.
+		if grpcCall && r.Body != nil && r.Body != http.NoBody {
+			// Only the first message is read here, so streaming calls keep flowing
+			raw, interrupt, err := wm.inspectGRPCMessage(tx, r, siteID, grpcService, grpcMethod)
+			if rejection, ok := grpcUninspectable(err, settings.GRPC); ok {
+				if rejection != nil {
+					logs.Warning("WAF rejected gRPC call %s/%s to %s: %v", grpcService, grpcMethod, siteDomain, err)
 
-					// Log WAF blocking event
 					wafLogService.LogWAFEvent(
 						tx,
 						r,
 						"blocked",
-						http.StatusForbidden,
-						http.StatusForbidden,
+						rejection.httpStatus,
+						rejection.httpStatus,
 						0,
 						time.Since(startTime),
 						siteID,
 						siteDomain,
 					)
 
-					// Use error template instead of basic HTTP error
-					serveWAFErrorPage(w, "Request Blocked", http.StatusForbidden,
-						"The WAF has blocked this request due to a security violation in the body content")
+					serveGRPCStatus(w, grpcContentType(r), rejection.code, rejection.message)
 					return
 				}
+				logs.Debug("Forwarding gRPC call %s/%s to %s uninspected: %v", grpcService, grpcMethod, siteDomain, err)
+			} else if err != nil {
+				logs.Error("Failed to read gRPC message for WAF processing: %v", err)
+				serveGRPCError(w, grpcContentType(r), http.StatusBadRequest, "Failed to read request message")
+				return
+			}
+
+			if interrupt != nil {
+				logs.Warning("WAF blocked gRPC call %s/%s to %s during body processing", grpcService, grpcMethod, siteDomain)
+
+				// Log WAF blocking event
+				wafLogService.LogWAFEvent(
+					tx,
+					r,
+					"blocked",
+					interrupt.Status,
+					interrupt.Status,
+					0,
+					time.Since(startTime),
+					siteID,
+					siteDomain,
+				)
+
+				deny(interrupt.Status, "The WAF has blocked this request due to a security violation in the body content")
+				return
+			}
+
+			if settings.GRPC.InspectStreamMessages {
+				// Later messages of client streams are inspected as the upstream reads them
+				call := r.Clone(r.Context())
+				r.Body = newGRPCStreamBody(raw, r.Body, r.Header.Get("Grpc-Encoding"), settings.GRPC, func(message []byte) *grpcRejectedError {
+					return wm.inspectGRPCStreamMessage(waf, call, siteID, siteDomain, grpcService, grpcMethod, message)
+				})
+			} else {
+				r.Body = replayBody{Reader: io.MultiReader(bytes.NewReader(raw), r.Body), Closer: r.Body}
+			}
+		} else if tx.IsRequestBodyAccessible() && r.Body != nil && r.Body != http.NoBody {
+			interrupt, _, err := tx.ReadRequestBodyFrom(r.Body)
+			if err != nil {
+				logs.Error("Failed to read request body for WAF processing: %v", err)
+				http.Error(w, "Failed to read request body", http.StatusInternalServerError)
+				return
+			}
+
+			if interrupt != nil {
+				logs.Warning("WAF blocked request to %s during body processing", siteDomain)
+
+				// Log WAF blocking event
+				wafLogService.LogWAFEvent(
+					tx,
+					r,
+					"blocked",
+					interrupt.Status,
+					interrupt.Status,
+					0,
+					time.Since(startTime),
+					siteID,
+					siteDomain,
+				)
+
+				// Use error template instead of basic HTTP error
+				deny(interrupt.Status, "The WAF has blocked this request due to a security violation in the body content")
+				return
 			}
+
+			// Replay the buffered body to the upstream, followed by anything past
+			// the inspection limit that Coraza did not read
+			bodyReader, err := tx.RequestBodyReader()
+			if err != nil {
+				logs.Error("Failed to get the buffered request body: %v", err)
+				http.Error(w, "Failed to read request body", http.StatusInternalServerError)
+				return
+			}
+			r.Body = replayBody{Reader: io.MultiReader(bodyReader, r.Body), Closer: r.Body}
 		}
 
 		// Process request body phase
@@ -468,114 +639,109 @@ func (wm *WAFManager) WAFHandler(next http.Handler, siteID int, siteDomain strin
 			)
 
 			// Use error template instead of basic HTTP error
-			serveWAFErrorPage(w, "Request Blocked", intervention.Status,
-				"The WAF has blocked this request due to a security violation")
+			deny(intervention.Status, "The WAF has blocked this request due to a security violation")
 			return
 		}
 
-		// Create a response writer wrapper to capture the response
-		rww := newResponseWriterWrapper(w)
+		// Rules with the challenge action let the request pass with TX:challenge set, it only
+		// reaches the upstream once the client solved the challenge
+		if challengeRequested(tx) && !hasClearance(r) {
+			logs.Info("WAF challenged request to %s", siteDomain)
 
-		// Call the next handler
-		next.ServeHTTP(rww, r)
+			wafLogService.LogWAFEvent(
+				tx,
+				r,
+				"challenged",
+				http.StatusForbidden,
+				0,
+				0,
+				time.Since(startTime),
+				siteID,
+				siteDomain,
+			)
 
-		// Process response headers
-		for key, values := range rww.Header() {
-			for _, value := range values {
-				tx.AddResponseHeader(key, value)
-			}
+			serveChallenge(w, r, http.StatusForbidden)
+			return
 		}
-		tx.ProcessResponseHeaders(rww.statusCode, rww.proto)
 
-		// Process response body
-		if len(rww.body) > 0 {
-			interrupt, _, err := tx.WriteResponseBody(rww.body)
-			if err != nil {
-				logs.Error("WAF response body processing error: %v", err)
-			} else if interrupt != nil {
-				logs.Warning("WAF blocked response from %s during body processing", siteDomain)
+		// Inspect the response while streaming it to the client
+		ri := newResponseInterceptor(w, tx, r.Proto)
+		if grpcCall {
+			ri.grpcContentType = grpcContentType(r)
+		}
 
-				// Log WAF blocking event (response)
-				wafLogService.LogWAFEvent(
-					tx,
-					r,
-					"blocked",
-					http.StatusForbidden,
-					http.StatusForbidden,
-					int64(len(rww.body)),
-					time.Since(startTime),
-					siteID,
-					siteDomain,
-				)
+		// Inspect the text messages of WebSocket connections
+		if upgrade && site.WebSocketInspection {
+			if wsWAF, err := wm.GetWebSocketWAF(site); err != nil {
+				logs.Error("Failed to get WebSocket WAF instance for site %d: %v", siteID, err)
+			} else {
+				// Frames are inspected as sent, so compression must not be negotiated
+				r.Header.Del("Sec-WebSocket-Extensions")
 
-				http.Error(w, "Forbidden", http.StatusForbidden)
-				return
+				handshake := r.Clone(r.Context())
+				ri.hijackHook = func(conn net.Conn) net.Conn {
+					return wm.inspectWebSocket(conn, wsWAF, handshake, site)
+				}
 			}
+		}
+
+		// Call the next handler
+		next.ServeHTTP(ri, r)
 
-			// Process response body phase
-			tx.ProcessResponseBody()
+		if err := ri.finish(); err != nil {
+			logs.Error("Failed to write response from %s: %v", siteDomain, err)
 		}
 
-		// Check if the response should be blocked
-		if intervention := tx.Interruption(); intervention != nil {
-			logs.Warning("WAF blocked response from %s: %s", siteDomain, intervention.Action)
+		// Check if the response was blocked
+		if ri.interruption != nil {
+			logs.Warning("WAF blocked response from %s: %s", siteDomain, ri.interruption.Action)
 
 			// Log WAF blocking event (response)
 			wafLogService.LogWAFEvent(
 				tx,
 				r,
 				"blocked",
-				http.StatusForbidden,
-				http.StatusForbidden,
-				int64(len(rww.body)),
+				ri.statusCode,
+				ri.statusCode,
+				ri.bytesWritten,
 				time.Since(startTime),
 				siteID,
 				siteDomain,
 			)
-
-			http.Error(w, "Forbidden", http.StatusForbidden)
 			return
 		}
 
-		// After processing, update cache with decision
-		decision := "allowed"
-		if intervention := tx.Interruption(); intervention != nil {
-			decision = "blocked"
-			// Existing blocked request handling
-		}
-
-		// Update cache
-		wafDecisionCacheMutex.Lock()
-		wafDecisionCache[cacheKey] = wafruleCache{
-			decision:  decision,
-			timestamp: time.Now(),
+		// Update cache. Challenged requests only passed thanks to their clearance cookie,
+		// which the cache key does not cover, so other clients must still be challenged.
+		if cacheable && !challengeRequested(tx) {
+			if err := store.Set(r.Context(), decisionKey, "allowed", wafCacheTTL); err != nil {
+				stateStoreFailed("decision cache update", err)
+			}
 		}
-		wafDecisionCacheMutex.Unlock()
 
 		// Log allowed request
 		wafLogService.LogWAFEvent(
 			tx,
 			r,
 			"allowed",
-			rww.statusCode,
+			ri.statusCode,
 			0,
-			int64(len(rww.body)),
+			ri.bytesWritten,
 			time.Since(startTime),
 			siteID,
 			siteDomain,
 		)
-
-		// Write the response body if not blocked
-		w.Write(rww.body)
 	})
 }
 
+// replayBody replays the request body buffered by the WAF while closing the original body
+type replayBody struct {
+	io.Reader
+	io.Closer
+}
+
 // serveWAFErrorPage renders a custom WAF block page
 func serveWAFErrorPage(w http.ResponseWriter, title string, statusCode int, message string) {
-	// Set status code and content type
-	w.WriteHeader(statusCode)
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-
 	// Path to the WAF block page
 	blockPagePath := "proxy/waf_block.html"
 
@@ -593,39 +759,14 @@ func serveWAFErrorPage(w http.ResponseWriter, title string, statusCode int, mess
 	htmlContent = strings.Replace(htmlContent, "{{.ErrorCode}}", fmt.Sprintf("%d", statusCode), -1)
 	htmlContent = strings.Replace(htmlContent, "{{.ErrorMessage}}", message, -1)
 
+	// Set content type and status code
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(statusCode)
+
 	// Write the response
 	w.Write([]byte(htmlContent))
 }
 
-// responseWriterWrapper wraps an http.ResponseWriter to capture the response
-type responseWriterWrapper struct {
-	http.ResponseWriter
-	statusCode int
-	proto      string
-	body       []byte
-}
-
-// newResponseWriterWrapper creates a new response writer wrapper
-func newResponseWriterWrapper(w http.ResponseWriter) *responseWriterWrapper {
-	return &responseWriterWrapper{
-		ResponseWriter: w,
-		statusCode:     http.StatusOK,
-		proto:          "HTTP/1.1",
-	}
-}
-
-// WriteHeader captures the status code
-func (rww *responseWriterWrapper) WriteHeader(statusCode int) {
-	rww.statusCode = statusCode
-	rww.ResponseWriter.WriteHeader(statusCode)
-}
-
-// Write captures the response body
-func (rww *responseWriterWrapper) Write(b []byte) (int, error) {
-	rww.body = append(rww.body, b...)
-	return len(b), nil
-}
-
 // CheckForRuleUpdates checks for rule updates less frequently and reuses connections
 func (wm *WAFManager) CheckForRuleUpdates() {
 	// Try to acquire the mutex with a timeout, but use a non-blocking approach first
@@ -0,0 +1,363 @@
+package proxy
+
+import (
+	"SeproWAF/models"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/beego/beego/v2/core/logs"
+	"github.com/corazawaf/coraza/v3"
+)
+
+const (
+	// maxWebSocketMessageSize caps how much of a text message is inspected
+	maxWebSocketMessageSize = 1 << 20
+
+	// maxRuleID is the upper bound used when removing the rules outside a subset
+	maxRuleID = 99999999
+
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpClose        = 0x8
+
+	// wsClosePolicyViolation is the close code sent when a message is blocked
+	wsClosePolicyViolation = 1008
+)
+
+// alwaysKeptRuleRanges are CRS initialization and blocking evaluation rules, which
+// anomaly scoring rules depend on, so they are kept in every rule subset
+var alwaysKeptRuleRanges = []models.RuleIDRange{
+	{Start: 900000, End: 901999},
+	{Start: 949000, End: 949999},
+}
+
+// errWebSocketMessageBlocked is returned by the inspected connection once a message is blocked
+var errWebSocketMessageBlocked = errors.New("websocket message blocked by WAF")
+
+// webSocketWAF is the WAF instance used to inspect the WebSocket frames of a site
+type webSocketWAF struct {
+	ruleIDs string
+	waf     coraza.WAF
+}
+
+// GetWebSocketWAF gets or creates the WAF instance used for the WebSocket frames of a site.
+// Only the rules in the site's WebSocket rule subset are kept.
+func (wm *WAFManager) GetWebSocketWAF(site *models.Site) (coraza.WAF, error) {
+	wm.mutex.RLock()
+	instance, exists := wm.wsInstances[site.ID]
+	wm.mutex.RUnlock()
+
+	if exists && instance.ruleIDs == site.WebSocketRuleIDs {
+		return instance.waf, nil
+	}
+
+	ranges, err := models.ParseRuleIDRanges(site.WebSocketRuleIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	waf, err := wm.loadRules(site.ID, ruleSubsetDirectives(ranges))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create WebSocket WAF instance: %v", err)
+	}
+
+	wm.mutex.Lock()
+	wm.wsInstances[site.ID] = &webSocketWAF{ruleIDs: site.WebSocketRuleIDs, waf: waf}
+	wm.mutex.Unlock()
+
+	return waf, nil
+}
+
+// ruleSubsetDirectives removes every rule outside the given ranges. No ranges keeps all rules.
+func ruleSubsetDirectives(ranges []models.RuleIDRange) string {
+	if len(ranges) == 0 {
+		return ""
+	}
+
+	keep := append(append([]models.RuleIDRange{}, ranges...), alwaysKeptRuleRanges...)
+	sort.Slice(keep, func(i, j int) bool { return keep[i].Start < keep[j].Start })
+
+	var removed []string
+	next := 1
+	for _, r := range keep {
+		if r.Start > next {
+			removed = append(removed, fmt.Sprintf("%d-%d", next, r.Start-1))
+		}
+		if r.End+1 > next {
+			next = r.End + 1
+		}
+	}
+	if next <= maxRuleID {
+		removed = append(removed, fmt.Sprintf("%d-%d", next, maxRuleID))
+	}
+
+	if len(removed) == 0 {
+		return ""
+	}
+	return "SecRuleRemoveById " + strings.Join(removed, " ")
+}
+
+// isWebSocketUpgrade checks if the request is a WebSocket handshake
+func isWebSocketUpgrade(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket") &&
+		strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade")
+}
+
+// wsFrameParser reassembles the text messages of a client-to-server frame stream
+type wsFrameParser struct {
+	header    []byte
+	remaining uint64
+	mask      [4]byte
+	maskPos   int
+	opcode    byte
+	fin       bool
+	inText    bool // The current message is a text message
+	message   []byte
+	onMessage func(message []byte) error
+}
+
+// feed parses the next chunk of the stream, calling onMessage for every complete text message
+func (p *wsFrameParser) feed(b []byte) error {
+	for len(b) > 0 {
+		if p.remaining == 0 && !p.headerComplete() {
+			// Collect the frame header
+			need := p.headerLength() - len(p.header)
+			if need > len(b) {
+				need = len(b)
+			}
+			p.header = append(p.header, b[:need]...)
+			b = b[need:]
+
+			if p.headerComplete() {
+				if err := p.startFrame(); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		// Consume the frame payload
+		n := uint64(len(b))
+		if n > p.remaining {
+			n = p.remaining
+		}
+		if p.inText && p.opcode < wsOpClose {
+			p.appendPayload(b[:n])
+		}
+		p.remaining -= n
+		b = b[n:]
+
+		if p.remaining == 0 {
+			if err := p.endFrame(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// headerLength returns the length of the current frame header, as far as it is known
+func (p *wsFrameParser) headerLength() int {
+	if len(p.header) < 2 {
+		return 2
+	}
+
+	length := 2
+	switch p.header[1] & 0x7f {
+	case 126:
+		length += 2
+	case 127:
+		length += 8
+	}
+	if p.header[1]&0x80 != 0 {
+		length += 4
+	}
+	return length
+}
+
+// headerComplete reports whether the whole frame header was collected
+func (p *wsFrameParser) headerComplete() bool {
+	return len(p.header) >= 2 && len(p.header) == p.headerLength()
+}
+
+// startFrame decodes the collected header
+func (p *wsFrameParser) startFrame() error {
+	p.fin = p.header[0]&0x80 != 0
+	p.opcode = p.header[0] & 0x0f
+
+	offset := 2
+	switch length := p.header[1] & 0x7f; length {
+	case 126:
+		p.remaining = uint64(binary.BigEndian.Uint16(p.header[2:4]))
+		offset += 2
+	case 127:
+		p.remaining = binary.BigEndian.Uint64(p.header[2:10])
+		offset += 8
+	default:
+		p.remaining = uint64(length)
+	}
+
+	if p.header[1]&0x80 != 0 {
+		copy(p.mask[:], p.header[offset:offset+4])
+	} else {
+		p.mask = [4]byte{}
+	}
+	p.maskPos = 0
+
+	switch p.opcode {
+	case wsOpText:
+		p.inText = true
+		p.message = p.message[:0]
+	case wsOpContinuation:
+		// Continues the current message
+	default:
+		if p.opcode < wsOpClose {
+			// Binary messages are not inspected
+			p.inText = false
+		}
+	}
+
+	p.header = p.header[:0]
+
+	// Frames without payload end right away
+	if p.remaining == 0 {
+		return p.endFrame()
+	}
+	return nil
+}
+
+// appendPayload unmasks and stores the payload of a text message
+func (p *wsFrameParser) appendPayload(b []byte) {
+	for _, c := range b {
+		if len(p.message) < maxWebSocketMessageSize {
+			p.message = append(p.message, c^p.mask[p.maskPos%4])
+		}
+		p.maskPos++
+	}
+}
+
+// endFrame hands complete text messages over for inspection
+func (p *wsFrameParser) endFrame() error {
+	if p.opcode >= wsOpClose {
+		// Control frames can be interleaved with a fragmented message
+		return nil
+	}
+
+	if p.fin && p.inText {
+		p.inText = false
+		return p.onMessage(p.message)
+	}
+	return nil
+}
+
+// webSocketConn inspects the client messages of a hijacked WebSocket connection
+type webSocketConn struct {
+	net.Conn
+	parser     *wsFrameParser
+	writeMutex sync.Mutex
+	blocked    bool
+}
+
+// Read reads from the client, inspecting complete text messages before handing them on
+func (c *webSocketConn) Read(b []byte) (int, error) {
+	if c.blocked {
+		return 0, errWebSocketMessageBlocked
+	}
+
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		if perr := c.parser.feed(b[:n]); perr != nil {
+			c.blocked = true
+			c.closeWithPolicyViolation()
+			return 0, perr
+		}
+	}
+	return n, err
+}
+
+// Write writes to the client
+func (c *webSocketConn) Write(b []byte) (int, error) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	return c.Conn.Write(b)
+}
+
+// closeWithPolicyViolation sends a close frame with the policy violation code and closes the connection
+func (c *webSocketConn) closeWithPolicyViolation() {
+	reason := "Blocked by WAF"
+	frame := []byte{0x80 | wsOpClose, byte(2 + len(reason))}
+	frame = binary.BigEndian.AppendUint16(frame, wsClosePolicyViolation)
+	frame = append(frame, reason...)
+
+	c.writeMutex.Lock()
+	c.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+	c.Conn.Write(frame)
+	c.writeMutex.Unlock()
+
+	c.Conn.Close()
+}
+
+// inspectWebSocket wraps a hijacked connection so that its text messages are inspected by the WAF
+func (wm *WAFManager) inspectWebSocket(conn net.Conn, waf coraza.WAF, r *http.Request, site *models.Site) net.Conn {
+	wsConn := &webSocketConn{Conn: conn}
+	wsConn.parser = &wsFrameParser{
+		onMessage: func(message []byte) error {
+			return wm.inspectWebSocketMessage(waf, r, site, message)
+		},
+	}
+	return wsConn
+}
+
+// inspectWebSocketMessage runs a text message through the WAF as the body of the handshake request
+func (wm *WAFManager) inspectWebSocketMessage(waf coraza.WAF, r *http.Request, site *models.Site, message []byte) error {
+	startTime := time.Now()
+
+	tx := waf.NewTransaction()
+	defer func() {
+		tx.ProcessLogging()
+		tx.Close()
+	}()
+
+	processConnection(tx, r)
+	tx.ProcessURI(r.URL.String(), r.Method, r.Proto)
+	tx.AddRequestHeader("Host", r.Host)
+	for name, values := range r.Header {
+		for _, value := range values {
+			tx.AddRequestHeader(name, value)
+		}
+	}
+	tx.ProcessRequestHeaders()
+
+	// Expose the message both as an argument and as the raw body
+	tx.AddPostRequestArgument("websocket_message", string(message))
+	if _, _, err := tx.WriteRequestBody(message); err != nil {
+		logs.Error("WAF WebSocket message processing error: %v", err)
+	}
+	if _, err := tx.ProcessRequestBody(); err != nil {
+		logs.Error("WAF WebSocket message processing error: %v", err)
+	}
+
+	if intervention := tx.Interruption(); intervention != nil {
+		logs.Warning("WAF blocked WebSocket message to %s: %s (rule: %d)", site.Domain, intervention.Action, intervention.RuleID)
+
+		wafLogService.LogWebSocketEvent(tx, r, "blocked", wsClosePolicyViolation, string(message), time.Since(startTime), site.ID, site.Domain)
+		return errWebSocketMessageBlocked
+	}
+
+	// Log messages that matched rules without being blocked
+	for _, rule := range tx.MatchedRules() {
+		if rule.Message() != "" {
+			wafLogService.LogWebSocketEvent(tx, r, "detected", 0, string(message), time.Since(startTime), site.ID, site.Domain)
+			break
+		}
+	}
+
+	return nil
+}
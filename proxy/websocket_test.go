@@ -0,0 +1,227 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net/http/httptest"
+	"testing"
+)
+
+// wsFrame encodes a client frame, masked with a fixed key unless mask is false
+func wsFrame(fin bool, opcode byte, payload []byte, mask bool) []byte {
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+	frame := []byte{first}
+
+	maskBit := byte(0)
+	if mask {
+		maskBit = 0x80
+	}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, maskBit|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+
+	if !mask {
+		return append(frame, payload...)
+	}
+	key := [4]byte{0x37, 0xfa, 0x21, 0x3d}
+	frame = append(frame, key[:]...)
+	for i, c := range payload {
+		frame = append(frame, c^key[i%4])
+	}
+	return frame
+}
+
+func concatFrames(frames ...[]byte) []byte {
+	return bytes.Join(frames, nil)
+}
+
+func TestWebSocketFrameParser(t *testing.T) {
+	long := bytes.Repeat([]byte("a"), 300)
+	huge := bytes.Repeat([]byte("b"), 70000)
+
+	tests := []struct {
+		name   string
+		stream []byte
+		want   []string
+	}{
+		{
+			name:   "single masked text frame",
+			stream: wsFrame(true, wsOpText, []byte("hello"), true),
+			want:   []string{"hello"},
+		},
+		{
+			name:   "unmasked text frame",
+			stream: wsFrame(true, wsOpText, []byte("hello"), false),
+			want:   []string{"hello"},
+		},
+		{
+			name:   "16-bit length",
+			stream: wsFrame(true, wsOpText, long, true),
+			want:   []string{string(long)},
+		},
+		{
+			name:   "64-bit length",
+			stream: wsFrame(true, wsOpText, huge, true),
+			want:   []string{string(huge)},
+		},
+		{
+			name:   "empty text frame",
+			stream: wsFrame(true, wsOpText, nil, true),
+			want:   []string{""},
+		},
+		{
+			name: "fragmented message",
+			stream: concatFrames(
+				wsFrame(false, wsOpText, []byte("<scr"), true),
+				wsFrame(false, wsOpContinuation, []byte("ipt>"), true),
+				wsFrame(true, wsOpContinuation, []byte("alert(1)"), true),
+			),
+			want: []string{"<script>alert(1)"},
+		},
+		{
+			name: "control frames inside a fragmented message",
+			stream: concatFrames(
+				wsFrame(false, wsOpText, []byte("union "), true),
+				wsFrame(true, 0x9, []byte("ping payload"), true),
+				wsFrame(true, wsOpClose, []byte{0x03, 0xe8}, true),
+				wsFrame(true, wsOpContinuation, []byte("select"), true),
+			),
+			want: []string{"union select"},
+		},
+		{
+			name: "binary messages are skipped",
+			stream: concatFrames(
+				wsFrame(false, 0x2, []byte{0x00, 0x01}, true),
+				wsFrame(true, wsOpContinuation, []byte{0x02}, true),
+				wsFrame(true, wsOpText, []byte("after"), true),
+			),
+			want: []string{"after"},
+		},
+		{
+			name:   "continuation without a message",
+			stream: wsFrame(true, wsOpContinuation, []byte("stray"), true),
+			want:   nil,
+		},
+		{
+			name: "several messages",
+			stream: concatFrames(
+				wsFrame(true, wsOpText, []byte("one"), true),
+				wsFrame(true, wsOpText, []byte("two"), true),
+			),
+			want: []string{"one", "two"},
+		},
+		{
+			name:   "truncated header",
+			stream: wsFrame(true, wsOpText, long, true)[:3],
+			want:   nil,
+		},
+		{
+			name:   "truncated payload",
+			stream: wsFrame(true, wsOpText, []byte("hello"), true)[:8],
+			want:   nil,
+		},
+	}
+
+	for _, tt := range tests {
+		for _, chunk := range []int{0, 1, 7} {
+			var got []string
+			p := &wsFrameParser{onMessage: func(message []byte) error {
+				got = append(got, string(message))
+				return nil
+			}}
+
+			stream := tt.stream
+			if chunk == 0 {
+				if err := p.feed(stream); err != nil {
+					t.Fatalf("%s: feed: %v", tt.name, err)
+				}
+			}
+			for chunk > 0 && len(stream) > 0 {
+				n := min(chunk, len(stream))
+				if err := p.feed(stream[:n]); err != nil {
+					t.Fatalf("%s: feed in chunks of %d: %v", tt.name, chunk, err)
+				}
+				stream = stream[n:]
+			}
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("%s (chunks of %d): got %d messages, want %d", tt.name, chunk, len(got), len(tt.want))
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("%s (chunks of %d): message %d = %.40q, want %.40q", tt.name, chunk, i, got[i], tt.want[i])
+				}
+			}
+		}
+	}
+}
+
+func TestWebSocketFrameParserCapsMessages(t *testing.T) {
+	payload := bytes.Repeat([]byte("c"), maxWebSocketMessageSize+1000)
+
+	var got []byte
+	p := &wsFrameParser{onMessage: func(message []byte) error {
+		got = append([]byte(nil), message...)
+		return nil
+	}}
+	if err := p.feed(wsFrame(true, wsOpText, payload, true)); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != maxWebSocketMessageSize {
+		t.Fatalf("inspected %d bytes, want %d", len(got), maxWebSocketMessageSize)
+	}
+}
+
+func TestWebSocketFrameParserStopsOnBlockedMessage(t *testing.T) {
+	blocked := errors.New("blocked")
+	calls := 0
+	p := &wsFrameParser{onMessage: func(message []byte) error {
+		calls++
+		return blocked
+	}}
+
+	stream := concatFrames(
+		wsFrame(true, wsOpText, []byte("bad"), true),
+		wsFrame(true, wsOpText, []byte("next"), true),
+	)
+	if err := p.feed(stream); !errors.Is(err, blocked) {
+		t.Fatalf("feed returned %v, want the message error", err)
+	}
+	if calls != 1 {
+		t.Fatalf("onMessage called %d times after a blocked message", calls)
+	}
+}
+
+func TestIsWebSocketUpgrade(t *testing.T) {
+	tests := []struct {
+		upgrade    string
+		connection string
+		want       bool
+	}{
+		{"websocket", "Upgrade", true},
+		{"WebSocket", "keep-alive, Upgrade", true},
+		{"websocket", "keep-alive", false},
+		{"h2c", "Upgrade", false},
+		{"", "", false},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/ws", nil)
+		r.Header.Set("Upgrade", tt.upgrade)
+		r.Header.Set("Connection", tt.connection)
+		if got := isWebSocketUpgrade(r); got != tt.want {
+			t.Errorf("isWebSocketUpgrade(%q, %q) = %v, want %v", tt.upgrade, tt.connection, got, tt.want)
+		}
+	}
+}
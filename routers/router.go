@@ -35,6 +35,7 @@ func init() {
 	web.Router("/waf/logs", &controllers.UIController{}, "get:WAFLogsList")
 	web.Router("/waf/logs/:id", &controllers.UIController{}, "get:WAFLogDetail")
 	web.Router("/waf/rules", &controllers.UIController{}, "get:GlobalRules")
+	web.Router("/admin/bans", &controllers.UIController{}, "get:BanList")
 
 	// API Routes
 	// Public API routes
@@ -55,6 +56,15 @@ func init() {
 	web.Router("/api/sites/:id/toggle-status", &controllers.SiteController{}, "post:ToggleSiteStatus")
 	web.Router("/api/sites/:id/toggle-waf", &controllers.SiteController{}, "post:ToggleWAF")
 	web.Router("/api/sites/:id/stats", &controllers.SiteController{}, "get:GetSiteStats")
+	web.Router("/api/sites/:id/settings", &controllers.SiteController{}, "get:GetSiteSettings;put:UpdateSiteSettings")
+	web.Router("/api/sites/:id/upstreams", &controllers.UpstreamController{}, "get:ListUpstreams;post:CreateUpstream")
+	web.Router("/api/sites/:id/upstreams/:upstreamId", &controllers.UpstreamController{}, "put:UpdateUpstream;delete:DeleteUpstream")
+	web.Router("/api/sites/:id/routes", &controllers.RouteController{}, "get:ListRoutes;post:CreateRoute")
+	web.Router("/api/sites/:id/routes/:routeId", &controllers.RouteController{}, "put:UpdateRoute;delete:DeleteRoute")
+	web.Router("/api/sites/:id/grpc-descriptors", &controllers.GRPCController{}, "get:GetDescriptorSet;put:UploadDescriptorSet;delete:DeleteDescriptorSet")
+	web.Router("/api/sites/:id/ip-access", &controllers.IPAccessController{}, "get:ListEntries;post:AddEntry")
+	web.Router("/api/sites/:id/ip-access/import", &controllers.IPAccessController{}, "post:ImportEntries")
+	web.Router("/api/sites/:id/ip-access/:entryId", &controllers.IPAccessController{}, "delete:DeleteEntry")
 
 	// API Routes for Certificate Management
 	web.Router("/api/certificates", &controllers.CertificateController{}, "get:ListCertificates;post:UploadCertificate")
@@ -64,8 +74,28 @@ func init() {
 	web.Router("/api/sites/:siteId/waf/rules", &controllers.WAFRuleController{}, "get:GetRules;post:CreateRule")
 	web.Router("/api/waf/rules/:id", &controllers.WAFRuleController{}, "get:GetRule;put:UpdateRule;delete:DeleteRule")
 	web.Router("/api/waf/rules/:id/toggle", &controllers.WAFRuleController{}, "post:ToggleRuleStatus")
+	web.Router("/api/waf/rules/:id/revisions", &controllers.WAFRuleController{}, "get:GetRuleRevisions")
+	web.Router("/api/waf/rules/:id/revisions/:revision", &controllers.WAFRuleController{}, "get:GetRuleRevision")
+	web.Router("/api/waf/rules/:id/diff", &controllers.WAFRuleController{}, "get:DiffRuleRevisions")
+	web.Router("/api/waf/rules/:id/rollback", &controllers.WAFRuleController{}, "post:RollbackRule")
 	web.Router("/api/waf/templates", &controllers.WAFRuleController{}, "get:GetRuleTemplates")
 	web.Router("/api/waf/test-rule", &controllers.WAFRuleController{}, "post:TestRule")
+	web.Router("/api/sites/:siteId/waf/replay", &controllers.WAFRuleController{}, "post:ReplayRules")
+
+	// API Routes for WAF Data Lists
+	web.Router("/api/waf/lists", &controllers.DataListController{}, "get:ListDataLists;post:CreateDataList")
+	web.Router("/api/waf/lists/:id", &controllers.DataListController{}, "get:GetDataList;put:UpdateDataList;delete:DeleteDataList")
+	web.Router("/api/waf/lists/:id/entries", &controllers.DataListController{}, "post:AddDataListEntries;delete:RemoveDataListEntries")
+
+	// Global IP access list
+	web.Router("/api/ip-access", &controllers.IPAccessController{}, "get:ListEntries;post:AddEntry")
+	web.Router("/api/ip-access/import", &controllers.IPAccessController{}, "post:ImportEntries")
+	web.Router("/api/ip-access/:entryId", &controllers.IPAccessController{}, "delete:DeleteEntry")
+
+	// Temporary bans and the policies placing them
+	web.Router("/api/bans", &controllers.BanController{}, "get:ListBans;post:AddBan;delete:RemoveBan")
+	web.Router("/api/bans/policies", &controllers.BanController{}, "get:ListBanPolicies;post:CreateBanPolicy")
+	web.Router("/api/bans/policies/:id", &controllers.BanController{}, "put:UpdateBanPolicy;delete:DeleteBanPolicy")
 
 	// WAF logs routes
 	// WAF logs summary (GenAI)
@@ -89,4 +119,5 @@ func init() {
 	web.Router("/api/dashboard/top-attacked-sites", &controllers.DashboardController{}, "get:GetTopAttackedSites")
 	web.Router("/api/dashboard/attacks-by-hour", &controllers.DashboardController{}, "get:GetAttacksByHour")
 	web.Router("/api/dashboard/geo-distribution", &controllers.DashboardController{}, "get:GetGeoAttackDistribution")
+	web.Router("/api/dashboard/circuit-breakers", &controllers.DashboardController{}, "get:GetCircuitBreakers")
 }
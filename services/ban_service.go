@@ -0,0 +1,297 @@
+package services
+
+import (
+	"SeproWAF/models"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/beego/beego/v2/core/logs"
+	txtype "github.com/corazawaf/coraza/v3/types"
+)
+
+const (
+	banKeyPrefix   = "ban:"      // State store keys of bans, followed by target:value
+	banHitsPrefix  = "banhits:"  // Blocks counted by a policy, followed by policyID:target:value
+	banLevelPrefix = "banlevel:" // Bans a policy placed on a client, followed by policyID:target:value
+)
+
+// Ban is a temporary ban of a client, shared by the replicas through the state store
+type Ban struct {
+	Kind      models.BanTarget `json:"kind"`
+	Value     string           `json:"value"`
+	SiteID    int              `json:"siteId"`   // Site the client misbehaved on, zero for bans added by hand
+	PolicyID  int              `json:"policyId"` // Policy that placed the ban, zero for bans added by hand
+	Level     int              `json:"level"`    // Number of bans the policy placed on the client in a row
+	Reason    string           `json:"reason"`
+	CreatedAt time.Time        `json:"createdAt"`
+	ExpiresAt time.Time        `json:"expiresAt"`
+}
+
+// banKey returns the state store key of a ban
+func banKey(kind models.BanTarget, value string) string {
+	return banKeyPrefix + string(kind) + ":" + value
+}
+
+// AddBan stores a ban until it expires, replacing an existing ban of the same client
+func AddBan(ctx context.Context, ban *Ban) error {
+	ttl := time.Until(ban.ExpiresAt)
+	if ttl <= 0 {
+		return nil
+	}
+
+	data, err := json.Marshal(ban)
+	if err != nil {
+		return err
+	}
+	return GetStateStore().Set(ctx, banKey(ban.Kind, ban.Value), string(data), ttl)
+}
+
+// GetBan returns the active ban of a client, nil when it is not banned
+func GetBan(ctx context.Context, kind models.BanTarget, value string) (*Ban, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	data, ok, err := GetStateStore().Get(ctx, banKey(kind, value))
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	ban := &Ban{}
+	if err := json.Unmarshal([]byte(data), ban); err != nil {
+		return nil, err
+	}
+	return ban, nil
+}
+
+// RemoveBan lifts the ban of a client
+func RemoveBan(ctx context.Context, kind models.BanTarget, value string) error {
+	return GetStateStore().Delete(ctx, banKey(kind, value))
+}
+
+// ListBans returns the active bans, the ones expiring last first
+func ListBans(ctx context.Context) ([]*Ban, error) {
+	values, err := GetStateStore().Scan(ctx, banKeyPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	bans := make([]*Ban, 0, len(values))
+	for _, data := range values {
+		ban := &Ban{}
+		if json.Unmarshal([]byte(data), ban) == nil {
+			bans = append(bans, ban)
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].ExpiresAt.After(bans[j].ExpiresAt)
+	})
+	return bans, nil
+}
+
+// blockEvent is a request blocked by the WAF, counted by the ban policies
+type blockEvent struct {
+	siteID   int
+	severity string
+	ip       string
+	ja4      string
+}
+
+// BanEngine bans clients that keep getting blocked by the WAF, following the ban policies.
+// Counters and ban levels live in the state store, so blocks on every replica add up.
+type BanEngine struct {
+	mutex    sync.RWMutex
+	policies []*models.BanPolicy
+	events   chan blockEvent
+}
+
+var (
+	banEngine     *BanEngine
+	banEngineOnce sync.Once
+)
+
+// GetBanEngine returns the ban engine, loading the ban policies on first use
+func GetBanEngine() *BanEngine {
+	banEngineOnce.Do(func() {
+		banEngine = &BanEngine{events: make(chan blockEvent, 1000)}
+		if err := banEngine.Reload(); err != nil {
+			logs.Error("Failed to load ban policies: %v", err)
+		}
+		go banEngine.run()
+		go banEngine.watch(time.Minute)
+	})
+	return banEngine
+}
+
+// Reload reads the ban policies again after they changed
+func (e *BanEngine) Reload() error {
+	policies, err := models.GetBanPolicies()
+	if err != nil {
+		return err
+	}
+
+	e.mutex.Lock()
+	e.policies = policies
+	e.mutex.Unlock()
+	return nil
+}
+
+// watch periodically reloads the policies, picking up changes made through other replicas
+func (e *BanEngine) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := e.Reload(); err != nil {
+			logs.Error("Failed to reload ban policies: %v", err)
+		}
+	}
+}
+
+// RecordBlock queues a blocked request for the ban policies. Blocks are dropped rather
+// than slowing down requests when the engine falls behind.
+func (e *BanEngine) RecordBlock(req *http.Request, severity string, siteID int) {
+	e.mutex.RLock()
+	enabled := len(e.policies) > 0
+	e.mutex.RUnlock()
+	if !enabled {
+		return
+	}
+
+	event := blockEvent{
+		siteID:   siteID,
+		severity: severity,
+		ip:       ClientIP(req),
+		ja4:      req.Header.Get("X-JA4"),
+	}
+	select {
+	case e.events <- event:
+	default:
+	}
+}
+
+// run counts the queued blocks
+func (e *BanEngine) run() {
+	for event := range e.events {
+		e.mutex.RLock()
+		policies := e.policies
+		e.mutex.RUnlock()
+
+		for _, policy := range policies {
+			if !policy.Counts(event.siteID, event.severity) {
+				continue
+			}
+			value := event.ip
+			if policy.Target == models.BanTargetJA4 {
+				value = event.ja4
+			}
+			if value == "" {
+				continue
+			}
+			if err := e.count(context.Background(), policy, value, event.siteID); err != nil {
+				logs.Error("Ban policy %d failed: %v", policy.ID, err)
+			}
+		}
+	}
+}
+
+// count adds a block of a client to a policy and bans the client once it reaches the threshold
+func (e *BanEngine) count(ctx context.Context, policy *models.BanPolicy, value string, siteID int) error {
+	store := GetStateStore()
+	client := fmt.Sprintf("%d:%s:%s", policy.ID, policy.Target, value)
+
+	hits, err := store.IncrBy(ctx, banHitsPrefix+client, 1, time.Duration(policy.Window)*time.Minute)
+	if err != nil || hits < int64(policy.Threshold) {
+		return err
+	}
+	if err := store.Delete(ctx, banHitsPrefix+client); err != nil {
+		return err
+	}
+
+	// Each ban in a row lasts longer, until the client behaved for ResetAfter minutes
+	level := 1
+	if data, ok, err := store.Get(ctx, banLevelPrefix+client); err != nil {
+		return err
+	} else if ok {
+		previous, _ := strconv.Atoi(data)
+		level = previous + 1
+	}
+	duration := banDuration(policy, level)
+	resetAfter := time.Duration(policy.ResetAfter) * time.Minute
+	if err := store.Set(ctx, banLevelPrefix+client, strconv.Itoa(level), duration+resetAfter); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	ban := &Ban{
+		Kind:     policy.Target,
+		Value:    value,
+		SiteID:   siteID,
+		PolicyID: policy.ID,
+		Level:    level,
+		Reason: fmt.Sprintf("%d blocks within %d minutes (policy %q, ban %d)",
+			policy.Threshold, policy.Window, policy.Name, level),
+		CreatedAt: now,
+		ExpiresAt: now.Add(duration),
+	}
+
+	// Keep a longer ban placed by another policy
+	if existing, err := GetBan(ctx, ban.Kind, ban.Value); err == nil && existing != nil && existing.ExpiresAt.After(ban.ExpiresAt) {
+		return nil
+	}
+
+	logs.Warning("Banning %s %s for %s: %s", ban.Kind, ban.Value, duration, ban.Reason)
+	return AddBan(ctx, ban)
+}
+
+// banDuration returns how long the ban of the given level lasts
+func banDuration(policy *models.BanPolicy, level int) time.Duration {
+	seconds := float64(policy.BanDuration) * math.Pow(policy.Multiplier, float64(level-1))
+	seconds = math.Min(seconds, float64(policy.MaxBanDuration))
+	return time.Duration(seconds) * time.Second
+}
+
+// LiftBan removes the ban of a client and forgets its earlier bans, so that a
+// new ban starts short again
+func (e *BanEngine) LiftBan(ctx context.Context, kind models.BanTarget, value string) error {
+	if err := RemoveBan(ctx, kind, value); err != nil {
+		return err
+	}
+
+	e.mutex.RLock()
+	policies := e.policies
+	e.mutex.RUnlock()
+
+	store := GetStateStore()
+	for _, policy := range policies {
+		client := fmt.Sprintf("%d:%s:%s", policy.ID, kind, value)
+		if err := store.Delete(ctx, banLevelPrefix+client); err != nil {
+			return err
+		}
+		if err := store.Delete(ctx, banHitsPrefix+client); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// interruptionSeverity returns the severity of the rule that interrupted a transaction
+func interruptionSeverity(tx txtype.Transaction) string {
+	interruption := tx.Interruption()
+	if interruption == nil {
+		return ""
+	}
+	for _, rule := range tx.MatchedRules() {
+		if rule.Rule().ID() == interruption.RuleID {
+			return rule.Rule().Severity().String()
+		}
+	}
+	return ""
+}
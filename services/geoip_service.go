@@ -0,0 +1,214 @@
+package services
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/beego/beego/v2/core/logs"
+	"github.com/beego/beego/v2/server/web"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// GeoInfo is the location and network of an IP address
+type GeoInfo struct {
+	CountryCode   string  `json:"country_code"` // ISO 3166-1 alpha-2 code
+	CountryName   string  `json:"country_name"`
+	ContinentCode string  `json:"continent_code"`
+	Region        string  `json:"region"`
+	City          string  `json:"city"`
+	PostalCode    string  `json:"postal_code"`
+	Latitude      float64 `json:"latitude"`
+	Longitude     float64 `json:"longitude"`
+	ASN           uint    `json:"asn"`
+	ASOrg         string  `json:"as_org"`
+}
+
+// geoRecord holds the fields read from GeoIP2/GeoLite2 Country, City and ASN databases
+type geoRecord struct {
+	Continent struct {
+		Code string `maxminddb:"code"`
+	} `maxminddb:"continent"`
+	Country struct {
+		ISOCode string            `maxminddb:"iso_code"`
+		Names   map[string]string `maxminddb:"names"`
+	} `maxminddb:"country"`
+	Subdivisions []struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"subdivisions"`
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	Postal struct {
+		Code string `maxminddb:"code"`
+	} `maxminddb:"postal"`
+	Location struct {
+		Latitude  float64 `maxminddb:"latitude"`
+		Longitude float64 `maxminddb:"longitude"`
+	} `maxminddb:"location"`
+	AutonomousSystemNumber       uint   `maxminddb:"autonomous_system_number"`
+	AutonomousSystemOrganization string `maxminddb:"autonomous_system_organization"`
+}
+
+// geoDatabase is a MaxMind-format database file that is opened again when it changes
+type geoDatabase struct {
+	path    string
+	reader  *maxminddb.Reader
+	modTime time.Time
+	size    int64
+}
+
+// GeoIPService looks up the country and ASN of IP addresses in local .mmdb files
+type GeoIPService struct {
+	mutex     sync.RWMutex
+	databases []*geoDatabase // Location database first, then the ASN database
+}
+
+var (
+	geoIPService *GeoIPService
+	geoIPOnce    sync.Once
+)
+
+// GetGeoIPService returns the GeoIP service, opening the databases configured with
+// GeoIPDatabase and GeoIPASNDatabase on first use
+func GetGeoIPService() *GeoIPService {
+	geoIPOnce.Do(func() {
+		geoIPService = &GeoIPService{}
+		for _, key := range []string{"GeoIPDatabase", "GeoIPASNDatabase"} {
+			if path, err := web.AppConfig.String(key); err == nil && path != "" {
+				geoIPService.databases = append(geoIPService.databases, &geoDatabase{path: path})
+			}
+		}
+		if len(geoIPService.databases) == 0 {
+			return
+		}
+
+		geoIPService.refresh()
+
+		interval, err := web.AppConfig.Int("GeoIPReloadInterval")
+		if err != nil || interval <= 0 {
+			interval = 60
+		}
+		go geoIPService.watch(time.Duration(interval) * time.Second)
+	})
+	return geoIPService
+}
+
+// LookupGeoIP returns the location and network of an IP address, nil when it is unknown
+func LookupGeoIP(ip string) *GeoInfo {
+	return GetGeoIPService().Lookup(ip)
+}
+
+// watch opens the database files again after they were replaced, e.g. by geoipupdate
+func (s *GeoIPService) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.refresh()
+	}
+}
+
+// refresh opens the databases whose files changed since they were loaded
+func (s *GeoIPService) refresh() {
+	for _, database := range s.databases {
+		info, err := os.Stat(database.path)
+		if err != nil {
+			if database.modTime.IsZero() {
+				logs.Warning("GeoIP database %s not found: %v", database.path, err)
+				database.modTime = time.Unix(0, 0)
+			}
+			continue
+		}
+		if info.ModTime().Equal(database.modTime) && info.Size() == database.size {
+			continue
+		}
+
+		// Read the file into memory, so that it can be replaced while it is in use
+		data, err := os.ReadFile(database.path)
+		var reader *maxminddb.Reader
+		if err == nil {
+			reader, err = maxminddb.FromBytes(data)
+		}
+		if err != nil {
+			logs.Error("Failed to open GeoIP database %s: %v", database.path, err)
+			database.modTime, database.size = info.ModTime(), info.Size()
+			continue
+		}
+
+		s.mutex.Lock()
+		previous := database.reader
+		database.reader = reader
+		database.modTime, database.size = info.ModTime(), info.Size()
+		s.mutex.Unlock()
+
+		if previous != nil {
+			previous.Close()
+		}
+		logs.Info("Loaded GeoIP database %s (%s, built %s)", database.path, reader.Metadata.DatabaseType,
+			time.Unix(int64(reader.Metadata.BuildEpoch), 0).Format("2006-01-02"))
+	}
+}
+
+// Lookup returns the location and network of an IP address, nil when no database knows it
+func (s *GeoIPService) Lookup(ipStr string) *GeoInfo {
+	ip := net.ParseIP(ipStr)
+	if ip == nil || ip.IsPrivate() || ip.IsLoopback() || ip.IsUnspecified() {
+		return nil
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var record geoRecord
+	found := false
+	for _, database := range s.databases {
+		if database.reader == nil {
+			continue
+		}
+		_, ok, err := database.reader.LookupNetwork(ip, &record)
+		if err != nil {
+			logs.Debug("GeoIP lookup of %s in %s failed: %v", ipStr, database.path, err)
+			continue
+		}
+		found = found || ok
+	}
+	if !found {
+		return nil
+	}
+
+	info := &GeoInfo{
+		CountryCode:   record.Country.ISOCode,
+		CountryName:   record.Country.Names["en"],
+		ContinentCode: record.Continent.Code,
+		City:          record.City.Names["en"],
+		PostalCode:    record.Postal.Code,
+		Latitude:      record.Location.Latitude,
+		Longitude:     record.Location.Longitude,
+		ASN:           record.AutonomousSystemNumber,
+		ASOrg:         record.AutonomousSystemOrganization,
+	}
+	if len(record.Subdivisions) > 0 {
+		info.Region = record.Subdivisions[0].ISOCode
+	}
+	return info
+}
+
+// geoInfoContextKey stores the GeoIP data of the client in the request context
+type geoInfoContextKey struct{}
+
+// WithGeoInfo returns a shallow copy of the request carrying the GeoIP data of its client
+func WithGeoInfo(r *http.Request, info *GeoInfo) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), geoInfoContextKey{}, info))
+}
+
+// GeoInfoFromRequest returns the GeoIP data of the client of a request, looking it up when the proxy did not
+func GeoInfoFromRequest(r *http.Request) *GeoInfo {
+	if info, ok := r.Context().Value(geoInfoContextKey{}).(*GeoInfo); ok {
+		return info
+	}
+	return LookupGeoIP(ClientIP(r))
+}
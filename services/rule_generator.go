@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"regexp"
+	"strings"
 	"text/template"
 
 	"SeproWAF/models"
@@ -40,9 +42,9 @@ func NewRuleGenerator() *RuleGenerator {
 		rg.RegisterTemplate(models.IPBlockRule, "ip_block", ipBlockTmpl)
 	}
 
-	// Initialize rate limiting template
-	rateLimitTemplateStr := `SecRule REMOTE_ADDR "." "id:{{.ruleId}}1,phase:1,pass,nolog,setvar:tx.{{.ruleId}}_counter=+1,expirevar:tx.{{.ruleId}}_counter={{.timeWindow}}"
-	SecRule TX:{{.ruleId}}_counter "@gt {{.requestLimit}}" "id:{{.ruleId}}2,phase:1,{{.action}},status:429,log,msg:'Rate limit exceeded: {{.requestLimit}} requests in {{.timeWindow}} seconds',tag:'CUSTOM-RULE',tag:'RATE-LIMIT'"`
+	// Initialize rate limiting template. TX variables do not outlive a transaction, so rate
+	// limits are enforced by the proxy's rate limiter and only described in the rules file.
+	rateLimitTemplateStr := `# Rate limit {{.ruleId}}: {{.requestLimit}} requests in {{.timeWindow}} seconds, enforced by the proxy rate limiter`
 	rateLimitTmpl, err := template.New("rate_limit").Parse(rateLimitTemplateStr)
 	if err != nil {
 		logs.Error("Failed to parse rate limit template: %v", err)
@@ -110,6 +112,15 @@ func (rg *RuleGenerator) GenerateRule(rule *models.WAFRule) (string, error) {
 		return rule.RuleText, nil
 	}
 
+	// Exclusions are built from their parameters instead of a template
+	if rule.Type == models.ExclusionRule {
+		config, err := rule.GetExclusionConfig()
+		if err != nil {
+			return "", err
+		}
+		return generateExclusion(rule.ID+100000, config), nil
+	}
+
 	// For non-custom rules, check for templates
 	templates, exists := rg.templates[rule.Type]
 	if !exists {
@@ -138,6 +149,10 @@ func (rg *RuleGenerator) GenerateRule(rule *models.WAFRule) (string, error) {
 	// Add common parameters
 	params["ruleId"] = rule.ID + 100000
 	params["action"] = rule.Action
+	if rule.Action == models.ActionChallenge {
+		// The proxy challenges requests whose transaction sets TX:challenge
+		params["action"] = "pass,setvar:tx.challenge=1"
+	}
 
 	var tmpl *template.Template
 	switch rule.Type {
@@ -249,6 +264,18 @@ func (rg *RuleGenerator) ValidateRuleParameters(rule *models.WAFRule) error {
 		if _, ok := params["timeWindow"]; !ok {
 			return fmt.Errorf("rate limit rule requires a timeWindow parameter")
 		}
+		if _, err := models.ParseRateLimitConfig(params); err != nil {
+			return err
+		}
+		switch rule.Action {
+		case models.ActionBlock, models.ActionLog, models.ActionDelay, models.ActionChallenge:
+		default:
+			return fmt.Errorf("rate limit rule action must be block, log, delay or challenge")
+		}
+	case models.ExclusionRule:
+		if _, err := models.ParseExclusionConfig(params); err != nil {
+			return err
+		}
 	case models.SQLiRule, models.XSSRule, models.PathTraversalRule:
 		if _, ok := params["target"]; !ok {
 			return fmt.Errorf("%s rule requires a target parameter", rule.Type)
@@ -262,3 +289,48 @@ func (rg *RuleGenerator) ValidateRuleParameters(rule *models.WAFRule) error {
 
 	return nil
 }
+
+// generateExclusion writes an exclusion as a phase 1 rule removing the excluded rules, or their
+// target, from the transactions it matches. Custom rules are loaded before the CRS, so the
+// exclusion is applied per transaction with ctl rather than SecRuleRemoveById.
+func generateExclusion(ruleID int, config *models.ExclusionConfig) string {
+	var ctl string
+	variable := config.Variable()
+	switch {
+	case config.Kind == models.ExclusionByTag && variable != "":
+		ctl = fmt.Sprintf("ctl:ruleRemoveTargetByTag=%s;%s", config.Rules, variable)
+	case config.Kind == models.ExclusionByTag:
+		ctl = "ctl:ruleRemoveByTag=" + config.Rules
+	case variable != "":
+		ctl = fmt.Sprintf("ctl:ruleRemoveTargetById=%s;%s", config.Rules, variable)
+	default:
+		ctl = "ctl:ruleRemoveById=" + config.Rules
+	}
+
+	// Each condition is a target and operator with the transformations it needs
+	var conditions [][2]string
+	if config.PathPrefix != "" {
+		// Match the decoded path with dot segments resolved, and only on segment boundaries,
+		// so that /api/../admin or /apiv2 do not fall under an exclusion for /api
+		prefix := regexp.QuoteMeta(strings.TrimSuffix(config.PathPrefix, "/"))
+		conditions = append(conditions, [2]string{
+			fmt.Sprintf(`REQUEST_FILENAME "@rx ^%s(?:/|$)"`, prefix),
+			"t:none,t:urlDecodeUni,t:normalisePath",
+		})
+	}
+	if config.Method != "" {
+		conditions = append(conditions, [2]string{fmt.Sprintf(`REQUEST_METHOD "@streq %s"`, config.Method), "t:none"})
+	}
+
+	actions := fmt.Sprintf("id:%d,phase:1,pass,nolog,tag:'CUSTOM-RULE',tag:'EXCLUSION'", ruleID)
+	switch len(conditions) {
+	case 0:
+		return fmt.Sprintf(`SecAction "%s,%s"`, actions, ctl)
+	case 1:
+		return fmt.Sprintf(`SecRule %s "%s,%s,%s"`, conditions[0][0], actions, conditions[0][1], ctl)
+	default:
+		// The ctl action runs once the whole chain matched
+		return fmt.Sprintf("SecRule %s \"%s,%s,chain\"\n    SecRule %s \"%s,%s\"",
+			conditions[0][0], actions, conditions[0][1], conditions[1][0], conditions[1][1], ctl)
+	}
+}
@@ -0,0 +1,65 @@
+package services
+
+import (
+	"SeproWAF/models"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/corazawaf/coraza/v3"
+)
+
+func TestGenerateExclusionPathScope(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   models.ExclusionConfig
+		method   string
+		uri      string
+		excluded bool
+	}{
+		{"below the prefix", models.ExclusionConfig{PathPrefix: "/api"}, "GET", "/api/users", true},
+		{"the prefix itself", models.ExclusionConfig{PathPrefix: "/api"}, "GET", "/api", true},
+		{"prefix with trailing slash", models.ExclusionConfig{PathPrefix: "/api/"}, "GET", "/api/users", true},
+		{"repeated slashes", models.ExclusionConfig{PathPrefix: "/api"}, "GET", "//api//users", true},
+		{"dot segments into the prefix", models.ExclusionConfig{PathPrefix: "/api"}, "GET", "/static/../api/users", true},
+		{"same start of another segment", models.ExclusionConfig{PathPrefix: "/api"}, "GET", "/apiv2/users", false},
+		{"dot segments out of the prefix", models.ExclusionConfig{PathPrefix: "/api"}, "GET", "/api/../admin", false},
+		{"encoded dot segments", models.ExclusionConfig{PathPrefix: "/api"}, "GET", "/api/%2e%2e/admin", false},
+		{"double encoded dot segments", models.ExclusionConfig{PathPrefix: "/api"}, "GET", "/api/%252e%252e/admin", false},
+		{"other path", models.ExclusionConfig{PathPrefix: "/api"}, "GET", "/admin", false},
+		{"regex characters are literal", models.ExclusionConfig{PathPrefix: "/v1.0"}, "GET", "/v1x0/users", false},
+		{"prefix with regex characters", models.ExclusionConfig{PathPrefix: "/v1.0"}, "GET", "/v1.0/users", true},
+		{"path and method", models.ExclusionConfig{PathPrefix: "/api", Method: "POST"}, "POST", "/api/users", true},
+		{"path and other method", models.ExclusionConfig{PathPrefix: "/api", Method: "POST"}, "GET", "/api/users", false},
+		{"method only", models.ExclusionConfig{Method: "POST"}, "POST", "/admin", true},
+		{"every request", models.ExclusionConfig{}, "GET", "/admin", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := tt.config
+			config.Kind = models.ExclusionByID
+			config.Rules = "1001"
+			exclusion := generateExclusion(100001, &config)
+
+			waf, err := coraza.NewWAF(coraza.NewWAFConfig().WithDirectives(strings.Join([]string{
+				"SecRuleEngine On",
+				exclusion,
+				`SecRule ARGS "@contains attack" "id:1001,phase:1,deny,status:403"`,
+			}, "\n")))
+			if err != nil {
+				t.Fatalf("rules do not compile: %v\n%s", err, exclusion)
+			}
+
+			tx := waf.NewTransaction()
+			defer tx.Close()
+			tx.ProcessURI(tt.uri+"?q=attack", tt.method, "HTTP/1.1")
+			tx.ProcessRequestHeaders()
+
+			blocked := tx.Interruption() != nil && tx.Interruption().Status == http.StatusForbidden
+			if blocked == tt.excluded {
+				t.Errorf("%s %s blocked = %v, want the exclusion to apply: %v\n%s", tt.method, tt.uri, blocked, tt.excluded, exclusion)
+			}
+		})
+	}
+}
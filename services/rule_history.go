@@ -0,0 +1,163 @@
+package services
+
+import (
+	"SeproWAF/models"
+	"encoding/json"
+	"strings"
+)
+
+// RuleFieldChange is a rule field that differs between two revisions
+type RuleFieldChange struct {
+	Field string      `json:"field"`
+	From  interface{} `json:"from"`
+	To    interface{} `json:"to"`
+}
+
+// RuleTextLine is a line of the rule text diff. Op is " " for unchanged, "-" for removed and "+" for added lines.
+type RuleTextLine struct {
+	Op   string `json:"op"`
+	Text string `json:"text"`
+}
+
+// RuleDiff describes how a rule changed between two revisions
+type RuleDiff struct {
+	RuleID   int               `json:"ruleId"`
+	From     int               `json:"from"`
+	To       int               `json:"to"`
+	Changes  []RuleFieldChange `json:"changes"`
+	RuleText []RuleTextLine    `json:"ruleText"`
+}
+
+// DiffRuleRevisions compares the rules stored in two revisions
+func DiffRuleRevisions(from, to *models.WAFRuleRevision) *RuleDiff {
+	diff := &RuleDiff{
+		RuleID:   to.RuleID,
+		From:     from.Revision,
+		To:       to.Revision,
+		Changes:  []RuleFieldChange{},
+		RuleText: diffLines(from.Rule.RuleText, to.Rule.RuleText),
+	}
+
+	a, b := from.Rule, to.Rule
+	fields := []struct {
+		name     string
+		from, to interface{}
+	}{
+		{"name", a.Name, b.Name},
+		{"description", a.Description, b.Description},
+		{"type", a.Type, b.Type},
+		{"action", a.Action, b.Action},
+		{"status", a.Status, b.Status},
+		{"priority", a.Priority, b.Priority},
+		{"parameters", canonicalParameters(a.Parameters), canonicalParameters(b.Parameters)},
+	}
+	for _, field := range fields {
+		if field.from != field.to {
+			diff.Changes = append(diff.Changes, RuleFieldChange{Field: field.name, From: field.from, To: field.to})
+		}
+	}
+	if a.RuleText != b.RuleText {
+		diff.Changes = append(diff.Changes, RuleFieldChange{Field: "ruleText", From: a.RuleText, To: b.RuleText})
+	}
+
+	return diff
+}
+
+// canonicalParameters re-encodes rule parameters so that key order and spacing do not count as changes
+func canonicalParameters(parameters string) string {
+	var value interface{}
+	if err := json.Unmarshal([]byte(parameters), &value); err != nil {
+		return parameters
+	}
+	canonical, err := json.Marshal(value)
+	if err != nil {
+		return parameters
+	}
+	return string(canonical)
+}
+
+// maxDiffCells caps the size of the table diffLines fills, the product of the line counts of
+// the changed parts of both texts. Larger changes are shown as replacing all their lines.
+const maxDiffCells = 1 << 20
+
+// diffLines returns a line diff of two texts, based on their longest common subsequence of lines
+func diffLines(from, to string) []RuleTextLine {
+	a, b := splitLines(from), splitLines(to)
+	lines := []RuleTextLine{}
+
+	// Unchanged lines at the start and end are kept out of the table
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		lines = append(lines, RuleTextLine{Op: " ", Text: a[prefix]})
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	lines = append(lines, diffChangedLines(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])...)
+	for _, text := range a[len(a)-suffix:] {
+		lines = append(lines, RuleTextLine{Op: " ", Text: text})
+	}
+	return lines
+}
+
+// diffChangedLines diffs the changed parts of two texts
+func diffChangedLines(a, b []string) []RuleTextLine {
+	lines := []RuleTextLine{}
+	if len(a)*len(b) > maxDiffCells {
+		for _, text := range a {
+			lines = append(lines, RuleTextLine{Op: "-", Text: text})
+		}
+		for _, text := range b {
+			lines = append(lines, RuleTextLine{Op: "+", Text: text})
+		}
+		return lines
+	}
+
+	// common[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	common := make([][]int, len(a)+1)
+	for i := range common {
+		common[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				common[i][j] = common[i+1][j+1] + 1
+			} else {
+				common[i][j] = max(common[i+1][j], common[i][j+1])
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			lines = append(lines, RuleTextLine{Op: " ", Text: a[i]})
+			i++
+			j++
+		case common[i+1][j] >= common[i][j+1]:
+			lines = append(lines, RuleTextLine{Op: "-", Text: a[i]})
+			i++
+		default:
+			lines = append(lines, RuleTextLine{Op: "+", Text: b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		lines = append(lines, RuleTextLine{Op: "-", Text: a[i]})
+	}
+	for ; j < len(b); j++ {
+		lines = append(lines, RuleTextLine{Op: "+", Text: b[j]})
+	}
+	return lines
+}
+
+// splitLines splits a text into lines, an empty text has none
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
@@ -0,0 +1,104 @@
+package services
+
+import (
+	"SeproWAF/models"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// formatDiff renders a diff as one "<op><text>" entry per line
+func formatDiff(lines []RuleTextLine) string {
+	var parts []string
+	for _, line := range lines {
+		parts = append(parts, line.Op+line.Text)
+	}
+	return strings.Join(parts, "|")
+}
+
+func TestDiffLines(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to string
+		want     string
+	}{
+		{"identical", "a\nb", "a\nb", " a| b"},
+		{"both empty", "", "", ""},
+		{"added text", "", "a\nb", "+a|+b"},
+		{"removed text", "a\nb", "", "-a|-b"},
+		{"changed middle line", "a\nb\nc", "a\nx\nc", " a|-b|+x| c"},
+		{"inserted line", "a\nc", "a\nb\nc", " a|+b| c"},
+		{"removed line", "a\nb\nc", "a\nc", " a|-b| c"},
+		{"changed first and last", "a\nb\nc", "x\nb\ny", "-a|+x| b|-c|+y"},
+		{"moved line", "a\nb\nc", "b\nc\na", "-a| b| c|+a"},
+		{"trailing newline ignored", "a\nb\n", "a\nb", " a| b"},
+		{"repeated lines", "a\na\nb", "a\nb\nb", " a|-a|+b| b"},
+	}
+
+	for _, tt := range tests {
+		if got := formatDiff(diffLines(tt.from, tt.to)); got != tt.want {
+			t.Errorf("%s: diffLines = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDiffLinesLargeTexts(t *testing.T) {
+	numbered := func(prefix string, n int) []string {
+		lines := make([]string, n)
+		for i := range lines {
+			lines[i] = fmt.Sprintf("%s%d", prefix, i)
+		}
+		return lines
+	}
+
+	// Completely different texts over the cap are shown as replaced
+	a, b := numbered("a", 2000), numbered("b", 2000)
+	lines := diffLines(strings.Join(a, "\n"), strings.Join(b, "\n"))
+	if len(lines) != 4000 || lines[0] != (RuleTextLine{Op: "-", Text: "a0"}) || lines[2000] != (RuleTextLine{Op: "+", Text: "b0"}) {
+		t.Fatalf("diff of large texts has %d lines starting with %v", len(lines), lines[0])
+	}
+
+	// A small change in a large text is still diffed line by line
+	shared := numbered("line", 5000)
+	changed := append([]string(nil), shared...)
+	changed[2500] = "changed"
+	lines = diffLines(strings.Join(shared, "\n"), strings.Join(changed, "\n"))
+	if len(lines) != 5001 {
+		t.Fatalf("diff of a one line change has %d lines, want 5001", len(lines))
+	}
+	if lines[2500] != (RuleTextLine{Op: "-", Text: "line2500"}) || lines[2501] != (RuleTextLine{Op: "+", Text: "changed"}) {
+		t.Errorf("changed line shown as %v, %v", lines[2500], lines[2501])
+	}
+	for i, line := range lines {
+		if i != 2500 && i != 2501 && line.Op != " " {
+			t.Fatalf("line %d shown as %v, only the changed line differs", i, line)
+		}
+	}
+}
+
+func TestDiffRuleRevisions(t *testing.T) {
+	from := &models.WAFRuleRevision{RuleID: 7, Revision: 1, Rule: &models.WAFRule{
+		Name:       "Block admin",
+		Action:     models.ActionBlock,
+		Parameters: `{"path": "/admin", "methods": ["GET"]}`,
+		RuleText:   "SecRule REQUEST_URI \"@beginsWith /admin\"",
+	}}
+	to := &models.WAFRuleRevision{RuleID: 7, Revision: 2, Rule: &models.WAFRule{
+		Name:       "Block admin",
+		Action:     models.ActionLog,
+		Parameters: `{"methods":["GET"],"path":"/admin"}`,
+		RuleText:   "SecRule REQUEST_URI \"@beginsWith /admin\"",
+	}}
+
+	diff := DiffRuleRevisions(from, to)
+	if diff.RuleID != 7 || diff.From != 1 || diff.To != 2 {
+		t.Errorf("diff of rule %d from %d to %d", diff.RuleID, diff.From, diff.To)
+	}
+	// Reordered parameters are not a change
+	if len(diff.Changes) != 1 || diff.Changes[0].Field != "action" {
+		t.Errorf("changes = %+v, want only the action", diff.Changes)
+	}
+	if formatDiff(diff.RuleText) != ` SecRule REQUEST_URI "@beginsWith /admin"` {
+		t.Errorf("rule text diff = %q", formatDiff(diff.RuleText))
+	}
+}
@@ -0,0 +1,274 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/beego/beego/v2/core/logs"
+	"github.com/beego/beego/v2/server/web"
+)
+
+// StateStore holds the counters, bans and cached decisions shared by the proxy replicas.
+// Keys expire after their TTL; a zero TTL keeps a key until it is deleted.
+type StateStore interface {
+	// Get returns the value of a key, false when it does not exist
+	Get(ctx context.Context, key string) (string, bool, error)
+	// Set stores the value of a key
+	Set(ctx context.Context, key, value string, ttl time.Duration) error
+	// Delete removes a key
+	Delete(ctx context.Context, key string) error
+	// IncrBy adds delta to a counter and returns its new value. The TTL is set when the counter is created.
+	IncrBy(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error)
+	// TakeToken takes a token from a bucket refilled with rate tokens per second up to burst,
+	// and returns whether one was available and the tokens left
+	TakeToken(ctx context.Context, key string, rate float64, burst int, now time.Time) (bool, float64, error)
+	// Scan returns the keys starting with a prefix and their values
+	Scan(ctx context.Context, prefix string) (map[string]string, error)
+	// Close releases the store
+	Close() error
+}
+
+// StateFailureMode defines how requests are treated when the state store cannot be reached
+type StateFailureMode string
+
+const (
+	StateFailOpen   StateFailureMode = "open"   // Requests pass as if no limit or ban applied
+	StateFailClosed StateFailureMode = "closed" // Requests are treated as over the limit or banned
+)
+
+// ErrStateStoreClosed is returned by a store after Close
+var ErrStateStoreClosed = errors.New("state store is closed")
+
+var (
+	stateStore       StateStore
+	stateFailureMode StateFailureMode
+	stateStoreOnce   sync.Once
+)
+
+// GetStateStore returns the state store configured with StateStore: "memory" keeps the state
+// in this process, "redis" shares it through the Redis server at StateStoreRedisAddr
+func GetStateStore() StateStore {
+	stateStoreOnce.Do(func() {
+		stateFailureMode = StateFailOpen
+		if mode, _ := web.AppConfig.String("StateStoreFailureMode"); strings.EqualFold(mode, string(StateFailClosed)) {
+			stateFailureMode = StateFailClosed
+		}
+
+		kind, _ := web.AppConfig.String("StateStore")
+		switch strings.ToLower(kind) {
+		case "redis":
+			addr, _ := web.AppConfig.String("StateStoreRedisAddr")
+			if addr == "" {
+				addr = "localhost:6379"
+			}
+			password, _ := web.AppConfig.String("StateStoreRedisPassword")
+			database, _ := web.AppConfig.Int("StateStoreRedisDB")
+			prefix, err := web.AppConfig.String("StateStorePrefix")
+			if err != nil || prefix == "" {
+				prefix = "seprowaf:"
+			}
+			timeout, err := web.AppConfig.Int("StateStoreTimeout")
+			if err != nil || timeout <= 0 {
+				timeout = 100
+			}
+
+			stateStore = NewRedisStateStore(RedisStateStoreOptions{
+				Addr:     addr,
+				Password: password,
+				DB:       database,
+				Prefix:   prefix,
+				Timeout:  time.Duration(timeout) * time.Millisecond,
+			})
+			logs.Info("Using Redis state store at %s (fail %s)", addr, stateFailureMode)
+		case "", "memory":
+			stateStore = NewMemoryStateStore()
+		default:
+			logs.Warning("Unknown state store %q, keeping state in memory", kind)
+			stateStore = NewMemoryStateStore()
+		}
+	})
+	return stateStore
+}
+
+// GetStateFailureMode returns how requests are treated when the state store cannot be reached
+func GetStateFailureMode() StateFailureMode {
+	GetStateStore()
+	return stateFailureMode
+}
+
+// memoryEntry is a key of the memory store, holding either a value or a token bucket
+type memoryEntry struct {
+	value     string
+	tokens    float64
+	updated   time.Time
+	expiresAt time.Time // Zero when the key does not expire
+}
+
+// expired checks if the entry outlived its TTL
+func (e *memoryEntry) expired(now time.Time) bool {
+	return !e.expiresAt.IsZero() && !now.Before(e.expiresAt)
+}
+
+// MemoryStateStore keeps the state in this process, for single node deployments
+type MemoryStateStore struct {
+	mutex   sync.Mutex
+	entries map[string]*memoryEntry
+	done    chan struct{}
+}
+
+// NewMemoryStateStore creates a memory store and starts dropping expired keys
+func NewMemoryStateStore() *MemoryStateStore {
+	s := &MemoryStateStore{
+		entries: make(map[string]*memoryEntry),
+		done:    make(chan struct{}),
+	}
+	go s.cleanup()
+	return s
+}
+
+// entry returns a live entry, nil when the key does not exist or expired
+func (s *MemoryStateStore) entry(key string, now time.Time) *memoryEntry {
+	entry, ok := s.entries[key]
+	if !ok {
+		return nil
+	}
+	if entry.expired(now) {
+		delete(s.entries, key)
+		return nil
+	}
+	return entry
+}
+
+// Get returns the value of a key
+func (s *MemoryStateStore) Get(ctx context.Context, key string) (string, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	entry := s.entry(key, time.Now())
+	if entry == nil {
+		return "", false, nil
+	}
+	return entry.value, true, nil
+}
+
+// Set stores the value of a key
+func (s *MemoryStateStore) Set(ctx context.Context, key, value string, ttl time.Duration) error {
+	entry := &memoryEntry{value: value}
+	if ttl > 0 {
+		entry.expiresAt = time.Now().Add(ttl)
+	}
+
+	s.mutex.Lock()
+	s.entries[key] = entry
+	s.mutex.Unlock()
+	return nil
+}
+
+// Delete removes a key
+func (s *MemoryStateStore) Delete(ctx context.Context, key string) error {
+	s.mutex.Lock()
+	delete(s.entries, key)
+	s.mutex.Unlock()
+	return nil
+}
+
+// IncrBy adds delta to a counter
+func (s *MemoryStateStore) IncrBy(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	entry := s.entry(key, now)
+	if entry == nil {
+		entry = &memoryEntry{value: "0"}
+		if ttl > 0 {
+			entry.expiresAt = now.Add(ttl)
+		}
+		s.entries[key] = entry
+	}
+
+	value, err := strconv.ParseInt(entry.value, 10, 64)
+	if err != nil {
+		return 0, errors.New("value is not an integer")
+	}
+	value += delta
+	entry.value = strconv.FormatInt(value, 10)
+	return value, nil
+}
+
+// TakeToken takes a token from a bucket
+func (s *MemoryStateStore) TakeToken(ctx context.Context, key string, rate float64, burst int, now time.Time) (bool, float64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	entry := s.entry(key, now)
+	if entry == nil {
+		entry = &memoryEntry{tokens: float64(burst), updated: now}
+		s.entries[key] = entry
+	} else if elapsed := now.Sub(entry.updated); elapsed > 0 {
+		entry.tokens = math.Min(float64(burst), entry.tokens+elapsed.Seconds()*rate)
+		entry.updated = now
+	}
+
+	allowed := entry.tokens >= 1
+	if allowed {
+		entry.tokens--
+	}
+	// A full bucket is the same as no bucket
+	entry.expiresAt = now.Add(time.Duration((float64(burst) - entry.tokens) / rate * float64(time.Second)))
+	return allowed, entry.tokens, nil
+}
+
+// Scan returns the keys starting with a prefix
+func (s *MemoryStateStore) Scan(ctx context.Context, prefix string) (map[string]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	values := make(map[string]string)
+	for key, entry := range s.entries {
+		// Token buckets hold no value, as in Redis where they are hashes
+		if strings.HasPrefix(key, prefix) && !entry.expired(now) && entry.updated.IsZero() {
+			values[key] = entry.value
+		}
+	}
+	return values, nil
+}
+
+// Close stops dropping expired keys
+func (s *MemoryStateStore) Close() error {
+	select {
+	case <-s.done:
+		return ErrStateStoreClosed
+	default:
+		close(s.done)
+		return nil
+	}
+}
+
+// cleanup periodically drops expired keys
+func (s *MemoryStateStore) cleanup() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			now := time.Now()
+			s.mutex.Lock()
+			for key, entry := range s.entries {
+				if entry.expired(now) {
+					delete(s.entries, key)
+				}
+			}
+			s.mutex.Unlock()
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// incrByScript increments a counter and sets its TTL when it has none, i.e. when it was just created
+var incrByScript = redis.NewScript(`
+local value = redis.call('INCRBY', KEYS[1], ARGV[1])
+if tonumber(ARGV[2]) > 0 and redis.call('PTTL', KEYS[1]) < 0 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return value
+`)
+
+// takeTokenScript refills a token bucket stored as a hash of tokens and the time of the last
+// refill in milliseconds, then takes a token. Tokens are returned as a string, Lua numbers
+// are truncated to integers in replies.
+var takeTokenScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(state[1])
+local ts = tonumber(state[2])
+if tokens == nil or ts == nil then
+	tokens = burst
+	ts = now
+elseif now > ts then
+	tokens = math.min(burst, tokens + (now - ts) / 1000 * rate)
+	ts = now
+end
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', ts)
+redis.call('PEXPIRE', KEYS[1], math.max(1, math.ceil((burst - tokens) / rate * 1000)))
+return {allowed, tostring(tokens)}
+`)
+
+// RedisStateStoreOptions configures the connection of a Redis state store
+type RedisStateStoreOptions struct {
+	Addr     string
+	Password string
+	DB       int
+	Prefix   string        // Prepended to every key, so that several deployments can share a server
+	Timeout  time.Duration // Limit of each command, after which the store counts as unreachable
+}
+
+// RedisStateStore shares the state between replicas through a Redis server, or any server
+// speaking the Redis protocol such as Valkey, KeyDB or miniredis
+type RedisStateStore struct {
+	client *redis.Client
+	prefix string
+}
+
+// NewRedisStateStore creates a Redis store; the connection is opened on first use
+func NewRedisStateStore(options RedisStateStoreOptions) *RedisStateStore {
+	return &RedisStateStore{
+		client: redis.NewClient(&redis.Options{
+			Addr:         options.Addr,
+			Password:     options.Password,
+			DB:           options.DB,
+			DialTimeout:  options.Timeout,
+			ReadTimeout:  options.Timeout,
+			WriteTimeout: options.Timeout,
+			PoolTimeout:  options.Timeout,
+			MaxRetries:   -1, // Fail fast, callers fall back to the failure mode
+		}),
+		prefix: options.Prefix,
+	}
+}
+
+// Get returns the value of a key
+func (s *RedisStateStore) Get(ctx context.Context, key string) (string, bool, error) {
+	value, err := s.client.Get(ctx, s.prefix+key).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return value, true, nil
+}
+
+// Set stores the value of a key
+func (s *RedisStateStore) Set(ctx context.Context, key, value string, ttl time.Duration) error {
+	return s.client.Set(ctx, s.prefix+key, value, ttl).Err()
+}
+
+// Delete removes a key
+func (s *RedisStateStore) Delete(ctx context.Context, key string) error {
+	return s.client.Del(ctx, s.prefix+key).Err()
+}
+
+// IncrBy adds delta to a counter
+func (s *RedisStateStore) IncrBy(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	return incrByScript.Run(ctx, s.client, []string{s.prefix + key}, delta, ttl.Milliseconds()).Int64()
+}
+
+// TakeToken takes a token from a bucket
+func (s *RedisStateStore) TakeToken(ctx context.Context, key string, rate float64, burst int, now time.Time) (bool, float64, error) {
+	reply, err := takeTokenScript.Run(ctx, s.client, []string{s.prefix + key},
+		strconv.FormatFloat(rate, 'f', -1, 64), burst, now.UnixMilli()).Slice()
+	if err != nil {
+		return false, 0, err
+	}
+	if len(reply) != 2 {
+		return false, 0, errors.New("unexpected token bucket reply")
+	}
+
+	allowed, _ := reply[0].(int64)
+	text, _ := reply[1].(string)
+	tokens, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return false, 0, errors.New("unexpected token bucket reply")
+	}
+	return allowed == 1, tokens, nil
+}
+
+// Scan returns the keys starting with a prefix
+func (s *RedisStateStore) Scan(ctx context.Context, prefix string) (map[string]string, error) {
+	var keys []string
+	iter := s.client.Scan(ctx, 0, escapeRedisPattern(s.prefix+prefix)+"*", 500).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]string, len(keys))
+	for start := 0; start < len(keys); start += 500 {
+		batch := keys[start:min(start+500, len(keys))]
+		results, err := s.client.MGet(ctx, batch...).Result()
+		if err != nil {
+			return nil, err
+		}
+		for i, result := range results {
+			// Keys may expire between SCAN and MGET, and token buckets are not strings
+			if value, ok := result.(string); ok {
+				values[strings.TrimPrefix(batch[i], s.prefix)] = value
+			}
+		}
+	}
+	return values, nil
+}
+
+// Close closes the connections to the server
+func (s *RedisStateStore) Close() error {
+	return s.client.Close()
+}
+
+// escapeRedisPattern escapes the glob characters of a SCAN MATCH pattern
+func escapeRedisPattern(pattern string) string {
+	var b strings.Builder
+	for _, c := range pattern {
+		switch c {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
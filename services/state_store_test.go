@@ -0,0 +1,338 @@
+package services
+
+import (
+	"context"
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/beego/beego/v2/server/web"
+)
+
+// testStateStore is a store under test, with a way to let its keys age
+type testStateStore struct {
+	name    string
+	store   StateStore
+	advance func(d time.Duration)
+	server  *miniredis.Miniredis // Nil for the memory store
+}
+
+// newTestStateStores returns a memory store and a Redis store backed by miniredis
+func newTestStateStores(t *testing.T) []testStateStore {
+	t.Helper()
+
+	memory := NewMemoryStateStore()
+	t.Cleanup(func() { memory.Close() })
+
+	server := miniredis.RunT(t)
+	redis := NewRedisStateStore(RedisStateStoreOptions{Addr: server.Addr(), Prefix: "seprowaf:", Timeout: time.Second})
+	t.Cleanup(func() { redis.Close() })
+
+	return []testStateStore{
+		{name: "memory", store: memory, advance: time.Sleep},
+		{name: "redis", store: redis, advance: server.FastForward, server: server},
+	}
+}
+
+func TestStateStoreGetSetDelete(t *testing.T) {
+	ctx := context.Background()
+	for _, ts := range newTestStateStores(t) {
+		t.Run(ts.name, func(t *testing.T) {
+			s := ts.store
+			if _, found, err := s.Get(ctx, "missing"); found || err != nil {
+				t.Fatalf("Get(missing) = %v, %v", found, err)
+			}
+
+			if err := s.Set(ctx, "kept", "a", 0); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Set(ctx, "short", "b", 50*time.Millisecond); err != nil {
+				t.Fatal(err)
+			}
+			if value, found, err := s.Get(ctx, "short"); value != "b" || !found || err != nil {
+				t.Fatalf("Get(short) = %q, %v, %v", value, found, err)
+			}
+
+			ts.advance(80 * time.Millisecond)
+			if _, found, _ := s.Get(ctx, "short"); found {
+				t.Error("key outlived its TTL")
+			}
+			if value, found, _ := s.Get(ctx, "kept"); value != "a" || !found {
+				t.Errorf("key without TTL = %q, %v", value, found)
+			}
+
+			if err := s.Delete(ctx, "kept"); err != nil {
+				t.Fatal(err)
+			}
+			if _, found, _ := s.Get(ctx, "kept"); found {
+				t.Error("deleted key still exists")
+			}
+		})
+	}
+}
+
+func TestStateStoreIncrBy(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name   string
+		deltas []int64
+		want   []int64
+	}{
+		{"counts up", []int64{1, 1, 1}, []int64{1, 2, 3}},
+		{"larger deltas", []int64{5, 10}, []int64{5, 15}},
+		{"negative deltas", []int64{1, 1, -1}, []int64{1, 2, 1}},
+	}
+
+	for _, ts := range newTestStateStores(t) {
+		t.Run(ts.name, func(t *testing.T) {
+			for _, tt := range tests {
+				for i, delta := range tt.deltas {
+					got, err := ts.store.IncrBy(ctx, tt.name, delta, time.Minute)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if got != tt.want[i] {
+						t.Errorf("%s: IncrBy #%d = %d, want %d", tt.name, i, got, tt.want[i])
+					}
+				}
+			}
+
+			if err := ts.store.Set(ctx, "text", "abc", 0); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ts.store.IncrBy(ctx, "text", 1, 0); err == nil {
+				t.Error("IncrBy on a non-integer value succeeded")
+			}
+		})
+	}
+}
+
+func TestStateStoreIncrByTTL(t *testing.T) {
+	ctx := context.Background()
+	for _, ts := range newTestStateStores(t) {
+		t.Run(ts.name, func(t *testing.T) {
+			s := ts.store
+
+			// The TTL starts when the counter is created, later increments do not extend it
+			if _, err := s.IncrBy(ctx, "counter", 1, 100*time.Millisecond); err != nil {
+				t.Fatal(err)
+			}
+			ts.advance(60 * time.Millisecond)
+			if got, _ := s.IncrBy(ctx, "counter", 1, 100*time.Millisecond); got != 2 {
+				t.Fatalf("second IncrBy = %d, want 2", got)
+			}
+			ts.advance(60 * time.Millisecond)
+			if got, _ := s.IncrBy(ctx, "counter", 1, 100*time.Millisecond); got != 1 {
+				t.Fatalf("IncrBy after the TTL = %d, want a new counter", got)
+			}
+
+			// Counters without a TTL are kept
+			if _, err := s.IncrBy(ctx, "forever", 1, 0); err != nil {
+				t.Fatal(err)
+			}
+			ts.advance(120 * time.Millisecond)
+			if got, _ := s.IncrBy(ctx, "forever", 1, 0); got != 2 {
+				t.Fatalf("IncrBy without TTL = %d, want 2", got)
+			}
+
+			if ts.server != nil {
+				if ttl := ts.server.TTL("seprowaf:forever"); ttl != 0 {
+					t.Errorf("counter without TTL expires in %v", ttl)
+				}
+				if _, err := s.IncrBy(ctx, "minute", 1, time.Minute); err != nil {
+					t.Fatal(err)
+				}
+				if ttl := ts.server.TTL("seprowaf:minute"); ttl != time.Minute {
+					t.Errorf("counter TTL = %v, want 1m", ttl)
+				}
+			}
+		})
+	}
+}
+
+func TestStateStoreTakeToken(t *testing.T) {
+	ctx := context.Background()
+	start := time.Unix(1700000000, 0)
+
+	// A bucket of 3 tokens refilled with 2 tokens per second
+	steps := []struct {
+		at          time.Duration
+		wantAllowed bool
+		wantTokens  float64
+	}{
+		{0, true, 2},
+		{0, true, 1},
+		{0, true, 0},
+		{0, false, 0},
+		{250 * time.Millisecond, false, 0.5},
+		{500 * time.Millisecond, true, 0},
+		{1750 * time.Millisecond, true, 1.5},
+		{1750 * time.Millisecond, true, 0.5},
+		// A clock going back does not refill the bucket
+		{time.Second, false, 0.5},
+		// Refills are capped at the burst
+		{time.Hour, true, 2},
+	}
+
+	for _, ts := range newTestStateStores(t) {
+		t.Run(ts.name, func(t *testing.T) {
+			for i, step := range steps {
+				allowed, tokens, err := ts.store.TakeToken(ctx, "bucket", 2, 3, start.Add(step.at))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if allowed != step.wantAllowed || math.Abs(tokens-step.wantTokens) > 1e-9 {
+					t.Errorf("step %d at %v = %v, %v, want %v, %v", i, step.at, allowed, tokens, step.wantAllowed, step.wantTokens)
+				}
+			}
+
+			// Buckets expire once they would be full again
+			if ts.server != nil {
+				if ttl := ts.server.TTL("seprowaf:bucket"); ttl != 500*time.Millisecond {
+					t.Errorf("bucket TTL = %v, want 500ms", ttl)
+				}
+			}
+		})
+	}
+}
+
+func TestStateStoreScan(t *testing.T) {
+	ctx := context.Background()
+	for _, ts := range newTestStateStores(t) {
+		t.Run(ts.name, func(t *testing.T) {
+			s := ts.store
+			values := map[string]string{
+				"ban:ip:10.0.0.1":  "a",
+				"ban:ip:10.0.0.2":  "b",
+				"ban:ja4:t13d":     "c",
+				"banned":           "d",
+				"ban:ip*:literal":  "e",
+				"ban:ip?:literal":  "f",
+				"ban:ip[0]:quoted": "g",
+			}
+			for key, value := range values {
+				if err := s.Set(ctx, key, value, 0); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := s.Set(ctx, "ban:ip:10.0.0.3", "expired", 50*time.Millisecond); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := s.TakeToken(ctx, "ban:ip:bucket", 1, 5, time.Now()); err != nil {
+				t.Fatal(err)
+			}
+			ts.advance(80 * time.Millisecond)
+
+			tests := []struct {
+				prefix string
+				want   []string
+			}{
+				{"ban:ip:", []string{"ban:ip:10.0.0.1", "ban:ip:10.0.0.2"}},
+				{"ban:ja4:", []string{"ban:ja4:t13d"}},
+				{"ban:ip*", []string{"ban:ip*:literal"}},
+				{"ban:ip?", []string{"ban:ip?:literal"}},
+				{"ban:ip[", []string{"ban:ip[0]:quoted"}},
+				{"none:", nil},
+			}
+
+			for _, tt := range tests {
+				got, err := s.Scan(ctx, tt.prefix)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(got) != len(tt.want) {
+					t.Errorf("Scan(%q) = %v, want %v", tt.prefix, got, tt.want)
+					continue
+				}
+				for _, key := range tt.want {
+					if got[key] != values[key] {
+						t.Errorf("Scan(%q)[%q] = %q, want %q", tt.prefix, key, got[key], values[key])
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestRedisStateStorePrefix(t *testing.T) {
+	ctx := context.Background()
+	server := miniredis.RunT(t)
+	store := NewRedisStateStore(RedisStateStoreOptions{Addr: server.Addr(), Prefix: "site-a:", Timeout: time.Second})
+	defer store.Close()
+
+	if err := store.Set(ctx, "key", "value", 0); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := server.Get("site-a:key"); err != nil || value != "value" {
+		t.Fatalf("key stored as %q, %v", value, err)
+	}
+
+	// Keys of another deployment sharing the server are not visible
+	server.Set("site-b:key", "other")
+	values, err := store.Scan(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 1 || values["key"] != "value" {
+		t.Fatalf("Scan = %v, want only the own key", values)
+	}
+}
+
+func TestRedisStateStoreUnreachable(t *testing.T) {
+	ctx := context.Background()
+	server := miniredis.RunT(t)
+	store := NewRedisStateStore(RedisStateStoreOptions{Addr: server.Addr(), Timeout: 100 * time.Millisecond})
+	defer store.Close()
+	server.Close()
+
+	if _, _, err := store.Get(ctx, "key"); err == nil {
+		t.Error("Get succeeded without a server")
+	}
+	if _, err := store.IncrBy(ctx, "key", 1, time.Minute); err == nil {
+		t.Error("IncrBy succeeded without a server")
+	}
+	if _, _, err := store.TakeToken(ctx, "key", 1, 1, time.Now()); err == nil {
+		t.Error("TakeToken succeeded without a server")
+	}
+	if _, err := store.Scan(ctx, ""); err == nil {
+		t.Error("Scan succeeded without a server")
+	}
+}
+
+func TestMemoryStateStoreClose(t *testing.T) {
+	store := NewMemoryStateStore()
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Close(); err != ErrStateStoreClosed {
+		t.Fatalf("second Close = %v, want ErrStateStoreClosed", err)
+	}
+}
+
+func TestGetStateFailureMode(t *testing.T) {
+	tests := []struct {
+		config string
+		want   StateFailureMode
+	}{
+		{"", StateFailOpen},
+		{"open", StateFailOpen},
+		{"closed", StateFailClosed},
+		{"Closed", StateFailClosed},
+		{"unknown", StateFailOpen},
+	}
+
+	defer func() {
+		web.AppConfig.Set("StateStoreFailureMode", "")
+		stateStoreOnce = sync.Once{}
+	}()
+	for _, tt := range tests {
+		web.AppConfig.Set("StateStoreFailureMode", tt.config)
+		stateStoreOnce = sync.Once{}
+		if got := GetStateFailureMode(); got != tt.want {
+			t.Errorf("StateStoreFailureMode %q = %q, want %q", tt.config, got, tt.want)
+		}
+	}
+}
@@ -3,6 +3,9 @@ package services
 import (
 	db "SeproWAF/database"
 	"SeproWAF/models"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"net"
@@ -48,8 +51,60 @@ type WAFLogEntry struct {
 	BlockStatus    int
 	ResponseSize   int64
 	Timestamp      time.Time
+
+	WebSocketMessage string    // Inspected WebSocket message, empty for HTTP requests
+	Decision         *Decision // Set instead of Transaction for requests decided before the WAF
+}
+
+// Decision describes why a request was handled before a WAF transaction was created
+type Decision struct {
+	Source   string // Component that decided, e.g. "ip_access"
+	Message  string
+	Severity string
+	Category string
+}
+
+// ruleMatch describes the decision like a matched rule, so that log views can show it
+func (d *Decision) ruleMatch(action string) map[string]interface{} {
+	return map[string]interface{}{
+		"id":             0,
+		"message":        d.Message,
+		"severity":       d.Severity,
+		"category":       d.Category,
+		"source":         d.Source,
+		"isInterruption": action == "blocked",
+	}
+}
+
+// newEventID returns a random ID for log entries that have no WAF transaction
+func newEventID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// clientIPContextKey stores the client IP resolved by the proxy in the request context
+type clientIPContextKey struct{}
+
+// WithClientIP returns a shallow copy of the request carrying the resolved client IP
+func WithClientIP(r *http.Request, ip string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), clientIPContextKey{}, ip))
 }
 
+// ClientIP returns the resolved client IP of a request, falling back to its remote address
+func ClientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPContextKey{}).(string); ok && ip != "" {
+		return ip
+	}
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return ip
+	}
+	return r.RemoteAddr
+}
+
+// maxLoggedWebSocketMessage caps the size of WebSocket messages stored in log details
+const maxLoggedWebSocketMessage = 4096
+
 // Update the function signature to include better defaults
 func NewWAFLogService(retentionDays int, logDetails bool, bufferSize int) *WAFLogService {
 	if bufferSize < 500 {
@@ -98,6 +153,11 @@ func (s *WAFLogService) LogWAFEvent(tx txtype.Transaction, req *http.Request, ac
 		Timestamp:      time.Now(),
 	}
 
+	// Clients that keep getting blocked are banned by the ban policies
+	if action == "blocked" && tx != nil {
+		GetBanEngine().RecordBlock(req, interruptionSeverity(tx), siteID)
+	}
+
 	s.batchMutex.Lock()
 	s.logBatch = append(s.logBatch, entry)
 
@@ -109,6 +169,59 @@ func (s *WAFLogService) LogWAFEvent(tx txtype.Transaction, req *http.Request, ac
 	s.batchMutex.Unlock()
 }
 
+// LogDecisionEvent logs a request that was allowed, blocked or monitored before a WAF transaction was created
+func (s *WAFLogService) LogDecisionEvent(req *http.Request, decision *Decision, action string, statusCode int, blockStatus int, siteID int, domain string) {
+	entry := &WAFLogEntry{
+		Request:     req,
+		Decision:    decision,
+		Action:      action,
+		StatusCode:  statusCode,
+		BlockStatus: blockStatus,
+		SiteID:      siteID,
+		Domain:      domain,
+		Timestamp:   time.Now(),
+	}
+
+	s.batchMutex.Lock()
+	s.logBatch = append(s.logBatch, entry)
+
+	// If we've reached batch size, signal immediate processing
+	if len(s.logBatch) >= s.batchSize {
+		go s.flushBatch()
+	}
+	s.batchMutex.Unlock()
+}
+
+// LogWebSocketEvent logs the inspection of a WebSocket message asynchronously.
+// The request is the handshake of the connection the message was sent on.
+func (s *WAFLogService) LogWebSocketEvent(tx txtype.Transaction, req *http.Request, action string, closeCode int, message string, processingTime time.Duration, siteID int, domain string) {
+	if len(message) > maxLoggedWebSocketMessage {
+		message = message[:maxLoggedWebSocketMessage]
+	}
+
+	entry := &WAFLogEntry{
+		Transaction:      tx,
+		Request:          req,
+		Action:           action,
+		StatusCode:       http.StatusSwitchingProtocols,
+		BlockStatus:      closeCode,
+		ProcessingTime:   int64(processingTime),
+		SiteID:           siteID,
+		Domain:           domain,
+		Timestamp:        time.Now(),
+		WebSocketMessage: message,
+	}
+
+	s.batchMutex.Lock()
+	s.logBatch = append(s.logBatch, entry)
+
+	// If we've reached batch size, signal immediate processing
+	if len(s.logBatch) >= s.batchSize {
+		go s.flushBatch()
+	}
+	s.batchMutex.Unlock()
+}
+
 // processLogs handles log entries from the channel
 func (s *WAFLogService) processLogs() {
 	defer s.wg.Done()
@@ -396,16 +509,96 @@ func (s *WAFLogService) createLogObjects(entry *WAFLogEntry) (*models.WAFLog, []
 	tx := entry.Transaction
 	req := entry.Request
 
-	// Extract client IP
-	clientIP := req.RemoteAddr
-	if ip, _, err := net.SplitHostPort(clientIP); err == nil {
-		clientIP = ip
-	}
+	// Client IP resolved through the trusted proxies
+	clientIP := ClientIP(req)
 
-	var matchedRules string
+	var matchedRules, transactionID string
 	var ruleMatches []map[string]interface{}
 	var severity, category string
+	if tx != nil {
+		transactionID = tx.ID()
+		ruleMatches, severity, category = summarizeMatchedRules(tx)
+	} else {
+		// Requests decided before the WAF carry the decision instead of a transaction
+		transactionID = newEventID()
+		ruleMatches = []map[string]interface{}{entry.Decision.ruleMatch(entry.Action)}
+		severity, category = entry.Decision.Severity, entry.Decision.Category
+	}
+
+	if len(ruleMatches) > 0 {
+		if jsonData, err := json.Marshal(ruleMatches); err == nil {
+			matchedRules = string(jsonData)
+		} else {
+			logs.Error("Failed to marshal matched rules: %v", err)
+			matchedRules = "[]"
+		}
+	} else {
+		matchedRules = "[]"
+	}
+
+	log := &models.WAFLog{
+		TransactionID:   transactionID,
+		SiteID:          entry.SiteID,
+		Domain:          entry.Domain,
+		ClientIP:        clientIP,
+		Method:          req.Method,
+		URI:             req.URL.Path,
+		QueryString:     req.URL.RawQuery,
+		Protocol:        req.Proto,
+		UserAgent:       req.Header.Get("User-Agent"),
+		Referer:         req.Header.Get("Referer"),
+		JA4Fingerprint:  req.Header.Get("X-JA4"),
+		JA4SFingerprint: req.Header.Get("X-JA4S"),
+		JA4HFingerprint: req.Header.Get("X-JA4H"),
+		JA4TFingerprint: req.Header.Get("X-JA4T"),
+		Action:          entry.Action,
+		StatusCode:      entry.StatusCode,
+		BlockStatusCode: entry.BlockStatus,
+		ResponseSize:    entry.ResponseSize,
+		MatchedRules:    matchedRules,
+		Severity:        severity,
+		Category:        category,
+		ProcessingTime:  int(entry.ProcessingTime),
+		CreatedAt:       entry.Timestamp,
+	}
+	if geo := GeoInfoFromRequest(req); geo != nil {
+		log.Country = geo.CountryCode
+		log.ASN = geo.ASN
+	}
 
+	var details []*models.WAFLogDetail
+	if s.logDetails {
+		if headers, err := json.Marshal(req.Header); err == nil {
+			details = append(details, &models.WAFLogDetail{
+				DetailType:    "request_headers",
+				Content:       string(headers),
+				TransactionID: log.TransactionID,
+			})
+		}
+
+		if len(ruleMatches) > 0 {
+			if matchBytes, err := json.Marshal(ruleMatches); err == nil {
+				details = append(details, &models.WAFLogDetail{
+					DetailType:    "rule_matches",
+					Content:       string(matchBytes),
+					TransactionID: log.TransactionID,
+				})
+			}
+		}
+
+		if entry.WebSocketMessage != "" {
+			details = append(details, &models.WAFLogDetail{
+				DetailType:    "websocket_message",
+				Content:       entry.WebSocketMessage,
+				TransactionID: log.TransactionID,
+			})
+		}
+	}
+	return log, details
+}
+
+// summarizeMatchedRules describes the rules matched in a transaction, with the severity and category of the interruption
+func summarizeMatchedRules(tx txtype.Transaction) (ruleMatches []map[string]interface{}, severity, category string) {
 	// Track interruption rule ID to avoid duplicates
 	var interruptionRuleID int = 0
 	var interruptionFound bool = false
@@ -552,61 +745,7 @@ func (s *WAFLogService) createLogObjects(entry *WAFLogEntry) (*models.WAFLog, []
 		logs.Warning("Interruption rule (ID: %d) not found in matched rules", interruptionRuleID)
 	}
 
-	if len(ruleMatches) > 0 {
-		if jsonData, err := json.Marshal(ruleMatches); err == nil {
-			matchedRules = string(jsonData)
-		} else {
-			logs.Error("Failed to marshal matched rules: %v", err)
-			matchedRules = "[]"
-		}
-	} else {
-		matchedRules = "[]"
-	}
-
-	log := &models.WAFLog{
-		TransactionID:   tx.ID(),
-		SiteID:          entry.SiteID,
-		Domain:          entry.Domain,
-		ClientIP:        clientIP,
-		Method:          req.Method,
-		URI:             req.URL.Path,
-		QueryString:     req.URL.RawQuery,
-		Protocol:        req.Proto,
-		UserAgent:       req.Header.Get("User-Agent"),
-		Referer:         req.Header.Get("Referer"),
-		JA4Fingerprint:  req.Header.Get("X-JA4"),
-		Action:          entry.Action,
-		StatusCode:      entry.StatusCode,
-		BlockStatusCode: entry.BlockStatus,
-		ResponseSize:    entry.ResponseSize,
-		MatchedRules:    matchedRules,
-		Severity:        severity,
-		Category:        category,
-		ProcessingTime:  int(entry.ProcessingTime),
-		CreatedAt:       entry.Timestamp,
-	}
-
-	var details []*models.WAFLogDetail
-	if s.logDetails {
-		if headers, err := json.Marshal(req.Header); err == nil {
-			details = append(details, &models.WAFLogDetail{
-				DetailType:    "request_headers",
-				Content:       string(headers),
-				TransactionID: log.TransactionID,
-			})
-		}
-
-		if len(ruleMatches) > 0 {
-			if matchBytes, err := json.Marshal(ruleMatches); err == nil {
-				details = append(details, &models.WAFLogDetail{
-					DetailType:    "rule_matches",
-					Content:       string(matchBytes),
-					TransactionID: log.TransactionID,
-				})
-			}
-		}
-	}
-	return log, details
+	return ruleMatches, severity, category
 }
 
 // extractCategoryFromTags tries to determine a category from rule tags
@@ -267,6 +267,16 @@
                     <p class="text-xs text-gray-500 mt-2">All security systems operational</p>
                 </div>
             </div>
+
+            <!-- Circuit Breakers Card -->
+            <div class="bg-white rounded-lg shadow-sm border border-gray-100">
+                <div class="p-6 border-b border-gray-100">
+                    <h2 class="text-lg font-semibold text-gray-800">Circuit Breakers</h2>
+                </div>
+                <div class="p-4" id="circuit-breakers">
+                    <p class="text-sm text-gray-500 text-center py-2">Loading...</p>
+                </div>
+            </div>
         </div>
     </div>
     
@@ -436,6 +446,14 @@ document.addEventListener('DOMContentLoaded', function() {
                 renderGeoAttackChart(null);
             }
             
+            // Get upstream circuit breakers that are open or changed state recently
+            const breakersData = await api.get('/dashboard/circuit-breakers');
+            if (breakersData.data && breakersData.data.success) {
+                renderCircuitBreakers(breakersData.data.circuit_breakers);
+            } else {
+                renderCircuitBreakers([]);
+            }
+            
             // Render sparkline chart for attack trends
             renderSparkline();
             
@@ -598,6 +616,40 @@ document.addEventListener('DOMContentLoaded', function() {
         });
     }
     
+    // Circuit breakers list
+    function renderCircuitBreakers(breakers) {
+        const container = document.getElementById('circuit-breakers');
+        container.innerHTML = '';
+        
+        if (!breakers || breakers.length === 0) {
+            container.innerHTML = `<p class="text-sm text-gray-500 text-center py-2">All upstreams are accepting traffic</p>`;
+            return;
+        }
+        
+        const badges = {
+            open: 'bg-red-100 text-red-700',
+            half_open: 'bg-yellow-100 text-yellow-700',
+            closed: 'bg-green-100 text-green-700'
+        };
+        
+        breakers.forEach(breaker => {
+            const last = breaker.transitions && breaker.transitions.length > 0
+                ? breaker.transitions[breaker.transitions.length - 1]
+                : null;
+            const div = document.createElement('div');
+            div.className = 'flex items-start p-3 rounded-lg hover:bg-gray-50';
+            div.innerHTML = `
+                <div class="min-w-0">
+                    <a href="/waf/sites/${breaker.site_id}" class="text-sm font-medium text-gray-800 hover:text-indigo-600">${breaker.domain}</a>
+                    <p class="text-xs text-gray-500 truncate">${breaker.url}</p>
+                    <p class="text-xs text-gray-500">${last ? last.reason : ''} &middot; ${formatDate(breaker.since)}</p>
+                </div>
+                <span class="ml-auto inline-flex rounded-full px-2 py-1 text-xs font-semibold ${badges[breaker.state] || ''}">${breaker.state.replace('_', '-')}</span>
+            `;
+            container.appendChild(div);
+        });
+    }
+    
     // NEW: Top Attacked Sites chart
     function renderTopAttackedSitesChart(data) {
         const ctx = document.getElementById('topAttackedSitesChart').getContext('2d');
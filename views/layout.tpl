@@ -177,6 +177,10 @@
                         <i class="bi bi-people mr-3 text-lg"></i>
                         <span>Users</span>
                     </a>
+                    <a href="/admin/bans" class="sidebar-item flex items-center px-3 py-2.5 text-sm rounded-lg font-medium text-gray-600 hover:text-indigo-600 hover:bg-indigo-50 transition-colors">
+                        <i class="bi bi-slash-circle mr-3 text-lg"></i>
+                        <span>Bans</span>
+                    </a>
                 </div>
             </div>
 
@@ -111,6 +111,58 @@
     </div>
 </div>
 
+<div class="flex flex-wrap mb-4">
+    <div class="w-full">
+        <div class="bg-white rounded-lg shadow">
+            <div class="px-4 py-3 border-b flex justify-between items-center">
+                <h5 class="text-lg font-medium mb-0">Upstream Servers</h5>
+                <div class="flex items-center space-x-2">
+                    <select id="lb-policy" class="px-2 py-1 text-sm border border-gray-300 rounded-md">
+                        <option value="round_robin">Round Robin</option>
+                        <option value="least_conn">Least Connections</option>
+                        <option value="weighted">Weighted</option>
+                        <option value="ip_hash">Consistent Hash (Client IP)</option>
+                        <option value="cookie_hash">Consistent Hash (Cookie)</option>
+                    </select>
+                    <input type="text" id="lb-hash-cookie" placeholder="Cookie name" class="hidden px-2 py-1 text-sm border border-gray-300 rounded-md w-32">
+                    <button type="button" id="lb-save-btn" class="px-3 py-1 text-sm border border-blue-600 text-blue-600 hover:bg-blue-600 hover:text-white rounded-md">Save</button>
+                </div>
+            </div>
+            <div class="p-0">
+                <div class="overflow-x-auto">
+                    <table class="w-full">
+                        <thead class="bg-gray-50">
+                            <tr>
+                                <th class="px-4 py-2 text-left text-sm font-medium text-gray-700">URL</th>
+                                <th class="px-4 py-2 text-left text-sm font-medium text-gray-700">Weight</th>
+                                <th class="px-4 py-2 text-left text-sm font-medium text-gray-700">Status</th>
+                                <th class="px-4 py-2 text-left text-sm font-medium text-gray-700">Health</th>
+                                <th class="px-4 py-2 text-right text-sm font-medium text-gray-700">Actions</th>
+                            </tr>
+                        </thead>
+                        <tbody id="upstreams-tbody" class="divide-y">
+                            <tr>
+                                <td colspan="5" class="px-4 py-2 text-center">Loading upstreams...</td>
+                            </tr>
+                        </tbody>
+                    </table>
+                </div>
+            </div>
+            <div class="px-4 py-3 border-t">
+                <form id="add-upstream-form" class="flex flex-wrap items-center gap-2">
+                    <input type="text" id="upstream-url" placeholder="http://10.0.0.1:8080" required class="flex-grow px-3 py-1 text-sm border border-gray-300 rounded-md">
+                    <input type="number" id="upstream-weight" value="1" min="1" class="w-20 px-3 py-1 text-sm border border-gray-300 rounded-md">
+                    <input type="text" id="upstream-health-path" placeholder="Health check path (e.g. /healthz)" class="w-56 px-3 py-1 text-sm border border-gray-300 rounded-md">
+                    <button type="submit" class="px-3 py-1 text-sm bg-blue-600 hover:bg-blue-700 text-white rounded-md">
+                        <i class="bi bi-plus"></i> Add Upstream
+                    </button>
+                </form>
+                <p class="text-xs text-gray-500 mt-2">When no upstream is enabled, requests are forwarded to the target URL <code>{{.Site.TargetURL}}</code>.</p>
+            </div>
+        </div>
+    </div>
+</div>
+
 <div class="flex flex-wrap mb-4">
     <div class="w-full">
         <div class="bg-white rounded-lg shadow">
@@ -392,6 +444,7 @@ document.addEventListener('DOMContentLoaded', function() {
     // Load site statistics and charts
     loadSiteStats();
     loadRecentAttacks();
+    loadUpstreams();
     
     // Load site stats
     async function loadSiteStats() {
@@ -485,6 +538,152 @@ document.addEventListener('DOMContentLoaded', function() {
         }
     }
     
+    // Load the upstream pool of the site
+    async function loadUpstreams() {
+        const tbody = document.getElementById('upstreams-tbody');
+
+        try {
+            const [response, statsResponse] = await Promise.all([
+                api.get(`/sites/${siteId}/upstreams`),
+                api.get(`/sites/${siteId}/stats`)
+            ]);
+            const upstreams = response.data.upstreams || [];
+
+            // Map upstream IDs to their health as seen by the proxy
+            const health = {};
+            (statsResponse.data.upstreams || []).forEach(h => {
+                health[h.upstream_id] = h;
+            });
+
+            document.getElementById('lb-policy').value = response.data.load_balancing;
+            document.getElementById('lb-hash-cookie').value = response.data.hash_cookie || '';
+            updateHashCookieInput();
+
+            tbody.innerHTML = '';
+
+            if (upstreams.length === 0) {
+                tbody.innerHTML = '<tr><td colspan="5" class="px-4 py-2 text-center">No upstreams configured - using the target URL</td></tr>';
+                return;
+            }
+
+            upstreams.forEach(upstream => {
+                const tr = document.createElement('tr');
+                tr.className = 'hover:bg-gray-50';
+                tr.innerHTML = `
+                    <td class="px-4 py-2"><code></code></td>
+                    <td class="px-4 py-2">${upstream.Weight}</td>
+                    <td class="px-4 py-2">
+                        <span class="px-2 py-1 text-xs font-medium rounded-full ${upstream.Enabled ? 'bg-green-500' : 'bg-gray-500'} text-white">
+                            ${upstream.Enabled ? 'Enabled' : 'Disabled'}
+                        </span>
+                    </td>
+                    <td class="px-4 py-2">${formatUpstreamHealth(health[upstream.ID])}</td>
+                    <td class="px-4 py-2 text-right">
+                        <button type="button" class="upstream-toggle px-2 py-1 text-xs border border-gray-400 text-gray-700 hover:bg-gray-100 rounded-md">
+                            ${upstream.Enabled ? 'Disable' : 'Enable'}
+                        </button>
+                        <button type="button" class="upstream-delete px-2 py-1 text-xs border border-red-400 text-red-700 hover:bg-red-100 rounded-md">
+                            <i class="bi bi-trash"></i>
+                        </button>
+                    </td>
+                `;
+                tr.querySelector('code').textContent = upstream.URL;
+                if (health[upstream.ID] && health[upstream.ID].last_error) {
+                    tr.querySelector('.upstream-health').title = health[upstream.ID].last_error;
+                }
+                tr.querySelector('.upstream-toggle').addEventListener('click', () => toggleUpstream(upstream));
+                tr.querySelector('.upstream-delete').addEventListener('click', () => deleteUpstream(upstream));
+                tbody.appendChild(tr);
+            });
+        } catch (error) {
+            console.error('Error loading upstreams:', error);
+            tbody.innerHTML = '<tr><td colspan="5" class="px-4 py-2 text-center text-red-500">Failed to load upstreams</td></tr>';
+        }
+    }
+
+    function formatUpstreamHealth(h) {
+        if (!h) {
+            return '<span class="upstream-health px-2 py-1 text-xs font-medium rounded-full bg-gray-500 text-white">Unknown</span>';
+        }
+        if (h.ejected) {
+            return `<span class="upstream-health px-2 py-1 text-xs font-medium rounded-full bg-yellow-500 text-white">Ejected until ${formatDate(h.ejected_until)}</span>`;
+        }
+        if (!h.healthy) {
+            return '<span class="upstream-health px-2 py-1 text-xs font-medium rounded-full bg-red-500 text-white">Unhealthy</span>';
+        }
+        if (h.circuit_breaker && h.circuit_breaker.state === 'open') {
+            return `<span class="upstream-health px-2 py-1 text-xs font-medium rounded-full bg-red-500 text-white">Circuit open until ${formatDate(h.circuit_breaker.open_until)}</span>`;
+        }
+        if (h.circuit_breaker && h.circuit_breaker.state === 'half_open') {
+            return '<span class="upstream-health px-2 py-1 text-xs font-medium rounded-full bg-yellow-500 text-white">Circuit half-open</span>';
+        }
+        return `<span class="upstream-health px-2 py-1 text-xs font-medium rounded-full bg-green-500 text-white">Healthy</span> <span class="text-xs text-gray-500">${h.active_connections} active</span>`;
+    }
+
+    async function toggleUpstream(upstream) {
+        try {
+            await api.put(`/sites/${siteId}/upstreams/${upstream.ID}`, { enabled: !upstream.Enabled });
+            showToast('Upstream updated successfully', 'success');
+            loadUpstreams();
+        } catch (error) {
+            console.error('Error updating upstream:', error);
+            showToast('Failed to update upstream', 'danger');
+        }
+    }
+
+    async function deleteUpstream(upstream) {
+        if (!confirm(`Remove upstream ${upstream.URL}?`)) {
+            return;
+        }
+
+        try {
+            await api.delete(`/sites/${siteId}/upstreams/${upstream.ID}`);
+            showToast('Upstream removed successfully', 'success');
+            loadUpstreams();
+        } catch (error) {
+            console.error('Error deleting upstream:', error);
+            showToast('Failed to remove upstream', 'danger');
+        }
+    }
+
+    function updateHashCookieInput() {
+        const isCookieHash = document.getElementById('lb-policy').value === 'cookie_hash';
+        document.getElementById('lb-hash-cookie').classList.toggle('hidden', !isCookieHash);
+    }
+
+    document.getElementById('lb-policy').addEventListener('change', updateHashCookieInput);
+
+    document.getElementById('lb-save-btn').addEventListener('click', async function() {
+        try {
+            await api.put(`/sites/${siteId}`, {
+                load_balancing: document.getElementById('lb-policy').value,
+                hash_cookie: document.getElementById('lb-hash-cookie').value
+            });
+            showToast('Load balancing policy updated successfully', 'success');
+        } catch (error) {
+            console.error('Error updating load balancing policy:', error);
+            showToast(error.response?.data?.error || 'Failed to update load balancing policy', 'danger');
+        }
+    });
+
+    document.getElementById('add-upstream-form').addEventListener('submit', async function(e) {
+        e.preventDefault();
+
+        try {
+            await api.post(`/sites/${siteId}/upstreams`, {
+                url: document.getElementById('upstream-url').value,
+                weight: parseInt(document.getElementById('upstream-weight').value, 10) || 1,
+                health_check_path: document.getElementById('upstream-health-path').value
+            });
+            showToast('Upstream added successfully', 'success');
+            this.reset();
+            loadUpstreams();
+        } catch (error) {
+            console.error('Error adding upstream:', error);
+            showToast(error.response?.data?.error || 'Failed to add upstream', 'danger');
+        }
+    });
+    
     // Helper function to format dates
     function formatDate(dateString) {
         if (!dateString) return 'N/A';
@@ -119,6 +119,135 @@
                         </div>
                     </div>
                     
+                    <div class="mb-5">
+                        <div class="flex items-center">
+                            <input type="checkbox" id="site-websocket-inspection" name="site-websocket-inspection"
+                                class="h-4 w-4 rounded border-gray-300 text-blue-600 focus:ring-blue-500" {{if .Site.WebSocketInspection}}checked{{end}}>
+                            <label for="site-websocket-inspection" class="ml-2 block text-sm font-medium text-gray-700">Inspect WebSocket messages</label>
+                        </div>
+                        <div class="mt-1 text-sm text-gray-500">Run text messages sent by clients through the WAF. Blocked messages close the connection with code 1008.</div>
+                    </div>
+
+                    <div class="mb-5">
+                        <label for="site-websocket-rules" class="block text-sm font-medium text-gray-700 mb-1">WebSocket Rule IDs (optional)</label>
+                        <input type="text" id="site-websocket-rules" name="site-websocket-rules" value="{{.Site.WebSocketRuleIDs}}" placeholder="e.g. 941000-941999, 942000-942999"
+                            class="px-3 py-2 mt-1 block w-full rounded-md border-gray-300 bg-gray-50 
+                            text-gray-900 shadow-sm focus:border-blue-500 focus:ring-2 focus:ring-blue-500 
+                            focus:ring-opacity-30 focus:outline-none transition duration-200 ease-in-out
+                            hover:bg-gray-100">
+                        <div class="mt-1 text-sm text-gray-500">Comma-separated rule IDs or ranges applied to WebSocket messages. Leave empty to apply all rules.</div>
+                    </div>
+
+                    <div class="mb-5">
+                        <div class="flex items-center">
+                            <input type="checkbox" id="site-grpc-inspection" name="site-grpc-inspection"
+                                class="h-4 w-4 rounded border-gray-300 text-blue-600 focus:ring-blue-500" {{if .Site.GRPCInspection}}checked{{end}}>
+                            <label for="site-grpc-inspection" class="ml-2 block text-sm font-medium text-gray-700">Inspect gRPC calls</label>
+                        </div>
+                        <div class="mt-1 text-sm text-gray-500">Expose the gRPC service and method to the WAF and decode request messages with the site's descriptor set. Blocked calls get a gRPC status instead of the block page.</div>
+                        <div class="grid grid-cols-1 md:grid-cols-2 gap-4 mt-3">
+                            <div>
+                                <label for="grpc-oversized-messages" class="block text-sm font-medium text-gray-700 mb-1">Messages over 4 MiB</label>
+                                <select id="grpc-oversized-messages" name="grpc-oversized-messages"
+                                    class="px-3 py-2 mt-1 block w-full rounded-md border-gray-300 bg-gray-50 
+                            text-gray-900 shadow-sm focus:border-blue-500 focus:ring-2 focus:ring-blue-500 
+                            focus:ring-opacity-30 focus:outline-none transition duration-200 ease-in-out
+                            hover:bg-gray-100">
+                                    <option value="reject">Reject (RESOURCE_EXHAUSTED)</option>
+                                    <option value="allow">Forward uninspected</option>
+                                </select>
+                            </div>
+                            <div>
+                                <label for="grpc-unsupported-encoding" class="block text-sm font-medium text-gray-700 mb-1">Messages not compressed with gzip</label>
+                                <select id="grpc-unsupported-encoding" name="grpc-unsupported-encoding"
+                                    class="px-3 py-2 mt-1 block w-full rounded-md border-gray-300 bg-gray-50 
+                            text-gray-900 shadow-sm focus:border-blue-500 focus:ring-2 focus:ring-blue-500 
+                            focus:ring-opacity-30 focus:outline-none transition duration-200 ease-in-out
+                            hover:bg-gray-100">
+                                    <option value="reject">Reject (UNIMPLEMENTED)</option>
+                                    <option value="allow">Forward uninspected</option>
+                                </select>
+                            </div>
+                        </div>
+                        <div class="flex items-center mt-3">
+                            <input type="checkbox" id="grpc-inspect-stream-messages" name="grpc-inspect-stream-messages"
+                                class="h-4 w-4 rounded border-gray-300 text-blue-600 focus:ring-blue-500">
+                            <label for="grpc-inspect-stream-messages" class="ml-2 block text-sm font-medium text-gray-700">Inspect every message of client streams</label>
+                        </div>
+                        <div class="mt-1 text-sm text-gray-500">When off, only the first request message of a call is inspected.</div>
+                    </div>
+                    
+                    <div class="mb-5">
+                        <label for="site-trusted-proxies" class="block text-sm font-medium text-gray-700 mb-1">Trusted Proxies (optional)</label>
+                        <input type="text" id="site-trusted-proxies" name="site-trusted-proxies" value="{{.Site.TrustedProxies}}" placeholder="e.g. 10.0.0.0/8, 192.168.1.10"
+                            class="px-3 py-2 mt-1 block w-full rounded-md border-gray-300 bg-gray-50 
+                            text-gray-900 shadow-sm focus:border-blue-500 focus:ring-2 focus:ring-blue-500 
+                            focus:ring-opacity-30 focus:outline-none transition duration-200 ease-in-out
+                            hover:bg-gray-100">
+                        <div class="mt-1 text-sm text-gray-500">Comma-separated CIDRs of load balancers or proxies in front of this site. Their forwarding headers are used to find the real client IP.</div>
+                    </div>
+
+                    <div class="mb-5">
+                        <label for="site-client-ip-header" class="block text-sm font-medium text-gray-700 mb-1">Client IP Header (optional)</label>
+                        <input type="text" id="site-client-ip-header" name="site-client-ip-header" value="{{.Site.ClientIPHeader}}" placeholder="e.g. CF-Connecting-IP"
+                            class="px-3 py-2 mt-1 block w-full rounded-md border-gray-300 bg-gray-50 
+                            text-gray-900 shadow-sm focus:border-blue-500 focus:ring-2 focus:ring-blue-500 
+                            focus:ring-opacity-30 focus:outline-none transition duration-200 ease-in-out
+                            hover:bg-gray-100">
+                        <div class="mt-1 text-sm text-gray-500">Header set by the trusted proxies. Leave empty to use Forwarded or X-Forwarded-For.</div>
+                    </div>
+                    
+                    <div class="mb-5 pt-5 border-t">
+                        <h6 class="text-md font-medium text-gray-800 mb-3">WAF Engine</h6>
+                        <div class="grid grid-cols-1 md:grid-cols-2 gap-4">
+                            <div>
+                                <label for="waf-engine-mode" class="block text-sm font-medium text-gray-700 mb-1">Engine Mode</label>
+                                <select id="waf-engine-mode" name="waf-engine-mode"
+                                    class="px-3 py-2 mt-1 block w-full rounded-md border-gray-300 bg-gray-50 
+                            text-gray-900 shadow-sm focus:border-blue-500 focus:ring-2 focus:ring-blue-500 
+                            focus:ring-opacity-30 focus:outline-none transition duration-200 ease-in-out
+                            hover:bg-gray-100">
+                                    <option value="On">On (block attacks)</option>
+                                    <option value="DetectionOnly">Detection only (log, never block)</option>
+                                    <option value="Off">Off (no inspection)</option>
+                                </select>
+                                <div class="mt-1 text-sm text-gray-500">Use detection only to onboard a new application without blocking it.</div>
+                            </div>
+                            <div>
+                                <label for="waf-paranoia-level" class="block text-sm font-medium text-gray-700 mb-1">CRS Paranoia Level</label>
+                                <select id="waf-paranoia-level" name="waf-paranoia-level"
+                                    class="px-3 py-2 mt-1 block w-full rounded-md border-gray-300 bg-gray-50 
+                            text-gray-900 shadow-sm focus:border-blue-500 focus:ring-2 focus:ring-blue-500 
+                            focus:ring-opacity-30 focus:outline-none transition duration-200 ease-in-out
+                            hover:bg-gray-100">
+                                    <option value="1">1 - Baseline</option>
+                                    <option value="2">2 - Elevated</option>
+                                    <option value="3">3 - High</option>
+                                    <option value="4">4 - Paranoid</option>
+                                </select>
+                                <div class="mt-1 text-sm text-gray-500">Higher levels enable stricter rules and more false positives.</div>
+                            </div>
+                            <div>
+                                <label for="waf-inbound-threshold" class="block text-sm font-medium text-gray-700 mb-1">Inbound Anomaly Threshold</label>
+                                <input type="number" min="1" max="10000" id="waf-inbound-threshold" name="waf-inbound-threshold"
+                                    class="px-3 py-2 mt-1 block w-full rounded-md border-gray-300 bg-gray-50 
+                            text-gray-900 shadow-sm focus:border-blue-500 focus:ring-2 focus:ring-blue-500 
+                            focus:ring-opacity-30 focus:outline-none transition duration-200 ease-in-out
+                            hover:bg-gray-100">
+                                <div class="mt-1 text-sm text-gray-500">Anomaly score at which requests are blocked (CRS default 5).</div>
+                            </div>
+                            <div>
+                                <label for="waf-outbound-threshold" class="block text-sm font-medium text-gray-700 mb-1">Outbound Anomaly Threshold</label>
+                                <input type="number" min="1" max="10000" id="waf-outbound-threshold" name="waf-outbound-threshold"
+                                    class="px-3 py-2 mt-1 block w-full rounded-md border-gray-300 bg-gray-50 
+                            text-gray-900 shadow-sm focus:border-blue-500 focus:ring-2 focus:ring-blue-500 
+                            focus:ring-opacity-30 focus:outline-none transition duration-200 ease-in-out
+                            hover:bg-gray-100">
+                                <div class="mt-1 text-sm text-gray-500">Anomaly score at which responses are blocked (CRS default 4).</div>
+                            </div>
+                        </div>
+                    </div>
+
                     <div class="p-4 rounded-md bg-red-100 text-red-700 border border-red-200 hidden" id="edit-site-error"></div>
                     <div class="p-4 rounded-md bg-green-100 text-green-700 border border-green-200 hidden" id="edit-site-success">Site updated successfully!</div>
                     
@@ -182,6 +311,26 @@ document.addEventListener('DOMContentLoaded', function() {
     }
 
     loadCertificates();
+
+    async function loadWAFSettings() {
+        try {
+            const response = await api.get(`/sites/${siteId}/settings`);
+            const waf = response.data.waf;
+            document.getElementById('waf-engine-mode').value = waf.engine_mode;
+            document.getElementById('waf-paranoia-level').value = waf.paranoia_level;
+            document.getElementById('waf-inbound-threshold').value = waf.inbound_anomaly_threshold;
+            document.getElementById('waf-outbound-threshold').value = waf.outbound_anomaly_threshold;
+
+            const grpc = response.data.grpc;
+            document.getElementById('grpc-oversized-messages').value = grpc.oversized_messages;
+            document.getElementById('grpc-unsupported-encoding').value = grpc.unsupported_encoding;
+            document.getElementById('grpc-inspect-stream-messages').checked = grpc.inspect_stream_messages;
+        } catch (error) {
+            console.error('Error loading WAF settings:', error);
+        }
+    }
+
+    loadWAFSettings();
     
     editSiteForm.addEventListener('submit', async function(e) {
         e.preventDefault();
@@ -198,6 +347,11 @@ document.addEventListener('DOMContentLoaded', function() {
         }
         
         const certificateId = document.getElementById('site-certificate').value;
+        const websocketInspection = document.getElementById('site-websocket-inspection').checked;
+        const websocketRuleIDs = document.getElementById('site-websocket-rules').value;
+        const grpcInspection = document.getElementById('site-grpc-inspection').checked;
+        const trustedProxies = document.getElementById('site-trusted-proxies').value;
+        const clientIPHeader = document.getElementById('site-client-ip-header').value;
         
         // Basic validation
         if (!name || !domain || !targetURL) {
@@ -212,7 +366,12 @@ document.addEventListener('DOMContentLoaded', function() {
             const data = {
                 name: name,
                 domain: domain,
-                target_url: targetURL
+                target_url: targetURL,
+                websocket_inspection: websocketInspection,
+                websocket_rule_ids: websocketRuleIDs,
+                grpc_inspection: grpcInspection,
+                trusted_proxies: trustedProxies,
+                client_ip_header: clientIPHeader
             };
             
             // Add status if admin
@@ -228,6 +387,19 @@ document.addEventListener('DOMContentLoaded', function() {
             }
             
             await api.put(`/sites/${siteId}`, data);
+            await api.put(`/sites/${siteId}/settings`, {
+                waf: {
+                    engine_mode: document.getElementById('waf-engine-mode').value,
+                    paranoia_level: parseInt(document.getElementById('waf-paranoia-level').value),
+                    inbound_anomaly_threshold: parseInt(document.getElementById('waf-inbound-threshold').value),
+                    outbound_anomaly_threshold: parseInt(document.getElementById('waf-outbound-threshold').value)
+                },
+                grpc: {
+                    oversized_messages: document.getElementById('grpc-oversized-messages').value,
+                    unsupported_encoding: document.getElementById('grpc-unsupported-encoding').value,
+                    inspect_stream_messages: document.getElementById('grpc-inspect-stream-messages').checked
+                }
+            });
             
             // Show success message
             errorElement.classList.add('hidden');
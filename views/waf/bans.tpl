@@ -0,0 +1,441 @@
+<div class="flex flex-wrap mb-4">
+    <div class="w-full md:w-2/3">
+        <h1 class="text-2xl font-bold">Bans</h1>
+        <p class="text-xl text-gray-600">Clients temporarily banned from every site, and the policies banning them</p>
+    </div>
+    <div class="w-full md:w-1/3 text-left md:text-right">
+        <button type="button" id="add-ban-btn" class="px-3 py-2 bg-blue-600 text-white rounded hover:bg-blue-700 inline-flex items-center">
+            <i class="bi bi-plus-circle mr-1"></i> Ban Client
+        </button>
+    </div>
+</div>
+
+<div class="flex flex-wrap mb-6">
+    <div class="w-full">
+        <div class="bg-white rounded-lg shadow-md">
+            <div class="px-4 py-3 border-b border-gray-200 flex justify-between items-center">
+                <h5 class="text-lg font-semibold mb-0">Active Bans</h5>
+                <button type="button" id="refresh-bans-btn" class="px-2 py-1 border border-gray-400 text-gray-600 rounded hover:bg-gray-100">
+                    <i class="bi bi-arrow-clockwise"></i>
+                </button>
+            </div>
+            <div class="p-0">
+                <div class="overflow-x-auto">
+                    <table class="min-w-full table-auto mb-0 [&>tbody>tr:hover]:bg-gray-100">
+                        <thead>
+                            <tr class="bg-gray-50 border-b border-gray-200">
+                                <th class="px-4 py-2 text-left">Client</th>
+                                <th class="px-4 py-2 text-left">Reason</th>
+                                <th class="px-4 py-2 text-left">Since</th>
+                                <th class="px-4 py-2 text-left">Expires</th>
+                                <th class="px-4 py-2 text-left">Actions</th>
+                            </tr>
+                        </thead>
+                        <tbody id="ban-list">
+                            <tr>
+                                <td colspan="5" class="text-center py-4">Loading bans...</td>
+                            </tr>
+                        </tbody>
+                    </table>
+                </div>
+            </div>
+        </div>
+    </div>
+</div>
+
+<div class="flex flex-wrap">
+    <div class="w-full">
+        <div class="bg-white rounded-lg shadow-md">
+            <div class="px-4 py-3 border-b border-gray-200 flex justify-between items-center">
+                <h5 class="text-lg font-semibold mb-0">Ban Policies</h5>
+                <button type="button" id="add-policy-btn" class="px-3 py-1 bg-blue-600 text-white rounded hover:bg-blue-700 inline-flex items-center">
+                    <i class="bi bi-plus-circle mr-1"></i> Add Policy
+                </button>
+            </div>
+            <div class="p-0">
+                <div class="overflow-x-auto">
+                    <table class="min-w-full table-auto mb-0 [&>tbody>tr:hover]:bg-gray-100">
+                        <thead>
+                            <tr class="bg-gray-50 border-b border-gray-200">
+                                <th class="px-4 py-2 text-left">Name</th>
+                                <th class="px-4 py-2 text-left">Trigger</th>
+                                <th class="px-4 py-2 text-left">Bans</th>
+                                <th class="px-4 py-2 text-left">Status</th>
+                                <th class="px-4 py-2 text-left">Actions</th>
+                            </tr>
+                        </thead>
+                        <tbody id="policy-list">
+                            <tr>
+                                <td colspan="5" class="text-center py-4">Loading policies...</td>
+                            </tr>
+                        </tbody>
+                    </table>
+                </div>
+            </div>
+        </div>
+    </div>
+</div>
+
+<!-- Ban Client Modal -->
+<div id="banModal" class="fixed inset-0 z-50 hidden overflow-y-auto bg-gray-900 bg-opacity-50 flex">
+    <div class="relative p-4 w-full max-w-md mx-auto md:h-auto flex items-center">
+        <div class="bg-white rounded-lg shadow-xl w-full">
+            <div class="px-4 py-3 border-b border-gray-200">
+                <h5 class="text-lg font-semibold">Ban Client</h5>
+            </div>
+            <div class="p-4 space-y-3">
+                <div>
+                    <label class="block text-sm font-medium text-gray-700 mb-1" for="ban-kind">Kind</label>
+                    <select id="ban-kind" class="w-full border border-gray-300 rounded px-3 py-2">
+                        <option value="ip">IP address</option>
+                        <option value="ja4">JA4 fingerprint</option>
+                    </select>
+                </div>
+                <div>
+                    <label class="block text-sm font-medium text-gray-700 mb-1" for="ban-value">Value</label>
+                    <input type="text" id="ban-value" class="w-full border border-gray-300 rounded px-3 py-2" placeholder="203.0.113.7">
+                </div>
+                <div>
+                    <label class="block text-sm font-medium text-gray-700 mb-1" for="ban-duration">Duration</label>
+                    <input type="text" id="ban-duration" class="w-full border border-gray-300 rounded px-3 py-2" value="1h">
+                </div>
+                <div>
+                    <label class="block text-sm font-medium text-gray-700 mb-1" for="ban-reason">Reason</label>
+                    <input type="text" id="ban-reason" class="w-full border border-gray-300 rounded px-3 py-2">
+                </div>
+                <div id="ban-error" class="p-4 text-red-700 bg-red-100 border border-red-200 rounded hidden"></div>
+            </div>
+            <div class="px-4 py-3 border-t border-gray-200 flex justify-end space-x-3">
+                <button type="button" class="px-3 py-2 bg-gray-500 text-white rounded hover:bg-gray-600" data-dismiss-modal="banModal">Cancel</button>
+                <button type="button" class="px-3 py-2 bg-red-600 text-white rounded hover:bg-red-700" id="confirm-ban">Ban</button>
+            </div>
+        </div>
+    </div>
+</div>
+
+<!-- Policy Modal -->
+<div id="policyModal" class="fixed inset-0 z-50 hidden overflow-y-auto bg-gray-900 bg-opacity-50 flex">
+    <div class="relative p-4 w-full max-w-lg mx-auto md:h-auto flex items-center">
+        <div class="bg-white rounded-lg shadow-xl w-full">
+            <div class="px-4 py-3 border-b border-gray-200">
+                <h5 class="text-lg font-semibold" id="policy-modal-title">Add Policy</h5>
+            </div>
+            <div class="p-4 grid grid-cols-2 gap-3">
+                <div class="col-span-2">
+                    <label class="block text-sm font-medium text-gray-700 mb-1" for="policy-name">Name</label>
+                    <input type="text" id="policy-name" class="w-full border border-gray-300 rounded px-3 py-2">
+                </div>
+                <div>
+                    <label class="block text-sm font-medium text-gray-700 mb-1" for="policy-target">Ban</label>
+                    <select id="policy-target" class="w-full border border-gray-300 rounded px-3 py-2">
+                        <option value="ip">Client IP</option>
+                        <option value="ja4">JA4 fingerprint</option>
+                    </select>
+                </div>
+                <div>
+                    <label class="block text-sm font-medium text-gray-700 mb-1" for="policy-site">Site ID (0 for all)</label>
+                    <input type="number" id="policy-site" class="w-full border border-gray-300 rounded px-3 py-2" value="0" min="0">
+                </div>
+                <div>
+                    <label class="block text-sm font-medium text-gray-700 mb-1" for="policy-threshold">Blocks</label>
+                    <input type="number" id="policy-threshold" class="w-full border border-gray-300 rounded px-3 py-2" value="5" min="1">
+                </div>
+                <div>
+                    <label class="block text-sm font-medium text-gray-700 mb-1" for="policy-window">Within (minutes)</label>
+                    <input type="number" id="policy-window" class="w-full border border-gray-300 rounded px-3 py-2" value="10" min="1" max="1440">
+                </div>
+                <div class="col-span-2">
+                    <label class="block text-sm font-medium text-gray-700 mb-1" for="policy-severity">Minimum severity</label>
+                    <select id="policy-severity" class="w-full border border-gray-300 rounded px-3 py-2">
+                        <option value="">Any block</option>
+                        <option value="EMERGENCY">EMERGENCY</option>
+                        <option value="ALERT">ALERT</option>
+                        <option value="CRITICAL">CRITICAL</option>
+                        <option value="ERROR">ERROR</option>
+                        <option value="WARNING">WARNING</option>
+                        <option value="NOTICE">NOTICE</option>
+                    </select>
+                </div>
+                <div>
+                    <label class="block text-sm font-medium text-gray-700 mb-1" for="policy-duration">First ban (seconds)</label>
+                    <input type="number" id="policy-duration" class="w-full border border-gray-300 rounded px-3 py-2" value="300" min="1">
+                </div>
+                <div>
+                    <label class="block text-sm font-medium text-gray-700 mb-1" for="policy-max-duration">Longest ban (seconds)</label>
+                    <input type="number" id="policy-max-duration" class="w-full border border-gray-300 rounded px-3 py-2" value="604800" min="1">
+                </div>
+                <div>
+                    <label class="block text-sm font-medium text-gray-700 mb-1" for="policy-multiplier">Multiplier</label>
+                    <input type="number" id="policy-multiplier" class="w-full border border-gray-300 rounded px-3 py-2" value="2" min="1" step="0.5">
+                </div>
+                <div>
+                    <label class="block text-sm font-medium text-gray-700 mb-1" for="policy-reset">Reset after (minutes)</label>
+                    <input type="number" id="policy-reset" class="w-full border border-gray-300 rounded px-3 py-2" value="1440" min="1">
+                </div>
+                <div class="col-span-2">
+                    <label class="inline-flex items-center">
+                        <input type="checkbox" id="policy-enabled" class="mr-2" checked> Enabled
+                    </label>
+                </div>
+                <div id="policy-error" class="col-span-2 p-4 text-red-700 bg-red-100 border border-red-200 rounded hidden"></div>
+            </div>
+            <div class="px-4 py-3 border-t border-gray-200 flex justify-end space-x-3">
+                <button type="button" class="px-3 py-2 bg-gray-500 text-white rounded hover:bg-gray-600" data-dismiss-modal="policyModal">Cancel</button>
+                <button type="button" class="px-3 py-2 bg-blue-600 text-white rounded hover:bg-blue-700" id="save-policy">Save</button>
+            </div>
+        </div>
+    </div>
+</div>
+
+<script>
+document.addEventListener('DOMContentLoaded', function() {
+    let policies = [];
+    let editingPolicyId = null;
+
+    loadBans();
+    loadPolicies();
+
+    function escapeHtml(unsafe) {
+        return String(unsafe)
+            .replace(/&/g, "&amp;")
+            .replace(/</g, "&lt;")
+            .replace(/>/g, "&gt;")
+            .replace(/"/g, "&quot;")
+            .replace(/'/g, "&#039;");
+    }
+
+    function formatDuration(seconds) {
+        if (seconds % 86400 === 0) return `${seconds / 86400}d`;
+        if (seconds % 3600 === 0) return `${seconds / 3600}h`;
+        if (seconds % 60 === 0) return `${seconds / 60}m`;
+        return `${seconds}s`;
+    }
+
+    function errorMessage(error, fallback) {
+        if (error.response && error.response.data && error.response.data.error) {
+            return error.response.data.error;
+        }
+        return fallback;
+    }
+
+    // Function to load the active bans
+    async function loadBans() {
+        const tbody = document.getElementById('ban-list');
+        try {
+            const response = await api.get('/bans');
+            const bans = response.data;
+
+            if (bans.length === 0) {
+                tbody.innerHTML = `
+                    <tr>
+                        <td colspan="5" class="text-center py-4">No client is banned.</td>
+                    </tr>
+                `;
+                return;
+            }
+
+            tbody.innerHTML = '';
+            bans.forEach(ban => {
+                const tr = document.createElement('tr');
+                tr.innerHTML = `
+                    <td class="px-4 py-2 border-b border-gray-200">
+                        <span class="inline-block px-2 py-1 text-xs font-semibold rounded-full bg-gray-500 text-white uppercase">${escapeHtml(ban.kind)}</span>
+                        <span class="font-mono ml-1">${escapeHtml(ban.value)}</span>
+                    </td>
+                    <td class="px-4 py-2 border-b border-gray-200">${escapeHtml(ban.reason)}</td>
+                    <td class="px-4 py-2 border-b border-gray-200">${new Date(ban.createdAt).toLocaleString()}</td>
+                    <td class="px-4 py-2 border-b border-gray-200">${new Date(ban.expiresAt).toLocaleString()}</td>
+                    <td class="px-4 py-2 border-b border-gray-200">
+                        <button class="lift-ban px-2 py-1 border border-red-600 text-red-600 rounded hover:bg-red-600 hover:text-white" title="Lift ban">
+                            <i class="bi bi-unlock"></i>
+                        </button>
+                    </td>
+                `;
+                tr.querySelector('.lift-ban').addEventListener('click', () => liftBan(ban));
+                tbody.appendChild(tr);
+            });
+        } catch (error) {
+            console.error('Error loading bans:', error);
+            tbody.innerHTML = `
+                <tr>
+                    <td colspan="5" class="text-center py-4 text-red-600">${escapeHtml(errorMessage(error, 'Failed to load bans. Please try again.'))}</td>
+                </tr>
+            `;
+        }
+    }
+
+    // Function to load the ban policies
+    async function loadPolicies() {
+        const tbody = document.getElementById('policy-list');
+        try {
+            const response = await api.get('/bans/policies');
+            policies = response.data;
+
+            if (policies.length === 0) {
+                tbody.innerHTML = `
+                    <tr>
+                        <td colspan="5" class="text-center py-4">No ban policies. Add one to ban clients that keep getting blocked.</td>
+                    </tr>
+                `;
+                return;
+            }
+
+            tbody.innerHTML = '';
+            policies.forEach(policy => {
+                const severity = policy.minSeverity ? `${escapeHtml(policy.minSeverity)} or worse` : 'any';
+                const site = policy.siteId ? `site ${policy.siteId}` : 'any site';
+                const tr = document.createElement('tr');
+                tr.innerHTML = `
+                    <td class="px-4 py-2 border-b border-gray-200">${escapeHtml(policy.name)}</td>
+                    <td class="px-4 py-2 border-b border-gray-200">${policy.threshold} ${severity} blocks within ${policy.window} min on ${site}</td>
+                    <td class="px-4 py-2 border-b border-gray-200">${policy.target.toUpperCase()} for ${formatDuration(policy.banDuration)}, &times;${policy.multiplier} up to ${formatDuration(policy.maxBanDuration)}</td>
+                    <td class="px-4 py-2 border-b border-gray-200">
+                        <span class="inline-block px-2 py-1 text-xs font-semibold rounded-full ${policy.enabled ? 'bg-green-500' : 'bg-gray-400'} text-white">${policy.enabled ? 'Enabled' : 'Disabled'}</span>
+                    </td>
+                    <td class="px-4 py-2 border-b border-gray-200">
+                        <div class="inline-flex space-x-1">
+                            <button class="edit-policy px-2 py-1 border border-blue-600 text-blue-600 rounded hover:bg-blue-600 hover:text-white" title="Edit">
+                                <i class="bi bi-pencil"></i>
+                            </button>
+                            <button class="delete-policy px-2 py-1 border border-red-600 text-red-600 rounded hover:bg-red-600 hover:text-white" title="Delete">
+                                <i class="bi bi-trash"></i>
+                            </button>
+                        </div>
+                    </td>
+                `;
+                tr.querySelector('.edit-policy').addEventListener('click', () => showPolicyModal(policy));
+                tr.querySelector('.delete-policy').addEventListener('click', () => deletePolicy(policy));
+                tbody.appendChild(tr);
+            });
+        } catch (error) {
+            console.error('Error loading ban policies:', error);
+            tbody.innerHTML = `
+                <tr>
+                    <td colspan="5" class="text-center py-4 text-red-600">Failed to load ban policies. Please try again.</td>
+                </tr>
+            `;
+        }
+    }
+
+    async function liftBan(ban) {
+        if (!confirm(`Lift the ban of ${ban.kind} ${ban.value}?`)) {
+            return;
+        }
+        try {
+            await api.delete('/bans', { params: { kind: ban.kind, value: ban.value } });
+            showToast('Ban lifted successfully', 'success');
+            loadBans();
+        } catch (error) {
+            console.error('Error lifting ban:', error);
+            showToast(errorMessage(error, 'Failed to lift ban'), 'danger');
+        }
+    }
+
+    async function deletePolicy(policy) {
+        if (!confirm(`Delete the ban policy "${policy.name}"? Bans it placed run out as planned.`)) {
+            return;
+        }
+        try {
+            await api.delete(`/bans/policies/${policy.id}`);
+            showToast('Policy deleted successfully', 'success');
+            loadPolicies();
+        } catch (error) {
+            console.error('Error deleting ban policy:', error);
+            showToast(errorMessage(error, 'Failed to delete policy'), 'danger');
+        }
+    }
+
+    function showPolicyModal(policy) {
+        editingPolicyId = policy ? policy.id : null;
+        document.getElementById('policy-modal-title').textContent = policy ? 'Edit Policy' : 'Add Policy';
+        document.getElementById('policy-name').value = policy ? policy.name : '';
+        document.getElementById('policy-target').value = policy ? policy.target : 'ip';
+        document.getElementById('policy-site').value = policy ? policy.siteId : 0;
+        document.getElementById('policy-threshold').value = policy ? policy.threshold : 5;
+        document.getElementById('policy-window').value = policy ? policy.window : 10;
+        document.getElementById('policy-severity').value = policy ? policy.minSeverity : 'CRITICAL';
+        document.getElementById('policy-duration').value = policy ? policy.banDuration : 300;
+        document.getElementById('policy-max-duration').value = policy ? policy.maxBanDuration : 604800;
+        document.getElementById('policy-multiplier').value = policy ? policy.multiplier : 2;
+        document.getElementById('policy-reset').value = policy ? policy.resetAfter : 1440;
+        document.getElementById('policy-enabled').checked = policy ? policy.enabled : true;
+        document.getElementById('policy-error').classList.add('hidden');
+        document.getElementById('policyModal').classList.remove('hidden');
+    }
+
+    document.getElementById('add-policy-btn').addEventListener('click', () => showPolicyModal(null));
+
+    document.getElementById('add-ban-btn').addEventListener('click', function() {
+        document.getElementById('ban-value').value = '';
+        document.getElementById('ban-reason').value = '';
+        document.getElementById('ban-error').classList.add('hidden');
+        document.getElementById('banModal').classList.remove('hidden');
+    });
+
+    document.getElementById('refresh-bans-btn').addEventListener('click', loadBans);
+
+    // Modal close buttons
+    document.querySelectorAll('[data-dismiss-modal]').forEach(button => {
+        button.addEventListener('click', function() {
+            document.getElementById(this.getAttribute('data-dismiss-modal')).classList.add('hidden');
+        });
+    });
+
+    // Ban a client by hand
+    document.getElementById('confirm-ban').addEventListener('click', async function() {
+        const errorElement = document.getElementById('ban-error');
+        errorElement.classList.add('hidden');
+
+        try {
+            await api.post('/bans', {
+                kind: document.getElementById('ban-kind').value,
+                value: document.getElementById('ban-value').value.trim(),
+                duration: document.getElementById('ban-duration').value.trim(),
+                reason: document.getElementById('ban-reason').value.trim()
+            });
+            document.getElementById('banModal').classList.add('hidden');
+            showToast('Client banned successfully', 'success');
+            loadBans();
+        } catch (error) {
+            console.error('Error banning client:', error);
+            errorElement.textContent = errorMessage(error, 'Failed to ban client');
+            errorElement.classList.remove('hidden');
+        }
+    });
+
+    // Save a ban policy
+    document.getElementById('save-policy').addEventListener('click', async function() {
+        const errorElement = document.getElementById('policy-error');
+        errorElement.classList.add('hidden');
+
+        const policy = {
+            name: document.getElementById('policy-name').value.trim(),
+            target: document.getElementById('policy-target').value,
+            siteId: parseInt(document.getElementById('policy-site').value, 10) || 0,
+            threshold: parseInt(document.getElementById('policy-threshold').value, 10) || 0,
+            window: parseInt(document.getElementById('policy-window').value, 10) || 0,
+            minSeverity: document.getElementById('policy-severity').value,
+            banDuration: parseInt(document.getElementById('policy-duration').value, 10) || 0,
+            maxBanDuration: parseInt(document.getElementById('policy-max-duration').value, 10) || 0,
+            multiplier: parseFloat(document.getElementById('policy-multiplier').value) || 0,
+            resetAfter: parseInt(document.getElementById('policy-reset').value, 10) || 0,
+            enabled: document.getElementById('policy-enabled').checked
+        };
+
+        try {
+            if (editingPolicyId) {
+                await api.put(`/bans/policies/${editingPolicyId}`, policy);
+            } else {
+                await api.post('/bans/policies', policy);
+            }
+            document.getElementById('policyModal').classList.add('hidden');
+            showToast('Policy saved successfully', 'success');
+            loadPolicies();
+        } catch (error) {
+            console.error('Error saving ban policy:', error);
+            errorElement.textContent = errorMessage(error, 'Failed to save policy');
+            errorElement.classList.remove('hidden');
+        }
+    });
+});
+</script>
@@ -297,6 +297,9 @@ document.addEventListener('DOMContentLoaded', function() {
             case 'allowed':
                 actionElement.classList.add('bg-green-500');
                 break;
+            case 'challenged':
+                actionElement.classList.add('bg-yellow-500');
+                break;
             default:
                 actionElement.classList.add('bg-gray-500');
         }
@@ -343,14 +346,14 @@ document.addEventListener('DOMContentLoaded', function() {
         
         // Process details if available
         if (details && details.length > 0) {
-            processLogDetails(details);
+            processLogDetails(details, log);
         }
         
         // Add raw JSON data
         document.getElementById('raw-json').textContent = JSON.stringify({log, details}, null, 2);
     }
     
-    function processLogDetails(details) {
+    function processLogDetails(details, log) {
         details.forEach(detail => {
             try {
                 const content = JSON.parse(detail.Content);
@@ -368,7 +371,7 @@ document.addEventListener('DOMContentLoaded', function() {
                         renderBody('response-body-content', content);
                         break;
                     case 'rule_matches':
-                        renderRuleMatches(content);
+                        renderRuleMatches(content, log);
                         break;
                 }
             } catch (error) {
@@ -425,7 +428,7 @@ document.addEventListener('DOMContentLoaded', function() {
         container.innerHTML = `<pre class="bg-gray-100 p-4 rounded-md overflow-x-auto text-sm">${content}</pre>`;
     }
     
-    function renderRuleMatches(matches) {
+    function renderRuleMatches(matches, log) {
         const container = document.getElementById('rule-matches-content');
         
         if (!matches || !Array.isArray(matches) || matches.length === 0) {
@@ -478,7 +481,12 @@ document.addEventListener('DOMContentLoaded', function() {
                 <div class="mb-6 border rounded-md overflow-hidden ${match.isInterruption ? 'border-red-500 shadow-md' : ''}">
                     <div class="px-4 py-3 ${severityClass} text-white font-medium flex justify-between items-center">
                         <div>Rule ID: ${match.id || 'N/A'}</div>
-                        ${match.isInterruption ? '<span class="bg-white text-red-600 px-2 py-1 rounded-full text-xs font-bold">INTERRUPTION</span>' : ''}
+                        <div class="flex items-center gap-2">
+                            ${match.isInterruption ? '<span class="bg-white text-red-600 px-2 py-1 rounded-full text-xs font-bold">INTERRUPTION</span>' : ''}
+                            ${match.id ? `<a href="${escapeHtml(exclusionURL(log, match))}" class="bg-white text-gray-700 hover:text-blue-600 px-2 py-1 rounded text-xs font-medium" title="Create an exclusion for this false positive">
+                                Create exclusion
+                            </a>` : ''}
+                        </div>
                     </div>
                     
                     <div class="p-4">
@@ -571,6 +579,34 @@ document.addEventListener('DOMContentLoaded', function() {
         container.innerHTML = html;
     }
     
+    // exclusionURL links to a new exclusion rule pre-filled from a matched rule, the
+    // variable it matched and the path of the logged request
+    function exclusionURL(log, match) {
+        const params = new URLSearchParams({
+            type: 'EXCLUSION',
+            name: `Exclude rule ${match.id} on ${log.URI || '/'}`,
+            removeBy: 'id',
+            rules: match.id,
+            pathPrefix: log.URI || '/'
+        });
+        
+        // Only drop the matched argument, cookie or header from the rule when there is one
+        const targetTypes = {
+            'ARGS': 'arg',
+            'ARGS_GET': 'arg',
+            'ARGS_POST': 'arg',
+            'REQUEST_COOKIES': 'cookie',
+            'REQUEST_HEADERS': 'header'
+        };
+        const [variable, ...key] = (match.variable_name || '').split(':');
+        if (targetTypes[variable] && key.length) {
+            params.set('targetType', targetTypes[variable]);
+            params.set('targetName', key.join(':'));
+        }
+        
+        return `/waf/sites/${log.SiteID}/rules/new?${params}`;
+    }
+    
     // Helper functions
     function escapeHtml(unsafe) {
         return String(unsafe)
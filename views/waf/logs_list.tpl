@@ -59,6 +59,7 @@
                                 <option value="allowed">Allowed</option>
                                 <option value="blocked">Blocked</option>
                                 <option value="blocked_response">Blocked Response</option>
+                                <option value="challenged">Challenged</option>
                             </select>
                             <div class="pointer-events-none absolute inset-y-0 right-0 flex items-center px-2 text-gray-700">
                                 <svg class="h-5 w-5" xmlns="http://www.w3.org/2000/svg" fill="none" viewBox="0 0 24 24" stroke="currentColor">
@@ -655,6 +656,9 @@ document.addEventListener('DOMContentLoaded', function() {
                 case 'allowed':
                     actionClass = 'bg-green-500';
                     break;
+                case 'challenged':
+                    actionClass = 'bg-yellow-500';
+                    break;
                 default:
                     actionClass = 'bg-gray-500';
             }
@@ -794,6 +798,7 @@ document.addEventListener('DOMContentLoaded', function() {
 .action-blocked { background-color: #ef4444 !important; }
 .action-allowed { background-color: #22c55e !important; }
 .action-blocked_response { background-color: #ef4444 !important; }
+.action-challenged { background-color: #eab308 !important; }
 
 /* Make sure table is responsive */
 .overflow-x-auto {
@@ -80,6 +80,7 @@
                                     id="ruleAction" name="action">
                                     <option value="deny">Block Request (403 Forbidden)</option>
                                     <option value="pass">Allow but Log (Monitor Mode)</option>
+                                    <option value="challenge">Challenge Browser (Proof of Work)</option>
                                 </select>
                                 <div class="absolute inset-y-0 right-0 flex items-center pr-2 pointer-events-none">
                                     <i class="bi bi-chevron-down text-gray-400"></i>
@@ -118,11 +119,70 @@
                         </div>
                     </div>
                     
+                    <!-- What If Section -->
+                    <div id="whatIfPanel" class="mt-6 hidden">
+                        <div class="bg-gray-50 border rounded-md overflow-hidden">
+                            <div class="px-4 py-3 bg-gray-100 border-b flex justify-between items-center">
+                                <h6 class="font-medium flex items-center">
+                                    <i class="bi bi-shuffle mr-2 text-purple-600"></i>
+                                    What If
+                                </h6>
+                                <span class="text-xs text-gray-500">Replays recorded requests through the site's rules with and without this rule</span>
+                            </div>
+                            <div class="p-4 space-y-4">
+                                <div class="grid grid-cols-1 md:grid-cols-2 gap-4">
+                                    <div>
+                                        <label class="inline-flex items-center text-sm font-medium text-gray-700 mb-1">
+                                            <input type="radio" name="whatIfSource" value="logs" class="mr-2" checked>
+                                            Recent WAF log entries
+                                        </label>
+                                        <input type="number" id="whatIfRecentLogs" min="1" max="10000" value="500"
+                                            class="w-full rounded-md border border-gray-300 px-3 py-2 focus:border-blue-500 focus:ring-blue-500 sm:text-sm">
+                                    </div>
+                                    <div>
+                                        <label class="inline-flex items-center text-sm font-medium text-gray-700 mb-1">
+                                            <input type="radio" name="whatIfSource" value="file" class="mr-2">
+                                            Corpus file (JSONL, HAR or exported log entries)
+                                        </label>
+                                        <input type="file" id="whatIfCorpus" accept=".jsonl,.json,.har"
+                                            class="w-full text-sm text-gray-700">
+                                    </div>
+                                </div>
+                                <div class="flex justify-end">
+                                    <button type="button" id="runWhatIfBtn" class="px-3 py-2 bg-purple-600 hover:bg-purple-700 text-white rounded-md inline-flex items-center text-sm transition shadow-sm">
+                                        <i class="bi bi-play mr-1"></i> Replay
+                                    </button>
+                                </div>
+                                <div id="whatIfResults" class="hidden">
+                                    <div id="whatIfSummary" class="flex flex-wrap gap-2 mb-3 text-sm"></div>
+                                    <div class="overflow-x-auto max-h-80">
+                                        <table class="min-w-full divide-y divide-gray-200 text-sm">
+                                            <thead class="bg-gray-100">
+                                                <tr>
+                                                    <th class="px-3 py-2 text-left font-medium text-gray-500">Request</th>
+                                                    <th class="px-3 py-2 text-left font-medium text-gray-500">Change</th>
+                                                    <th class="px-3 py-2 text-left font-medium text-gray-500">Outcome</th>
+                                                    <th class="px-3 py-2 text-left font-medium text-gray-500">Rules</th>
+                                                </tr>
+                                            </thead>
+                                            <tbody id="whatIfTable" class="bg-white divide-y divide-gray-200"></tbody>
+                                        </table>
+                                    </div>
+                                </div>
+                            </div>
+                        </div>
+                    </div>
+                    
                     <!-- Form Actions -->
                     <div class="flex justify-between pt-4 border-t">
-                        <button type="button" id="testRuleBtn" class="px-4 py-2.5 bg-indigo-600 hover:bg-indigo-700 text-white rounded-md inline-flex items-center transition shadow-sm">
-                            <i class="bi bi-lightning mr-2"></i> Test Rule
-                        </button>
+                        <div class="space-x-2">
+                            <button type="button" id="testRuleBtn" class="px-4 py-2.5 bg-indigo-600 hover:bg-indigo-700 text-white rounded-md inline-flex items-center transition shadow-sm">
+                                <i class="bi bi-lightning mr-2"></i> Test Rule
+                            </button>
+                            <button type="button" id="whatIfBtn" class="px-4 py-2.5 bg-purple-600 hover:bg-purple-700 text-white rounded-md inline-flex items-center transition shadow-sm">
+                                <i class="bi bi-shuffle mr-2"></i> What If
+                            </button>
+                        </div>
                         <div class="space-x-2">
                             <a href="/waf/sites/{{.SiteID}}/rules" class="px-4 py-2.5 bg-gray-200 hover:bg-gray-300 text-gray-700 rounded-md inline-flex items-center transition">
                                 <i class="bi bi-x-circle mr-2"></i> Cancel
@@ -192,6 +252,14 @@ document.addEventListener('DOMContentLoaded', function() {
     let ruleTemplates = [];
     let currentRule = null;
     
+    // A new rule can be pre-filled from the URL, e.g. ?type=EXCLUSION&rules=942100 from a log entry
+    const query = new URLSearchParams(window.location.search);
+    const prefill = !isEdit && query.get('type') ? {
+        type: query.get('type'),
+        name: query.get('name') || '',
+        parameters: Object.fromEntries([...query.entries()].filter(([key]) => key !== 'type' && key !== 'name'))
+    } : null;
+    
     // Load templates first
     loadTemplates();
     
@@ -209,6 +277,12 @@ document.addEventListener('DOMContentLoaded', function() {
     // Handle test button
     document.getElementById('testRuleBtn').addEventListener('click', testRule);
     
+    // Handle what-if panel
+    document.getElementById('whatIfBtn').addEventListener('click', function() {
+        document.getElementById('whatIfPanel').classList.toggle('hidden');
+    });
+    document.getElementById('runWhatIfBtn').addEventListener('click', runWhatIf);
+    
     // Handle rule type change
     document.getElementById('ruleType').addEventListener('change', function() {
         const selectedType = this.value;
@@ -250,8 +324,12 @@ document.addEventListener('DOMContentLoaded', function() {
             document.getElementById('rule-form-loading').classList.add('hidden');
             document.getElementById('rule-form-content').classList.remove('hidden');
             
-            // If not in edit mode, handle any initial selection
-            if (!isEdit && typeSelect.value) {
+            // If not in edit mode, handle any pre-filled or initial selection
+            if (prefill && ruleTemplates.some(t => t.type === prefill.type)) {
+                typeSelect.value = prefill.type;
+                document.getElementById('ruleName').value = prefill.name;
+                updateParameterForm(prefill.type, true);
+            } else if (!isEdit && typeSelect.value) {
                 updateParameterForm(typeSelect.value);
             }
         } catch (error) {
@@ -307,6 +385,8 @@ document.addEventListener('DOMContentLoaded', function() {
             } catch (e) {
                 console.error('Error parsing rule parameters:', e);
             }
+        } else if (prefill && prefill.type === ruleType) {
+            currentParams = prefill.parameters;
         }
         
         // Special handling for custom rules
@@ -392,6 +472,10 @@ document.addEventListener('DOMContentLoaded', function() {
                     data-example="rate-limit">
                     API Rate Limiting
                 </button>
+                <button type="button" class="text-xs bg-gray-200 hover:bg-gray-300 px-2 py-1 rounded inline-flex items-center transition example-rule-btn"
+                    data-example="challenge-bot">
+                    Challenge Headless Browsers
+                </button>
             `;
             fieldset.appendChild(exampleButtonsDiv);
             
@@ -406,6 +490,9 @@ document.addEventListener('DOMContentLoaded', function() {
                 'rate-limit': {
                     text: `SecRule REQUEST_URI "@beginsWith /api/login" "id:10003,phase:1,pass,nolog,setvar:ip.login_counter=+1,expirevar:ip.login_counter=60"
 SecRule IP:login_counter "@gt 5" "id:10004,phase:1,deny,status:429,log,msg:'Login rate limit exceeded'"`
+                },
+                'challenge-bot': {
+                    text: `SecRule REQUEST_HEADERS:User-Agent "@contains HeadlessChrome" "id:10005,phase:1,pass,log,setvar:tx.challenge=1,msg:'Headless browser challenged'"`
                 }
             };
             
@@ -663,6 +750,94 @@ SecRule IP:login_counter "@gt 5" "id:10004,phase:1,deny,status:429,log,msg:'Logi
         }
     }
     
+    // Replay recorded requests through the site's rules with this rule as it is in the form
+    async function runWhatIf() {
+        const button = document.getElementById('runWhatIfBtn');
+        try {
+            const rule = collectFormData();
+            if (rule.rule_text !== undefined) {
+                rule.ruleText = rule.rule_text;
+            }
+            const payload = { candidate: { rules: [rule] } };
+            
+            const source = document.querySelector('input[name="whatIfSource"]:checked').value;
+            if (source === 'file') {
+                const file = document.getElementById('whatIfCorpus').files[0];
+                if (!file) {
+                    showToast('Select a corpus file to replay', 'warning');
+                    return;
+                }
+                payload.corpus = await file.text();
+            } else {
+                payload.recentLogs = parseInt(document.getElementById('whatIfRecentLogs').value) || 500;
+            }
+            
+            button.innerHTML = '<i class="bi bi-hourglass-split animate-spin mr-1"></i> Replaying...';
+            button.disabled = true;
+            
+            const response = await axios.post(`/api/sites/${rule.siteId}/waf/replay`, payload, {
+                headers: {
+                    'Authorization': 'Bearer ' + localStorage.getItem('sepro_waf_token'),
+                    'Content-Type': 'application/json'
+                }
+            });
+            renderWhatIf(response.data);
+        } catch (error) {
+            console.error('Error replaying requests:', error);
+            showToast(error.response?.data?.error || 'Failed to replay requests', 'danger');
+        } finally {
+            button.innerHTML = '<i class="bi bi-play mr-1"></i> Replay';
+            button.disabled = false;
+        }
+    }
+    
+    // Show the replay report, listing only the requests whose outcome changed
+    function renderWhatIf(report) {
+        const counts = [
+            ['Newly blocked', report.newlyBlocked, 'bg-red-100 text-red-800'],
+            ['Newly passed', report.newlyPassed, 'bg-yellow-100 text-yellow-800'],
+            ['Action changed', report.actionChanged, 'bg-orange-100 text-orange-800'],
+            ['Rules changed', report.rulesChanged, 'bg-blue-100 text-blue-800'],
+            ['Unchanged', report.unchanged, 'bg-green-100 text-green-800'],
+            ['Errors', report.errors, 'bg-gray-200 text-gray-800']
+        ];
+        document.getElementById('whatIfSummary').innerHTML =
+            `<span class="px-2 py-1 rounded bg-gray-100 text-gray-800">${report.total} requests</span>` +
+            counts.map(([label, count, style]) => `<span class="px-2 py-1 rounded ${style}">${label}: ${count}</span>`).join('');
+        
+        const changed = (report.results || []).filter(result => result.change !== 'unchanged');
+        const table = document.getElementById('whatIfTable');
+        if (changed.length === 0) {
+            table.innerHTML = '<tr><td colspan="4" class="px-3 py-4 text-center text-gray-500">No request would be handled differently</td></tr>';
+        } else {
+            table.innerHTML = changed.map(result => {
+                const outcome = result.error
+                    ? escapeHtml(result.error)
+                    : `${escapeHtml(result.baseline.action)} &rarr; ${escapeHtml(result.candidate.action)}`;
+                const rules = [
+                    ...(result.addedRules || []).map(id => `<span class="text-red-700">+${id}</span>`),
+                    ...(result.removedRules || []).map(id => `<span class="text-green-700">-${id}</span>`)
+                ].join(' ');
+                return `<tr>
+                    <td class="px-3 py-2 font-mono break-all">${escapeHtml(result.method)} ${escapeHtml(result.url)}</td>
+                    <td class="px-3 py-2 whitespace-nowrap">${escapeHtml(result.change.replace('_', ' '))}</td>
+                    <td class="px-3 py-2 whitespace-nowrap">${outcome}</td>
+                    <td class="px-3 py-2 font-mono">${rules}</td>
+                </tr>`;
+            }).join('');
+        }
+        document.getElementById('whatIfResults').classList.remove('hidden');
+    }
+    
+    function escapeHtml(unsafe) {
+        return String(unsafe)
+            .replace(/&/g, "&amp;")
+            .replace(/</g, "&lt;")
+            .replace(/>/g, "&gt;")
+            .replace(/"/g, "&quot;")
+            .replace(/'/g, "&#039;");
+    }
+    
     // Save rule
     async function saveRule() {
         try {